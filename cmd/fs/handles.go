@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/confine"
+)
+
+// handleEntry binds an open file to the capability that opened it.
+type handleEntry struct {
+	file      *os.File
+	flag      int // the flags it was opened with
+	claims    *capability.Capability
+	path      string
+	createdAt time.Time
+	lastUsed  atomic.Int64 // unix nanoseconds
+
+	// mu serializes requests that use or move the file offset, which is
+	// the handle's cursor.
+	mu sync.Mutex
+}
+
+// readable reports whether the handle was opened for reading.
+func (e *handleEntry) readable() bool {
+	return e.flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY
+}
+
+// writable reports whether the handle was opened for writing.
+func (e *handleEntry) writable() bool {
+	return e.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (e *handleEntry) touch() {
+	e.lastUsed.Store(time.Now().UnixNano())
+}
+
+// cursor returns the handle's cursor. The caller holds e.mu.
+func (e *handleEntry) cursor() (int64, error) {
+	return e.file.Seek(0, io.SeekCurrent)
+}
+
+// errSeekBeforeStart reports a seek to a negative offset.
+var errSeekBeforeStart = errors.New("cannot seek before the start of the file")
+
+// read reads into buf at off, or at the cursor if off is negative, and
+// leaves the cursor after what it read. eof reports that the read reached
+// the end of the file. The caller holds e.mu.
+func (e *handleEntry) read(buf []byte, off int64) (n int, pos int64, eof bool, err error) {
+	if off < 0 {
+		if off, err = e.cursor(); err != nil {
+			return 0, 0, false, err
+		}
+	}
+	n, err = e.file.ReadAt(buf, off)
+	eof = err == io.EOF
+	if err != nil && !eof {
+		return n, 0, false, err
+	}
+	pos, err = e.file.Seek(off+int64(n), io.SeekStart)
+	return n, pos, eof, err
+}
+
+// readSize returns how many of n bytes a read at off, or at the cursor if
+// off is negative, can return: no more than a regular file holds past
+// there. Other files may always return n. The caller holds e.mu.
+func (e *handleEntry) readSize(n, off int64) (int64, error) {
+	info, err := e.file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return n, err
+	}
+	if off < 0 {
+		if off, err = e.cursor(); err != nil {
+			return 0, err
+		}
+	}
+	return min(n, max(info.Size()-off, 0)), nil
+}
+
+// write writes data at off, or at the cursor if off is negative, or at the
+// end of the file if atEnd or the handle appends, and leaves the cursor
+// after it. The caller holds e.mu.
+func (e *handleEntry) write(data []byte, off int64, atEnd bool) (n int, pos int64, err error) {
+	switch {
+	case e.flag&os.O_APPEND != 0:
+		// The kernel puts every write on an append handle at the end.
+	case atEnd:
+		_, err = e.file.Seek(0, io.SeekEnd)
+	case off >= 0:
+		_, err = e.file.Seek(off, io.SeekStart)
+	}
+	if err == nil {
+		n, err = e.file.Write(data)
+	}
+	if err != nil {
+		return n, 0, err
+	}
+	pos, err = e.cursor()
+	return n, pos, err
+}
+
+// seek moves the cursor by offset from whence (io.SeekStart, SeekCurrent
+// or SeekEnd) and returns where it is. The caller holds e.mu.
+func (e *handleEntry) seek(offset int64, whence int) (int64, error) {
+	pos, err := e.file.Seek(offset, whence)
+	if errors.Is(err, syscall.EINVAL) {
+		return 0, errSeekBeforeStart
+	}
+	return pos, err
+}
+
+// handleLimitError reports that a capability, or fs as a whole, holds as
+// many handles as it may.
+type handleLimitError struct {
+	scope string // "capability" or "fs"
+	limit int
+}
+
+func (e *handleLimitError) Error() string {
+	return fmt.Sprintf("too many open handles: %s limit %d reached", e.scope, e.limit)
+}
+
+// handleTable maps opaque handle IDs to open files, within limits on how
+// many fs, and each capability, may hold at once.
+type handleTable struct {
+	mu      sync.RWMutex
+	handles map[string]*handleEntry
+	open    int            // handles held or being opened
+	perCap  map[string]int // the same, by cap_id
+	nextID  atomic.Uint64
+
+	max       int // 0 = unlimited
+	maxPerCap int // 0 = unlimited
+}
+
+func newHandleTable(max, maxPerCap int) *handleTable {
+	return &handleTable{
+		handles:   make(map[string]*handleEntry),
+		perCap:    make(map[string]int),
+		max:       max,
+		maxPerCap: maxPerCap,
+	}
+}
+
+// Open opens hostPath, the real path beneath root a request was authorized
+// for, with flag and, when creating it, perm. Neither symlinks nor renames
+// can take it out of root, and a symlink swapped in since the check fails
+// it with confine.ErrChanged. hostPath is kept for later policy checks. A
+// slot is taken before the file is opened, so a full table creates nothing.
+func (ht *handleTable) Open(root *confine.Root, hostPath string, claims *capability.Capability, flag int, perm os.FileMode) (string, error) {
+	if err := ht.reserve(claims.ID); err != nil {
+		return "", err
+	}
+	f, err := root.OpenRealPath(hostPath, flag, perm)
+	if err != nil {
+		ht.mu.Lock()
+		ht.releaseLocked(claims.ID)
+		ht.mu.Unlock()
+		return "", err
+	}
+	id := fmt.Sprintf("h%d", ht.nextID.Add(1))
+	e := &handleEntry{
+		file:      f,
+		flag:      flag,
+		claims:    claims,
+		path:      hostPath,
+		createdAt: time.Now(),
+	}
+	e.touch()
+	ht.mu.Lock()
+	ht.handles[id] = e
+	ht.mu.Unlock()
+	return id, nil
+}
+
+func (ht *handleTable) reserve(capID string) error {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if ht.maxPerCap > 0 && ht.perCap[capID] >= ht.maxPerCap {
+		return &handleLimitError{scope: "capability", limit: ht.maxPerCap}
+	}
+	if ht.max > 0 && ht.open >= ht.max {
+		return &handleLimitError{scope: "fs", limit: ht.max}
+	}
+	ht.open++
+	ht.perCap[capID]++
+	return nil
+}
+
+func (ht *handleTable) releaseLocked(capID string) {
+	ht.open--
+	if ht.perCap[capID]--; ht.perCap[capID] <= 0 {
+		delete(ht.perCap, capID)
+	}
+}
+
+// Get returns the handle's entry and marks it used.
+func (ht *handleTable) Get(id string) (*handleEntry, bool) {
+	ht.mu.RLock()
+	e, ok := ht.handles[id]
+	ht.mu.RUnlock()
+	if ok {
+		e.touch()
+	}
+	return e, ok
+}
+
+// Close removes the handle and closes its file. It reports false if the
+// handle was not open, so that of concurrent closes only one succeeds.
+func (ht *handleTable) Close(id string) (*handleEntry, bool) {
+	ht.mu.Lock()
+	e, ok := ht.handles[id]
+	if ok {
+		delete(ht.handles, id)
+		ht.releaseLocked(e.claims.ID)
+	}
+	ht.mu.Unlock()
+	if ok {
+		e.file.Close()
+	}
+	return e, ok
+}
+
+// Count returns the number of handles capID holds.
+func (ht *handleTable) Count(capID string) int {
+	ht.mu.RLock()
+	defer ht.mu.RUnlock()
+	return ht.perCap[capID]
+}
+
+// reapedHandle is a handle Reap closed, and why.
+type reapedHandle struct {
+	id     string
+	entry  *handleEntry
+	reason string
+}
+
+// Reap closes the handles unused for longer than idle (if positive), and
+// those whose capability has expired or, by gone, been revoked.
+func (ht *handleTable) Reap(idle time.Duration, gone func(*capability.Capability) bool) []reapedHandle {
+	now := time.Now()
+	var reaped []reapedHandle
+	ht.mu.Lock()
+	for id, e := range ht.handles {
+		reason := ""
+		switch {
+		case e.claims.IsExpired():
+			reason = "capability expired"
+		case gone(e.claims):
+			reason = "capability revoked"
+		case idle > 0 && now.Sub(time.Unix(0, e.lastUsed.Load())) > idle:
+			reason = "idle"
+		default:
+			continue
+		}
+		delete(ht.handles, id)
+		ht.releaseLocked(e.claims.ID)
+		reaped = append(reaped, reapedHandle{id: id, entry: e, reason: reason})
+	}
+	ht.mu.Unlock()
+	for _, r := range reaped {
+		r.entry.file.Close()
+	}
+	return reaped
+}
+
+// handleInfo describes an open handle for fs.handles.
+type handleInfo struct {
+	Handle   string `json:"handle"`
+	CapID    string `json:"cap_id"`
+	Subject  string `json:"subject,omitempty"`
+	Path     string `json:"path"`
+	Write    bool   `json:"write"`
+	AgeSec   int64  `json:"age_sec"`
+	IdleSec  int64  `json:"idle_sec"`
+	openedAt time.Time
+}
+
+// List describes the open handles, oldest first.
+func (ht *handleTable) List() []handleInfo {
+	now := time.Now()
+	ht.mu.RLock()
+	list := make([]handleInfo, 0, len(ht.handles))
+	for id, e := range ht.handles {
+		list = append(list, handleInfo{
+			Handle:   id,
+			CapID:    e.claims.ID,
+			Subject:  e.claims.Subject,
+			Path:     e.path,
+			Write:    e.writable(),
+			AgeSec:   int64(now.Sub(e.createdAt).Seconds()),
+			IdleSec:  int64(now.Sub(time.Unix(0, e.lastUsed.Load())).Seconds()),
+			openedAt: e.createdAt,
+		})
+	}
+	ht.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].openedAt.Before(list[j].openedAt) })
+	return list
+}
+
+// CloseAll closes every handle, at shutdown.
+func (ht *handleTable) CloseAll() {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	for _, e := range ht.handles {
+		e.file.Close()
+	}
+	ht.handles = make(map[string]*handleEntry)
+	ht.perCap = make(map[string]int)
+	ht.open = 0
+}
+
+// offsetParam returns params' offset, and whether it has one; without one,
+// handles read and write at their cursor.
+func offsetParam(params map[string]any) (int64, bool, error) {
+	v, ok := params["offset"]
+	if !ok || v == nil {
+		return 0, false, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != float64(int64(f)) {
+		return 0, false, errors.New("offset must be a non-negative integer")
+	}
+	return int64(f), true, nil
+}
+
+// seekWhence maps fs.seek's whence to io's.
+var seekWhence = map[string]int{
+	"set": io.SeekStart,
+	"cur": io.SeekCurrent,
+	"end": io.SeekEnd,
+}
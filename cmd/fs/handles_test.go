@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/confine"
+)
+
+// testRoot returns a confined root over a directory holding a.txt.
+func testRoot(t *testing.T) *confine.Root {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello strata\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := confine.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+	return root
+}
+
+func testClaims(id string) *capability.Capability {
+	return &capability.Capability{ID: id, Subject: "uid:1000", Service: "fs", ExpiresAt: time.Now().Add(time.Hour)}
+}
+
+// hostOf returns the real host path of name beneath root.
+func hostOf(t *testing.T, root *confine.Root, name string) string {
+	t.Helper()
+	host, err := root.RealPath(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host
+}
+
+// open opens a.txt in ht for claims, failing the test on error.
+func open(t *testing.T, ht *handleTable, root *confine.Root, claims *capability.Capability, flag int) string {
+	t.Helper()
+	id, err := ht.Open(root, hostOf(t, root, "a.txt"), claims, flag, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return id
+}
+
+func TestHandleTable_Limits(t *testing.T) {
+	root := testRoot(t)
+	ht := newHandleTable(3, 2)
+	a, b, c := testClaims("a"), testClaims("b"), testClaims("c")
+
+	first := open(t, ht, root, a, os.O_RDONLY)
+	open(t, ht, root, a, os.O_RDONLY)
+	open(t, ht, root, b, os.O_RDONLY)
+
+	cases := []struct {
+		claims *capability.Capability
+		scope  string
+		limit  int
+	}{
+		{a, "capability", 2},
+		{c, "fs", 3},
+	}
+	for _, tc := range cases {
+		_, err := ht.Open(root, hostOf(t, root, "a.txt"), tc.claims, os.O_RDONLY, 0)
+		var le *handleLimitError
+		if !errors.As(err, &le) || le.scope != tc.scope || le.limit != tc.limit {
+			t.Errorf("cap %s: err = %v, want %s limit %d", tc.claims.ID, err, tc.scope, tc.limit)
+		}
+	}
+
+	if _, ok := ht.Close(first); !ok {
+		t.Fatal("Close of an open handle reported false")
+	}
+	if _, ok := ht.Close(first); ok {
+		t.Error("second Close reported true")
+	}
+	if n := ht.Count("a"); n != 1 {
+		t.Errorf("Count(a) = %d after closing one, want 1", n)
+	}
+	open(t, ht, root, c, os.O_RDONLY)
+}
+
+func TestHandleTable_FailedOpenFreesSlot(t *testing.T) {
+	root := testRoot(t)
+	ht := newHandleTable(1, 1)
+	claims := testClaims("a")
+	if _, err := ht.Open(root, hostOf(t, root, "missing.txt"), claims, os.O_RDONLY, 0); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("err = %v, want not found", err)
+	}
+	// A symlink swapped in after the check fails the open, too.
+	host := hostOf(t, root, "a.txt")
+	os.Rename(host, host+".orig")
+	os.Symlink("a.txt.orig", host)
+	if _, err := ht.Open(root, host, claims, os.O_RDONLY, 0); !errors.Is(err, confine.ErrChanged) {
+		t.Fatalf("err = %v, want confine.ErrChanged", err)
+	}
+	if n := ht.Count("a"); n != 0 {
+		t.Errorf("Count = %d after a failed open, want 0", n)
+	}
+	open(t, ht, root, claims, os.O_RDONLY)
+}
+
+func TestHandleTable_Reap(t *testing.T) {
+	root := testRoot(t)
+	ht := newHandleTable(0, 0)
+	live, expired, revoked := testClaims("live"), testClaims("expired"), testClaims("revoked")
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+
+	keep := open(t, ht, root, live, os.O_RDONLY)
+	idle := open(t, ht, root, live, os.O_RDONLY)
+	open(t, ht, root, expired, os.O_RDONLY)
+	open(t, ht, root, revoked, os.O_RDONLY)
+	e, _ := ht.Get(idle)
+	e.lastUsed.Store(time.Now().Add(-time.Hour).UnixNano())
+
+	gone := func(c *capability.Capability) bool { return c.ID == "revoked" }
+	reasons := map[string]string{}
+	for _, r := range ht.Reap(time.Minute, gone) {
+		reasons[r.entry.claims.ID+"/"+r.id] = r.reason
+		if _, err := r.entry.file.Stat(); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("reaped handle %s left open", r.id)
+		}
+	}
+	want := map[string]string{
+		"live/" + idle: "idle",
+		"expired/h3":   "capability expired",
+		"revoked/h4":   "capability revoked",
+	}
+	if len(reasons) != len(want) {
+		t.Fatalf("reaped %v, want %v", reasons, want)
+	}
+	for k, v := range want {
+		if reasons[k] != v {
+			t.Errorf("reaped %s: %q, want %q", k, reasons[k], v)
+		}
+	}
+	if _, ok := ht.Get(keep); !ok || ht.Count("live") != 1 || ht.Count("expired") != 0 {
+		t.Errorf("after Reap: counts live=%d expired=%d", ht.Count("live"), ht.Count("expired"))
+	}
+	if r := ht.Reap(0, gone); len(r) != 0 {
+		t.Errorf("idle timeout 0 reaped %d handles", len(r))
+	}
+}
+
+func TestHandleTable_List(t *testing.T) {
+	root := testRoot(t)
+	ht := newHandleTable(0, 0)
+	r := open(t, ht, root, testClaims("a"), os.O_RDONLY)
+	w := open(t, ht, root, testClaims("b"), os.O_WRONLY)
+	e, _ := ht.Get(r)
+	e.createdAt = e.createdAt.Add(-time.Minute)
+
+	list := ht.List()
+	if len(list) != 2 || list[0].Handle != r || list[1].Handle != w {
+		t.Fatalf("List = %+v, want %s then %s", list, r, w)
+	}
+	if l := list[0]; l.CapID != "a" || l.Subject != "uid:1000" || l.Path != hostOf(t, root, "a.txt") || l.Write || l.AgeSec < 60 {
+		t.Errorf("List[0] = %+v", l)
+	}
+	if !list[1].Write {
+		t.Error("write handle listed as read-only")
+	}
+}
+
+func TestHandleEntry_ReadCursor(t *testing.T) {
+	root := testRoot(t)
+	ht := newHandleTable(0, 0)
+	e, _ := ht.Get(open(t, ht, root, testClaims("a"), os.O_RDONLY))
+
+	cases := []struct {
+		off  int64
+		size int
+		data string
+		pos  int64
+		eof  bool
+	}{
+		{-1, 5, "hello", 5, false},
+		{-1, 5, " stra", 10, false},
+		{-1, 5, "ta\n", 13, true},
+		{-1, 5, "", 13, true},
+		{6, 3, "str", 9, false}, // an offset moves the cursor
+		{-1, 2, "at", 11, false},
+		{0, 13, "hello strata\n", 13, false},
+	}
+	for i, tc := range cases {
+		buf := make([]byte, tc.size)
+		n, pos, eof, err := e.read(buf, tc.off)
+		if err != nil || string(buf[:n]) != tc.data || pos != tc.pos || eof != tc.eof {
+			t.Errorf("read %d = (%q, %d, %v, %v), want (%q, %d, %v)", i, buf[:n], pos, eof, err, tc.data, tc.pos, tc.eof)
+		}
+	}
+}
+
+func TestHandleEntry_ReadSize(t *testing.T) {
+	root := testRoot(t)
+	ht := newHandleTable(0, 0)
+	e, _ := ht.Get(open(t, ht, root, testClaims("a"), os.O_RDONLY))
+	if _, err := e.seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	// a.txt holds 13 bytes; a read is charged only what it can return.
+	cases := []struct {
+		n, off, want int64
+	}{
+		{4096, 0, 13},
+		{5, 0, 5},
+		{4096, -1, 3}, // from the cursor
+		{4096, 13, 0},
+		{4096, 100, 0},
+	}
+	for _, tc := range cases {
+		if got, err := e.readSize(tc.n, tc.off); err != nil || got != tc.want {
+			t.Errorf("readSize(%d, %d) = (%d, %v), want %d", tc.n, tc.off, got, err, tc.want)
+		}
+	}
+}
+
+func TestHandleEntry_Seek(t *testing.T) {
+	root := testRoot(t)
+	ht := newHandleTable(0, 0)
+	e, _ := ht.Get(open(t, ht, root, testClaims("a"), os.O_RDONLY))
+
+	cases := []struct {
+		offset int64
+		whence string
+		pos    int64
+		err    error
+	}{
+		{4, "set", 4, nil},
+		{2, "cur", 6, nil},
+		{0, "cur", 6, nil},
+		{-3, "end", 10, nil},
+		{100, "set", 100, nil}, // past the end is allowed
+		{-1, "set", 0, errSeekBeforeStart},
+		{-20, "end", 0, errSeekBeforeStart},
+	}
+	for _, tc := range cases {
+		pos, err := e.seek(tc.offset, seekWhence[tc.whence])
+		if !errors.Is(err, tc.err) || err == nil && pos != tc.pos {
+			t.Errorf("seek(%d, %s) = (%d, %v), want (%d, %v)", tc.offset, tc.whence, pos, err, tc.pos, tc.err)
+		}
+	}
+	// A failed seek leaves the cursor where it was.
+	if pos, _ := e.cursor(); pos != 100 {
+		t.Errorf("cursor = %d after failed seeks, want 100", pos)
+	}
+	if _, _, eof, err := e.read(make([]byte, 1), -1); !eof || err != nil {
+		t.Errorf("read past the end: eof=%v err=%v", eof, err)
+	}
+}
+
+func TestHandleEntry_WriteCursor(t *testing.T) {
+	root := testRoot(t)
+	ht := newHandleTable(0, 0)
+	e, _ := ht.Get(open(t, ht, root, testClaims("a"), os.O_RDWR))
+
+	steps := []struct {
+		data  string
+		off   int64
+		atEnd bool
+		pos   int64
+	}{
+		{"HE", -1, false, 2},
+		{"LL", -1, false, 4},
+		{"S", 6, false, 7},
+		{"!", -1, true, 14},
+	}
+	for i, st := range steps {
+		n, pos, err := e.write([]byte(st.data), st.off, st.atEnd)
+		if err != nil || n != len(st.data) || pos != st.pos {
+			t.Errorf("write %d = (%d, %d, %v), want (%d, %d)", i, n, pos, err, len(st.data), st.pos)
+		}
+	}
+	buf := make([]byte, 32)
+	n, _, _, _ := e.read(buf, 0)
+	if got := string(buf[:n]); got != "HELLo Strata\n!" {
+		t.Errorf("file = %q", got)
+	}
+
+	// On an append handle every write lands at the end.
+	a, _ := ht.Get(open(t, ht, root, testClaims("a"), os.O_WRONLY|os.O_APPEND))
+	if _, pos, err := a.write([]byte("?"), 0, false); err != nil || pos != 15 {
+		t.Errorf("append write = (%d, %v), want cursor 15", pos, err)
+	}
+}
+
+func TestHandleEntry_ClosedFile(t *testing.T) {
+	root := testRoot(t)
+	ht := newHandleTable(0, 0)
+	id := open(t, ht, root, testClaims("a"), os.O_RDONLY)
+	e, _ := ht.Get(id)
+	ht.Close(id)
+	if _, _, _, err := e.read(make([]byte, 1), -1); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("read on a closed handle: %v, want os.ErrClosed", err)
+	}
+	if _, _, _, err := e.read(make([]byte, 1), 0); errors.Is(err, io.EOF) {
+		t.Error("read on a closed handle reported EOF")
+	}
+}
+
+func TestOffsetParam(t *testing.T) {
+	cases := []struct {
+		params map[string]any
+		off    int64
+		has    bool
+		bad    bool
+	}{
+		{map[string]any{}, 0, false, false},
+		{map[string]any{"offset": nil}, 0, false, false},
+		{map[string]any{"offset": float64(0)}, 0, true, false},
+		{map[string]any{"offset": float64(42)}, 42, true, false},
+		{map[string]any{"offset": float64(-1)}, 0, false, true},
+		{map[string]any{"offset": 1.5}, 0, false, true},
+		{map[string]any{"offset": "7"}, 0, false, true},
+	}
+	for _, tc := range cases {
+		off, has, err := offsetParam(tc.params)
+		if (err != nil) != tc.bad || off != tc.off || has != tc.has {
+			t.Errorf("offsetParam(%v) = (%d, %v, %v)", tc.params, off, has, err)
+		}
+	}
+}
@@ -5,102 +5,110 @@
 package main
 
 import (
+	"context"
 	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"sync"
-	"sync/atomic"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/Gao-OS/StrataOS/internal/auth"
 	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/confine"
 	"github.com/Gao-OS/StrataOS/internal/ipc"
 	"github.com/Gao-OS/StrataOS/internal/policy"
+	"github.com/Gao-OS/StrataOS/internal/revocation"
 )
 
-// handleEntry binds an open file to the capability that opened it.
-type handleEntry struct {
-	file      *os.File
-	capID     string
-	path      string
-	createdAt time.Time
-}
+// revocationSyncInterval is how often fs re-subscribes to identity and
+// fetches any revocations it missed.
+const revocationSyncInterval = 30 * time.Second
 
-// handleTable maps opaque handle IDs to open files and tracks revoked capabilities.
-type handleTable struct {
-	mu      sync.RWMutex
-	handles map[string]*handleEntry
-	revoked map[string]struct{}
-	nextID  atomic.Uint64
-}
+// stateSyncInterval is how often fs syncs the rate-limit and quota
+// state it shares with the node's other services to disk.
+const stateSyncInterval = time.Second
 
-func newHandleTable() *handleTable {
-	return &handleTable{
-		handles: make(map[string]*handleEntry),
-		revoked: make(map[string]struct{}),
-	}
-}
+// rulesReloadInterval is how often fs checks its policy rules file for
+// changes.
+const rulesReloadInterval = 2 * time.Second
 
-func (ht *handleTable) Open(path, capID string) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return "", err
-	}
-	absPath, _ := filepath.Abs(path)
-	id := fmt.Sprintf("h%d", ht.nextID.Add(1))
-	ht.mu.Lock()
-	ht.handles[id] = &handleEntry{
-		file:      f,
-		capID:     capID,
-		path:      absPath,
-		createdAt: time.Now(),
-	}
-	ht.mu.Unlock()
-	return id, nil
-}
+// Handle limits, unless STRATA_FS_HANDLE_IDLE, STRATA_FS_MAX_HANDLES and
+// STRATA_FS_MAX_HANDLES_PER_CAP say otherwise.
+const (
+	defaultHandleIdle       = 10 * time.Minute
+	defaultMaxHandles       = 4096
+	defaultMaxHandlesPerCap = 256
+)
 
-func (ht *handleTable) Get(id string) (*handleEntry, bool) {
-	ht.mu.RLock()
-	defer ht.mu.RUnlock()
-	e, ok := ht.handles[id]
-	return e, ok
-}
+// handleReapInterval is how often fs closes idle handles and those of
+// expired or revoked capabilities; at most half the idle timeout.
+const handleReapInterval = 30 * time.Second
 
-func (ht *handleTable) Revoke(capID string) {
-	ht.mu.Lock()
-	defer ht.mu.Unlock()
-	ht.revoked[capID] = struct{}{}
+// maxDataSize bounds the data one request reads or writes; it matches the
+// IPC frame limit.
+const maxDataSize = 1 << 20
+
+// defaultPerm is the mode of files created without a perm param, less what
+// the capability's create_perm withholds.
+const defaultPerm = 0o644
+
+// handleIOError maps an error from a handle's file: one closed by fs.close
+// or the reaper mid-request is as gone as a handle never opened.
+func handleIOError(reqID string, err error) ipc.Response {
+	if errors.Is(err, os.ErrClosed) {
+		return ipc.ErrorResponse(reqID, ipc.ErrNotFound, "invalid handle")
+	}
+	return ipc.ErrorResponse(reqID, ipc.ErrInternal, err.Error())
 }
 
-func (ht *handleTable) IsRevoked(capID string) bool {
-	ht.mu.RLock()
-	defer ht.mu.RUnlock()
-	_, ok := ht.revoked[capID]
-	return ok
+// envDuration returns the duration in the environment variable name, or
+// def if it is unset.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Fatalf("[fs] %s: invalid duration %q", name, v)
+	}
+	return d
 }
 
-func (ht *handleTable) CloseAll() {
-	ht.mu.Lock()
-	defer ht.mu.Unlock()
-	for _, e := range ht.handles {
-		e.file.Close()
+// envInt returns the non-negative integer in the environment variable
+// name, or def if it is unset.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
 	}
-	ht.handles = make(map[string]*handleEntry)
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Fatalf("[fs] %s: invalid count %q", name, v)
+	}
+	return n
 }
 
 // extractClaims verifies the PASETO token from the request.
 // Returns nil claims if no token is present (policy.Authorize handles that).
-// Returns an error response only if the token is present but cryptographically invalid.
-func extractClaims(req *ipc.Request, pubKey ed25519.PublicKey) (*capability.Capability, *ipc.Response) {
+// Returns an error response only if the token is present but of a version
+// not in versions, cryptographically invalid, expired, or bound to a holder
+// the caller cannot prove to be.
+func extractClaims(req *ipc.Request, pubKey ed25519.PublicKey, versions []auth.Version) (*capability.Capability, *ipc.Response) {
 	if req.Auth == nil || req.Auth.Token == "" {
 		return nil, nil
 	}
-	cap, err := auth.Verify(req.Auth.Token, pubKey)
+	err := auth.CheckVersion(req.Auth.Token, versions)
+	var cap *capability.Capability
+	if err == nil {
+		cap, err = auth.Verify(req.Auth.Token, pubKey)
+	}
 	if err != nil {
 		resp := ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, "invalid token: "+err.Error())
 		return nil, &resp
@@ -109,13 +117,200 @@ func extractClaims(req *ipc.Request, pubKey ed25519.PublicKey) (*capability.Capa
 		resp := ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, "token expired")
 		return nil, &resp
 	}
+	if err := auth.CheckBinding(cap, req.PeerUID(), req.ReqID, req.Method, req.Auth.Proof); err != nil {
+		resp := ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, err.Error())
+		return nil, &resp
+	}
 	return cap, nil
 }
 
+// pathError converts an error resolving a path beneath the served
+// directory into an IPC error response; what names the kind of object.
+func pathError(reqID string, err error, what string) ipc.Response {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ipc.ErrorResponse(reqID, ipc.ErrNotFound, what+" not found")
+	case errors.Is(err, os.ErrExist):
+		return ipc.ErrorResponse(reqID, ipc.ErrConflict, what+" already exists")
+	case errors.Is(err, syscall.EISDIR):
+		return ipc.ErrorResponse(reqID, ipc.ErrInvalidRequest, what+" is a directory")
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return ipc.ErrorResponse(reqID, ipc.ErrConflict, what+" is not empty")
+	case errors.Is(err, confine.ErrEscape):
+		return ipc.ErrorResponse(reqID, ipc.ErrPermDenied, "path escapes the capability root")
+	case errors.Is(err, confine.ErrChanged):
+		return ipc.ErrorResponse(reqID, ipc.ErrConflict, "path changed while the request was checked")
+	}
+	return ipc.ErrorResponse(reqID, ipc.ErrInternal, err.Error())
+}
+
+// openFlags maps fs.open's flags to open(2) flags. read and write choose
+// the access; the others imply write.
+var openFlags = map[string]int{
+	"read":      0,
+	"write":     0,
+	"create":    os.O_CREATE,
+	"exclusive": os.O_EXCL,
+	"append":    os.O_APPEND,
+	"truncate":  os.O_TRUNC,
+}
+
+// parseOpenFlags decodes fs.open's flags param, or its older mode param
+// ("r" or "rw"), into open(2) flags and the rights they need besides
+// fs.open: fs.write to write and fs.create to create. Files are opened for
+// reading by default.
+func parseOpenFlags(params map[string]any) (int, []string, error) {
+	var names []string
+	switch raw := params["flags"].(type) {
+	case nil:
+		switch mode, _ := params["mode"].(string); mode {
+		case "", "r":
+			names = []string{"read"}
+		case "rw":
+			names = []string{"read", "write"}
+		default:
+			return 0, nil, fmt.Errorf("mode must be \"r\" or \"rw\"")
+		}
+	case []any:
+		for _, f := range raw {
+			name, _ := f.(string)
+			if _, ok := openFlags[name]; !ok {
+				return 0, nil, fmt.Errorf("unknown flag %v: want read, write, create, exclusive, append or truncate", f)
+			}
+			names = append(names, name)
+		}
+	default:
+		return 0, nil, fmt.Errorf("flags must be a list")
+	}
+
+	flag := 0
+	read, write := false, false
+	for _, name := range names {
+		flag |= openFlags[name]
+		switch name {
+		case "read":
+			read = true
+		case "write", "create", "append", "truncate":
+			write = true
+		}
+	}
+	if flag&os.O_EXCL != 0 && flag&os.O_CREATE == 0 {
+		return 0, nil, fmt.Errorf("exclusive requires create")
+	}
+	var rights []string
+	switch {
+	case read && write:
+		flag |= os.O_RDWR
+	case write:
+		flag |= os.O_WRONLY
+	case !read:
+		return 0, nil, fmt.Errorf("flags must include read or write")
+	}
+	if write {
+		rights = append(rights, "fs.write")
+	}
+	if flag&os.O_CREATE != 0 {
+		rights = append(rights, "fs.create")
+	}
+	return flag, rights, nil
+}
+
+// parsePerm decodes the perm param of requests that may create a file,
+// defaulting to defaultPerm within claims' create_perm.
+func parsePerm(params map[string]any, claims *capability.Capability) (os.FileMode, error) {
+	raw, ok := params["perm"]
+	if !ok {
+		return policy.CreatePerm(claims, defaultPerm), nil
+	}
+	s, _ := raw.(string)
+	return policy.ParsePerm(s)
+}
+
+// internalCtxKeys are the authorization context keys fs derives itself,
+// which an fs.explain caller may not supply.
+var internalCtxKeys = []string{
+	policy.CtxMethod, policy.CtxHostPath, policy.CtxLabels, policy.CtxWrite,
+	policy.CtxQuota, policy.CtxBytes, policy.CtxRights, policy.CtxFileSize,
+	policy.CtxDir,
+}
+
+// parseDirPerm is parsePerm for directories, which by default get search
+// bits wherever they may be read; create_perm allows them those too.
+func parseDirPerm(params map[string]any, claims *capability.Capability) (os.FileMode, error) {
+	if _, ok := params["perm"]; ok {
+		return parsePerm(params, claims)
+	}
+	perm := policy.CreatePerm(claims, 0o755)
+	return perm | (perm&0o444)>>2, nil
+}
+
+// createFlags returns the open flags of an fs.create request: by default
+// the file must not exist yet.
+func createFlags(params map[string]any) int {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if exclusive, ok := params["exclusive"].(bool); ok && !exclusive {
+		flag &^= os.O_EXCL
+	}
+	return flag
+}
+
+// requestData decodes the data a write carries: data_b64, base64-encoded,
+// or data, a plain string.
+func requestData(params map[string]any) ([]byte, error) {
+	var data []byte
+	if b64, ok := params["data_b64"].(string); ok {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(b64); err != nil {
+			return nil, fmt.Errorf("invalid data_b64: %v", err)
+		}
+	} else if s, ok := params["data"].(string); ok {
+		data = []byte(s)
+	} else {
+		return nil, fmt.Errorf("missing data or data_b64 param")
+	}
+	if len(data) > maxDataSize {
+		return nil, fmt.Errorf("data exceeds maximum (%d bytes)", maxDataSize)
+	}
+	return data, nil
+}
+
+// fileStat describes a file for fs.stat.
+func fileStat(info os.FileInfo) map[string]any {
+	typ := "other"
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		typ = "file"
+	case mode.IsDir():
+		typ = "dir"
+	case mode&os.ModeSymlink != 0:
+		typ = "symlink"
+	}
+	result := map[string]any{
+		"name":  info.Name(),
+		"type":  typ,
+		"size":  info.Size(),
+		"mode":  fmt.Sprintf("%#o", info.Mode().Perm()),
+		"mtime": info.ModTime().UTC().Format(time.RFC3339Nano),
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		result["inode"] = st.Ino
+		result["nlink"] = st.Nlink
+	}
+	return result
+}
+
+// joinHost joins name to the host path dir; "" (no host path) stays "".
+func joinHost(dir, name string) string {
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, name)
+}
+
 // policyError converts a policy.PolicyError into an IPC error response.
 func policyError(reqID string, err error) ipc.Response {
 	if pe, ok := err.(*policy.PolicyError); ok {
-		return ipc.FullErrorResponse(reqID, pe.Code, pe.Name, pe.Message, nil)
+		return ipc.FullErrorResponse(reqID, pe.Code, pe.Name, pe.Message, pe.Details)
 	}
 	return ipc.ErrorResponse(reqID, ipc.ErrInternal, err.Error())
 }
@@ -144,11 +339,313 @@ func main() {
 	}
 	log.Printf("[fs] loaded identity public key")
 
-	handles := newHandleTable()
-	srv := ipc.NewServer(filepath.Join(runtimeDir, "fs.sock"))
+	_, versions, err := auth.ConfiguredVersions(os.Getenv("STRATA_TOKEN_VERSION"), os.Getenv("STRATA_TOKEN_VERSIONS"))
+	if err != nil {
+		log.Fatalf("[fs] token versions: %v", err)
+	}
+	log.Printf("[fs] accepting %v tokens", versions)
+
+	// Handles are closed once idle for too long, and are limited in
+	// number per capability and in all; 0 lifts a limit.
+	handleIdle := envDuration("STRATA_FS_HANDLE_IDLE", defaultHandleIdle)
+	maxHandles := envInt("STRATA_FS_MAX_HANDLES", defaultMaxHandles)
+	maxHandlesPerCap := envInt("STRATA_FS_MAX_HANDLES_PER_CAP", defaultMaxHandlesPerCap)
+	handles := newHandleTable(maxHandles, maxHandlesPerCap)
+	log.Printf("[fs] handles: idle timeout %v, at most %d per capability and %d in all",
+		handleIdle, maxHandlesPerCap, maxHandles)
+	sockPath := filepath.Join(runtimeDir, "fs.sock")
+	srv := ipc.NewServer(sockPath)
+
+	// Mirror identity's revocation list; revoked capabilities' handles
+	// become unusable as soon as the revocation arrives, and are closed
+	// by the reaper, which it wakes.
+	reapNow := make(chan struct{}, 1)
+	revoked := revocation.NewFollower("fs", "unix://"+sockPath, filepath.Join(runtimeDir, "identity.sock"),
+		func(r auth.Revocation) {
+			if r.Selector != nil {
+				log.Printf("[fs] capabilities matching %+v revoked (handles invalidated)", *r.Selector)
+			} else {
+				log.Printf("[fs] capability %s revoked (handles invalidated)", r.CapID)
+			}
+			select {
+			case reapNow <- struct{}{}:
+			default:
+			}
+		})
+	if err := revoked.Sync(); err != nil {
+		log.Printf("[fs] initial revocation sync failed: %v", err)
+	}
+
+	// max_uses counts live in the state directory so a restart does not
+	// hand out fresh uses.
+	stateDir := os.Getenv("STRATA_STATE_DIR")
+	if stateDir == "" {
+		stateDir = runtimeDir
+	}
+	usesPath := filepath.Join(stateDir, "fs-uses.json")
+	uses, err := policy.OpenUseCounter(usesPath)
+	if err != nil {
+		log.Fatalf("[fs] %v", err)
+	}
+	// Spent one-shot capabilities are revoked everywhere, not just here,
+	// once the request that spent them is done with them.
+	oneShots := newOneShots(handles.Count, func(claims *capability.Capability) {
+		if err := revoked.Revoke(claims.ID); err != nil {
+			log.Printf("[fs] one-shot capability %s not revoked: %v", claims.ID, err)
+		}
+	})
+	uses.OnExhausted = oneShots.Spent
+	policy.SetUseCounter(uses)
+	log.Printf("[fs] loaded use counts for %d capabilities from %s", uses.Len(), usesPath)
+
+	// Rate-limit buckets are shared by the node's services through a
+	// directory in the state directory, so neither a restart nor spreading
+	// requests over services refills them.
+	if os.Getenv("STRATA_RATE_LIMITER") == "memory" {
+		log.Printf("[fs] rate limits kept in memory")
+	} else {
+		limitsPath := filepath.Join(stateDir, "ratelimits")
+		limiter, err := policy.OpenFileLimiter(limitsPath)
+		if err != nil {
+			log.Fatalf("[fs] %v", err)
+		}
+		policy.SetLimiter(limiter)
+		log.Printf("[fs] rate limits shared through %s", limitsPath)
+	}
+
+	// Quota usage is shared the same way. Handles do not survive a
+	// restart, so neither do open_handles counts.
+	quotasPath := filepath.Join(stateDir, "quotas")
+	quotas, err := policy.OpenQuotaTracker(quotasPath)
+	if err != nil {
+		log.Fatalf("[fs] %v", err)
+	}
+	if err := quotas.ResetHandles("fs"); err != nil {
+		log.Fatalf("[fs] %v", err)
+	}
+	policy.SetQuotaTracker(quotas)
+	log.Printf("[fs] quota usage shared through %s", quotasPath)
+
+	if os.Getenv("STRATA_POLICY_DEBUG") != "" {
+		policy.SetDebug(true)
+		log.Printf("[fs] policy debug on: denials carry decision traces")
+	}
+
+	// Operator policy rules, reloaded whenever the file changes.
+	rulesPath := os.Getenv("STRATA_POLICY_RULES")
+	if rulesPath != "" {
+		rules, err := policy.LoadRules(rulesPath)
+		if err != nil {
+			log.Fatalf("[fs] %v", err)
+		}
+		policy.SetRules(rules)
+		log.Printf("[fs] loaded %d policy rules from %s", len(rules.Rules), rulesPath)
+	}
+
+	// Resource labels, matched against capability attributes.
+	var labels *policy.LabelDB
+	if path := os.Getenv("STRATA_FS_LABELS"); path != "" {
+		if labels, err = policy.LoadLabels(path); err != nil {
+			log.Fatalf("[fs] %v", err)
+		}
+		log.Printf("[fs] loaded labels for %d paths from %s", labels.Len(), path)
+	}
+	// labelsOf returns the labels of a host path; "" has none.
+	labelsOf := func(host string) []string {
+		if host == "" {
+			return nil
+		}
+		return labels.Lookup(host)
+	}
+
+	// Each capability's paths resolve beneath its path_prefix, or the root
+	// of its paths their first component names. Those with neither are
+	// served from STRATA_FS_ROOT, or refused if it is unset.
+	defaultRoot := os.Getenv("STRATA_FS_ROOT")
+	if defaultRoot != "" {
+		log.Printf("[fs] capabilities without a path_prefix are served from %s", defaultRoot)
+	}
+	// resolve returns the directory a request path resolves beneath for
+	// claims and the path relative to it, or dir "" if there is none.
+	resolve := func(claims *capability.Capability, path string) (dir, rel string) {
+		switch {
+		case claims == nil:
+			return "", ""
+		case len(claims.Constraints.Paths) > 0:
+			root, rel, ok := policy.SplitRootPath(claims.Constraints.Paths, path)
+			if !ok {
+				return "", ""
+			}
+			return root.Root, rel
+		case claims.Constraints.PathPrefix != "":
+			return claims.Constraints.PathPrefix, path
+		}
+		return defaultRoot, path
+	}
+	// hostPath returns the host path path names for claims, for rules and
+	// labels, or "" if it resolves nowhere. Symlinks beneath the root are
+	// resolved, so a link cannot take a request past a rule on its target;
+	// with follow false a final symlink is not, for requests on the entry
+	// itself. A path that cannot be resolved is taken as written.
+	hostPath := func(claims *capability.Capability, path string, follow bool) string {
+		dir, rel := resolve(claims, path)
+		if dir == "" {
+			return ""
+		}
+		if root, err := confine.OpenRoot(dir); err == nil {
+			real, err := root.RealPath(rel, follow)
+			root.Close()
+			if err == nil {
+				return real
+			}
+		}
+		abs, err := filepath.Abs(filepath.Join(dir, rel))
+		if err != nil {
+			return ""
+		}
+		return abs
+	}
+	// pathCtx is the authorization context of a request reading, or
+	// writing, path.
+	pathCtx := func(claims *capability.Capability, path string, write bool) map[string]any {
+		host := hostPath(claims, path, true)
+		ctx := map[string]any{
+			"path":             path,
+			policy.CtxHostPath: host,
+			policy.CtxLabels:   labelsOf(host),
+		}
+		if write {
+			ctx[policy.CtxWrite] = true
+		}
+		return ctx
+	}
+	// listCtx is the authorization context of listing path. Entries are
+	// charged to the list_entries quota once counted; a spent quota denies
+	// the listing up front.
+	listCtx := func(claims *capability.Capability, path string) map[string]any {
+		ctx := pathCtx(claims, path, false)
+		ctx[policy.CtxQuota] = map[string]int64{policy.QuotaListEntries: 0}
+		return ctx
+	}
+	// entryCtx is the authorization context of a request changing the
+	// entry path itself, which a symlink there does not redirect.
+	entryCtx := func(claims *capability.Capability, path string) map[string]any {
+		ctx := pathCtx(claims, path, true)
+		host := hostPath(claims, path, false)
+		ctx[policy.CtxHostPath] = host
+		ctx[policy.CtxLabels] = labelsOf(host)
+		return ctx
+	}
+	// openRoot opens the root path resolves beneath for claims and returns
+	// the path relative to it. Neither it nor the errors sent back name
+	// host paths.
+	openRoot := func(req *ipc.Request, claims *capability.Capability, path string) (*confine.Root, string, *ipc.Response) {
+		dir, rel := resolve(claims, path)
+		if dir == "" {
+			msg := "capability has no path_prefix and fs has no default root"
+			if len(claims.Constraints.Paths) > 0 {
+				msg = "path names none of the capability's roots"
+			}
+			resp := ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, msg)
+			return nil, "", &resp
+		}
+		root, err := confine.OpenRoot(dir)
+		if err != nil {
+			log.Printf("[fs] cannot open root of cap=%s: %v", claims.ID, err)
+			resp := pathError(req.ReqID, err, "capability root")
+			if resp.Error.Code == ipc.ErrInternal {
+				resp = ipc.ErrorResponse(req.ReqID, ipc.ErrInternal, "cannot open capability root")
+			}
+			return nil, "", &resp
+		}
+		return root, rel, nil
+	}
+
+	// openCtx is the authorization context of opening path with flag,
+	// needing rights besides the method's own. Opening to write also needs
+	// a writable root; creating, a perm create_perm allows. A handle
+	// counts against the open_handles quota while it is held.
+	openCtx := func(claims *capability.Capability, path string, flag int, rights []string, perm os.FileMode) map[string]any {
+		ctx := pathCtx(claims, path, flag&(os.O_WRONLY|os.O_RDWR) != 0)
+		ctx[policy.CtxQuota] = map[string]int64{policy.QuotaOpenHandles: 1}
+		if len(rights) > 0 {
+			ctx[policy.CtxRights] = rights
+		}
+		if flag&os.O_TRUNC != 0 {
+			ctx[policy.CtxFileSize] = int64(0)
+		}
+		if flag&os.O_CREATE != 0 {
+			ctx[policy.CtxPerm] = perm
+		}
+		return ctx
+	}
+	// mkdirCtx is the authorization context of creating the directory path
+	// with perm.
+	mkdirCtx := func(claims *capability.Capability, path string, perm os.FileMode) map[string]any {
+		ctx := pathCtx(claims, path, true)
+		ctx[policy.CtxPerm] = perm
+		ctx[policy.CtxDir] = true
+		return ctx
+	}
+	// handleCtx is the authorization context of a request on an open
+	// handle, whose path was checked when it was opened; its path and
+	// labels are passed for operator policy rules and labels changed since.
+	handleCtx := func(entry *handleEntry, write bool) map[string]any {
+		ctx := map[string]any{
+			policy.CtxHandle: true,
+			"path":           entry.path,
+			policy.CtxLabels: labelsOf(entry.path),
+		}
+		if write {
+			ctx[policy.CtxWrite] = true
+		}
+		return ctx
+	}
+
+	// openHandle authorizes method to open path with flag, needing rights
+	// besides its own, and opens it.
+	openHandle := func(req *ipc.Request, claims *capability.Capability, method, path string,
+		flag int, rights []string, perm os.FileMode) ipc.Response {
+		ctx := openCtx(claims, path, flag, rights, perm)
+		// A denial charges nothing; from here on the handle's charge is
+		// released unless it is opened.
+		chargedAt := time.Now()
+		if err := policy.Authorize(claims, method, ctx); err != nil {
+			return policyError(req.ReqID, err)
+		}
+		defer oneShots.Done(claims)
+		opened := false
+		defer func() {
+			if !opened {
+				policy.ReleaseQuota(claims, policy.QuotaOpenHandles, 1, chargedAt)
+			}
+		}()
+
+		if revoked.IsRevoked(claims) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+		}
+
+		root, _, errResp := openRoot(req, claims, path)
+		if errResp != nil {
+			return *errResp
+		}
+		handle, err := handles.Open(root, ctx[policy.CtxHostPath].(string), claims, flag, perm)
+		root.Close()
+		var limitErr *handleLimitError
+		if errors.As(err, &limitErr) {
+			return ipc.FullErrorResponse(req.ReqID, ipc.ErrResourceExhaust, "RESOURCE_EXHAUSTED", limitErr.Error(),
+				map[string]any{"scope": limitErr.scope, "limit": limitErr.limit})
+		}
+		if err != nil {
+			return pathError(req.ReqID, err, "file")
+		}
+		opened = true
+		log.Printf("[fs] opened %s -> %s flags=%#x (cap=%s)", path, handle, flag, claims.ID)
+		return ipc.SuccessResponse(req.ReqID, map[string]string{"handle": handle})
+	}
 
 	srv.Handle("fs.open", func(req *ipc.Request) ipc.Response {
-		claims, errResp := extractClaims(req, pubKey)
+		claims, errResp := extractClaims(req, pubKey, versions)
 		if errResp != nil {
 			return *errResp
 		}
@@ -157,35 +654,43 @@ func main() {
 		if path == "" {
 			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing path param")
 		}
-
-		if err := policy.Authorize(claims, "fs.open", map[string]any{"path": path}); err != nil {
-			return policyError(req.ReqID, err)
+		flag, rights, err := parseOpenFlags(req.Params)
+		if err != nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+		}
+		perm, err := parsePerm(req.Params, claims)
+		if err != nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
 		}
+		return openHandle(req, claims, "fs.open", path, flag, rights, perm)
+	})
 
-		if handles.IsRevoked(claims.ID) {
-			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+	// fs.create creates a file and opens it for writing; by default it
+	// must not exist yet.
+	srv.Handle("fs.create", func(req *ipc.Request) ipc.Response {
+		claims, errResp := extractClaims(req, pubKey, versions)
+		if errResp != nil {
+			return *errResp
 		}
 
-		handle, err := handles.Open(path, claims.ID)
+		path, _ := req.Params["path"].(string)
+		if path == "" {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing path param")
+		}
+		perm, err := parsePerm(req.Params, claims)
 		if err != nil {
-			if os.IsNotExist(err) {
-				return ipc.ErrorResponse(req.ReqID, ipc.ErrNotFound, "file not found")
-			}
-			return ipc.ErrorResponse(req.ReqID, ipc.ErrInternal, err.Error())
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
 		}
-		log.Printf("[fs] opened %s -> %s (cap=%s)", path, handle, claims.ID)
-		return ipc.SuccessResponse(req.ReqID, map[string]string{"handle": handle})
+		return openHandle(req, claims, "fs.create", path, createFlags(req.Params), nil, perm)
 	})
 
 	srv.Handle("fs.read", func(req *ipc.Request) ipc.Response {
-		claims, errResp := extractClaims(req, pubKey)
+		claims, errResp := extractClaims(req, pubKey, versions)
 		if errResp != nil {
 			return *errResp
 		}
-
-		// No path context for read — handle was already opened with permission.
-		if err := policy.Authorize(claims, "fs.read", nil); err != nil {
-			return policyError(req.ReqID, err)
+		if claims == nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, "token required")
 		}
 
 		handle, _ := req.Params["handle"].(string)
@@ -196,40 +701,255 @@ func main() {
 		if !ok {
 			return ipc.ErrorResponse(req.ReqID, ipc.ErrNotFound, "invalid handle")
 		}
-
-		// Handle binding: only the capability that opened the handle may use it.
-		if entry.capID != claims.ID {
+		// Handle binding: only the capability that opened the handle may
+		// use it, checked before anything is charged.
+		if entry.claims.ID != claims.ID {
 			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "handle not bound to this capability")
 		}
 
-		if handles.IsRevoked(entry.capID) {
-			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+		offset, hasOffset, err := offsetParam(req.Params)
+		if err != nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
 		}
-
-		offset, _ := req.Params["offset"].(float64)
 		size, _ := req.Params["size"].(float64)
 		if size <= 0 {
 			size = 4096
 		}
-		const maxReadSize = 1 << 20 // 1 MiB, matches IPC frame limit
-		if size > maxReadSize {
+		if size > maxDataSize {
 			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest,
-				fmt.Sprintf("size exceeds maximum (%d bytes)", maxReadSize))
+				fmt.Sprintf("size exceeds maximum (%d bytes)", maxDataSize))
 		}
 
-		buf := make([]byte, int(size))
-		n, err := entry.file.ReadAt(buf, int64(offset))
-		if err != nil && err != io.EOF {
-			return ipc.ErrorResponse(req.ReqID, ipc.ErrInternal, err.Error())
+		// Read at offset, or at the cursor, and leave the cursor after
+		// what was read.
+		if !hasOffset {
+			offset = -1
 		}
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+		want, err := entry.readSize(int64(size), offset)
+		if err != nil {
+			return handleIOError(req.ReqID, err)
+		}
+
+		// The handle was already opened with permission, which also spent
+		// the use; its path and labels are passed for operator policy rules
+		// and labels changed since. What the file holds of the requested
+		// size is charged against byte-rate limits and the bytes_read
+		// quota; what goes unread all the same is returned to the quota.
+		ctx := handleCtx(entry, false)
+		ctx[policy.CtxBytes] = want
+		ctx[policy.CtxQuota] = map[string]int64{policy.QuotaBytesRead: want}
+		chargedAt := time.Now()
+		if err := policy.Authorize(claims, "fs.read", ctx); err != nil {
+			return policyError(req.ReqID, err)
+		}
+		unread := want
+		defer func() { policy.ReleaseQuota(claims, policy.QuotaBytesRead, unread, chargedAt) }()
+
+		if revoked.IsRevoked(claims) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+		}
+
+		if !entry.readable() {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "handle not open for reading")
+		}
+
+		buf := make([]byte, want)
+		n, pos, eof, err := entry.read(buf, offset)
+		unread -= int64(n)
+		if err != nil {
+			return handleIOError(req.ReqID, err)
+		}
+		// A read the file cut short reached its end.
+		eof = eof || int64(n) < int64(size)
 		return ipc.SuccessResponse(req.ReqID, map[string]any{
 			"data":       string(buf[:n]),
 			"bytes_read": n,
+			"eof":        eof,
+			"offset":     pos,
+		})
+	})
+
+	// writeHandle authorizes method on the handle req names, as fs.read
+	// does, with ctx describing the change given the file's size, and then
+	// makes it with do, which reports the bytes it wrote. The handle must
+	// be open for writing, and its cursor stays put from ctx to do. Of the
+	// bytes_written quota ctx charges, what do does not write is returned.
+	writeHandle := func(req *ipc.Request, method string, ctx func(e *handleEntry, size int64) map[string]any,
+		do func(e *handleEntry) (any, int64, error)) ipc.Response {
+		claims, errResp := extractClaims(req, pubKey, versions)
+		if errResp != nil {
+			return *errResp
+		}
+		if claims == nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, "token required")
+		}
+
+		handle, _ := req.Params["handle"].(string)
+		if handle == "" {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing handle param")
+		}
+		entry, ok := handles.Get(handle)
+		if !ok {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrNotFound, "invalid handle")
+		}
+		if entry.claims.ID != claims.ID {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "handle not bound to this capability")
+		}
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+		info, err := entry.file.Stat()
+		if err != nil {
+			return handleIOError(req.ReqID, err)
+		}
+		c := handleCtx(entry, true)
+		for k, v := range ctx(entry, info.Size()) {
+			c[k] = v
+		}
+		chargedAt := time.Now()
+		if err := policy.Authorize(claims, method, c); err != nil {
+			return policyError(req.ReqID, err)
+		}
+		quota, _ := c[policy.CtxQuota].(map[string]int64)
+		unwritten := quota[policy.QuotaBytesWritten]
+		defer func() { policy.ReleaseQuota(claims, policy.QuotaBytesWritten, unwritten, chargedAt) }()
+
+		if revoked.IsRevoked(claims) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+		}
+		if !entry.writable() {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "handle not open for writing")
+		}
+
+		result, written, err := do(entry)
+		unwritten -= written
+		if err != nil {
+			return handleIOError(req.ReqID, err)
+		}
+		return ipc.SuccessResponse(req.ReqID, result)
+	}
+
+	// writeData writes a request's data at offset, or at the cursor, or at
+	// the end of the file if atEnd, and leaves the cursor after it. The data
+	// is charged against byte-rate limits and the bytes_written quota, and
+	// may not grow the file past max_file_size; what goes unwritten is
+	// returned to the quota.
+	writeData := func(req *ipc.Request, method string, atEnd bool) ipc.Response {
+		data, err := requestData(req.Params)
+		if err != nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+		}
+		offset, hasOffset, err := offsetParam(req.Params)
+		if err != nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+		}
+		n := int64(len(data))
+		return writeHandle(req, method, func(e *handleEntry, size int64) map[string]any {
+			end := offset + n
+			switch {
+			case atEnd || e.flag&os.O_APPEND != 0:
+				end = size + n
+			case !hasOffset:
+				// A failed cursor read fails the write that follows.
+				pos, _ := e.cursor()
+				end = pos + n
+			}
+			return map[string]any{
+				policy.CtxBytes:    n,
+				policy.CtxQuota:    map[string]int64{policy.QuotaBytesWritten: n},
+				policy.CtxFileSize: max(size, end),
+			}
+		}, func(e *handleEntry) (any, int64, error) {
+			at := offset
+			if !hasOffset {
+				at = -1
+			}
+			written, pos, err := e.write(data, at, atEnd)
+			if err != nil {
+				return nil, int64(written), err
+			}
+			return map[string]any{"bytes_written": written, "offset": pos}, int64(written), nil
+		})
+	}
+
+	srv.Handle("fs.write", func(req *ipc.Request) ipc.Response {
+		return writeData(req, "fs.write", false)
+	})
+
+	srv.Handle("fs.append", func(req *ipc.Request) ipc.Response {
+		return writeData(req, "fs.append", true)
+	})
+
+	// fs.seek moves a handle's cursor and, like fs.close, needs no right:
+	// it reads and writes nothing.
+	srv.Handle("fs.seek", func(req *ipc.Request) ipc.Response {
+		claims, errResp := extractClaims(req, pubKey, versions)
+		if errResp != nil {
+			return *errResp
+		}
+		if claims == nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, "token required")
+		}
+
+		handle, _ := req.Params["handle"].(string)
+		if handle == "" {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing handle param")
+		}
+		offset, _ := req.Params["offset"].(float64)
+		if offset != float64(int64(offset)) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "offset must be an integer")
+		}
+		whenceName, _ := req.Params["whence"].(string)
+		if whenceName == "" {
+			whenceName = "set"
+		}
+		whence, ok := seekWhence[whenceName]
+		if !ok {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest,
+				fmt.Sprintf("unknown whence %q: want set, cur or end", whenceName))
+		}
+
+		entry, ok := handles.Get(handle)
+		if !ok {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrNotFound, "invalid handle")
+		}
+		if entry.claims.ID != claims.ID {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "handle not bound to this capability")
+		}
+		if revoked.IsRevoked(claims) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+		}
+
+		entry.mu.Lock()
+		pos, err := entry.seek(int64(offset), whence)
+		entry.mu.Unlock()
+		if errors.Is(err, errSeekBeforeStart) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+		}
+		if err != nil {
+			return handleIOError(req.ReqID, err)
+		}
+		return ipc.SuccessResponse(req.ReqID, map[string]any{"offset": pos})
+	})
+
+	srv.Handle("fs.truncate", func(req *ipc.Request) ipc.Response {
+		size, _ := req.Params["size"].(float64)
+		if size < 0 || size != float64(int64(size)) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "size must be a non-negative integer")
+		}
+		return writeHandle(req, "fs.truncate", func(*handleEntry, int64) map[string]any {
+			return map[string]any{policy.CtxFileSize: int64(size)}
+		}, func(e *handleEntry) (any, int64, error) {
+			if err := e.file.Truncate(int64(size)); err != nil {
+				return nil, 0, err
+			}
+			return map[string]any{"size": int64(size)}, 0, nil
 		})
 	})
 
 	srv.Handle("fs.list", func(req *ipc.Request) ipc.Response {
-		claims, errResp := extractClaims(req, pubKey)
+		claims, errResp := extractClaims(req, pubKey, versions)
 		if errResp != nil {
 			return *errResp
 		}
@@ -239,57 +959,615 @@ func main() {
 			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing path param")
 		}
 
-		if err := policy.Authorize(claims, "fs.list", map[string]any{"path": path}); err != nil {
+		ctx := listCtx(claims, path)
+		host := ctx[policy.CtxHostPath].(string)
+		if err := policy.Authorize(claims, "fs.list", ctx); err != nil {
 			return policyError(req.ReqID, err)
 		}
+		defer oneShots.Done(claims)
 
-		if handles.IsRevoked(claims.ID) {
+		if revoked.IsRevoked(claims) {
 			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
 		}
 
-		entries, err := os.ReadDir(path)
-		if err != nil {
-			if os.IsNotExist(err) {
-				return ipc.ErrorResponse(req.ReqID, ipc.ErrNotFound, "directory not found")
+		var items []map[string]any
+		if len(claims.Constraints.Paths) > 0 && filepath.Clean(path) == "." {
+			// A capability with several roots sees them as the top directory.
+			for _, r := range claims.Constraints.Paths {
+				items = append(items, map[string]any{"name": r.RootName(), "is_dir": true})
 			}
-			return ipc.ErrorResponse(req.ReqID, ipc.ErrInternal, err.Error())
+		} else {
+			root, rel, errResp := openRoot(req, claims, path)
+			if errResp != nil {
+				return *errResp
+			}
+			entries, err := root.ReadDir(rel)
+			if err != nil {
+				root.Close()
+				return pathError(req.ReqID, err, "directory")
+			}
+			for _, e := range entries {
+				// Entries the capability's paths exclude, or whose labels
+				// its attributes do not satisfy, are hidden; symlinks by
+				// what they lead to.
+				entryHost := filepath.Join(host, e.Name())
+				if e.Mode()&os.ModeSymlink != 0 {
+					if real, err := root.RealPath(filepath.Join(rel, e.Name()), true); err == nil {
+						entryHost = real
+					}
+				}
+				if policy.CheckPath(claims, filepath.Join(path, e.Name()), entryHost, false) != nil ||
+					policy.CheckLabels(claims, labelsOf(entryHost)) != nil {
+					continue
+				}
+				items = append(items, map[string]any{
+					"name":   e.Name(),
+					"is_dir": e.IsDir(),
+					"size":   e.Size(),
+				})
+			}
+			root.Close()
+		}
+		if err := policy.ChargeQuota(claims, policy.QuotaListEntries, int64(len(items))); err != nil {
+			return policyError(req.ReqID, err)
 		}
+		return ipc.SuccessResponse(req.ReqID, map[string]any{"entries": items})
+	})
 
-		var items []map[string]any
+	// checkTree refuses to change the directory rel beneath root, reached
+	// by the request path path, as a whole if the capability may not change
+	// every entry in it: its paths constraint, labels and the operator's
+	// rules for the request's method apply to each. Moving it to newPath
+	// ("" if it stays) also needs every entry to be one the capability may
+	// change where it lands.
+	var checkTree func(req *ipc.Request, claims *capability.Capability, root *confine.Root, rel, path, newPath string) *ipc.Response
+	checkTree = func(req *ipc.Request, claims *capability.Capability, root *confine.Root, rel, path, newPath string) *ipc.Response {
+		if len(claims.Constraints.Paths) == 0 && labels == nil && !policy.RulesLoaded() {
+			return nil
+		}
+		entries, err := root.ReadDir(rel)
+		if err != nil {
+			resp := pathError(req.ReqID, err, "directory")
+			return &resp
+		}
+		// mayChange reports whether the capability may change the entry at
+		// path p, host path host; entries are taken as they are, symlinks
+		// not followed.
+		mayChange := func(p, host string) bool {
+			return policy.CheckPath(claims, p, host, true) == nil &&
+				policy.CheckLabels(claims, labelsOf(host)) == nil &&
+				policy.CheckRules(claims, req.Method, map[string]any{
+					"path":             p,
+					policy.CtxHostPath: host,
+					policy.CtxWrite:    true,
+				}) == nil
+		}
+		host := hostPath(claims, path, true)
+		var newHost string
+		if newPath != "" {
+			newHost = hostPath(claims, newPath, true)
+		}
 		for _, e := range entries {
-			item := map[string]any{
-				"name":   e.Name(),
-				"is_dir": e.IsDir(),
+			p := filepath.Join(path, e.Name())
+			if !mayChange(p, joinHost(host, e.Name())) {
+				resp := ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied,
+					"directory holds entries the capability may not change")
+				return &resp
 			}
-			if info, err := e.Info(); err == nil {
-				item["size"] = info.Size()
+			var np string
+			if newPath != "" {
+				np = filepath.Join(newPath, e.Name())
+				if !mayChange(np, joinHost(newHost, e.Name())) {
+					resp := ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied,
+						"directory holds entries the capability may not place at the destination")
+					return &resp
+				}
+			}
+			if e.IsDir() {
+				if resp := checkTree(req, claims, root, filepath.Join(rel, e.Name()), p, np); resp != nil {
+					return resp
+				}
 			}
-			items = append(items, item)
 		}
-		return ipc.SuccessResponse(req.ReqID, map[string]any{"entries": items})
+		return nil
+	}
+	// entryRoot opens the root of a path naming an entry to create, remove
+	// or rename, which the root itself is not.
+	entryRoot := func(req *ipc.Request, claims *capability.Capability, path string) (*confine.Root, string, *ipc.Response) {
+		root, rel, errResp := openRoot(req, claims, path)
+		if errResp == nil && rel == "." {
+			root.Close()
+			resp := ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "path names the capability root")
+			return nil, "", &resp
+		}
+		return root, rel, errResp
+	}
+
+	srv.Handle("fs.stat", func(req *ipc.Request) ipc.Response {
+		claims, errResp := extractClaims(req, pubKey, versions)
+		if errResp != nil {
+			return *errResp
+		}
+
+		path, _ := req.Params["path"].(string)
+		if path == "" {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing path param")
+		}
+		if err := policy.Authorize(claims, "fs.stat", pathCtx(claims, path, false)); err != nil {
+			return policyError(req.ReqID, err)
+		}
+		defer oneShots.Done(claims)
+
+		if revoked.IsRevoked(claims) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+		}
+
+		if len(claims.Constraints.Paths) > 0 && filepath.Clean(path) == "." {
+			// The list of roots, as fs.list shows it.
+			return ipc.SuccessResponse(req.ReqID, map[string]any{"name": ".", "type": "dir"})
+		}
+		root, rel, errResp := openRoot(req, claims, path)
+		if errResp != nil {
+			return *errResp
+		}
+		stat := root.Stat
+		if nofollow, _ := req.Params["nofollow"].(bool); nofollow {
+			stat = root.Lstat
+		}
+		info, err := stat(rel)
+		root.Close()
+		if err != nil {
+			return pathError(req.ReqID, err, "file")
+		}
+		return ipc.SuccessResponse(req.ReqID, fileStat(info))
+	})
+
+	srv.Handle("fs.mkdir", func(req *ipc.Request) ipc.Response {
+		claims, errResp := extractClaims(req, pubKey, versions)
+		if errResp != nil {
+			return *errResp
+		}
+
+		path, _ := req.Params["path"].(string)
+		if path == "" {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing path param")
+		}
+		perm, err := parseDirPerm(req.Params, claims)
+		if err != nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+		}
+		if err := policy.Authorize(claims, "fs.mkdir", mkdirCtx(claims, path, perm)); err != nil {
+			return policyError(req.ReqID, err)
+		}
+		defer oneShots.Done(claims)
+
+		if revoked.IsRevoked(claims) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+		}
+
+		root, rel, errResp := entryRoot(req, claims, path)
+		if errResp != nil {
+			return *errResp
+		}
+		err = root.Mkdir(rel, perm)
+		root.Close()
+		if errors.Is(err, os.ErrNotExist) {
+			return pathError(req.ReqID, err, "parent directory")
+		}
+		if err != nil {
+			return pathError(req.ReqID, err, "directory")
+		}
+		log.Printf("[fs] mkdir %s mode=%#o (cap=%s)", path, perm, claims.ID)
+		return ipc.SuccessResponse(req.ReqID, map[string]any{})
+	})
+
+	// fs.remove removes a file or an empty directory, or with recursive
+	// set a directory and everything beneath it.
+	srv.Handle("fs.remove", func(req *ipc.Request) ipc.Response {
+		claims, errResp := extractClaims(req, pubKey, versions)
+		if errResp != nil {
+			return *errResp
+		}
+
+		path, _ := req.Params["path"].(string)
+		if path == "" {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing path param")
+		}
+		recursive, _ := req.Params["recursive"].(bool)
+		if err := policy.Authorize(claims, "fs.remove", entryCtx(claims, path)); err != nil {
+			return policyError(req.ReqID, err)
+		}
+		defer oneShots.Done(claims)
+
+		if revoked.IsRevoked(claims) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+		}
+
+		root, rel, errResp := entryRoot(req, claims, path)
+		if errResp != nil {
+			return *errResp
+		}
+		defer root.Close()
+		var err error
+		if recursive {
+			info, lerr := root.Lstat(rel)
+			if lerr != nil {
+				return pathError(req.ReqID, lerr, "file")
+			}
+			if info.IsDir() {
+				if resp := checkTree(req, claims, root, rel, path, ""); resp != nil {
+					return *resp
+				}
+			}
+			err = root.RemoveAll(rel)
+		} else {
+			err = root.Remove(rel)
+		}
+		if errors.Is(err, syscall.ENOTEMPTY) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrConflict, "directory not empty; set recursive to remove it with its contents")
+		}
+		if err != nil {
+			return pathError(req.ReqID, err, "file")
+		}
+		log.Printf("[fs] removed %s recursive=%v (cap=%s)", path, recursive, claims.ID)
+		return ipc.SuccessResponse(req.ReqID, map[string]any{})
+	})
+
+	// fs.rename moves a file or directory. Both paths must be writable by
+	// the capability; the destination is checked first, without spending.
+	srv.Handle("fs.rename", func(req *ipc.Request) ipc.Response {
+		claims, errResp := extractClaims(req, pubKey, versions)
+		if errResp != nil {
+			return *errResp
+		}
+
+		path, _ := req.Params["path"].(string)
+		newPath, _ := req.Params["new_path"].(string)
+		if path == "" || newPath == "" {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing path or new_path param")
+		}
+		if err := policy.Check(claims, "fs.rename", entryCtx(claims, newPath)); err != nil {
+			return policyError(req.ReqID, err)
+		}
+		if err := policy.Authorize(claims, "fs.rename", entryCtx(claims, path)); err != nil {
+			return policyError(req.ReqID, err)
+		}
+		defer oneShots.Done(claims)
+
+		if revoked.IsRevoked(claims) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+		}
+
+		root, rel, errResp := entryRoot(req, claims, path)
+		if errResp != nil {
+			return *errResp
+		}
+		defer root.Close()
+		dst, newRel, errResp := entryRoot(req, claims, newPath)
+		if errResp != nil {
+			return *errResp
+		}
+		defer dst.Close()
+		info, err := root.Lstat(rel)
+		if err != nil {
+			return pathError(req.ReqID, err, "file")
+		}
+		if info.IsDir() {
+			if resp := checkTree(req, claims, root, rel, path, newPath); resp != nil {
+				return *resp
+			}
+		}
+		err = root.Rename(rel, dst, newRel)
+		if errors.Is(err, syscall.EXDEV) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "cannot rename across filesystems")
+		}
+		if err != nil {
+			return pathError(req.ReqID, err, "file")
+		}
+		log.Printf("[fs] renamed %s -> %s (cap=%s)", path, newPath, claims.ID)
+		return ipc.SuccessResponse(req.ReqID, map[string]any{})
+	})
+
+	// fs.symlink creates a relative symlink whose target stays beneath the
+	// link's root and is readable by the capability.
+	srv.Handle("fs.symlink", func(req *ipc.Request) ipc.Response {
+		claims, errResp := extractClaims(req, pubKey, versions)
+		if errResp != nil {
+			return *errResp
+		}
+
+		path, _ := req.Params["path"].(string)
+		target, _ := req.Params["target"].(string)
+		if path == "" || target == "" {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing path or target param")
+		}
+		if filepath.IsAbs(target) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "target must be relative")
+		}
+		// What the link leads to, as a request path.
+		targetPath := filepath.Join(filepath.Dir(path), target)
+		if err := policy.Check(claims, "fs.symlink", pathCtx(claims, targetPath, false)); err != nil {
+			return policyError(req.ReqID, err)
+		}
+		if err := policy.Authorize(claims, "fs.symlink", entryCtx(claims, path)); err != nil {
+			return policyError(req.ReqID, err)
+		}
+		defer oneShots.Done(claims)
+
+		if revoked.IsRevoked(claims) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+		}
+
+		root, rel, errResp := entryRoot(req, claims, path)
+		if errResp != nil {
+			return *errResp
+		}
+		err := root.Symlink(target, rel)
+		root.Close()
+		if err != nil {
+			return pathError(req.ReqID, err, "file")
+		}
+		log.Printf("[fs] symlink %s -> %s (cap=%s)", path, target, claims.ID)
+		return ipc.SuccessResponse(req.ReqID, map[string]any{})
+	})
+
+	// fs.close needs no right: the capability that opened a handle may
+	// always let it go, revoked or not.
+	srv.Handle("fs.close", func(req *ipc.Request) ipc.Response {
+		claims, errResp := extractClaims(req, pubKey, versions)
+		if errResp != nil {
+			return *errResp
+		}
+		if claims == nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, "token required")
+		}
+
+		handle, _ := req.Params["handle"].(string)
+		if handle == "" {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing handle param")
+		}
+		entry, ok := handles.Get(handle)
+		if !ok {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrNotFound, "invalid handle")
+		}
+		if entry.claims.ID != claims.ID {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "handle not bound to this capability")
+		}
+		if _, ok := handles.Close(handle); !ok {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrNotFound, "invalid handle")
+		}
+		policy.ReleaseQuota(claims, policy.QuotaOpenHandles, 1, entry.createdAt)
+		oneShots.Closed(claims)
+		log.Printf("[fs] closed %s (cap=%s)", handle, claims.ID)
+		return ipc.SuccessResponse(req.ReqID, map[string]any{})
+	})
+
+	// Admin: every open handle, with its capability, host path and age.
+	// Only root and fs's own UID may list them.
+	srv.Handle("fs.handles", func(req *ipc.Request) ipc.Response {
+		if req.Peer == nil || req.Peer.UID != 0 && req.Peer.UID != os.Getuid() {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "fs.handles requires root or fs's own UID")
+		}
+		list := handles.List()
+		return ipc.SuccessResponse(req.ReqID, map[string]any{
+			"handles": list,
+			"open":    len(list),
+			"limits": map[string]any{
+				"max":              maxHandles,
+				"max_per_cap":      maxHandlesPerCap,
+				"idle_timeout_sec": int64(handleIdle.Seconds()),
+			},
+		})
+	})
+
+	// Dry run: what would Authorize decide for this token, method and ctx?
+	// Nothing is opened, and no use or rate-limit token is spent.
+	// explainCtx builds the authorization context method would build for
+	// a request with params: paths are resolved and labelled, handles
+	// looked up, and quotas charged, here, never taken from the caller.
+	explainCtx := func(req *ipc.Request, claims *capability.Capability, method string,
+		params map[string]any) (map[string]any, *ipc.Response) {
+		fail := func(code int, msg string) (map[string]any, *ipc.Response) {
+			resp := ipc.ErrorResponse(req.ReqID, code, msg)
+			return nil, &resp
+		}
+		for _, k := range internalCtxKeys {
+			if _, ok := params[k]; ok {
+				return fail(ipc.ErrInvalidRequest, fmt.Sprintf("ctx key %q is set by fs, not the caller", k))
+			}
+		}
+		if h, ok := params["handle"]; ok {
+			handle, _ := h.(string)
+			if handle == "" {
+				return fail(ipc.ErrInvalidRequest, "ctx handle must be a handle ID")
+			}
+			entry, ok := handles.Get(handle)
+			if !ok {
+				return fail(ipc.ErrNotFound, "invalid handle")
+			}
+			if claims == nil || entry.claims.ID != claims.ID {
+				return fail(ipc.ErrPermDenied, "handle not bound to this capability")
+			}
+			switch method {
+			case "fs.read":
+				size, _ := params["size"].(float64)
+				if size <= 0 {
+					size = 4096
+				}
+				offset, hasOffset, err := offsetParam(params)
+				if err != nil {
+					return fail(ipc.ErrInvalidRequest, err.Error())
+				}
+				if !hasOffset {
+					offset = -1
+				}
+				entry.mu.Lock()
+				want, err := entry.readSize(int64(size), offset)
+				entry.mu.Unlock()
+				if err != nil {
+					return fail(ipc.ErrInternal, err.Error())
+				}
+				ctx := handleCtx(entry, false)
+				ctx[policy.CtxBytes] = want
+				ctx[policy.CtxQuota] = map[string]int64{policy.QuotaBytesRead: want}
+				return ctx, nil
+			case "fs.write", "fs.append", "fs.truncate":
+				return handleCtx(entry, true), nil
+			}
+			return handleCtx(entry, false), nil
+		}
+
+		path, _ := params["path"].(string)
+		if path == "" {
+			return map[string]any{}, nil
+		}
+		switch method {
+		case "fs.open", "fs.create":
+			flag, rights := createFlags(params), []string(nil)
+			if method == "fs.open" {
+				var err error
+				if flag, rights, err = parseOpenFlags(params); err != nil {
+					return fail(ipc.ErrInvalidRequest, err.Error())
+				}
+			}
+			perm, err := parsePerm(params, claims)
+			if err != nil {
+				return fail(ipc.ErrInvalidRequest, err.Error())
+			}
+			return openCtx(claims, path, flag, rights, perm), nil
+		case "fs.list":
+			return listCtx(claims, path), nil
+		case "fs.mkdir":
+			perm, err := parseDirPerm(params, claims)
+			if err != nil {
+				return fail(ipc.ErrInvalidRequest, err.Error())
+			}
+			return mkdirCtx(claims, path, perm), nil
+		case "fs.remove", "fs.rename", "fs.symlink":
+			return entryCtx(claims, path), nil
+		}
+		return pathCtx(claims, path, false), nil
+	}
+
+	srv.Handle("fs.explain", func(req *ipc.Request) ipc.Response {
+		claims, errResp := extractClaims(req, pubKey, versions)
+		if errResp != nil {
+			return *errResp
+		}
+		method, _ := req.Params["method"].(string)
+		if !policy.MatchRight("fs.*", method) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "method param must be an fs method")
+		}
+		params, _ := req.Params["ctx"].(map[string]any)
+		ctx, errResp := explainCtx(req, claims, method, params)
+		if errResp != nil {
+			return *errResp
+		}
+
+		trace, err := policy.Explain(claims, method, ctx)
+		if err == nil {
+			if revoked.IsRevoked(claims) {
+				err = &policy.PolicyError{Code: policy.CodePermissionDenied, Name: "PERMISSION_DENIED", Message: "capability revoked"}
+				trace.Add("revocation", policy.StepFail, err.Error())
+			} else {
+				trace.Add("revocation", policy.StepPass, "")
+			}
+		}
+		// The operator's rules and the resource's labels are shown by name
+		// only while debugging, or to root and fs's own UID.
+		exp := policy.NewExplanation(method, trace, err)
+		if !policy.Debug() && (req.Peer == nil || req.Peer.UID != 0 && req.Peer.UID != os.Getuid()) {
+			exp.Redact()
+		}
+		return ipc.SuccessResponse(req.ReqID, exp)
 	})
 
-	// Internal revocation notification from identity service.
-	srv.Handle("fs.revoke", func(req *ipc.Request) ipc.Response {
-		capID, _ := req.Params["cap_id"].(string)
-		if capID == "" {
-			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing cap_id param")
+	// The caller's rate-limit buckets and quotas, and how much of them is
+	// left. Nothing is spent.
+	srv.Handle("fs.limits", func(req *ipc.Request) ipc.Response {
+		claims, errResp := extractClaims(req, pubKey, versions)
+		if errResp != nil {
+			return *errResp
+		}
+		if claims == nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, "token required")
+		}
+		buckets, err := policy.BucketLevels(claims.ID)
+		if err != nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInternal, err.Error())
+		}
+		if buckets == nil {
+			buckets = []policy.Bucket{}
+		}
+		quota, err := policy.QuotaReport(claims)
+		if err != nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInternal, err.Error())
+		}
+		result := map[string]any{
+			"cap_id":  claims.ID,
+			"buckets": buckets,
+			"handles": map[string]int{"open": handles.Count(claims.ID), "limit": maxHandlesPerCap},
+		}
+		if quota != nil {
+			result["quota"] = quota
 		}
-		handles.Revoke(capID)
-		log.Printf("[fs] capability %s revoked (handles invalidated)", capID)
-		return ipc.SuccessResponse(req.ReqID, map[string]string{"status": "revoked"})
+		return ipc.SuccessResponse(req.ReqID, result)
 	})
 
+	// Revocations pushed by the identity service.
+	srv.Handle("fs.revoke", revoked.Handle)
+
 	if err := srv.Start(); err != nil {
 		log.Fatalf("[fs] start failed: %v", err)
 	}
 	log.Printf("[fs] ready")
 
+	ctx, cancel := context.WithCancel(context.Background())
+	go policy.SyncState(ctx, stateSyncInterval, func(err error) {
+		log.Printf("[fs] %v", err)
+	})
+	go revoked.Run(ctx, revocationSyncInterval)
+	go func() {
+		interval := handleReapInterval
+		if handleIdle > 0 && handleIdle/2 < interval {
+			interval = handleIdle / 2
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-reapNow:
+			}
+			for _, r := range handles.Reap(handleIdle, revoked.IsRevoked) {
+				policy.ReleaseQuota(r.entry.claims, policy.QuotaOpenHandles, 1, r.entry.createdAt)
+				oneShots.Closed(r.entry.claims)
+				log.Printf("[fs] closed %s: %s (cap=%s)", r.id, r.reason, r.entry.claims.ID)
+			}
+		}
+	}()
+	if rulesPath != "" {
+		go policy.WatchRules(ctx, rulesPath, rulesReloadInterval, func(rules *policy.RuleSet, err error) {
+			if err != nil {
+				log.Printf("[fs] policy rules not reloaded, keeping previous: %v", err)
+				return
+			}
+			log.Printf("[fs] reloaded %d policy rules from %s", len(rules.Rules), rulesPath)
+		})
+	}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	<-sig
 
 	log.Printf("[fs] shutting down")
+	cancel()
 	handles.CloseAll()
+	oneShots.Flush()
 	srv.Stop()
+	if err := policy.FlushState(); err != nil {
+		log.Printf("[fs] %v", err)
+	}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// oneShots holds back the revocation of spent one-shot capabilities until
+// the request that spent the use has finished and the handles it opened
+// are closed, so that a one-shot token can open, read and close a file.
+// No further use can be spent meanwhile: the use counter refuses it.
+type oneShots struct {
+	mu      sync.Mutex
+	pending map[string]*spentOneShot
+	handles func(capID string) int // handles capID holds
+	revoke  func(claims *capability.Capability)
+}
+
+type spentOneShot struct {
+	claims   *capability.Capability
+	inFlight bool // the spending request has not finished
+}
+
+func newOneShots(handles func(capID string) int, revoke func(claims *capability.Capability)) *oneShots {
+	return &oneShots{
+		pending: make(map[string]*spentOneShot),
+		handles: handles,
+		revoke:  revoke,
+	}
+}
+
+// Spent records that a one-shot capability spent its use; it is the use
+// counter's OnExhausted. Other capabilities are ignored.
+func (o *oneShots) Spent(claims *capability.Capability) {
+	if !claims.Constraints.OneShot {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for id, p := range o.pending {
+		if p.claims.IsExpired() {
+			delete(o.pending, id)
+		}
+	}
+	o.pending[claims.ID] = &spentOneShot{claims: claims, inFlight: true}
+}
+
+// Done is called when a request that spent a use of claims has finished.
+// A use refunded because the request was denied leaves the capability
+// pending until it is spent again or expires.
+func (o *oneShots) Done(claims *capability.Capability) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if p, ok := o.pending[claims.ID]; ok {
+		p.inFlight = false
+		o.settleLocked(claims.ID)
+	}
+}
+
+// Closed is called when a handle of claims has been closed.
+func (o *oneShots) Closed(claims *capability.Capability) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.settleLocked(claims.ID)
+}
+
+// settleLocked revokes capID, in the background, once its spending
+// request has finished and it holds no handles.
+func (o *oneShots) settleLocked(capID string) {
+	p, ok := o.pending[capID]
+	if !ok || p.inFlight || o.handles(capID) > 0 {
+		return
+	}
+	delete(o.pending, capID)
+	go o.revoke(p.claims)
+}
+
+// Flush revokes every pending capability that has not expired, at
+// shutdown, when their handles are closed along with fs.
+func (o *oneShots) Flush() {
+	o.mu.Lock()
+	pending := o.pending
+	o.pending = make(map[string]*spentOneShot)
+	o.mu.Unlock()
+	for _, p := range pending {
+		if !p.claims.IsExpired() {
+			o.revoke(p.claims)
+		}
+	}
+}
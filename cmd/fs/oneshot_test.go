@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/policy"
+)
+
+func oneShotClaims(id string) *capability.Capability {
+	c := testClaims(id)
+	c.Constraints.MaxUses = 1
+	c.Constraints.OneShot = true
+	return c
+}
+
+// revokes returns a revoke func for newOneShots and the channel it reports on.
+func revokes() (func(*capability.Capability), chan string) {
+	ch := make(chan string, 4)
+	return func(c *capability.Capability) { ch <- c.ID }, ch
+}
+
+func expectRevoked(t *testing.T, ch chan string, want string) {
+	t.Helper()
+	select {
+	case id := <-ch:
+		if id != want {
+			t.Fatalf("revoked %s, want %s", id, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%s not revoked", want)
+	}
+}
+
+func expectNotRevoked(t *testing.T, ch chan string) {
+	t.Helper()
+	select {
+	case id := <-ch:
+		t.Fatalf("%s revoked early", id)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestOneShots_OpenReadClose(t *testing.T) {
+	root := testRoot(t)
+	ht := newHandleTable(0, 0)
+	revoke, revoked := revokes()
+	shots := newOneShots(ht.Count, revoke)
+	uses := policy.NewUseCounter()
+	uses.OnExhausted = shots.Spent
+	claims := oneShotClaims("once")
+
+	// fs.open spends the only use and opens the handle.
+	if err := uses.Spend(claims); err != nil {
+		t.Fatalf("Spend: %v", err)
+	}
+	id := open(t, ht, root, claims, os.O_RDONLY)
+	shots.Done(claims)
+	expectNotRevoked(t, revoked)
+
+	// fs.read works on the handle without spending.
+	e, ok := ht.Get(id)
+	if !ok {
+		t.Fatal("handle gone before it was closed")
+	}
+	buf := make([]byte, 64)
+	e.mu.Lock()
+	n, _, _, err := e.read(buf, -1)
+	e.mu.Unlock()
+	if err != nil || string(buf[:n]) != "hello strata\n" {
+		t.Fatalf("read = %q, %v", buf[:n], err)
+	}
+	if err := uses.Spend(claims); err == nil {
+		t.Fatal("second use spent")
+	}
+	expectNotRevoked(t, revoked)
+
+	// fs.close lets it go, and with it the capability.
+	if _, ok := ht.Close(id); !ok {
+		t.Fatal("Close reported false")
+	}
+	shots.Closed(claims)
+	expectRevoked(t, revoked, "once")
+}
+
+func TestOneShots_RequestWithoutHandle(t *testing.T) {
+	revoke, revoked := revokes()
+	shots := newOneShots(func(string) int { return 0 }, revoke)
+	claims := oneShotClaims("list")
+
+	shots.Spent(claims)
+	// A handle of another capability closing must not settle it early.
+	shots.Closed(claims)
+	expectNotRevoked(t, revoked)
+	shots.Done(claims)
+	expectRevoked(t, revoked, "list")
+
+	// Capabilities that are not one-shot are never revoked.
+	other := testClaims("many")
+	other.Constraints.MaxUses = 1
+	shots.Spent(other)
+	shots.Done(other)
+	expectNotRevoked(t, revoked)
+}
+
+func TestOneShots_Flush(t *testing.T) {
+	revoke, revoked := revokes()
+	shots := newOneShots(func(string) int { return 1 }, revoke)
+	claims := oneShotClaims("held")
+	shots.Spent(claims)
+	shots.Done(claims)
+	expectNotRevoked(t, revoked)
+	shots.Flush()
+	expectRevoked(t, revoked, "held")
+}
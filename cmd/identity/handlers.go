@@ -0,0 +1,491 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/auth"
+	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/ipc"
+	"github.com/Gao-OS/StrataOS/internal/policy"
+	"github.com/Gao-OS/StrataOS/internal/revocation"
+)
+
+// handlers holds the state identity's methods work on.
+type handlers struct {
+	tokens      *tokenMinter
+	issuance    *policy.IssuancePolicy
+	revocations *auth.RevocationList
+	refresh     *auth.RefreshStore
+	issued      *issuedLog
+	hub         *revocation.Hub
+}
+
+// register installs identity's methods on srv.
+func (h *handlers) register(srv *ipc.Server) {
+	srv.Handle("identity.issue", h.issue)
+	srv.Handle("identity.renew", h.renew)
+	srv.Handle("identity.revoke", h.revoke)
+	srv.Handle("identity.subscribe", h.subscribe)
+	srv.Handle("identity.introspect", h.introspect)
+	srv.Handle("identity.revocations", h.listRevocations)
+}
+
+// isAdmin reports whether the requester is an issuance admin: by UID, or by
+// presenting an admin capability as adminClaims checks it.
+func (h *handlers) isAdmin(req *ipc.Request) (bool, *ipc.Response) {
+	if req.Peer != nil && h.issuance.IsAdmin(req.Peer.UID) {
+		return true, nil
+	}
+	claims, errResp := adminClaims(req, h.tokens, h.revocations)
+	return claims != nil, errResp
+}
+
+// issue handles identity.issue: it checks the request against the issuance
+// policy and mints a token, with a refresh credential if asked.
+func (h *handlers) issue(req *ipc.Request) ipc.Response {
+	service, _ := req.Params["service"].(string)
+	if service == "" {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing service param")
+	}
+
+	var actions []string
+	if raw, ok := req.Params["actions"].([]any); ok {
+		for _, a := range raw {
+			if s, ok := a.(string); ok {
+				actions = append(actions, s)
+			}
+		}
+	}
+	var rights []string
+	if raw, ok := req.Params["rights"].([]any); ok {
+		for _, r := range raw {
+			if s, ok := r.(string); ok {
+				rights = append(rights, s)
+			}
+		}
+	}
+
+	positive := len(actions)
+	for _, r := range rights {
+		if err := policy.ValidateRight(r); err != nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+		}
+		if !strings.HasPrefix(r, "!") {
+			positive++
+		}
+	}
+	if positive == 0 {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "actions or rights required")
+	}
+
+	pathPrefix, _ := req.Params["path_prefix"].(string)
+	rateLimit, _ := req.Params["rate_limit"].(string)
+	subject, _ := req.Params["subject"].(string)
+	local, _ := req.Params["local"].(bool)
+	maxUses, _ := req.Params["max_uses"].(float64)
+	if maxUses < 0 || maxUses != float64(int(maxUses)) {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "max_uses must be a non-negative integer")
+	}
+	// A one-shot token has a single use and is revoked once it is spent.
+	oneShot, _ := req.Params["one_shot"].(bool)
+	if oneShot {
+		if maxUses > 1 {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "one_shot allows a single use")
+		}
+		maxUses = 1
+	}
+	confirm, err := parseConfirm(req.Params["cnf"])
+	if err != nil {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+	}
+	schedule, err := parseSchedule(req.Params["schedule"])
+	if err != nil {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+	}
+	ext, err := parseExtConstraints(req.Params["constraints"])
+	if err != nil {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+	}
+	attrs, err := parseAttrs(req.Params["attrs"])
+	if err != nil {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+	}
+	rateLimits, err := parseRateLimits(req.Params["rate_limits"])
+	if err != nil {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+	}
+	quotas, err := parseQuotas(req.Params["quotas"])
+	if err != nil {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+	}
+	paths, err := parsePaths(req.Params["paths"])
+	if err != nil {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+	}
+	if paths != nil && pathPrefix != "" {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "path_prefix and paths are exclusive")
+	}
+	maxFileSize, _ := req.Params["max_file_size"].(float64)
+	if maxFileSize < 0 || maxFileSize != float64(int64(maxFileSize)) {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "max_file_size must be a non-negative integer")
+	}
+	createPerm, _ := req.Params["create_perm"].(string)
+	var pathRoots []string
+	for _, r := range paths {
+		pathRoots = append(pathRoots, r.Root)
+	}
+
+	// Optional delegation lineage: the parent must be a live capability
+	// issued by this instance.
+	parent, _ := req.Params["parent"].(string)
+	if parent != "" {
+		if !h.issued.Known(parent) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrNotFound, "unknown parent capability: "+parent)
+		}
+		if h.revocations.IsRevoked(parent) {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "parent capability revoked")
+		}
+	}
+
+	ttlSec, _ := req.Params["ttl_seconds"].(float64)
+	if ttlSec <= 0 {
+		ttlSec = 3600
+	}
+
+	// Optional refresh credential, for renewing via identity.renew.
+	var refreshTTL time.Duration
+	wantRefresh, _ := req.Params["refresh"].(bool)
+	if sec, ok := req.Params["refresh_ttl_seconds"].(float64); ok && sec > 0 {
+		refreshTTL = time.Duration(sec) * time.Second
+	} else if wantRefresh {
+		refreshTTL = defaultRefreshTTL
+	}
+	// Use counts and quotas are kept per token, and every renewal is a
+	// new token, so a renewable token could never run out of them.
+	if refreshTTL > 0 && (maxUses > 0 || len(quotas) > 0) {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest,
+			"refresh cannot be combined with max_uses, one_shot or quotas")
+	}
+
+	adminCap, errResp := adminClaims(req, h.tokens, h.revocations)
+	if errResp != nil {
+		return *errResp
+	}
+	admin := adminCap != nil
+	peerUID := req.PeerUID()
+	// Tokens are attributed to the requesting UID unless an admin names
+	// another subject, so they can later be revoked by subject.
+	if subject == "" && peerUID >= 0 {
+		subject = policy.UIDSubject(peerUID)
+	}
+	if err := h.issuance.CheckIssuance(policy.IssuanceRequest{
+		PeerUID:    peerUID,
+		Admin:      admin,
+		Subject:    subject,
+		Service:    service,
+		Rights:     grantedRights(service, actions, rights),
+		TTL:        time.Duration(ttlSec) * time.Second,
+		RefreshTTL: refreshTTL,
+		PathPrefix: pathPrefix,
+		PathRoots:  pathRoots,
+		RateLimit:  rateLimit,
+		MaxUses:    int(maxUses),
+		Attrs:      attrs,
+	}); err != nil {
+		log.Printf("[identity] issuance denied for uid=%d service=%s: %v", peerUID, service, err)
+		return policyError(req.ReqID, err)
+	}
+
+	constraints := capability.Constraints{
+		PathPrefix: pathPrefix,
+		RateLimit:  rateLimit,
+		RateLimits: rateLimits,
+		MaxUses:    int(maxUses),
+		OneShot:    oneShot,
+		Schedule:   schedule,
+		Quotas:     quotas,
+		Paths:      paths,
+		Ext:        ext,
+
+		MaxFileSize: int64(maxFileSize),
+		CreatePerm:  createPerm,
+	}
+	// Constraints unknown here are left to the service that defines them.
+	if err := policy.ValidateConstraints(constraints); err != nil {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+	}
+	// Only now, with the token about to be issued, does issuing on the
+	// strength of an admin token spend its uses, rate and quota.
+	if admin {
+		if err := policy.Authorize(adminCap, "identity.issue", nil); err != nil {
+			return policyError(req.ReqID, err)
+		}
+	}
+	cap := capability.NewCapability(service, actions, constraints, time.Duration(ttlSec)*time.Second)
+	cap.Rights = rights
+	cap.Parent = parent
+	cap.Confirm = confirm
+	cap.Attrs = attrs
+	if subject != "" {
+		cap.Subject = subject
+	}
+
+	token, err := h.tokens.mint(cap, local)
+	if err != nil {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInternal, err.Error())
+	}
+
+	// A token asked for with a refresh credential is issued only with one.
+	result := map[string]any{
+		"token":   token,
+		"cap_id":  cap.ID,
+		"expires": cap.ExpiresAt.Unix(),
+	}
+	if refreshTTL > 0 {
+		cred, credExpires, err := h.refresh.Start(auth.RefreshGrant{
+			Subject:     cap.Subject,
+			Service:     cap.Service,
+			Actions:     cap.Actions,
+			Rights:      cap.Rights,
+			Constraints: cap.Constraints,
+			Confirm:     cap.Confirm,
+			Attrs:       cap.Attrs,
+			Local:       local,
+			TTL:         time.Duration(ttlSec) * time.Second,
+			RefreshTTL:  refreshTTL,
+		}, cap)
+		if err != nil {
+			log.Printf("[identity] %v", err)
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInternal, "cannot record refresh credential")
+		}
+		result["refresh_token"] = cred
+		result["refresh_expires"] = credExpires.Unix()
+	}
+	h.issued.Record(cap.ID, parent, cap.ExpiresAt)
+
+	log.Printf("[identity] issued capability %s for service=%s subject=%s actions=%v prefix=%q",
+		cap.ID, service, cap.Subject, actions, pathPrefix)
+	return ipc.SuccessResponse(req.ReqID, result)
+}
+
+// renew handles identity.renew, rotating a refresh credential for a fresh
+// token; a reused credential revokes its whole family.
+func (h *handlers) renew(req *ipc.Request) ipc.Response {
+	cred, _ := req.Params["refresh_token"].(string)
+	if cred == "" {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing refresh_token param")
+	}
+
+	var token string
+	cap, next, nextExpires, err := h.refresh.Renew(cred, func(g auth.RefreshGrant, prev *capability.Capability) (*capability.Capability, error) {
+		// Revoking any token of the family ends renewal, too.
+		if prev != nil && h.revocations.Matches(prev) {
+			return nil, auth.ErrRefreshRevoked
+		}
+		cap := g.NewCapability()
+		if prev != nil {
+			cap.Parent = prev.ID
+		}
+		var err error
+		token, err = h.tokens.mint(cap, g.Local)
+		return cap, err
+	})
+
+	var reuse *auth.RefreshReuseError
+	switch {
+	case errors.As(err, &reuse):
+		log.Printf("[identity] %v", err)
+		for capID, expires := range reuse.Caps {
+			if err := h.revocations.RevokeUntil(capID, expires); err != nil {
+				log.Printf("[identity] %v", err)
+			}
+			entry, _ := h.revocations.Get(capID)
+			h.hub.Publish(entry)
+		}
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "refresh credential reuse detected; token family revoked")
+	case errors.Is(err, auth.ErrRefreshInvalid), errors.Is(err, auth.ErrRefreshExpired):
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, err.Error())
+	case errors.Is(err, auth.ErrRefreshRevoked):
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, err.Error())
+	case cap == nil:
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInternal, err.Error())
+	case err != nil:
+		// Renewed in memory; only durability is lost.
+		log.Printf("[identity] %v", err)
+	}
+	h.issued.Record(cap.ID, cap.Parent, cap.ExpiresAt)
+	log.Printf("[identity] renewed capability %s -> %s", cap.Parent, cap.ID)
+
+	return ipc.SuccessResponse(req.ReqID, map[string]any{
+		"token":           token,
+		"cap_id":          cap.ID,
+		"expires":         cap.ExpiresAt.Unix(),
+		"refresh_token":   next,
+		"refresh_expires": nextExpires.Unix(),
+	})
+}
+
+// revoke handles identity.revoke by token, cap_id or selector and pushes
+// the revocation to subscribed verifiers.
+func (h *handlers) revoke(req *ipc.Request) ipc.Response {
+	capID, _ := req.Params["cap_id"].(string)
+	token, _ := req.Params["token"].(string)
+	rawSel, hasSel := req.Params["selector"].(map[string]any)
+	given := 0
+	for _, set := range []bool{capID != "", token != "", hasSel} {
+		if set {
+			given++
+		}
+	}
+	if given == 0 {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing cap_id, token or selector param")
+	}
+	if given > 1 {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "cap_id, token and selector are mutually exclusive")
+	}
+	// A token names itself and its expiry; anyone holding it may
+	// revoke it. Revoking by ID takes an admin or a trusted service,
+	// such as fs once a one-shot token is spent. Bulk revocation is an
+	// incident-response tool: admins only.
+	if token == "" {
+		admin, errResp := h.isAdmin(req)
+		if errResp != nil {
+			return *errResp
+		}
+		switch {
+		case hasSel && !admin:
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "bulk revocation requires an admin")
+		case !admin && !revocation.TrustedPeer(req.Peer):
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "revocation by cap_id requires an admin; present the token itself instead")
+		}
+	}
+
+	var entry auth.Revocation
+	if hasSel {
+		sel, err := parseSelector(rawSel)
+		if err != nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, err.Error())
+		}
+		// Retain the selector as long as any token it could cover lives,
+		// including those issued before a restart.
+		until := h.issued.LatestExpiry()
+		if floor := time.Now().Add(unknownRevocationRetention); until.Before(floor) {
+			until = floor
+		}
+		entry, err = h.revocations.RevokeMatching(sel, until)
+		if err != nil {
+			log.Printf("[identity] %v", err)
+		}
+		log.Printf("[identity] revoked capabilities matching %+v", sel)
+	} else {
+		var until time.Time
+		if token != "" {
+			claims, err := h.tokens.open(token)
+			if err != nil {
+				return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "invalid token: "+err.Error())
+			}
+			capID, until = claims.ID, claims.ExpiresAt
+		} else if until = h.issued.ExpiryOf(capID); until.IsZero() {
+			// Not on record, such as one issued before identity last
+			// restarted: kept for a bounded time rather than forever.
+			until = time.Now().Add(unknownRevocationRetention)
+		}
+		if err := h.revocations.RevokeUntil(capID, until); err != nil {
+			// The in-memory list is already updated; only durability is lost.
+			log.Printf("[identity] %v", err)
+		}
+		entry, _ = h.revocations.Get(capID)
+		log.Printf("[identity] revoked capability %s", capID)
+	}
+
+	// Push to every subscribed verifier; those that don't acknowledge
+	// catch up from identity.revocations when they next sync.
+	acked, pending := h.hub.Publish(entry)
+	if len(pending) > 0 {
+		log.Printf("[identity] revocation %d not acknowledged by %v", entry.Seq, pending)
+	}
+
+	return ipc.SuccessResponse(req.ReqID, map[string]any{
+		"status":  "revoked",
+		"seq":     entry.Seq,
+		"acked":   acked,
+		"pending": pending,
+	})
+}
+
+// subscribe handles identity.subscribe from trusted verifiers.
+func (h *handlers) subscribe(req *ipc.Request) ipc.Response {
+	if !revocation.TrustedPeer(req.Peer) {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "subscriber not trusted")
+	}
+	service, _ := req.Params["service"].(string)
+	endpoint, _ := req.Params["endpoint"].(string)
+	if service == "" {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing service param")
+	}
+	if endpoint == "" {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing endpoint param")
+	}
+	if h.hub.Subscribe(service, endpoint) {
+		log.Printf("[identity] %s subscribed to revocations at %s", service, endpoint)
+	}
+	return ipc.SuccessResponse(req.ReqID, map[string]any{"seq": h.revocations.Seq()})
+}
+
+// introspect handles identity.introspect.
+func (h *handlers) introspect(req *ipc.Request) ipc.Response {
+	token, _ := req.Params["token"].(string)
+	if token == "" {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing token param")
+	}
+	in := auth.IntrospectWith(token, h.tokens.open, h.revocations, h.issued.ParentOf)
+	if !auth.IsLocal(token) {
+		return ipc.SuccessResponse(req.ReqID, in)
+	}
+	// A local token's claims are hidden from its bearer: only admins
+	// see them, others learn just whether it is valid and for how long.
+	admin, errResp := h.isAdmin(req)
+	if errResp != nil {
+		return *errResp
+	}
+	if !admin {
+		return ipc.SuccessResponse(req.ReqID, in.Redacted())
+	}
+	return ipc.SuccessResponse(req.ReqID, in)
+}
+
+// listRevocations handles identity.revocations, paging through the list.
+// Entries name capability IDs and subjects, so only trusted verifiers and
+// admins may list them.
+func (h *handlers) listRevocations(req *ipc.Request) ipc.Response {
+	if !revocation.TrustedPeer(req.Peer) {
+		admin, errResp := h.isAdmin(req)
+		if errResp != nil {
+			return *errResp
+		}
+		if !admin {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "listing revocations requires an admin or a trusted service")
+		}
+	}
+	after, _ := req.Params["after"].(float64)
+	limit, _ := req.Params["limit"].(float64)
+	if limit <= 0 {
+		limit = defaultRevocationPage
+	}
+	if limit > maxRevocationPage {
+		limit = maxRevocationPage
+	}
+	page, more := h.revocations.List(uint64(after), int(limit))
+	next := uint64(after)
+	if len(page) > 0 {
+		next = page[len(page)-1].Seq
+	}
+	return ipc.SuccessResponse(req.ReqID, map[string]any{
+		"revocations": page,
+		"next":        next,
+		"more":        more,
+	})
+}
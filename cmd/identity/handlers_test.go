@@ -0,0 +1,507 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/auth"
+	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/ipc"
+	"github.com/Gao-OS/StrataOS/internal/policy"
+	"github.com/Gao-OS/StrataOS/internal/revocation"
+)
+
+// Test requester UIDs. None is root or the test's own UID, so none is a
+// trusted peer.
+const (
+	adminUID    = 70001 // an issuance admin
+	userUID     = 70002 // may issue fs.read tokens under the rule below
+	strangerUID = 70003 // may issue nothing
+)
+
+func newTestHandlers(t *testing.T) *handlers {
+	t.Helper()
+	dir := t.TempDir()
+	kp, err := auth.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := newTokenMinter(kp, auth.V4, []auth.Version{auth.V4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocations, err := auth.OpenRevocationList(filepath.Join(dir, "revocations.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := auth.OpenRefreshStore(filepath.Join(dir, "refresh.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &handlers{
+		tokens: tokens,
+		issuance: &policy.IssuancePolicy{
+			AdminUIDs: []int{adminUID},
+			Rules: []policy.IssuanceRule{{
+				UIDs:                 []int{userUID},
+				Service:              "fs",
+				Rights:               []string{"fs.read"},
+				MaxTTLSeconds:        600,
+				MaxRefreshTTLSeconds: 3600,
+			}},
+		},
+		revocations: revocations,
+		refresh:     refresh,
+		issued:      newIssuedLog(),
+		hub:         revocation.NewHub(),
+	}
+}
+
+// request builds a request from uid (none if negative) carrying token, if
+// any.
+func request(method string, uid int, token string, params map[string]any) *ipc.Request {
+	req := &ipc.Request{V: 1, ReqID: "r1", Method: method, Params: params}
+	if uid >= 0 {
+		req.Peer = &ipc.PeerCred{PID: 1, UID: uid, GID: uid}
+	}
+	if token != "" {
+		req.Auth = &ipc.Auth{Token: token}
+	}
+	return req
+}
+
+func expectOK(t *testing.T, resp ipc.Response) map[string]any {
+	t.Helper()
+	if !resp.OK {
+		t.Fatalf("request failed: %+v", resp.Error)
+	}
+	result, _ := resp.Result.(map[string]any)
+	return result
+}
+
+func expectError(t *testing.T, resp ipc.Response, code int) {
+	t.Helper()
+	if resp.OK {
+		t.Fatalf("request succeeded, want error %d", code)
+	}
+	if resp.Error.Code != code {
+		t.Fatalf("error = %d %s (%s), want %d", resp.Error.Code, resp.Error.Name, resp.Error.Message, code)
+	}
+}
+
+// mintToken mints a token for cap directly, bypassing identity.issue.
+func mintToken(t *testing.T, h *handlers, cap *capability.Capability, local bool) string {
+	t.Helper()
+	token, err := h.tokens.mint(cap, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.issued.Record(cap.ID, cap.Parent, cap.ExpiresAt)
+	return token
+}
+
+// adminToken mints a token authorized for identity.issue.
+func adminToken(t *testing.T, h *handlers) string {
+	t.Helper()
+	cap := capability.NewCapability("identity", nil, capability.Constraints{}, time.Hour)
+	cap.Rights = []string{"identity.issue"}
+	return mintToken(t, h, cap, false)
+}
+
+func readCap() *capability.Capability {
+	cap := capability.NewCapability("fs", nil, capability.Constraints{}, time.Hour)
+	cap.Rights = []string{"fs.read"}
+	cap.Subject = policy.UIDSubject(userUID)
+	return cap
+}
+
+func TestIntrospect_PublicToken(t *testing.T) {
+	h := newTestHandlers(t)
+	cap := readCap()
+	token := mintToken(t, h, cap, false)
+
+	resp := h.introspect(request("identity.introspect", strangerUID, "", map[string]any{"token": token}))
+	in, ok := resp.Result.(*auth.Introspection)
+	if !resp.OK || !ok {
+		t.Fatalf("introspect = %+v", resp)
+	}
+	if !in.Valid || in.Claims == nil || in.Claims.ID != cap.ID {
+		t.Errorf("introspection = %+v", in)
+	}
+}
+
+func TestIntrospect_MissingToken(t *testing.T) {
+	h := newTestHandlers(t)
+	expectError(t, h.introspect(request("identity.introspect", userUID, "", nil)), ipc.ErrInvalidRequest)
+}
+
+func TestIntrospect_InvalidToken(t *testing.T) {
+	h := newTestHandlers(t)
+	resp := h.introspect(request("identity.introspect", userUID, "", map[string]any{"token": "v4.public.garbage"}))
+	in, _ := resp.Result.(*auth.Introspection)
+	if !resp.OK || in == nil || in.Valid || in.Reason == "" {
+		t.Fatalf("introspect = %+v", resp)
+	}
+}
+
+func TestIntrospect_LocalTokenRedacted(t *testing.T) {
+	h := newTestHandlers(t)
+	token := mintToken(t, h, readCap(), true)
+
+	for _, uid := range []int{userUID, strangerUID, -1} {
+		resp := h.introspect(request("identity.introspect", uid, "", map[string]any{"token": token}))
+		in, _ := resp.Result.(*auth.Introspection)
+		if !resp.OK || in == nil {
+			t.Fatalf("uid %d: introspect = %+v", uid, resp)
+		}
+		if !in.Valid || in.Claims != nil || in.ExpiresIn == 0 {
+			t.Errorf("uid %d: introspection = %+v, want valid with claims hidden", uid, in)
+		}
+	}
+}
+
+func TestIntrospect_LocalTokenForAdmins(t *testing.T) {
+	h := newTestHandlers(t)
+	cap := readCap()
+	token := mintToken(t, h, cap, true)
+	params := map[string]any{"token": token}
+
+	// An admin UID sees the claims.
+	resp := h.introspect(request("identity.introspect", adminUID, "", params))
+	if in, _ := resp.Result.(*auth.Introspection); in == nil || in.Claims == nil || in.Claims.ID != cap.ID {
+		t.Errorf("admin UID: introspect = %+v", resp.Result)
+	}
+	// So does a caller presenting an admin token.
+	resp = h.introspect(request("identity.introspect", strangerUID, adminToken(t, h), params))
+	if in, _ := resp.Result.(*auth.Introspection); in == nil || in.Claims == nil {
+		t.Errorf("admin token: introspect = %+v", resp.Result)
+	}
+	// A token without issuance rights is no admin token.
+	resp = h.introspect(request("identity.introspect", strangerUID, mintToken(t, h, readCap(), false), params))
+	if in, _ := resp.Result.(*auth.Introspection); in == nil || in.Claims != nil {
+		t.Errorf("non-admin token: introspect = %+v", resp.Result)
+	}
+	// An unverifiable token is an error, not a silent downgrade.
+	expectError(t, h.introspect(request("identity.introspect", strangerUID, "v4.public.garbage", params)), ipc.ErrAuthRequired)
+}
+
+func TestRegister_ServesMethods(t *testing.T) {
+	h := newTestHandlers(t)
+	sock := filepath.Join(t.TempDir(), "identity.sock")
+	srv := ipc.NewServer(sock)
+	h.register(srv)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	token := mintToken(t, h, readCap(), false)
+	resp, err := ipc.SendRequest(sock, request("identity.introspect", -1, "", map[string]any{"token": token}))
+	if err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	result, _ := resp.Result.(map[string]any)
+	if !resp.OK || result["valid"] != true {
+		t.Errorf("identity.introspect over the socket = %+v", resp)
+	}
+}
+
+func issueParams(service string, rights ...string) map[string]any {
+	raw := make([]any, len(rights))
+	for i, r := range rights {
+		raw[i] = r
+	}
+	return map[string]any{"service": service, "rights": raw, "ttl_seconds": float64(300)}
+}
+
+func TestIssue_PeerUIDRule(t *testing.T) {
+	h := newTestHandlers(t)
+	result := expectOK(t, h.issue(request("identity.issue", userUID, "", issueParams("fs", "fs.read"))))
+
+	token, _ := result["token"].(string)
+	claims, err := h.tokens.open(token)
+	if err != nil {
+		t.Fatalf("issued token does not open: %v", err)
+	}
+	if claims.Subject != policy.UIDSubject(userUID) || claims.Service != "fs" {
+		t.Errorf("claims = %+v", claims)
+	}
+	if !h.issued.Known(claims.ID) {
+		t.Error("issued capability not recorded")
+	}
+}
+
+func TestIssue_Denied(t *testing.T) {
+	h := newTestHandlers(t)
+	cases := []struct {
+		name   string
+		uid    int
+		params map[string]any
+	}{
+		{"no peer", -1, issueParams("fs", "fs.read")},
+		{"stranger", strangerUID, issueParams("fs", "fs.read")},
+		{"right beyond the rule", userUID, issueParams("fs", "fs.write")},
+		{"service beyond the rule", userUID, issueParams("identity", "identity.issue")},
+		{"ttl beyond the rule", userUID, func() map[string]any {
+			p := issueParams("fs", "fs.read")
+			p["ttl_seconds"] = float64(3600)
+			return p
+		}()},
+		{"other subject", userUID, func() map[string]any {
+			p := issueParams("fs", "fs.read")
+			p["subject"] = "uid:0"
+			return p
+		}()},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectError(t, h.issue(request("identity.issue", tc.uid, "", tc.params)), ipc.ErrPermDenied)
+		})
+	}
+}
+
+func TestIssue_AdminUID(t *testing.T) {
+	h := newTestHandlers(t)
+	p := issueParams("identity", "identity.issue")
+	p["subject"] = "svc:backup"
+	result := expectOK(t, h.issue(request("identity.issue", adminUID, "", p)))
+	claims, err := h.tokens.open(result["token"].(string))
+	if err != nil || claims.Subject != "svc:backup" {
+		t.Errorf("claims = %+v, %v", claims, err)
+	}
+}
+
+func TestIssue_AdminToken(t *testing.T) {
+	h := newTestHandlers(t)
+	expectOK(t, h.issue(request("identity.issue", strangerUID, adminToken(t, h), issueParams("identity", "identity.issue"))))
+}
+
+func TestIssue_AdminTokenRejected(t *testing.T) {
+	h := newTestHandlers(t)
+	params := issueParams("fs", "fs.read")
+
+	// An unverifiable or expired token is refused outright.
+	expectError(t, h.issue(request("identity.issue", strangerUID, "v4.public.garbage", params)), ipc.ErrAuthRequired)
+	expired := capability.NewCapability("identity", nil, capability.Constraints{}, -time.Minute)
+	expired.Rights = []string{"identity.issue"}
+	expectError(t, h.issue(request("identity.issue", strangerUID, mintToken(t, h, expired, false), params)), ipc.ErrAuthRequired)
+
+	// A revoked admin token grants nothing.
+	admin := adminToken(t, h)
+	claims, _ := h.tokens.open(admin)
+	if err := h.revocations.RevokeUntil(claims.ID, claims.ExpiresAt); err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, h.issue(request("identity.issue", strangerUID, admin, params)), ipc.ErrPermDenied)
+
+	// Nor does a token without issuance rights, beyond the requester's own.
+	expectError(t, h.issue(request("identity.issue", strangerUID, mintToken(t, h, readCap(), false), params)), ipc.ErrPermDenied)
+}
+
+func TestIssue_AdminTokenSpentOnlyWhenIssuing(t *testing.T) {
+	h := newTestHandlers(t)
+	policy.SetUseCounter(policy.NewUseCounter())
+	defer policy.SetUseCounter(policy.NewUseCounter())
+
+	cap := capability.NewCapability("identity", nil, capability.Constraints{MaxUses: 1}, time.Hour)
+	cap.Rights = []string{"identity.issue"}
+	admin := mintToken(t, h, cap, false)
+
+	// A request refused for its parameters spends nothing.
+	bad := issueParams("fs", "fs.read")
+	bad["max_uses"] = float64(-1)
+	expectError(t, h.issue(request("identity.issue", strangerUID, admin, bad)), ipc.ErrInvalidRequest)
+
+	// Introspecting on the strength of the token spends nothing either.
+	h.introspect(request("identity.introspect", strangerUID, admin, map[string]any{"token": admin}))
+
+	// Issuing spends the only use; a spent token is no admin token.
+	expectOK(t, h.issue(request("identity.issue", strangerUID, admin, issueParams("fs", "fs.read"))))
+	expectError(t, h.issue(request("identity.issue", strangerUID, admin, issueParams("fs", "fs.read"))), ipc.ErrPermDenied)
+}
+
+func TestRevoke_ByToken(t *testing.T) {
+	h := newTestHandlers(t)
+	cap := readCap()
+	token := mintToken(t, h, cap, false)
+
+	// Anyone holding a token may revoke it.
+	result := expectOK(t, h.revoke(request("identity.revoke", strangerUID, "", map[string]any{"token": token})))
+	if result["status"] != "revoked" {
+		t.Errorf("result = %v", result)
+	}
+	if !h.revocations.IsRevoked(cap.ID) {
+		t.Error("token not revoked")
+	}
+	entry, _ := h.revocations.Get(cap.ID)
+	if !entry.ExpiresAt.Equal(cap.ExpiresAt) {
+		t.Errorf("retained until %v, want the token's expiry %v", entry.ExpiresAt, cap.ExpiresAt)
+	}
+
+	expectError(t, h.revoke(request("identity.revoke", strangerUID, "", map[string]any{"token": "v4.public.garbage"})), ipc.ErrInvalidRequest)
+}
+
+func TestRevoke_ByCapID(t *testing.T) {
+	h := newTestHandlers(t)
+	cap := readCap()
+	mintToken(t, h, cap, false)
+	params := map[string]any{"cap_id": cap.ID}
+
+	// Neither the subject nor a stranger may revoke by ID.
+	for _, uid := range []int{userUID, strangerUID, -1} {
+		expectError(t, h.revoke(request("identity.revoke", uid, "", params)), ipc.ErrPermDenied)
+	}
+	expectError(t, h.revoke(request("identity.revoke", strangerUID, mintToken(t, h, readCap(), false), params)), ipc.ErrPermDenied)
+	if h.revocations.IsRevoked(cap.ID) {
+		t.Fatal("revoked by an unauthorized caller")
+	}
+
+	// A trusted service may, and so may an admin by UID or token.
+	expectOK(t, h.revoke(request("identity.revoke", os.Getuid(), "", params)))
+	for _, req := range []*ipc.Request{
+		request("identity.revoke", adminUID, "", map[string]any{"cap_id": "other-1"}),
+		request("identity.revoke", strangerUID, adminToken(t, h), map[string]any{"cap_id": "other-2"}),
+	} {
+		expectOK(t, h.revoke(req))
+	}
+	if !h.revocations.IsRevoked(cap.ID) || !h.revocations.IsRevoked("other-1") || !h.revocations.IsRevoked("other-2") {
+		t.Error("authorized revocations not recorded")
+	}
+	// An ID identity has no record of is kept for a bounded time.
+	entry, _ := h.revocations.Get("other-1")
+	if entry.ExpiresAt.IsZero() || entry.ExpiresAt.After(time.Now().Add(unknownRevocationRetention+time.Minute)) {
+		t.Errorf("unknown cap_id retained until %v", entry.ExpiresAt)
+	}
+}
+
+func TestRevoke_BySelector(t *testing.T) {
+	h := newTestHandlers(t)
+	cap := readCap()
+	cap.IssuedAt = cap.IssuedAt.Add(-time.Minute)
+	params := map[string]any{"selector": map[string]any{"service": "fs"}}
+
+	// Bulk revocation is for admins only; trusted services are not enough.
+	for _, uid := range []int{userUID, strangerUID, os.Getuid()} {
+		expectError(t, h.revoke(request("identity.revoke", uid, "", params)), ipc.ErrPermDenied)
+	}
+	expectOK(t, h.revoke(request("identity.revoke", adminUID, "", params)))
+	if !h.revocations.Matches(cap) {
+		t.Error("selector does not cover an fs token issued before it")
+	}
+
+	bad := map[string]any{"selector": map[string]any{}}
+	expectError(t, h.revoke(request("identity.revoke", adminUID, "", bad)), ipc.ErrInvalidRequest)
+}
+
+func TestRevoke_Params(t *testing.T) {
+	h := newTestHandlers(t)
+	expectError(t, h.revoke(request("identity.revoke", adminUID, "", nil)), ipc.ErrInvalidRequest)
+	both := map[string]any{"cap_id": "x", "token": "y"}
+	expectError(t, h.revoke(request("identity.revoke", adminUID, "", both)), ipc.ErrInvalidRequest)
+}
+
+func TestListRevocations_Authorization(t *testing.T) {
+	h := newTestHandlers(t)
+	if err := h.revocations.RevokeUntil("secret-id", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uid := range []int{userUID, strangerUID, -1} {
+		expectError(t, h.listRevocations(request("identity.revocations", uid, "", nil)), ipc.ErrPermDenied)
+	}
+	expectError(t, h.listRevocations(request("identity.revocations", strangerUID, mintToken(t, h, readCap(), false), nil)), ipc.ErrPermDenied)
+
+	for _, req := range []*ipc.Request{
+		request("identity.revocations", os.Getuid(), "", nil),
+		request("identity.revocations", adminUID, "", nil),
+		request("identity.revocations", strangerUID, adminToken(t, h), nil),
+	} {
+		result := expectOK(t, h.listRevocations(req))
+		if page, _ := result["revocations"].([]auth.Revocation); len(page) != 1 || page[0].CapID != "secret-id" {
+			t.Errorf("revocations = %v", result["revocations"])
+		}
+	}
+}
+
+// issueRenewable issues an fs.read token with a refresh credential as
+// userUID and returns the issue result.
+func issueRenewable(t *testing.T, h *handlers) map[string]any {
+	t.Helper()
+	p := issueParams("fs", "fs.read")
+	p["refresh"] = true
+	p["refresh_ttl_seconds"] = float64(600)
+	result := expectOK(t, h.issue(request("identity.issue", userUID, "", p)))
+	if result["refresh_token"] == nil {
+		t.Fatalf("no refresh credential in %v", result)
+	}
+	return result
+}
+
+func renewParams(cred any) map[string]any {
+	return map[string]any{"refresh_token": cred}
+}
+
+func TestRenew_Rotates(t *testing.T) {
+	h := newTestHandlers(t)
+	first := issueRenewable(t, h)
+
+	second := expectOK(t, h.renew(request("identity.renew", strangerUID, "", renewParams(first["refresh_token"]))))
+	if second["refresh_token"] == first["refresh_token"] || second["cap_id"] == first["cap_id"] {
+		t.Fatalf("renewal reused the credential or capability: %v", second)
+	}
+	claims, err := h.tokens.open(second["token"].(string))
+	if err != nil {
+		t.Fatalf("renewed token does not open: %v", err)
+	}
+	if claims.Parent != first["cap_id"] || claims.Subject != policy.UIDSubject(userUID) {
+		t.Errorf("renewed claims = %+v", claims)
+	}
+	expectOK(t, h.renew(request("identity.renew", strangerUID, "", renewParams(second["refresh_token"]))))
+}
+
+func TestRenew_ReuseRevokesFamily(t *testing.T) {
+	h := newTestHandlers(t)
+	first := issueRenewable(t, h)
+	second := expectOK(t, h.renew(request("identity.renew", userUID, "", renewParams(first["refresh_token"]))))
+
+	// Presenting the rotated-out credential again revokes every token of
+	// the family, and ends renewal for the current credential too.
+	expectError(t, h.renew(request("identity.renew", userUID, "", renewParams(first["refresh_token"]))), ipc.ErrPermDenied)
+	for _, id := range []any{first["cap_id"], second["cap_id"]} {
+		if !h.revocations.IsRevoked(id.(string)) {
+			t.Errorf("%v not revoked after reuse", id)
+		}
+	}
+	resp := h.renew(request("identity.renew", userUID, "", renewParams(second["refresh_token"])))
+	if resp.OK {
+		t.Error("renewed a family revoked for reuse")
+	}
+}
+
+func TestRenew_Refused(t *testing.T) {
+	h := newTestHandlers(t)
+	expectError(t, h.renew(request("identity.renew", userUID, "", nil)), ipc.ErrInvalidRequest)
+	expectError(t, h.renew(request("identity.renew", userUID, "", renewParams("not-a-credential"))), ipc.ErrAuthRequired)
+
+	// Revoking a token of the family ends its renewal.
+	first := issueRenewable(t, h)
+	expectOK(t, h.revoke(request("identity.revoke", userUID, "", map[string]any{"token": first["token"]})))
+	expectError(t, h.renew(request("identity.renew", userUID, "", renewParams(first["refresh_token"]))), ipc.ErrPermDenied)
+}
+
+func TestIssue_RefreshRules(t *testing.T) {
+	h := newTestHandlers(t)
+
+	// Use-limited tokens are not renewable.
+	p := issueParams("fs", "fs.read")
+	p["refresh"] = true
+	p["max_uses"] = float64(3)
+	expectError(t, h.issue(request("identity.issue", userUID, "", p)), ipc.ErrInvalidRequest)
+
+	// The issuance rule bounds the refresh credential's lifetime.
+	p = issueParams("fs", "fs.read")
+	p["refresh_ttl_seconds"] = float64(7200)
+	expectError(t, h.issue(request("identity.issue", userUID, "", p)), ipc.ErrPermDenied)
+}
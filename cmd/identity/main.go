@@ -1,20 +1,416 @@
-// Identity service: generates ed25519 keypair, issues and revokes
-// PASETO v2.public capability tokens over UDS.
+// Identity service: generates ed25519 keypair, issues, renews, revokes and
+// introspects PASETO capability tokens over UDS.
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/Gao-OS/StrataOS/internal/auth"
 	"github.com/Gao-OS/StrataOS/internal/capability"
 	"github.com/Gao-OS/StrataOS/internal/ipc"
+	"github.com/Gao-OS/StrataOS/internal/policy"
+	"github.com/Gao-OS/StrataOS/internal/revocation"
 )
 
+// Revocation list paging and garbage collection.
+const (
+	defaultRevocationPage = 100
+	maxRevocationPage     = 1000
+	revocationGCInterval  = time.Minute
+)
+
+// unknownRevocationRetention is how long a revocation is kept when identity
+// cannot tell when the tokens it covers expire, such as a cap_id issued
+// before identity last restarted.
+const unknownRevocationRetention = 30 * 24 * time.Hour
+
+// stateSyncInterval is how often identity syncs the rate-limit and quota
+// state it shares with the node's other services to disk.
+const stateSyncInterval = time.Second
+
+// rulesReloadInterval is how often identity checks its policy rules file
+// for changes.
+const rulesReloadInterval = 2 * time.Second
+
+// defaultRefreshTTL is the lifetime of a refresh credential when the
+// request does not give refresh_ttl_seconds.
+const defaultRefreshTTL = 24 * time.Hour
+
+// issuedRecord is what identity remembers about a capability it issued.
+type issuedRecord struct {
+	parent  string
+	expires time.Time
+}
+
+// issuedLog records every capability issued by this instance so that
+// introspection can report a token's parent chain and revocations can be
+// retained exactly as long as the token could still verify.
+type issuedLog struct {
+	mu      sync.RWMutex
+	records map[string]issuedRecord
+}
+
+func newIssuedLog() *issuedLog {
+	return &issuedLog{records: make(map[string]issuedRecord)}
+}
+
+func (l *issuedLog) Record(capID, parent string, expires time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records[capID] = issuedRecord{parent: parent, expires: expires}
+}
+
+// Known reports whether capID was issued by this instance.
+func (l *issuedLog) Known(capID string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.records[capID]
+	return ok
+}
+
+// ParentOf returns the parent of capID, if it has one.
+func (l *issuedLog) ParentOf(capID string) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	r, ok := l.records[capID]
+	return r.parent, ok && r.parent != ""
+}
+
+// ExpiryOf returns when capID expires, or the zero time if unknown.
+func (l *issuedLog) ExpiryOf(capID string) time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.records[capID].expires
+}
+
+// LatestExpiry returns the latest expiry of any capability still on
+// record, or the zero time if there are none.
+func (l *issuedLog) LatestExpiry() time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var latest time.Time
+	for _, r := range l.records {
+		if r.expires.After(latest) {
+			latest = r.expires
+		}
+	}
+	return latest
+}
+
+// Prune forgets capabilities that expired before now.
+func (l *issuedLog) Prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, r := range l.records {
+		if r.expires.Before(now) {
+			delete(l.records, id)
+		}
+	}
+}
+
+// tokenMinter turns capabilities into tokens and back. Public tokens use the
+// configured version and name the signing key in their footer; local tokens
+// are encrypted with a key only this identity instance holds. That key lives
+// in memory alone, like the signing key: no other service can open local
+// tokens, and none survive a restart of identity.
+type tokenMinter struct {
+	kp       *auth.KeyPair
+	version  auth.Version
+	accept   []auth.Version
+	localKey []byte
+}
+
+func newTokenMinter(kp *auth.KeyPair, version auth.Version, accept []auth.Version) (*tokenMinter, error) {
+	localKey := make([]byte, auth.LocalKeySize)
+	if _, err := rand.Read(localKey); err != nil {
+		return nil, fmt.Errorf("generate local token key: %w", err)
+	}
+	return &tokenMinter{kp: kp, version: version, accept: accept, localKey: localKey}, nil
+}
+
+func (m *tokenMinter) footer() *auth.Footer {
+	return &auth.Footer{KID: auth.KeyID(m.kp.Public)}
+}
+
+// mint encodes cap as a public token, or a local one if local is set.
+func (m *tokenMinter) mint(cap *capability.Capability, local bool) (string, error) {
+	if local {
+		return auth.Encrypt(cap, m.localKey, m.version, m.footer())
+	}
+	return auth.SignVersion(cap, m.kp.Private, m.version, m.footer())
+}
+
+// open verifies or decrypts a token minted by this instance, provided its
+// version is accepted.
+func (m *tokenMinter) open(token string) (*capability.Capability, error) {
+	if err := auth.CheckVersion(token, m.accept); err != nil {
+		return nil, err
+	}
+	if auth.IsLocal(token) {
+		return auth.Decrypt(token, m.localKey)
+	}
+	return auth.Verify(token, m.kp.Public)
+}
+
+// adminClaims returns the admin capability the request carries, if any: a
+// live token issued by this identity that is authorized for identity.issue.
+// It only checks the token, spending none of its uses, rate or quota; the
+// request that acts on it spends them. A present but unverifiable token is
+// an error rather than a silent downgrade.
+func adminClaims(req *ipc.Request, tokens *tokenMinter, revocations *auth.RevocationList) (*capability.Capability, *ipc.Response) {
+	if req.Auth == nil || req.Auth.Token == "" {
+		return nil, nil
+	}
+	claims, err := tokens.open(req.Auth.Token)
+	if err != nil {
+		resp := ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, "invalid token: "+err.Error())
+		return nil, &resp
+	}
+	if claims.IsExpired() {
+		resp := ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, "token expired")
+		return nil, &resp
+	}
+	if err := auth.CheckBinding(claims, req.PeerUID(), req.ReqID, req.Method, req.Auth.Proof); err != nil {
+		resp := ipc.ErrorResponse(req.ReqID, ipc.ErrAuthRequired, err.Error())
+		return nil, &resp
+	}
+	if revocations.Matches(claims) {
+		resp := ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "capability revoked")
+		return nil, &resp
+	}
+	// A valid token without issuance rights simply isn't an admin token;
+	// the requester may still be allowed by UID.
+	if policy.Check(claims, "identity.issue", nil) != nil {
+		return nil, nil
+	}
+	return claims, nil
+}
+
+// parseSelector decodes a bulk revocation selector from request params.
+// issued_before (unix seconds) defaults to now and may not be in the future.
+func parseSelector(raw map[string]any) (auth.Selector, error) {
+	sel := auth.Selector{IssuedBefore: time.Now()}
+	sel.Service, _ = raw["service"].(string)
+	sel.Subject, _ = raw["subject"].(string)
+	sel.Right, _ = raw["right"].(string)
+	if ts, ok := raw["issued_before"].(float64); ok {
+		t := time.Unix(int64(ts), 0)
+		if t.After(sel.IssuedBefore) {
+			return auth.Selector{}, fmt.Errorf("issued_before is in the future")
+		}
+		sel.IssuedBefore = t
+	}
+	if sel.Service == "" && sel.Subject == "" && sel.Right == "" && raw["issued_before"] == nil {
+		return auth.Selector{}, fmt.Errorf("selector must set at least one of service, subject, right, issued_before")
+	}
+	return sel, nil
+}
+
+// parseConfirm decodes an optional proof-of-possession binding
+// ({"uid": N} and/or {"key": "<base64 ed25519 public key>"}).
+func parseConfirm(raw any) (*capability.Confirm, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	m, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("cnf must be an object")
+	}
+	var cnf capability.Confirm
+	if uid, ok := m["uid"].(float64); ok {
+		if uid < 0 {
+			return nil, fmt.Errorf("cnf uid must be non-negative")
+		}
+		u := int(uid)
+		cnf.UID = &u
+	}
+	if key, ok := m["key"].(string); ok && key != "" {
+		if _, err := auth.ParseConfirmKey(key); err != nil {
+			return nil, err
+		}
+		cnf.Key = key
+	}
+	if cnf.UID == nil && cnf.Key == "" {
+		return nil, fmt.Errorf("cnf must set uid or key")
+	}
+	return &cnf, nil
+}
+
+// parseSchedule decodes and validates the optional schedule constraint.
+func parseSchedule(raw any) (*capability.Schedule, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	if _, ok := raw.(map[string]any); !ok {
+		return nil, fmt.Errorf("schedule must be an object")
+	}
+	data, _ := json.Marshal(raw)
+	var s capability.Schedule
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid schedule: %v", err)
+	}
+	if err := policy.ValidateSchedule(&s); err != nil {
+		return nil, fmt.Errorf("invalid schedule: %v", err)
+	}
+	return &s, nil
+}
+
+// parseExtConstraints decodes the optional constraints param: constraints
+// defined by services rather than by identity's own params.
+func parseExtConstraints(raw any) (map[string]json.RawMessage, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	m, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("constraints must be an object")
+	}
+	ext := make(map[string]json.RawMessage, len(m))
+	for name, v := range m {
+		if capability.IsBuiltinConstraint(name) {
+			return nil, fmt.Errorf("constraint %s has its own param", name)
+		}
+		ext[name], _ = json.Marshal(v)
+	}
+	return ext, nil
+}
+
+// parseRateLimits decodes the optional per-method rate limits: an object
+// mapping right patterns to rate limit expressions. They are validated
+// with the other constraints.
+func parseRateLimits(raw any) (map[string]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	m, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("rate_limits must be an object")
+	}
+	limits := make(map[string]string, len(m))
+	for pattern, v := range m {
+		expr, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("rate_limits[%s] must be a string", pattern)
+		}
+		limits[pattern] = expr
+	}
+	return limits, nil
+}
+
+// parseQuotas decodes the optional quotas: an object mapping quota names
+// to {"limit": N, "window": "hour"|"day"|"lifetime"}. They are validated
+// with the other constraints.
+func parseQuotas(raw any) (map[string]capability.Quota, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	m, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("quotas must be an object")
+	}
+	quotas := make(map[string]capability.Quota, len(m))
+	for name, v := range m {
+		q, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("quotas[%s] must be an object", name)
+		}
+		limit, ok := q["limit"].(float64)
+		if !ok || limit != float64(int64(limit)) {
+			return nil, fmt.Errorf("quotas[%s].limit must be an integer", name)
+		}
+		window, ok := q["window"].(string)
+		if !ok && q["window"] != nil {
+			return nil, fmt.Errorf("quotas[%s].window must be a string", name)
+		}
+		quotas[name] = capability.Quota{Limit: int64(limit), Window: window}
+	}
+	return quotas, nil
+}
+
+// parsePaths decodes the optional paths: a list of
+// {"root", "name", "allow", "deny", "mode"} objects. They are validated
+// with the other constraints.
+func parsePaths(raw any) ([]capability.PathRoot, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	if _, ok := raw.([]any); !ok {
+		return nil, fmt.Errorf("paths must be an array")
+	}
+	data, _ := json.Marshal(raw)
+	var roots []capability.PathRoot
+	if err := json.Unmarshal(data, &roots); err != nil {
+		return nil, fmt.Errorf("invalid paths: %v", err)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("paths must list at least one root")
+	}
+	return roots, nil
+}
+
+// parseAttrs decodes the optional subject attributes: an object mapping
+// each key to a value or a list of values.
+func parseAttrs(raw any) (map[string][]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	m, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("attrs must be an object")
+	}
+	attrs := make(map[string][]string, len(m))
+	for key, v := range m {
+		var values []any
+		switch v := v.(type) {
+		case string:
+			values = []any{v}
+		case []any:
+			values = v
+		default:
+			return nil, fmt.Errorf("attrs %s must be a string or a list of strings", key)
+		}
+		for _, value := range values {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("attrs %s must be a string or a list of strings", key)
+			}
+			if err := policy.ValidateAttr(key, s); err != nil {
+				return nil, err
+			}
+			attrs[key] = append(attrs[key], s)
+		}
+	}
+	return attrs, nil
+}
+
+// grantedRights expands legacy actions into fully-qualified rights so the
+// issuance policy sees a single form.
+func grantedRights(service string, actions, rights []string) []string {
+	out := append([]string{}, rights...)
+	for _, a := range actions {
+		out = append(out, service+"."+a)
+	}
+	return out
+}
+
+// policyError converts a policy.PolicyError into an IPC error response.
+func policyError(reqID string, err error) ipc.Response {
+	if pe, ok := err.(*policy.PolicyError); ok {
+		return ipc.FullErrorResponse(reqID, pe.Code, pe.Name, pe.Message, pe.Details)
+	}
+	return ipc.ErrorResponse(reqID, ipc.ErrInternal, err.Error())
+}
+
 func main() {
 	runtimeDir := os.Getenv("STRATA_RUNTIME_DIR")
 	if runtimeDir == "" {
@@ -35,96 +431,161 @@ func main() {
 	}
 	log.Printf("[identity] public key written to %s", pubKeyPath)
 
-	revocations := auth.NewRevocationList()
-
-	srv := ipc.NewServer(filepath.Join(runtimeDir, "identity.sock"))
-
-	srv.Handle("identity.issue", func(req *ipc.Request) ipc.Response {
-		service, _ := req.Params["service"].(string)
-		if service == "" {
-			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing service param")
-		}
-
-		var actions []string
-		if raw, ok := req.Params["actions"].([]any); ok {
-			for _, a := range raw {
-				if s, ok := a.(string); ok {
-					actions = append(actions, s)
-				}
-			}
-		}
-		var rights []string
-		if raw, ok := req.Params["rights"].([]any); ok {
-			for _, r := range raw {
-				if s, ok := r.(string); ok {
-					rights = append(rights, s)
-				}
-			}
-		}
+	version, versions, err := auth.ConfiguredVersions(os.Getenv("STRATA_TOKEN_VERSION"), os.Getenv("STRATA_TOKEN_VERSIONS"))
+	if err != nil {
+		log.Fatalf("[identity] token versions: %v", err)
+	}
+	tokens, err := newTokenMinter(kp, version, versions)
+	if err != nil {
+		log.Fatalf("[identity] %v", err)
+	}
+	log.Printf("[identity] issuing %s tokens (kid %s), accepting %v", version, auth.KeyID(kp.Public), versions)
 
-		if len(actions) == 0 && len(rights) == 0 {
-			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "actions or rights required")
+	issuance := policy.DefaultIssuancePolicy(os.Getuid())
+	if path := os.Getenv("STRATA_ISSUANCE_POLICY"); path != "" {
+		issuance, err = policy.LoadIssuancePolicy(path)
+		if err != nil {
+			log.Fatalf("[identity] %v", err)
 		}
+		log.Printf("[identity] loaded issuance policy from %s (%d rules)", path, len(issuance.Rules))
+	}
 
-		pathPrefix, _ := req.Params["path_prefix"].(string)
-		rateLimit, _ := req.Params["rate_limit"].(string)
+	if os.Getenv("STRATA_POLICY_DEBUG") != "" {
+		policy.SetDebug(true)
+		log.Printf("[identity] policy debug on: denials carry decision traces")
+	}
 
-		ttlSec, _ := req.Params["ttl_seconds"].(float64)
-		if ttlSec <= 0 {
-			ttlSec = 3600
+	// Operator policy rules also govern identity's own methods (such as
+	// admin tokens authorizing identity.issue).
+	rulesPath := os.Getenv("STRATA_POLICY_RULES")
+	if rulesPath != "" {
+		rules, err := policy.LoadRules(rulesPath)
+		if err != nil {
+			log.Fatalf("[identity] %v", err)
 		}
+		policy.SetRules(rules)
+		log.Printf("[identity] loaded %d policy rules from %s", len(rules.Rules), rulesPath)
+	}
 
-		cap := capability.NewCapability(service, actions, capability.Constraints{
-			PathPrefix: pathPrefix,
-			RateLimit:  rateLimit,
-		}, time.Duration(ttlSec)*time.Second)
-		cap.Rights = rights
+	// Revocations live in the state directory so they survive restarts.
+	stateDir := os.Getenv("STRATA_STATE_DIR")
+	if stateDir == "" {
+		stateDir = runtimeDir
+	}
+	revocationsPath := filepath.Join(stateDir, "revocations.json")
+	revocations, err := auth.OpenRevocationList(revocationsPath)
+	if err != nil {
+		log.Fatalf("[identity] %v", err)
+	}
+	log.Printf("[identity] loaded %d revocations from %s", revocations.Len(), revocationsPath)
 
-		token, err := auth.Sign(cap, kp.Private)
+	// Rate-limit buckets are shared with the node's other services.
+	if os.Getenv("STRATA_RATE_LIMITER") == "memory" {
+		log.Printf("[identity] rate limits kept in memory")
+	} else {
+		limitsPath := filepath.Join(stateDir, "ratelimits")
+		limiter, err := policy.OpenFileLimiter(limitsPath)
 		if err != nil {
-			return ipc.ErrorResponse(req.ReqID, ipc.ErrInternal, err.Error())
+			log.Fatalf("[identity] %v", err)
 		}
+		policy.SetLimiter(limiter)
+		log.Printf("[identity] rate limits shared through %s", limitsPath)
+	}
+	// So is quota usage, which introspection reports.
+	quotasPath := filepath.Join(stateDir, "quotas")
+	quotas, err := policy.OpenQuotaTracker(quotasPath)
+	if err != nil {
+		log.Fatalf("[identity] %v", err)
+	}
+	policy.SetQuotaTracker(quotas)
+	refreshPath := filepath.Join(stateDir, "refresh.json")
+	refresh, err := auth.OpenRefreshStore(refreshPath)
+	if err != nil {
+		log.Fatalf("[identity] %v", err)
+	}
+	log.Printf("[identity] loaded %d refresh families from %s", refresh.Len(), refreshPath)
+	issued := newIssuedLog()
+	hub := revocation.NewHub()
 
-		log.Printf("[identity] issued capability %s for service=%s actions=%v prefix=%q",
-			cap.ID, service, actions, pathPrefix)
-
-		return ipc.SuccessResponse(req.ReqID, map[string]any{
-			"token":   token,
-			"cap_id":  cap.ID,
-			"expires": cap.ExpiresAt.Unix(),
-		})
-	})
-
-	srv.Handle("identity.revoke", func(req *ipc.Request) ipc.Response {
-		capID, _ := req.Params["cap_id"].(string)
-		if capID == "" {
-			return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing cap_id param")
+	// max_uses counts live in the state directory, like fs's, so a restart
+	// does not hand out fresh uses of identity tokens.
+	usesPath := filepath.Join(stateDir, "identity-uses.json")
+	uses, err := policy.OpenUseCounter(usesPath)
+	if err != nil {
+		log.Fatalf("[identity] %v", err)
+	}
+	// A spent one-shot capability is revoked here and pushed to verifiers.
+	uses.OnExhausted = func(claims *capability.Capability) {
+		if !claims.Constraints.OneShot {
+			return
 		}
-		revocations.Revoke(capID)
-		log.Printf("[identity] revoked capability %s", capID)
-
-		// Notify FS to invalidate handles bound to this capability.
-		fsSock := filepath.Join(runtimeDir, "fs.sock")
-		if _, err := ipc.SendRequest(fsSock, &ipc.Request{
-			V:      1,
-			ReqID:  "revoke-" + capID,
-			Method: "fs.revoke",
-			Params: map[string]any{"cap_id": capID},
-		}); err != nil {
-			log.Printf("[identity] fs revocation notify failed: %v", err)
+		if err := revocations.RevokeUntil(claims.ID, claims.ExpiresAt); err != nil {
+			log.Printf("[identity] %v", err)
 		}
+		entry, _ := revocations.Get(claims.ID)
+		go hub.Publish(entry)
+		log.Printf("[identity] revoked spent one-shot capability %s", claims.ID)
+	}
+	policy.SetUseCounter(uses)
+	log.Printf("[identity] loaded use counts for %d capabilities from %s", uses.Len(), usesPath)
 
-		return ipc.SuccessResponse(req.ReqID, map[string]string{"status": "revoked"})
-	})
+	h := &handlers{
+		tokens:      tokens,
+		issuance:    issuance,
+		revocations: revocations,
+		refresh:     refresh,
+		issued:      issued,
+		hub:         hub,
+	}
+	srv := ipc.NewServer(filepath.Join(runtimeDir, "identity.sock"))
+	h.register(srv)
 
 	if err := srv.Start(); err != nil {
 		log.Fatalf("[identity] start failed: %v", err)
 	}
 	log.Printf("[identity] ready")
 
+	// Garbage-collect revocations (and issuance records) once the tokens
+	// they cover would have expired anyway.
+	go func() {
+		ticker := time.NewTicker(revocationGCInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			issued.Prune(now)
+			if err := refresh.Prune(now); err != nil {
+				log.Printf("[identity] %v", err)
+			}
+			n, err := revocations.Prune(now)
+			if err != nil {
+				log.Printf("[identity] %v", err)
+			}
+			if n > 0 {
+				log.Printf("[identity] pruned %d expired revocations", n)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go policy.SyncState(ctx, stateSyncInterval, func(err error) {
+		log.Printf("[identity] %v", err)
+	})
+	if rulesPath != "" {
+		go policy.WatchRules(ctx, rulesPath, rulesReloadInterval, func(rules *policy.RuleSet, err error) {
+			if err != nil {
+				log.Printf("[identity] policy rules not reloaded, keeping previous: %v", err)
+				return
+			}
+			log.Printf("[identity] reloaded %d policy rules from %s", len(rules.Rules), rulesPath)
+		})
+	}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	<-sig
 	log.Printf("[identity] shutting down")
+	cancel()
 	srv.Stop()
+	if err := policy.FlushState(); err != nil {
+		log.Printf("[identity] %v", err)
+	}
 }
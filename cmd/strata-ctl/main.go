@@ -5,6 +5,35 @@
 //
 //	strata-ctl <method> [params_json]
 //	strata-ctl -token <TOKEN> <method> [params_json]
+//	strata-ctl introspect <TOKEN>
+//	strata-ctl -token <TOKEN> introspect
+//	strata-ctl -token <TOKEN> explain <method> [ctx_json]
+//	strata-ctl -token <TOKEN> -key <KEYFILE> <method> [params_json]
+//	strata-ctl keygen <KEYFILE>
+//	strata-ctl check-rules <RULESFILE>
+//	strata-ctl limits <STATEDIR> [CAP_ID]
+//
+// The introspect command is shorthand for identity.introspect: it reports
+// whether the token is valid, its decoded claims, remaining lifetime,
+// revocation status, parent chain and the reason for any invalidity.
+//
+// The explain command asks the method's service (via <service>.explain)
+// whether the token would be allowed to call the method with the given
+// params, e.g. '{"path":"data/f.txt"}', and prints the decision trace. It
+// has no side effects.
+//
+// keygen writes a new ed25519 private key to KEYFILE and prints its public
+// half, for binding tokens with identity.issue's cnf.key. With -key, each
+// request carries a proof of possession signed by that key.
+//
+// check-rules validates a policy rules file (STRATA_POLICY_RULES) offline,
+// reporting unreachable and conflicting rules. It exits non-zero if the
+// file is invalid or has unreachable rules; conflicts are warnings.
+//
+// limits prints the rate-limit buckets in the services' shared state
+// directory (ratelimits in STRATA_STATE_DIR) with their current levels, for
+// every capability or just CAP_ID. A token holder can see its own with
+// fs.limits.
 //
 // The target socket is resolved via the registry service when available,
 // with fallback to the convention: method prefix → service.sock.
@@ -12,6 +41,7 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -20,12 +50,19 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/Gao-OS/StrataOS/internal/auth"
 	"github.com/Gao-OS/StrataOS/internal/ipc"
+	"github.com/Gao-OS/StrataOS/internal/policy"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "usage: strata-ctl [-token TOKEN] <method> [params_json]\n")
+		fmt.Fprintf(os.Stderr, "usage: strata-ctl [-token TOKEN] [-key KEYFILE] <method> [params_json]\n")
+		fmt.Fprintf(os.Stderr, "       strata-ctl [-token TOKEN] introspect [TOKEN]\n")
+		fmt.Fprintf(os.Stderr, "       strata-ctl -token TOKEN explain <method> [ctx_json]\n")
+		fmt.Fprintf(os.Stderr, "       strata-ctl keygen KEYFILE\n")
+		fmt.Fprintf(os.Stderr, "       strata-ctl check-rules RULESFILE\n")
+		fmt.Fprintf(os.Stderr, "       strata-ctl limits STATEDIR [CAP_ID]\n")
 		os.Exit(1)
 	}
 
@@ -35,7 +72,7 @@ func main() {
 	}
 
 	args := os.Args[1:]
-	var token string
+	var token, keyFile string
 
 	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
 		switch args[0] {
@@ -46,6 +83,13 @@ func main() {
 			}
 			token = args[1]
 			args = args[2:]
+		case "-key":
+			if len(args) < 2 {
+				fmt.Fprintf(os.Stderr, "error: missing key file\n")
+				os.Exit(1)
+			}
+			keyFile = args[1]
+			args = args[2:]
 		default:
 			fmt.Fprintf(os.Stderr, "error: unknown flag %s\n", args[0])
 			os.Exit(1)
@@ -58,14 +102,74 @@ func main() {
 	}
 
 	method := args[0]
+	if method == "keygen" {
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "error: keygen requires a key file\n")
+			os.Exit(1)
+		}
+		keygen(args[1])
+		return
+	}
+	if method == "check-rules" {
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "error: check-rules requires a rules file\n")
+			os.Exit(1)
+		}
+		checkRules(args[1])
+		return
+	}
+	if method == "limits" {
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "error: limits requires a state directory\n")
+			os.Exit(1)
+		}
+		capID := ""
+		if len(args) > 2 {
+			capID = args[2]
+		}
+		showLimits(args[1], capID)
+		return
+	}
+
 	var params map[string]any
-	if len(args) > 1 {
+	if len(args) > 1 && method != "introspect" && method != "explain" {
 		if err := json.Unmarshal([]byte(args[1]), &params); err != nil {
 			fmt.Fprintf(os.Stderr, "error: invalid params JSON: %v\n", err)
 			os.Exit(1)
 		}
 	}
 
+	if method == "introspect" {
+		// The inspected token travels as a param, not as request auth.
+		subject := token
+		if len(args) > 1 {
+			subject = args[1]
+		}
+		if subject == "" {
+			fmt.Fprintf(os.Stderr, "error: introspect requires a token\n")
+			os.Exit(1)
+		}
+		method = "identity.introspect"
+		params = map[string]any{"token": subject}
+		token = ""
+	}
+
+	if method == "explain" {
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "error: explain requires a method\n")
+			os.Exit(1)
+		}
+		var ctx map[string]any
+		if len(args) > 2 {
+			if err := json.Unmarshal([]byte(args[2]), &ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "error: invalid ctx JSON: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		params = map[string]any{"method": args[1], "ctx": ctx}
+		method = strings.SplitN(args[1], ".", 2)[0] + ".explain"
+	}
+
 	socketPath := resolveSocket(runtimeDir, method)
 
 	idBytes := make([]byte, 8)
@@ -79,6 +183,14 @@ func main() {
 	}
 	if token != "" {
 		req.Auth = &ipc.Auth{Token: token}
+		if keyFile != "" {
+			key, err := auth.LoadPrivateKey(keyFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			}
+			req.Auth.Proof = auth.SignProof(key, req.ReqID, req.Method)
+		}
 	}
 
 	resp, err := ipc.SendRequest(socketPath, req)
@@ -95,6 +207,67 @@ func main() {
 	}
 }
 
+// keygen writes a new proof-of-possession key to path and prints its
+// public key.
+func keygen(path string) {
+	kp, err := auth.GenerateKeyPair()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := kp.WritePrivateKey(path); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(kp.Public))
+}
+
+// checkRules validates a policy rules file and prints what Check finds.
+func checkRules(path string) {
+	rules, err := policy.LoadRules(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	unreachable := 0
+	for _, f := range rules.Check() {
+		fmt.Printf("%s: %s\n", f.Kind, f.Message)
+		if f.Kind == "unreachable" {
+			unreachable++
+		}
+	}
+	fmt.Printf("%d rules, default %s\n", len(rules.Rules), rules.Default)
+	if unreachable > 0 {
+		os.Exit(1)
+	}
+}
+
+func showLimits(path, capID string) {
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	limiter, err := policy.OpenFileLimiter(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	policy.SetLimiter(limiter)
+	buckets, err := policy.BucketLevels(capID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	for _, b := range buckets {
+		method := b.Method
+		if method == "" {
+			method = "*"
+		}
+		fmt.Printf("%s  %-12s %-20s %.1f/%.0f\n", b.CapID, method, b.Limit, b.Tokens, b.Burst)
+	}
+	fmt.Printf("%d buckets\n", len(buckets))
+}
+
 // resolveSocket determines the target socket for a method.
 // For registry.* and supervisor.* methods, uses direct convention (can't resolve themselves).
 // For other methods, tries registry.resolve first, then falls back to convention.
@@ -0,0 +1,32 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	for _, data := range []string{`{"a":1}`, `{}`} {
+		if err := Write(path, []byte(data)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil || string(got) != data {
+			t.Fatalf("read back %q, %v; want %q", got, err, data)
+		}
+	}
+	// The temporary file is gone once the rename lands.
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d entries, want 1", len(entries))
+	}
+}
+
+func TestWrite_MissingDir(t *testing.T) {
+	if err := Write(filepath.Join(t.TempDir(), "missing", "state.json"), nil); err == nil {
+		t.Error("Write into a missing directory succeeded")
+	}
+}
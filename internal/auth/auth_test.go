@@ -4,12 +4,16 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/policy"
 )
 
 // --- Key generation tests ---
@@ -154,7 +158,7 @@ func TestVerify_TamperedToken(t *testing.T) {
 
 	// Tamper with a byte in the middle of the token body.
 	runes := []byte(token)
-	// Find a position in the encoded body (after "v2.public.").
+	// Find a position in the encoded body (after the header).
 	idx := len(v2PublicHeader) + 10
 	if idx < len(runes) {
 		runes[idx] ^= 0xFF
@@ -216,6 +220,402 @@ func TestPAE_DifferentInputs(t *testing.T) {
 	}
 }
 
+// --- PASETO versions, footers and local tokens ---
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decode hex: %v", err)
+	}
+	return b
+}
+
+// Official PASETO test vectors (paseto-standard/test-vectors).
+const (
+	vectorSecretKey = "b4cbfb43df4ce210727d953e4a713307fa19bb7d9f85041438d9e11b942a3774" +
+		"1eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2"
+	vectorLocalKey = "707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f"
+	vectorFooter   = `{"kid":"zVhMiPBP9fRf2snEcT7gFTioeA9COcNy9DfgL1W60haN"}`
+)
+
+func TestPublicVectors(t *testing.T) {
+	sk := ed25519.PrivateKey(mustHex(t, vectorSecretKey))
+	msg2019 := `{"data":"this is a signed message","exp":"2019-01-01T00:00:00+00:00"}`
+	msg2022 := `{"data":"this is a signed message","exp":"2022-01-01T00:00:00+00:00"}`
+
+	tests := []struct {
+		name             string
+		v                Version
+		msg, f, implicit string
+		want             string
+	}{
+		{"2-S-1", V2, msg2019, "", "",
+			"v2.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAxOS0wMS0wMVQwMDowMDowMCswMDowMCJ9HQr8URrGntTu7Dz9J2IF23d1M7-9lH9xiqdGyJNvzp4angPW5Esc7C5huy_M8I8_DjJK2ZXC2SUYuOFM-Q_5Cw"},
+		{"4-S-1", V4, msg2022, "", "",
+			"v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9bg_XBBzds8lTZShVlwwKSgeKpLT3yukTw6JUz3W4h_ExsQV-P0V54zemZDcAxFaSeef1QlXEFtkqxT1ciiQEDA"},
+		{"4-S-2", V4, msg2022, vectorFooter, "",
+			"v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9v3Jt8mx_TdM2ceTGoqwrh4yDFn0XsHvvV_D0DtwQxVrJEBMl0F2caAdgnpKlt4p7xBnx1HcO-SPo8FPp214HDw.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9"},
+		{"4-S-3", V4, msg2022, vectorFooter, `{"test-vector":"4-S-3"}`,
+			"v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9NPWciuD3d0o5eXJXG5pJy-DiVEoyPYWs1YSTwWHNJq6DZD3je5gf-0M4JR9ipdUSJbIovzmBECeaWmaqcaP0DQ.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := signPublic(tt.v, sk, []byte(tt.msg), []byte(tt.f), []byte(tt.implicit))
+			if err != nil {
+				t.Fatalf("sign: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("token = %s\nwant    %s", got, tt.want)
+			}
+			msg, f, err := verifyPublic(tt.want, sk.Public().(ed25519.PublicKey), []byte(tt.implicit))
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if string(msg) != tt.msg || string(f) != tt.f {
+				t.Errorf("verify = %q, %q", msg, f)
+			}
+		})
+	}
+}
+
+func TestLocalVectors_V4(t *testing.T) {
+	key := mustHex(t, vectorLocalKey)
+	nonce := mustHex(t, "df654812bac492663825520ba2f6e67cf5ca5bdc13d4e7507a98cc4c2fcc3ad8")
+	secret := `{"data":"this is a secret message","exp":"2022-01-01T00:00:00+00:00"}`
+	hidden := `{"data":"this is a hidden message","exp":"2022-01-01T00:00:00+00:00"}`
+	cases := []struct {
+		name, msg, footer, implicit string
+		nonce                       []byte
+		want                        string
+	}{
+		{"4-E-1", secret, "", "", make([]byte, 32), "v4.local.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAr68PS4AXe7If_ZgesdkUMvSwscFlAl1pk5HC0e8kApeaqMfGo_7OpBnwJOAbY9V7WU6abu74MmcUE8YWAiaArVI8XJ5hOb_4v9RmDkneN0S92dx0OW4pgy7omxgf3S8c3LlQg"},
+		{"4-E-2", hidden, "", "", make([]byte, 32), "v4.local.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAr68PS4AXe7If_ZgesdkUMvS2csCgglvpk5HC0e8kApeaqMfGo_7OpBnwJOAbY9V7WU6abu74MmcUE8YWAiaArVI8XIemu9chy3WVKvRBfg6t8wwYHK0ArLxxfZP73W_vfwt5A"},
+		{"4-E-3", secret, "", "", nonce, "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WkwMsYXw6FSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t6-tyebyWG6Ov7kKvBdkrrAJ837lKP3iDag2hzUPHuMKA"},
+		{"4-E-4", hidden, "", "", nonce, "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WiA8rd3wgFSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t4gt6TiLm55vIH8c_lGxxZpE3AWlH4WTR0v45nsWoU3gQ"},
+		{"4-E-5", secret, vectorFooter, "", nonce, "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WkwMsYXw6FSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t4x-RMNXtQNbz7FvFZ_G-lFpk5RG3EOrwDL6CgDqcerSQ.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9"},
+		{"4-E-6", hidden, vectorFooter, "", nonce, "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WiA8rd3wgFSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t6pWSA5HX2wjb3P-xLQg5K5feUCX4P2fpVK3ZLWFbMSxQ.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9"},
+		{"4-E-7", secret, vectorFooter, `{"test-vector":"4-E-7"}`, nonce, "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WkwMsYXw6FSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t40KCCWLA7GYL9KFHzKlwY9_RnIfRrMQpueydLEAZGGcA.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9"},
+		{"4-E-8", hidden, vectorFooter, `{"test-vector":"4-E-8"}`, nonce, "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WiA8rd3wgFSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t5uvqQbMGlLLNYBc7A6_x7oqnpUK5WLvj24eE4DVPDZjw.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9"},
+		{"4-E-9", hidden, "arbitrary-string-that-isn't-json", `{"test-vector":"4-E-9"}`, nonce, "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WiA8rd3wgFSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t6tybdlmnMwcDMw0YxA_gFSE_IUWl78aMtOepFYSWYfQA.YXJiaXRyYXJ5LXN0cmluZy10aGF0LWlzbid0LWpzb24"},
+	}
+	for _, tc := range cases {
+		got, err := encryptLocal(V4, key, tc.nonce, []byte(tc.msg), []byte(tc.footer), []byte(tc.implicit))
+		if err != nil {
+			t.Fatalf("%s: encrypt: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: token = %s\nwant    %s", tc.name, got, tc.want)
+		}
+		plain, footer, err := decryptLocal(tc.want, key, []byte(tc.implicit))
+		if err != nil || string(plain) != tc.msg || string(footer) != tc.footer {
+			t.Errorf("%s: decrypt = (%q, %q, %v)", tc.name, plain, footer, err)
+		}
+		if tc.implicit != "" {
+			if _, _, err := decryptLocal(tc.want, key, nil); err == nil {
+				t.Errorf("%s: decrypted without its implicit assertion", tc.name)
+			}
+		}
+	}
+}
+
+func TestLocalVectors_V2(t *testing.T) {
+	key := mustHex(t, vectorLocalKey)
+	nonce := mustHex(t, "45742c976d684ff84ebdc0de59809a97cda2f64c84fda19b")
+	signed := `{"data":"this is a signed message","exp":"2019-01-01T00:00:00+00:00"}`
+	secret := `{"data":"this is a secret message","exp":"2019-01-01T00:00:00+00:00"}`
+	otherFooter := `{"kid":"UbkK8Y6iv4GZhFp6Tx3IWLWLfNXSEvJcdT3zdR65YZxo"}`
+	cases := []struct {
+		name, msg, footer string
+		nonce             []byte
+		want              string
+	}{
+		{"2-E-1", signed, "", make([]byte, 24), "v2.local.97TTOvgwIxNGvV80XKiGZg_kD3tsXM_-qB4dZGHOeN1cTkgQ4PnW8888l802W8d9AvEGnoNBY3BnqHORy8a5cC8aKpbA0En8XELw2yDk2f1sVODyfnDbi6rEGMY3pSfCbLWMM2oHJxvlEl2XbQ"},
+		{"2-E-2", secret, "", make([]byte, 24), "v2.local.CH50H-HM5tzdK4kOmQ8KbIvrzJfjYUGuu5Vy9ARSFHy9owVDMYg3-8rwtJZQjN9ABHb2njzFkvpr5cOYuRyt7CRXnHt42L5yZ7siD-4l-FoNsC7J2OlvLlIwlG06mzQVunrFNb7Z3_CHM0PK5w"},
+		{"2-E-3", signed, "", nonce, "v2.local.5K4SCXNhItIhyNuVIZcwrdtaDKiyF81-eWHScuE0idiVqCo72bbjo07W05mqQkhLZdVbxEa5I_u5sgVk1QLkcWEcOSlLHwNpCkvmGGlbCdNExn6Qclw3qTKIIl5-O5xRBN076fSDPo5xUCPpBA"},
+		{"2-E-4", secret, "", nonce, "v2.local.pvFdDeNtXxknVPsbBCZF6MGedVhPm40SneExdClOxa9HNR8wFv7cu1cB0B4WxDdT6oUc2toyLR6jA6sc-EUM5ll1EkeY47yYk6q8m1RCpqTIzUrIu3B6h232h62DPbIxtjGvNRAwsLK7LcV8oQ"},
+		{"2-E-5", signed, vectorFooter, nonce, "v2.local.5K4SCXNhItIhyNuVIZcwrdtaDKiyF81-eWHScuE0idiVqCo72bbjo07W05mqQkhLZdVbxEa5I_u5sgVk1QLkcWEcOSlLHwNpCkvmGGlbCdNExn6Qclw3qTKIIl5-zSLIrxZqOLwcFLYbVK1SrQ.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9"},
+		{"2-E-6", secret, vectorFooter, nonce, "v2.local.pvFdDeNtXxknVPsbBCZF6MGedVhPm40SneExdClOxa9HNR8wFv7cu1cB0B4WxDdT6oUc2toyLR6jA6sc-EUM5ll1EkeY47yYk6q8m1RCpqTIzUrIu3B6h232h62DnMXKdHn_Smp6L_NfaEnZ-A.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9"},
+		{"2-E-7", signed, otherFooter, nonce, "v2.local.5K4SCXNhItIhyNuVIZcwrdtaDKiyF81-eWHScuE0idiVqCo72bbjo07W05mqQkhLZdVbxEa5I_u5sgVk1QLkcWEcOSlLHwNpCkvmGGlbCdNExn6Qclw3qTKIIl5-i_LdbzmSXn-fMpoI65h2Rw.eyJraWQiOiJVYmtLOFk2aXY0R1poRnA2VHgzSVdMV0xmTlhTRXZKY2RUM3pkUjY1WVp4byJ9"},
+		{"2-E-8", secret, otherFooter, nonce, "v2.local.pvFdDeNtXxknVPsbBCZF6MGedVhPm40SneExdClOxa9HNR8wFv7cu1cB0B4WxDdT6oUc2toyLR6jA6sc-EUM5ll1EkeY47yYk6q8m1RCpqTIzUrIu3B6h232h62D94dJbEeRXlJGF7JRY9PzfA.eyJraWQiOiJVYmtLOFk2aXY0R1poRnA2VHgzSVdMV0xmTlhTRXZKY2RUM3pkUjY1WVp4byJ9"},
+		{"2-E-9", secret, "arbitrary-string-that-isn't-json", nonce, "v2.local.pvFdDeNtXxknVPsbBCZF6MGedVhPm40SneExdClOxa9HNR8wFv7cu1cB0B4WxDdT6oUc2toyLR6jA6sc-EUM5ll1EkeY47yYk6q8m1RCpqTIzUrIu3B6h232h62DoOJbyKBGPZG50XDZ6mbPtw.YXJiaXRyYXJ5LXN0cmluZy10aGF0LWlzbid0LWpzb24"},
+	}
+	for _, tc := range cases {
+		got, err := encryptLocal(V2, key, tc.nonce, []byte(tc.msg), []byte(tc.footer), nil)
+		if err != nil {
+			t.Fatalf("%s: encrypt: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: token = %s\nwant    %s", tc.name, got, tc.want)
+		}
+		plain, footer, err := decryptLocal(tc.want, key, nil)
+		if err != nil || string(plain) != tc.msg || string(footer) != tc.footer {
+			t.Errorf("%s: decrypt = (%q, %q, %v)", tc.name, plain, footer, err)
+		}
+	}
+}
+
+func TestHChaCha20_Vector(t *testing.T) {
+	// draft-irtf-cfrg-xchacha-03 section 2.2.1.
+	key := mustHex(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	nonce := mustHex(t, "000000090000004a0000000031415927")
+	want := "82413b4227b27bfed30e42508a877d73a0f9e4d58a74a853c12ec41326d3ecdc"
+	if got := hex.EncodeToString(hchacha20(key, nonce)); got != want {
+		t.Errorf("HChaCha20 = %s", got)
+	}
+}
+
+func TestXChaCha20Poly1305_Vector(t *testing.T) {
+	// draft-irtf-cfrg-xchacha-03 appendix A.3.1.
+	key := mustHex(t, "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	nonce := mustHex(t, "404142434445464748494a4b4c4d4e4f5051525354555657")
+	aad := mustHex(t, "50515253c0c1c2c3c4c5c6c7")
+	plaintext := "Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it."
+	want := "bd6d179d3e83d43b9576579493c0e939572a1700252bfaccbed2902c21396cbb" +
+		"731c7f1b0b4aa6440bf3a82f4eda7e39ae64c6708c54c216cb96b72e1213b452" +
+		"2f8c9ba40db5d945b11b69b982c1bb9e3f3fac2bc369488f76b2383565d3fff9" +
+		"21f9664c97637da9768812f615c68b13b52e" +
+		"c0875924c1c7987947deafd8780acf49" // tag
+
+	sealed := xchachaPolySeal(key, nonce, []byte(plaintext), aad)
+	if got := hex.EncodeToString(sealed); got != want {
+		t.Errorf("sealed = %s\nwant     %s", got, want)
+	}
+	opened, err := xchachaPolyOpen(key, nonce, mustHex(t, want), aad)
+	if err != nil || string(opened) != plaintext {
+		t.Errorf("open = (%q, %v)", opened, err)
+	}
+	sealed[0] ^= 1
+	if _, err := xchachaPolyOpen(key, nonce, sealed, aad); err == nil {
+		t.Error("open accepted a modified ciphertext")
+	}
+}
+
+func TestBlake2b_KnownAnswer(t *testing.T) {
+	// RFC 7693 Appendix A.
+	want := "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d1" +
+		"7d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"
+	if got := hex.EncodeToString(blake2bSum(64, nil, []byte("abc"))); got != want {
+		t.Errorf("BLAKE2b-512(abc) = %s", got)
+	}
+}
+
+func TestBlake2b_KeyedKnownAnswer(t *testing.T) {
+	// blake2b-kat.txt from the BLAKE2 reference implementation: the key is
+	// bytes 0x00..0x3f and the input bytes 0x00..n-1.
+	key := make([]byte, 64)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	in := make([]byte, 255)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	cases := []struct {
+		n    int
+		want string
+	}{
+		{0, "10ebb67700b1868efb4417987acf4690ae9d972fb7a590c2f02871799aaa4786b5e996e8f0f4eb981fc214b005f42d2ff4233499391653df7aefcbc13fc51568"},
+		{1, "961f6dd1e4dd30f63901690c512e78e4b45e4742ed197c3c5e45c549fd25f2e4187b0bc9fe30492b16b0d0bc4ef9b0f34c7003fac09a5ef1532e69430234cebd"},
+		{2, "da2cfbe2d8409a0f38026113884f84b50156371ae304c4430173d08a99d9fb1b983164a3770706d537f49e0c916d9f32b95cc37a95b99d857436f0232c88a965"},
+		{127, "76d2d819c92bce55fa8e092ab1bf9b9eab237a25267986cacf2b8ee14d214d730dc9a5aa2d7b596e86a1fd8fa0804c77402d2fcd45083688b218b1cdfa0dcbcb"},
+		{128, "72065ee4dd91c2d8509fa1fc28a37c7fc9fa7d5b3f8ad3d0d7a25626b57b1b44788d4caf806290425f9890a3a2a35a905ab4b37acfd0da6e4517b2525c9651e4"},
+		{129, "64475dfe7600d7171bea0b394e27c9b00d8e74dd1e416a79473682ad3dfdbb706631558055cfc8a40e07bd015a4540dcdea15883cbbf31412df1de1cd4152b91"},
+		{255, "142709d62e28fcccd0af97fad0f8465b971e82201dc51070faa0372aa43e92484be1c1e73ba10906d5d1853db6a4106e0a7bf9800d373d6dee2d46d62ef2a461"},
+	}
+	for _, tc := range cases {
+		if got := hex.EncodeToString(blake2bSum(64, key, in[:tc.n])); got != tc.want {
+			t.Errorf("keyed BLAKE2b-512(%d bytes) = %s", tc.n, got)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	for _, s := range []string{"v2", "v4"} {
+		if v, err := ParseVersion(s); err != nil || string(v) != s {
+			t.Errorf("ParseVersion(%q) = %q, %v", s, v, err)
+		}
+	}
+	for _, s := range []string{"", "v1", "v3", "V4"} {
+		if _, err := ParseVersion(s); err == nil {
+			t.Errorf("ParseVersion(%q) should fail", s)
+		}
+	}
+}
+
+func TestConfiguredVersions(t *testing.T) {
+	cases := []struct {
+		issue, accept string
+		want          Version
+		wantAccept    []Version
+	}{
+		{"", "", V4, []Version{V4}},
+		{"v2", "", V2, []Version{V2}},
+		{"", "v2, v4", V4, []Version{V2, V4}},
+	}
+	for _, tc := range cases {
+		v, accept, err := ConfiguredVersions(tc.issue, tc.accept)
+		if err != nil || v != tc.want || !reflect.DeepEqual(accept, tc.wantAccept) {
+			t.Errorf("ConfiguredVersions(%q, %q) = %q, %v, %v", tc.issue, tc.accept, v, accept, err)
+		}
+	}
+	for _, tc := range [][2]string{{"v3", ""}, {"", "v4,v5"}, {"v2", "v4"}} {
+		if _, _, err := ConfiguredVersions(tc[0], tc[1]); err == nil {
+			t.Errorf("ConfiguredVersions(%q, %q) should fail", tc[0], tc[1])
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	cap := &capability.Capability{ID: "x"}
+	v2, _ := SignVersion(cap, kp.Private, V2, nil)
+	v4, _ := SignVersion(cap, kp.Private, V4, nil)
+	if err := CheckVersion(v4, []Version{V4}); err != nil {
+		t.Errorf("v4 token with v4 accepted: %v", err)
+	}
+	if err := CheckVersion(v2, []Version{V4}); err == nil {
+		t.Error("v2 token accepted when only v4 is")
+	}
+	if err := CheckVersion(v2, []Version{V2, V4}); err != nil {
+		t.Errorf("v2 token with v2 accepted: %v", err)
+	}
+}
+
+func TestSign_DefaultsToV4(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	token, err := Sign(&capability.Capability{ID: "x"}, kp.Private)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if !strings.HasPrefix(token, v4PublicHeader) {
+		t.Errorf("token %q is not v4.public", token)
+	}
+}
+
+func TestSignVersion_FooterKeyID(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	other, _ := GenerateKeyPair()
+	cap := &capability.Capability{ID: "x", Service: "fs"}
+
+	for _, v := range []Version{V2, V4} {
+		token, err := SignVersion(cap, kp.Private, v, &Footer{KID: KeyID(kp.Public)})
+		if err != nil {
+			t.Fatalf("SignVersion(%s): %v", v, err)
+		}
+		f, err := TokenFooter(token)
+		if err != nil || f == nil || f.KID != KeyID(kp.Public) {
+			t.Fatalf("TokenFooter(%s) = %+v, %v", v, f, err)
+		}
+		if got, err := Verify(token, kp.Public); err != nil || got.ID != "x" {
+			t.Errorf("Verify(%s) = %v, %v", v, got, err)
+		}
+		if _, err := Verify(token, other.Public); err == nil {
+			t.Errorf("Verify(%s) with another key should fail", v)
+		}
+	}
+}
+
+func TestVerify_ForeignKeyID(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	other, _ := GenerateKeyPair()
+	// Signed by kp but naming another key: the signature is valid, the
+	// footer is not.
+	token, _ := SignVersion(&capability.Capability{ID: "x"}, kp.Private, V4, &Footer{KID: KeyID(other.Public)})
+	if _, err := Verify(token, kp.Public); err == nil || !strings.Contains(err.Error(), "key id") {
+		t.Errorf("Verify = %v, want unknown key id", err)
+	}
+}
+
+func TestVerify_FooterTampered(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	token, _ := SignVersion(&capability.Capability{ID: "x"}, kp.Private, V4, &Footer{KID: KeyID(kp.Public)})
+	stripped := token[:strings.LastIndex(token, ".")]
+	if _, err := Verify(stripped, kp.Public); err == nil {
+		t.Error("removing the footer should invalidate the signature")
+	}
+}
+
+func TestTokenFooter_None(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	token, _ := Sign(&capability.Capability{ID: "x"}, kp.Private)
+	if f, err := TokenFooter(token); f != nil || err != nil {
+		t.Errorf("TokenFooter = %+v, %v; want nil", f, err)
+	}
+}
+
+func TestEncryptDecrypt_RoundTrip(t *testing.T) {
+	key := mustHex(t, vectorLocalKey)
+	cap := &capability.Capability{
+		ID:        "local1",
+		Service:   "fs",
+		Rights:    []string{"fs.read"},
+		ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Second),
+	}
+	for _, v := range []Version{V2, V4} {
+		token, err := Encrypt(cap, key, v, &Footer{KID: "k1"})
+		if err != nil {
+			t.Fatalf("Encrypt(%s): %v", v, err)
+		}
+		if !IsLocal(token) || !strings.HasPrefix(token, string(v)+".local.") {
+			t.Errorf("token %q has wrong header", token)
+		}
+		if strings.Contains(token, "fs.read") {
+			t.Error("claims should not be readable")
+		}
+		got, err := Decrypt(token, key)
+		if err != nil {
+			t.Fatalf("Decrypt(%s): %v", v, err)
+		}
+		if got.ID != cap.ID || !got.ExpiresAt.Equal(cap.ExpiresAt) {
+			t.Errorf("Decrypt(%s) = %+v", v, got)
+		}
+		if _, err := Verify(token, make(ed25519.PublicKey, ed25519.PublicKeySize)); err == nil {
+			t.Errorf("Verify should reject a %s local token", v)
+		}
+	}
+}
+
+func TestEncrypt_RandomNonce(t *testing.T) {
+	key := mustHex(t, vectorLocalKey)
+	cap := &capability.Capability{ID: "x"}
+	a, _ := Encrypt(cap, key, V4, nil)
+	b, _ := Encrypt(cap, key, V4, nil)
+	if a == b {
+		t.Error("two encryptions of the same claims should differ")
+	}
+}
+
+func TestDecrypt_Rejects(t *testing.T) {
+	key := mustHex(t, vectorLocalKey)
+	wrong := make([]byte, LocalKeySize)
+	cap := &capability.Capability{ID: "x", Service: "fs"}
+
+	for _, v := range []Version{V2, V4} {
+		token, _ := Encrypt(cap, key, v, &Footer{KID: "k1"})
+		if _, err := Decrypt(token, wrong); err == nil {
+			t.Errorf("%s: wrong key accepted", v)
+		}
+
+		b := []byte(token)
+		b[len(string(v)+".local.")+40] ^= 0x01
+		if _, err := Decrypt(string(b), key); err == nil {
+			t.Errorf("%s: tampered body accepted", v)
+		}
+
+		refooted := token[:strings.LastIndex(token, ".")] + ".eyJraWQiOiJrMiJ9" // {"kid":"k2"}
+		if _, err := Decrypt(refooted, key); err == nil {
+			t.Errorf("%s: replaced footer accepted", v)
+		}
+	}
+	if _, err := Decrypt("v4.local.AAAA", key); err == nil {
+		t.Error("short token accepted")
+	}
+	if _, err := Encrypt(cap, key[:16], V4, nil); err == nil {
+		t.Error("short key accepted")
+	}
+}
+
 // --- Revocation list tests ---
 
 func TestRevocationList_Basic(t *testing.T) {
@@ -264,6 +664,240 @@ func TestRevocationList_Concurrent(t *testing.T) {
 	<-done
 }
 
+func TestRevocationList_PersistAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	rl, err := OpenRevocationList(path)
+	if err != nil {
+		t.Fatalf("OpenRevocationList: %v", err)
+	}
+	if err := rl.RevokeUntil("live", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RevokeUntil: %v", err)
+	}
+	if err := rl.Revoke("forever"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+
+	reloaded, err := OpenRevocationList(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !reloaded.IsRevoked("live") || !reloaded.IsRevoked("forever") {
+		t.Error("revocations should survive reload")
+	}
+
+	// Sequence numbers continue after reload.
+	reloaded.Revoke("third")
+	page, _ := reloaded.List(0, 0)
+	if len(page) != 3 || page[2].CapID != "third" || page[2].Seq != 3 {
+		t.Errorf("unexpected list after reload: %+v", page)
+	}
+}
+
+func TestRevocationList_PruneExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	rl, _ := OpenRevocationList(path)
+	rl.RevokeUntil("expired", time.Now().Add(-time.Minute))
+	rl.RevokeUntil("live", time.Now().Add(time.Hour))
+	rl.Revoke("unknown-expiry")
+
+	n, err := rl.Prune(time.Now())
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("pruned %d, want 1", n)
+	}
+	if rl.IsRevoked("expired") {
+		t.Error("expired entry should be pruned")
+	}
+	if !rl.IsRevoked("live") || !rl.IsRevoked("unknown-expiry") {
+		t.Error("unexpired and unknown-expiry entries must be kept")
+	}
+
+	reloaded, _ := OpenRevocationList(path)
+	if reloaded.Len() != 2 {
+		t.Errorf("reloaded Len = %d, want 2", reloaded.Len())
+	}
+}
+
+func TestRevocationList_PrunedOnLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	rl, _ := OpenRevocationList(path)
+	rl.RevokeUntil("soon", time.Now().Add(20*time.Millisecond))
+	time.Sleep(30 * time.Millisecond)
+
+	reloaded, _ := OpenRevocationList(path)
+	if reloaded.IsRevoked("soon") {
+		t.Error("entry expired while offline should be pruned on load")
+	}
+}
+
+func TestRevocationList_RevokeExtendsRetention(t *testing.T) {
+	rl := NewRevocationList()
+	soon := time.Now().Add(time.Minute)
+	later := time.Now().Add(time.Hour)
+	rl.RevokeUntil("abc", soon)
+	rl.RevokeUntil("abc", later)
+	rl.RevokeUntil("abc", soon) // never shortens
+
+	page, _ := rl.List(0, 0)
+	if len(page) != 1 {
+		t.Fatalf("len = %d, want 1", len(page))
+	}
+	if !page[0].ExpiresAt.Equal(later) {
+		t.Errorf("ExpiresAt = %v, want %v", page[0].ExpiresAt, later)
+	}
+	if page[0].Seq != 1 {
+		t.Errorf("Seq = %d, re-revoking must not allocate a new sequence", page[0].Seq)
+	}
+}
+
+func TestRevocationList_ListPagination(t *testing.T) {
+	rl := NewRevocationList()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		rl.Revoke(id)
+	}
+
+	var got []string
+	after := uint64(0)
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		page, more := rl.List(after, 2)
+		for _, r := range page {
+			got = append(got, r.CapID)
+			after = r.Seq
+		}
+		if !more {
+			break
+		}
+	}
+	if len(got) != 5 || got[0] != "a" || got[4] != "e" {
+		t.Errorf("paged IDs = %v, want [a b c d e]", got)
+	}
+}
+
+func TestSelector_Matches(t *testing.T) {
+	epoch := time.Now()
+	cap := &capability.Capability{
+		ID:       "x",
+		Subject:  "uid:1000",
+		Service:  "fs",
+		Actions:  []string{"read"},
+		Rights:   []string{"fs.list"},
+		IssuedAt: epoch.Add(-time.Minute),
+	}
+	cases := []struct {
+		name string
+		sel  Selector
+		want bool
+	}{
+		{"epoch only", Selector{IssuedBefore: epoch}, true},
+		{"issued after epoch", Selector{IssuedBefore: epoch.Add(-time.Hour)}, false},
+		{"service", Selector{Service: "fs", IssuedBefore: epoch}, true},
+		{"other service", Selector{Service: "net", IssuedBefore: epoch}, false},
+		{"subject", Selector{Subject: "uid:1000", IssuedBefore: epoch}, true},
+		{"other subject", Selector{Subject: "uid:0", IssuedBefore: epoch}, false},
+		{"right", Selector{Right: "fs.list", IssuedBefore: epoch}, true},
+		{"legacy action", Selector{Right: "fs.read", IssuedBefore: epoch}, true},
+		{"missing right", Selector{Right: "fs.write", IssuedBefore: epoch}, false},
+		{"all fields", Selector{Service: "fs", Subject: "uid:1000", Right: "fs.read", IssuedBefore: epoch}, true},
+	}
+	for _, tc := range cases {
+		if got := tc.sel.Matches(cap); got != tc.want {
+			t.Errorf("%s: Matches = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSelector_MatchesRightPatterns(t *testing.T) {
+	epoch := time.Now()
+	cap := &capability.Capability{
+		ID:       "x",
+		Service:  "fs",
+		Rights:   []string{"fs.*", "!fs.write"},
+		IssuedAt: epoch.Add(-time.Minute),
+	}
+	if !(&Selector{Right: "fs.read", IssuedBefore: epoch}).Matches(cap) {
+		t.Error("fs.* should cover a selector on fs.read")
+	}
+	if (&Selector{Right: "fs.write", IssuedBefore: epoch}).Matches(cap) {
+		t.Error("a negated right should not be matched by a selector")
+	}
+}
+
+func TestRevocationList_RevokeMatching(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	rl, _ := OpenRevocationList(path)
+	rl.Revoke("single")
+	epoch := time.Now()
+	entry, err := rl.RevokeMatching(Selector{Service: "fs", IssuedBefore: epoch}, epoch.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("RevokeMatching: %v", err)
+	}
+	if entry.Seq != 2 || entry.Selector == nil {
+		t.Errorf("entry = %+v, want seq 2 with selector", entry)
+	}
+
+	old := &capability.Capability{ID: "old", Service: "fs", IssuedAt: epoch.Add(-time.Second)}
+	fresh := &capability.Capability{ID: "new", Service: "fs", IssuedAt: epoch.Add(time.Second)}
+	if !rl.Matches(old) {
+		t.Error("token issued before the epoch should be revoked")
+	}
+	if rl.Matches(fresh) {
+		t.Error("token issued after the epoch should not be revoked")
+	}
+	if !rl.Matches(&capability.Capability{ID: "single", IssuedAt: epoch.Add(time.Second)}) {
+		t.Error("individually revoked ID should match")
+	}
+
+	reloaded, err := OpenRevocationList(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !reloaded.Matches(old) || reloaded.Len() != 2 {
+		t.Error("selector should survive reload")
+	}
+	page, _ := reloaded.List(1, 0)
+	if len(page) != 1 || page[0].Selector == nil || page[0].Selector.Service != "fs" {
+		t.Errorf("List after 1 = %+v, want the selector", page)
+	}
+}
+
+func TestRevocationList_PruneSelector(t *testing.T) {
+	rl := NewRevocationList()
+	rl.RevokeMatching(Selector{IssuedBefore: time.Now()}, time.Now().Add(-time.Minute))
+	if n, _ := rl.Prune(time.Now()); n != 1 || rl.Len() != 0 {
+		t.Errorf("pruned %d (Len %d), want expired selector removed", n, rl.Len())
+	}
+}
+
+func TestRevocationList_ApplyDedupes(t *testing.T) {
+	src := NewRevocationList()
+	src.Revoke("padding")
+	entry, _ := src.RevokeMatching(Selector{Subject: "uid:7", IssuedBefore: time.Now()}, time.Time{})
+
+	rl := NewRevocationList()
+	if fresh, _ := rl.Apply(entry); !fresh {
+		t.Error("first Apply should report a new entry")
+	}
+	if fresh, _ := rl.Apply(entry); fresh {
+		t.Error("second Apply of the same selector should be a no-op")
+	}
+	if rl.Len() != 1 {
+		t.Errorf("Len = %d, want 1", rl.Len())
+	}
+}
+
+func TestOpenRevocationList_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	os.WriteFile(path, []byte("{not json"), 0644)
+	if _, err := OpenRevocationList(path); err == nil {
+		t.Error("expected error for corrupt revocation file")
+	}
+}
+
 // --- Sign with nil capability ---
 
 func TestSign_NilCapability(t *testing.T) {
@@ -274,3 +908,165 @@ func TestSign_NilCapability(t *testing.T) {
 		t.Logf("Sign(nil) returned error (acceptable): %v", err)
 	}
 }
+
+// --- Introspection tests ---
+
+func TestIntrospect_Valid(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	cap := capability.NewCapability("fs", nil, capability.Constraints{PathPrefix: "/tmp"}, time.Hour)
+	cap.Rights = []string{"fs.read"}
+	token, _ := Sign(cap, kp.Private)
+
+	in := Introspect(token, kp.Public, NewRevocationList(), nil)
+	if !in.Valid {
+		t.Fatalf("expected valid, reason = %q", in.Reason)
+	}
+	if in.Claims == nil || in.Claims.ID != cap.ID {
+		t.Errorf("claims not decoded: %+v", in.Claims)
+	}
+	if in.ExpiresIn <= 0 || in.ExpiresIn > 3600 {
+		t.Errorf("ExpiresIn = %d, want (0, 3600]", in.ExpiresIn)
+	}
+	if in.Revoked {
+		t.Error("should not be revoked")
+	}
+	if len(in.ParentChain) != 0 {
+		t.Errorf("ParentChain = %v, want empty", in.ParentChain)
+	}
+}
+
+func TestIntrospect_Quota(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	cap := capability.NewCapability("fs", nil, capability.Constraints{
+		Quotas: map[string]capability.Quota{policy.QuotaBytesRead: {Limit: 100, Window: policy.WindowDay}},
+	}, time.Hour)
+	token, _ := Sign(cap, kp.Private)
+	if err := policy.ChargeQuota(cap, policy.QuotaBytesRead, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	in := Introspect(token, kp.Public, nil, nil)
+	if len(in.Quota) != 1 {
+		t.Fatalf("Quota = %+v, want one entry", in.Quota)
+	}
+	if q := in.Quota[0]; q.Name != policy.QuotaBytesRead || q.Used != 30 || q.Limit != 100 || q.ResetAt == nil {
+		t.Errorf("Quota[0] = %+v, want 30 of 100 bytes_read with a reset", q)
+	}
+
+	plain := capability.NewCapability("fs", []string{"read"}, capability.Constraints{}, time.Hour)
+	token, _ = Sign(plain, kp.Private)
+	if in := Introspect(token, kp.Public, nil, nil); in.Quota != nil {
+		t.Errorf("Quota = %+v for a token without quotas", in.Quota)
+	}
+}
+
+func TestIntrospect_Expired(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	cap := capability.NewCapability("fs", []string{"read"}, capability.Constraints{}, -time.Minute)
+	token, _ := Sign(cap, kp.Private)
+
+	in := Introspect(token, kp.Public, nil, nil)
+	if in.Valid {
+		t.Fatal("expired token should be invalid")
+	}
+	if in.Reason != "token expired" {
+		t.Errorf("Reason = %q, want %q", in.Reason, "token expired")
+	}
+	if in.ExpiresIn != 0 {
+		t.Errorf("ExpiresIn = %d, want 0", in.ExpiresIn)
+	}
+	if in.Claims == nil {
+		t.Error("claims should still be decoded for an expired token")
+	}
+}
+
+func TestIntrospect_Revoked(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	cap := capability.NewCapability("fs", []string{"read"}, capability.Constraints{}, time.Hour)
+	token, _ := Sign(cap, kp.Private)
+
+	rl := NewRevocationList()
+	rl.Revoke(cap.ID)
+
+	in := Introspect(token, kp.Public, rl, nil)
+	if in.Valid {
+		t.Fatal("revoked token should be invalid")
+	}
+	if !in.Revoked {
+		t.Error("Revoked should be true")
+	}
+	if in.Reason != "capability revoked" {
+		t.Errorf("Reason = %q, want %q", in.Reason, "capability revoked")
+	}
+}
+
+func TestIntrospect_BadSignature(t *testing.T) {
+	kp1, _ := GenerateKeyPair()
+	kp2, _ := GenerateKeyPair()
+	cap := capability.NewCapability("fs", []string{"read"}, capability.Constraints{}, time.Hour)
+	token, _ := Sign(cap, kp1.Private)
+
+	in := Introspect(token, kp2.Public, nil, nil)
+	if in.Valid {
+		t.Fatal("token signed by another key should be invalid")
+	}
+	if in.Reason != "invalid signature" {
+		t.Errorf("Reason = %q, want %q", in.Reason, "invalid signature")
+	}
+	if in.Claims != nil {
+		t.Error("claims must not be returned for an unverified token")
+	}
+}
+
+func TestIntrospect_ParentChain(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	cap := capability.NewCapability("fs", []string{"read"}, capability.Constraints{}, time.Hour)
+	cap.Parent = "p1"
+	token, _ := Sign(cap, kp.Private)
+
+	parents := map[string]string{"p1": "p2", "p2": "root"}
+	parentOf := func(id string) (string, bool) {
+		p, ok := parents[id]
+		return p, ok
+	}
+
+	in := Introspect(token, kp.Public, nil, parentOf)
+	want := []string{"p1", "p2", "root"}
+	if len(in.ParentChain) != len(want) {
+		t.Fatalf("ParentChain = %v, want %v", in.ParentChain, want)
+	}
+	for i := range want {
+		if in.ParentChain[i] != want[i] {
+			t.Errorf("ParentChain[%d] = %q, want %q", i, in.ParentChain[i], want[i])
+		}
+	}
+}
+
+func TestIntrospect_Redacted(t *testing.T) {
+	key := mustHex(t, vectorLocalKey)
+	cap := capability.NewCapability("fs", []string{"fs.read"}, capability.Constraints{}, time.Hour)
+	cap.Parent = "p1"
+	token, _ := Encrypt(cap, key, V4, nil)
+	open := func(t string) (*capability.Capability, error) { return Decrypt(t, key) }
+
+	in := IntrospectWith(token, open, nil, nil).Redacted()
+	if !in.Valid || in.ExpiresIn <= 0 {
+		t.Errorf("redacted = %+v, want valid with expires_in_sec", in)
+	}
+	if in.Claims != nil || len(in.ParentChain) != 0 {
+		t.Errorf("redacted introspection reveals claims: %+v", in)
+	}
+}
+
+func TestIntrospect_ParentChainCycle(t *testing.T) {
+	parentOf := func(id string) (string, bool) {
+		if id == "a" {
+			return "b", true
+		}
+		return "a", true
+	}
+	chain := parentChain("a", parentOf)
+	if len(chain) != 2 {
+		t.Errorf("cycle should stop after each ID once, got %v", chain)
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/policy"
+)
+
+// maxParentDepth bounds parent chain walks so a corrupt lineage cannot loop.
+const maxParentDepth = 32
+
+// Introspection is the decoded state of a token, for debugging and tooling.
+type Introspection struct {
+	Valid       bool                   `json:"valid"`
+	Reason      string                 `json:"reason,omitempty"`
+	Claims      *capability.Capability `json:"claims,omitempty"`
+	ExpiresIn   int64                  `json:"expires_in_sec"`
+	Revoked     bool                   `json:"revoked"`
+	ParentChain []string               `json:"parent_chain"`
+	// Quota is the token's standing against its quotas, as recorded by
+	// the policy package's quota tracker; absent if it has none.
+	Quota []policy.QuotaStatus `json:"quota,omitempty"`
+}
+
+// Introspect verifies token and reports its claims, remaining lifetime,
+// revocation status and parent chain. It never returns an error: a token
+// that fails verification yields Valid=false with Reason set.
+// parentOf resolves a capability ID to its parent ID; it may be nil.
+func Introspect(token string, key ed25519.PublicKey, rl *RevocationList, parentOf func(string) (string, bool)) *Introspection {
+	return IntrospectWith(token, func(t string) (*capability.Capability, error) {
+		return Verify(t, key)
+	}, rl, parentOf)
+}
+
+// IntrospectWith is Introspect with a caller-supplied token decoder, for
+// callers that also hold local token keys.
+func IntrospectWith(token string, open func(string) (*capability.Capability, error), rl *RevocationList, parentOf func(string) (string, bool)) *Introspection {
+	in := &Introspection{ParentChain: []string{}}
+
+	cap, err := open(token)
+	if err != nil {
+		in.Reason = err.Error()
+		return in
+	}
+	in.Claims = cap
+	in.ExpiresIn = int64(time.Until(cap.ExpiresAt).Seconds())
+	if in.ExpiresIn < 0 {
+		in.ExpiresIn = 0
+	}
+	if rl != nil {
+		in.Revoked = rl.Matches(cap)
+	}
+	in.ParentChain = parentChain(cap.Parent, parentOf)
+	in.Quota, _ = policy.QuotaReport(cap)
+
+	switch {
+	case cap.IsExpired():
+		in.Reason = "token expired"
+	case in.Revoked:
+		in.Reason = "capability revoked"
+	default:
+		in.Valid = true
+	}
+	return in
+}
+
+// Redacted returns in without what a token's claims reveal, leaving
+// whether it is valid, revoked and how long it has left. It is what the
+// bearer of a local token may learn of it.
+func (in *Introspection) Redacted() *Introspection {
+	return &Introspection{
+		Valid:       in.Valid,
+		Reason:      in.Reason,
+		ExpiresIn:   in.ExpiresIn,
+		Revoked:     in.Revoked,
+		ParentChain: []string{},
+	}
+}
+
+// parentChain walks parent links starting at id, nearest ancestor first.
+func parentChain(id string, parentOf func(string) (string, bool)) []string {
+	chain := []string{}
+	seen := make(map[string]struct{})
+	for id != "" && len(chain) < maxParentDepth {
+		if _, dup := seen[id]; dup {
+			break
+		}
+		seen[id] = struct{}{}
+		chain = append(chain, id)
+		if parentOf == nil {
+			break
+		}
+		next, ok := parentOf(id)
+		if !ok {
+			break
+		}
+		id = next
+	}
+	return chain
+}
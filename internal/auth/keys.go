@@ -1,5 +1,6 @@
-// Package auth handles ed25519 key management, PASETO v2.public token
-// signing/verification, and capability revocation.
+// Package auth handles ed25519 key management, PASETO v2/v4 token
+// signing, verification and encryption, capability revocation, and refresh
+// credentials.
 package auth
 
 import (
@@ -8,6 +9,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"strings"
 )
 
 type KeyPair struct {
@@ -44,3 +46,26 @@ func LoadPublicKey(path string) (ed25519.PublicKey, error) {
 	}
 	return ed25519.PublicKey(decoded), nil
 }
+
+// WritePrivateKey writes the base64-encoded private key to path, readable
+// only by its owner. Used for client proof-of-possession keys.
+func (kp *KeyPair) WritePrivateKey(path string) error {
+	encoded := base64.StdEncoding.EncodeToString(kp.Private)
+	return os.WriteFile(path, []byte(encoded), 0600)
+}
+
+// LoadPrivateKey reads a base64-encoded ed25519 private key from path.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read private key: %w", err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("decode private key: %w", err)
+	}
+	if len(decoded) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key size: %d", len(decoded))
+	}
+	return ed25519.PrivateKey(decoded), nil
+}
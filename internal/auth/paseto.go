@@ -2,6 +2,9 @@ package auth
 
 import (
 	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
@@ -11,7 +14,101 @@ import (
 	"github.com/Gao-OS/StrataOS/internal/capability"
 )
 
-const v2PublicHeader = "v2.public."
+// Version selects a PASETO protocol version.
+type Version string
+
+const (
+	V2 Version = "v2"
+	V4 Version = "v4"
+
+	// DefaultVersion is used by Sign and for new tokens unless configured.
+	DefaultVersion = V4
+)
+
+// ParseVersion parses a configured token version ("v2" or "v4").
+func ParseVersion(s string) (Version, error) {
+	switch Version(s) {
+	case V2, V4:
+		return Version(s), nil
+	}
+	return "", fmt.Errorf("unsupported token version %q", s)
+}
+
+// ConfiguredVersions parses a service's token version settings: issue is
+// the version new tokens use (DefaultVersion if empty) and accept the
+// comma-separated versions verifiers take (only issue if empty). The issued
+// version must be accepted.
+func ConfiguredVersions(issue, accept string) (Version, []Version, error) {
+	v := DefaultVersion
+	if issue != "" {
+		var err error
+		if v, err = ParseVersion(issue); err != nil {
+			return "", nil, err
+		}
+	}
+	if accept == "" {
+		return v, []Version{v}, nil
+	}
+	var versions []Version
+	for _, s := range strings.Split(accept, ",") {
+		a, err := ParseVersion(strings.TrimSpace(s))
+		if err != nil {
+			return "", nil, err
+		}
+		versions = append(versions, a)
+	}
+	if !acceptsVersion(versions, v) {
+		return "", nil, fmt.Errorf("issued token version %s is not accepted", v)
+	}
+	return v, versions, nil
+}
+
+// CheckVersion rejects token unless its version is one of accept, so a
+// verifier configured for v4 alone refuses v2 tokens even when they are
+// validly signed.
+func CheckVersion(token string, accept []Version) error {
+	v, _, _, _, err := splitToken(token)
+	if err != nil {
+		return err
+	}
+	if !acceptsVersion(accept, v) {
+		return fmt.Errorf("token version %s not accepted", v)
+	}
+	return nil
+}
+
+func acceptsVersion(accept []Version, v Version) bool {
+	for _, a := range accept {
+		if a == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Token headers.
+const (
+	v2PublicHeader = "v2.public."
+	v4PublicHeader = "v4.public."
+	v2LocalHeader  = "v2.local."
+	v4LocalHeader  = "v4.local."
+)
+
+// LocalKeySize is the size of a symmetric key for local tokens.
+const LocalKeySize = chachaKeySize
+
+// Footer is the optional token footer. It is authenticated but never
+// encrypted, so it may carry only public data such as a key ID.
+type Footer struct {
+	KID string `json:"kid,omitempty"`
+}
+
+// KeyID returns the identifier of pub carried in token footers, letting
+// verifiers tell which key a token was signed with.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
 
 // pae implements Pre-Authentication Encoding per the PASETO specification.
 // It binds the header, message, and footer together to prevent tampering.
@@ -27,46 +124,270 @@ func pae(pieces ...[]byte) []byte {
 	return buf
 }
 
-// Sign creates a PASETO v2.public token from a capability and ed25519 private key.
+// Sign creates a DefaultVersion public token from a capability and ed25519
+// private key, with no footer.
 func Sign(cap *capability.Capability, key ed25519.PrivateKey) (string, error) {
+	return SignVersion(cap, key, DefaultVersion, nil)
+}
+
+// SignVersion creates a v2.public or v4.public token, with an optional footer.
+func SignVersion(cap *capability.Capability, key ed25519.PrivateKey, v Version, footer *Footer) (string, error) {
 	message, err := json.Marshal(cap)
 	if err != nil {
 		return "", fmt.Errorf("marshal capability: %w", err)
 	}
+	f, err := encodeFooter(footer)
+	if err != nil {
+		return "", err
+	}
+	return signPublic(v, key, message, f, nil)
+}
+
+// Verify validates a v2.public or v4.public token and returns the embedded
+// capability. A token whose footer names a key ID must name key's.
+func Verify(token string, key ed25519.PublicKey) (*capability.Capability, error) {
+	message, f, err := verifyPublic(token, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeyID(f, KeyID(key)); err != nil {
+		return nil, err
+	}
+	return decodeClaims(message)
+}
+
+// Encrypt creates a v2.local or v4.local token: the claims are encrypted
+// with a symmetric key, so only holders of that key (not the bearer) can
+// read or verify them.
+func Encrypt(cap *capability.Capability, key []byte, v Version, footer *Footer) (string, error) {
+	message, err := json.Marshal(cap)
+	if err != nil {
+		return "", fmt.Errorf("marshal capability: %w", err)
+	}
+	f, err := encodeFooter(footer)
+	if err != nil {
+		return "", err
+	}
+	var nonce []byte
+	switch v {
+	case V2:
+		nonce = make([]byte, xchachaNonceLen)
+	case V4:
+		nonce = make([]byte, 32)
+	default:
+		return "", fmt.Errorf("unsupported token version %q", v)
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+	return encryptLocal(v, key, nonce, message, f, nil)
+}
+
+// Decrypt validates a v2.local or v4.local token and returns its claims.
+func Decrypt(token string, key []byte) (*capability.Capability, error) {
+	message, _, err := decryptLocal(token, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeClaims(message)
+}
+
+// IsLocal reports whether token is a local (symmetric) token.
+func IsLocal(token string) bool {
+	return strings.HasPrefix(token, v2LocalHeader) || strings.HasPrefix(token, v4LocalHeader)
+}
+
+// TokenFooter returns a token's decoded footer without verifying the
+// token, so a verifier can pick a key. It returns nil if there is none.
+func TokenFooter(token string) (*Footer, error) {
+	_, _, _, f, err := splitToken(token)
+	if err != nil || len(f) == 0 {
+		return nil, err
+	}
+	var footer Footer
+	if err := json.Unmarshal(f, &footer); err != nil {
+		return nil, fmt.Errorf("decode footer: %w", err)
+	}
+	return &footer, nil
+}
 
-	m2 := pae([]byte(v2PublicHeader), message, []byte{})
+// signPublic signs message as a public token. implicit is the v4 implicit
+// assertion; it must be empty for v2.
+func signPublic(v Version, key ed25519.PrivateKey, message, footer, implicit []byte) (string, error) {
+	h := string(v) + ".public."
+	var m2 []byte
+	switch v {
+	case V2:
+		m2 = pae([]byte(h), message, footer)
+	case V4:
+		m2 = pae([]byte(h), message, footer, implicit)
+	default:
+		return "", fmt.Errorf("unsupported token version %q", v)
+	}
 	sig := ed25519.Sign(key, m2)
 
 	body := make([]byte, len(message)+ed25519.SignatureSize)
 	copy(body, message)
 	copy(body[len(message):], sig)
+	return joinToken(h, body, footer), nil
+}
+
+// verifyPublic checks a public token's signature and returns its message
+// and raw footer.
+func verifyPublic(token string, key ed25519.PublicKey, implicit []byte) ([]byte, []byte, error) {
+	v, purpose, body, footer, err := splitToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if purpose != "public" {
+		return nil, nil, fmt.Errorf("invalid token header")
+	}
+	if len(body) < ed25519.SignatureSize {
+		return nil, nil, fmt.Errorf("token too short")
+	}
 
-	token := v2PublicHeader + base64.RawURLEncoding.EncodeToString(body)
-	return token, nil
+	message := body[:len(body)-ed25519.SignatureSize]
+	sig := body[len(body)-ed25519.SignatureSize:]
+
+	h := []byte(string(v) + ".public.")
+	var m2 []byte
+	if v == V2 {
+		m2 = pae(h, message, footer)
+	} else {
+		m2 = pae(h, message, footer, implicit)
+	}
+	if !ed25519.Verify(key, m2, sig) {
+		return nil, nil, fmt.Errorf("invalid signature")
+	}
+	return message, footer, nil
 }
 
-// Verify validates a PASETO v2.public token and returns the embedded capability.
-func Verify(token string, key ed25519.PublicKey) (*capability.Capability, error) {
-	if !strings.HasPrefix(token, v2PublicHeader) {
-		return nil, fmt.Errorf("invalid token header")
+// encryptLocal encrypts message as a local token with the given nonce:
+// for v2, the random input to the nonce derivation (24 bytes); for v4, the
+// 32-byte nonce itself. implicit must be empty for v2.
+func encryptLocal(v Version, key, nonce, message, footer, implicit []byte) (string, error) {
+	if len(key) != LocalKeySize {
+		return "", fmt.Errorf("invalid local key size: %d", len(key))
+	}
+	h := string(v) + ".local."
+	switch v {
+	case V2:
+		n := blake2bSum(xchachaNonceLen, nonce, message)
+		c := xchachaPolySeal(key, n, message, pae([]byte(h), n, footer))
+		return joinToken(h, append(n, c...), footer), nil
+	case V4:
+		ek, n2, ak := v4LocalKeys(key, nonce)
+		c := xchacha20XOR(ek, n2, message)
+		t := blake2bSum(32, ak, pae([]byte(h), nonce, c, footer, implicit))
+		body := append(append(append([]byte{}, nonce...), c...), t...)
+		return joinToken(h, body, footer), nil
 	}
+	return "", fmt.Errorf("unsupported token version %q", v)
+}
 
-	decoded, err := base64.RawURLEncoding.DecodeString(token[len(v2PublicHeader):])
+// decryptLocal authenticates and decrypts a local token, returning its
+// message and raw footer.
+func decryptLocal(token string, key, implicit []byte) ([]byte, []byte, error) {
+	if len(key) != LocalKeySize {
+		return nil, nil, fmt.Errorf("invalid local key size: %d", len(key))
+	}
+	v, purpose, body, footer, err := splitToken(token)
 	if err != nil {
-		return nil, fmt.Errorf("decode token: %w", err)
+		return nil, nil, err
+	}
+	if purpose != "local" {
+		return nil, nil, fmt.Errorf("invalid token header")
 	}
-	if len(decoded) < ed25519.SignatureSize {
-		return nil, fmt.Errorf("token too short")
+	h := []byte(string(v) + ".local.")
+	switch v {
+	case V2:
+		if len(body) < xchachaNonceLen+poly1305TagSize {
+			return nil, nil, fmt.Errorf("token too short")
+		}
+		n, c := body[:xchachaNonceLen], body[xchachaNonceLen:]
+		message, err := xchachaPolyOpen(key, n, c, pae(h, n, footer))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid token: %w", err)
+		}
+		return message, footer, nil
+	default: // V4
+		if len(body) < 64 {
+			return nil, nil, fmt.Errorf("token too short")
+		}
+		n, c, t := body[:32], body[32:len(body)-32], body[len(body)-32:]
+		ek, n2, ak := v4LocalKeys(key, n)
+		want := blake2bSum(32, ak, pae(h, n, c, footer, implicit))
+		if subtle.ConstantTimeCompare(t, want) != 1 {
+			return nil, nil, fmt.Errorf("invalid token: %w", errAEADOpen)
+		}
+		return xchacha20XOR(ek, n2, c), footer, nil
 	}
+}
 
-	message := decoded[:len(decoded)-ed25519.SignatureSize]
-	sig := decoded[len(decoded)-ed25519.SignatureSize:]
+// v4LocalKeys derives the v4.local encryption key, stream nonce and
+// authentication key from the shared key and the token nonce.
+func v4LocalKeys(key, nonce []byte) (ek, n2, ak []byte) {
+	tmp := blake2bSum(56, key, append([]byte("paseto-encryption-key"), nonce...))
+	ak = blake2bSum(32, key, append([]byte("paseto-auth-key-for-aead"), nonce...))
+	return tmp[:32], tmp[32:], ak
+}
 
-	m2 := pae([]byte(v2PublicHeader), message, []byte{})
-	if !ed25519.Verify(key, m2, sig) {
-		return nil, fmt.Errorf("invalid signature")
+// splitToken parses "version.purpose.payload[.footer]".
+func splitToken(token string) (Version, string, []byte, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 && len(parts) != 4 {
+		return "", "", nil, nil, fmt.Errorf("invalid token header")
 	}
+	v := Version(parts[0])
+	if (v != V2 && v != V4) || (parts[1] != "public" && parts[1] != "local") {
+		return "", "", nil, nil, fmt.Errorf("invalid token header")
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", "", nil, nil, fmt.Errorf("decode token: %w", err)
+	}
+	var footer []byte
+	if len(parts) == 4 {
+		if footer, err = base64.RawURLEncoding.DecodeString(parts[3]); err != nil {
+			return "", "", nil, nil, fmt.Errorf("decode footer: %w", err)
+		}
+	}
+	return v, parts[1], body, footer, nil
+}
+
+func joinToken(header string, body, footer []byte) string {
+	token := header + base64.RawURLEncoding.EncodeToString(body)
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+	return token
+}
+
+func encodeFooter(footer *Footer) ([]byte, error) {
+	if footer == nil || *footer == (Footer{}) {
+		return nil, nil
+	}
+	f, err := json.Marshal(footer)
+	if err != nil {
+		return nil, fmt.Errorf("marshal footer: %w", err)
+	}
+	return f, nil
+}
+
+// checkKeyID rejects a footer naming a key ID other than want. Footers
+// that are not JSON carry no key ID.
+func checkKeyID(footer []byte, want string) error {
+	var f Footer
+	if len(footer) == 0 || json.Unmarshal(footer, &f) != nil {
+		return nil
+	}
+	if f.KID != "" && f.KID != want {
+		return fmt.Errorf("unknown key id %q", f.KID)
+	}
+	return nil
+}
 
+func decodeClaims(message []byte) (*capability.Capability, error) {
 	var cap capability.Capability
 	if err := json.Unmarshal(message, &cap); err != nil {
 		return nil, fmt.Errorf("unmarshal capability: %w", err)
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// proofHeader domain-separates request proofs from token signatures.
+const proofHeader = "strata.pop.v1"
+
+// Binding failures.
+var (
+	ErrBoundToUID   = errors.New("token bound to another UID")
+	ErrProofMissing = errors.New("token requires a proof of possession")
+	ErrProofInvalid = errors.New("invalid proof of possession")
+)
+
+// proofMessage is what a holder signs to prove possession for one request.
+func proofMessage(reqID, method string) []byte {
+	return pae([]byte(proofHeader), []byte(reqID), []byte(method))
+}
+
+// SignProof returns the proof for a request, to be sent as auth.proof.
+func SignProof(key ed25519.PrivateKey, reqID, method string) string {
+	return base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, proofMessage(reqID, method)))
+}
+
+// ParseConfirmKey decodes a base64 ed25519 public key for a cnf claim.
+func ParseConfirmKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("decode cnf key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid cnf key size: %d", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// CheckBinding enforces cap's confirmation claim for one request. peerUID
+// is the caller's kernel-verified UID, or -1 if unknown. Unbound (bearer)
+// tokens always pass.
+func CheckBinding(cap *capability.Capability, peerUID int, reqID, method, proof string) error {
+	cnf := cap.Confirm
+	if cnf == nil {
+		return nil
+	}
+	if cnf.UID != nil && (peerUID < 0 || peerUID != *cnf.UID) {
+		return ErrBoundToUID
+	}
+	if cnf.Key != "" {
+		if proof == "" {
+			return ErrProofMissing
+		}
+		key, err := ParseConfirmKey(cnf.Key)
+		if err != nil {
+			return ErrProofInvalid
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(proof)
+		if err != nil || !ed25519.Verify(key, proofMessage(reqID, method), sig) {
+			return ErrProofInvalid
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+func boundCap(cnf *capability.Confirm) *capability.Capability {
+	cap := capability.NewCapability("fs", []string{"read"}, capability.Constraints{}, time.Hour)
+	cap.Confirm = cnf
+	return cap
+}
+
+func uidPtr(uid int) *int { return &uid }
+
+// --- Proof-of-possession tests ---
+
+func TestCheckBinding_Bearer(t *testing.T) {
+	if err := CheckBinding(boundCap(nil), -1, "r1", "fs.read", ""); err != nil {
+		t.Errorf("unbound token should pass: %v", err)
+	}
+}
+
+func TestCheckBinding_UID(t *testing.T) {
+	cap := boundCap(&capability.Confirm{UID: uidPtr(1000)})
+	if err := CheckBinding(cap, 1000, "r1", "fs.read", ""); err != nil {
+		t.Errorf("matching UID should pass: %v", err)
+	}
+	if err := CheckBinding(cap, 1001, "r1", "fs.read", ""); !errors.Is(err, ErrBoundToUID) {
+		t.Errorf("other UID: err = %v, want ErrBoundToUID", err)
+	}
+	if err := CheckBinding(cap, -1, "r1", "fs.read", ""); !errors.Is(err, ErrBoundToUID) {
+		t.Errorf("unknown peer: err = %v, want ErrBoundToUID", err)
+	}
+
+	root := boundCap(&capability.Confirm{UID: uidPtr(0)})
+	if err := CheckBinding(root, 0, "r1", "fs.read", ""); err != nil {
+		t.Errorf("binding to UID 0 should work: %v", err)
+	}
+}
+
+func TestCheckBinding_Key(t *testing.T) {
+	holder, _ := GenerateKeyPair()
+	other, _ := GenerateKeyPair()
+	cap := boundCap(&capability.Confirm{Key: base64.StdEncoding.EncodeToString(holder.Public)})
+
+	proof := SignProof(holder.Private, "r1", "fs.read")
+	if err := CheckBinding(cap, -1, "r1", "fs.read", proof); err != nil {
+		t.Errorf("valid proof should pass: %v", err)
+	}
+
+	cases := []struct {
+		name          string
+		reqID, method string
+		proof         string
+		want          error
+	}{
+		{"missing proof", "r1", "fs.read", "", ErrProofMissing},
+		{"wrong key", "r1", "fs.read", SignProof(other.Private, "r1", "fs.read"), ErrProofInvalid},
+		{"other req_id", "r2", "fs.read", proof, ErrProofInvalid},
+		{"other method", "r1", "fs.list", proof, ErrProofInvalid},
+		{"garbage", "r1", "fs.read", "!!!", ErrProofInvalid},
+	}
+	for _, tc := range cases {
+		if err := CheckBinding(cap, -1, tc.reqID, tc.method, tc.proof); !errors.Is(err, tc.want) {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestCheckBinding_UIDAndKey(t *testing.T) {
+	holder, _ := GenerateKeyPair()
+	cap := boundCap(&capability.Confirm{UID: uidPtr(1000), Key: base64.StdEncoding.EncodeToString(holder.Public)})
+	proof := SignProof(holder.Private, "r1", "fs.read")
+	if err := CheckBinding(cap, 1000, "r1", "fs.read", proof); err != nil {
+		t.Errorf("both satisfied should pass: %v", err)
+	}
+	if err := CheckBinding(cap, 1001, "r1", "fs.read", proof); err == nil {
+		t.Error("proof alone must not satisfy a UID binding")
+	}
+	if err := CheckBinding(cap, 1000, "r1", "fs.read", ""); err == nil {
+		t.Error("UID alone must not satisfy a key binding")
+	}
+}
+
+func TestSignVerify_BindingSurvivesToken(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	cap := boundCap(&capability.Confirm{UID: uidPtr(42)})
+	token, err := Sign(cap, kp.Private)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	got, err := Verify(token, kp.Public)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if got.Confirm == nil || got.Confirm.UID == nil || *got.Confirm.UID != 42 {
+		t.Errorf("cnf lost in round trip: %+v", got.Confirm)
+	}
+}
+
+func TestParseConfirmKey_Invalid(t *testing.T) {
+	for _, s := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseConfirmKey(s); err == nil {
+			t.Errorf("ParseConfirmKey(%q) should fail", s)
+		}
+	}
+}
+
+func TestPrivateKeyRoundTrip(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	path := t.TempDir() + "/client.key"
+	if err := kp.WritePrivateKey(path); err != nil {
+		t.Fatalf("WritePrivateKey: %v", err)
+	}
+	key, err := LoadPrivateKey(path)
+	if err != nil {
+		t.Fatalf("LoadPrivateKey: %v", err)
+	}
+	if !key.Equal(kp.Private) {
+		t.Error("loaded key differs")
+	}
+}
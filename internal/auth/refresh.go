@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/atomicfile"
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// Refresh credential failures.
+var (
+	ErrRefreshInvalid = errors.New("invalid refresh credential")
+	ErrRefreshExpired = errors.New("refresh credential expired")
+	ErrRefreshRevoked = errors.New("refresh credential family revoked")
+)
+
+// RefreshReuseError reports that a refresh credential that had already been
+// rotated out was presented again. The credential has leaked, so its whole
+// family is revoked; Caps lists the family's access tokens that may still
+// be live, with their expiries, so they can be revoked too.
+type RefreshReuseError struct {
+	Family string
+	Caps   map[string]time.Time
+}
+
+func (e *RefreshReuseError) Error() string {
+	return "refresh credential reuse detected; family " + e.Family + " revoked"
+}
+
+// RefreshGrant is what a refresh credential may re-mint: the claims of the
+// original access token, and the lifetimes of each renewed token and
+// refresh credential.
+type RefreshGrant struct {
+	Subject     string                 `json:"subject"`
+	Service     string                 `json:"service"`
+	Actions     []string               `json:"actions,omitempty"`
+	Rights      []string               `json:"rights,omitempty"`
+	Constraints capability.Constraints `json:"constraints"`
+	Confirm     *capability.Confirm    `json:"cnf,omitempty"`
+	Attrs       map[string][]string    `json:"attrs,omitempty"`
+	Local       bool                   `json:"local,omitempty"` // mint local (encrypted) tokens
+	TTL         time.Duration          `json:"ttl"`
+	RefreshTTL  time.Duration          `json:"refresh_ttl"`
+}
+
+// NewCapability mints a fresh access token's claims from the grant.
+func (g *RefreshGrant) NewCapability() *capability.Capability {
+	cap := capability.NewCapability(g.Service, g.Actions, g.Constraints, g.TTL)
+	cap.Subject = g.Subject
+	cap.Rights = g.Rights
+	cap.Confirm = g.Confirm
+	cap.Attrs = g.Attrs
+	return cap
+}
+
+// issuedRef identifies an access token minted within a family.
+type issuedRef struct {
+	ID        string    `json:"id"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// refreshFamily is a chain of access tokens and refresh credentials that
+// descend from one issuance.
+type refreshFamily struct {
+	Grant   RefreshGrant `json:"grant"`
+	Caps    []issuedRef  `json:"caps"` // unexpired access tokens, oldest first
+	Revoked bool         `json:"revoked"`
+}
+
+// refreshCredential is a stored refresh credential, keyed by its hash.
+type refreshCredential struct {
+	Family    string    `json:"family"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Used      bool      `json:"used"` // rotated out; presenting it again is reuse
+}
+
+// refreshFile is the on-disk form of a RefreshStore.
+type refreshFile struct {
+	Families    map[string]*refreshFamily     `json:"families"`
+	Credentials map[string]*refreshCredential `json:"credentials"`
+}
+
+// RefreshStore tracks refresh credentials and their token families.
+// Only SHA-256 hashes of credentials are kept. Stores created with
+// OpenRefreshStore persist every change to disk.
+type RefreshStore struct {
+	mu          sync.Mutex
+	families    map[string]*refreshFamily
+	credentials map[string]*refreshCredential // by credential hash
+	path        string                        // "" for in-memory stores
+}
+
+func NewRefreshStore() *RefreshStore {
+	return &RefreshStore{
+		families:    make(map[string]*refreshFamily),
+		credentials: make(map[string]*refreshCredential),
+	}
+}
+
+// OpenRefreshStore loads the store persisted at path, pruning expired
+// entries. A missing file yields an empty store.
+func OpenRefreshStore(path string) (*RefreshStore, error) {
+	s := NewRefreshStore()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("read refresh store: %w", err)
+	}
+	var f refreshFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse refresh store: %w", err)
+	}
+	if f.Families != nil {
+		s.families = f.Families
+	}
+	if f.Credentials != nil {
+		s.credentials = f.Credentials
+	}
+	if err := s.Prune(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Start opens a new family for an access token just issued under grant and
+// returns its first refresh credential. If the family cannot be persisted
+// it is dropped and the error returned, so no credential outlives a
+// restart unrecorded.
+func (s *RefreshStore) Start(grant RefreshGrant, cap *capability.Capability) (string, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	family := randomHex(16)
+	s.families[family] = &refreshFamily{Grant: grant, Caps: []issuedRef{refOf(cap)}}
+	cred, expires := s.issueLocked(family, grant.RefreshTTL)
+	if err := s.saveLocked(); err != nil {
+		delete(s.families, family)
+		delete(s.credentials, hashCredential(cred))
+		return "", time.Time{}, err
+	}
+	return cred, expires, nil
+}
+
+// Renew redeems credential for a new access token and a rotated refresh
+// credential. mint is given the grant and the claims of the family's latest
+// access token (to check it has not been revoked) and returns the new
+// token's claims; if it fails, nothing changes and its error is returned.
+//
+// Presenting a credential that was already rotated out revokes the whole
+// family and returns a *RefreshReuseError. A persistence error is returned
+// alongside a successful renewal, which stands in memory.
+func (s *RefreshStore) Renew(credential string, mint func(g RefreshGrant, prev *capability.Capability) (*capability.Capability, error)) (*capability.Capability, string, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.credentials[hashCredential(credential)]
+	if !ok {
+		return nil, "", time.Time{}, ErrRefreshInvalid
+	}
+	fam, ok := s.families[c.Family]
+	if !ok {
+		return nil, "", time.Time{}, ErrRefreshInvalid
+	}
+	if fam.Revoked {
+		return nil, "", time.Time{}, ErrRefreshRevoked
+	}
+	if c.Used {
+		fam.Revoked = true
+		caps := make(map[string]time.Time, len(fam.Caps))
+		for _, ref := range fam.Caps {
+			caps[ref.ID] = ref.ExpiresAt
+		}
+		s.saveLocked() // best effort: the family is revoked in memory regardless
+		return nil, "", time.Time{}, &RefreshReuseError{Family: c.Family, Caps: caps}
+	}
+	if time.Now().After(c.ExpiresAt) {
+		return nil, "", time.Time{}, ErrRefreshExpired
+	}
+
+	var prev *capability.Capability
+	if n := len(fam.Caps); n > 0 {
+		prev = fam.Grant.NewCapability()
+		prev.ID = fam.Caps[n-1].ID
+		prev.IssuedAt = fam.Caps[n-1].IssuedAt
+		prev.ExpiresAt = fam.Caps[n-1].ExpiresAt
+	}
+	cap, err := mint(fam.Grant, prev)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	c.Used = true
+	now := time.Now()
+	live := fam.Caps[:0]
+	for _, ref := range fam.Caps {
+		if ref.ExpiresAt.After(now) {
+			live = append(live, ref)
+		}
+	}
+	fam.Caps = append(live, refOf(cap))
+	cred, expires := s.issueLocked(c.Family, fam.Grant.RefreshTTL)
+	return cap, cred, expires, s.saveLocked()
+}
+
+// Prune drops credentials that expired before now, and families with no
+// live credentials left.
+func (s *RefreshStore) Prune(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	live := make(map[string]bool)
+	for h, c := range s.credentials {
+		if c.ExpiresAt.Before(now) {
+			delete(s.credentials, h)
+			changed = true
+			continue
+		}
+		live[c.Family] = true
+	}
+	for id := range s.families {
+		if !live[id] {
+			delete(s.families, id)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+// Len returns the number of token families held.
+func (s *RefreshStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.families)
+}
+
+// issueLocked creates a new credential in family. Caller must hold s.mu.
+func (s *RefreshStore) issueLocked(family string, ttl time.Duration) (string, time.Time) {
+	cred := randomHex(32)
+	expires := time.Now().Add(ttl)
+	s.credentials[hashCredential(cred)] = &refreshCredential{Family: family, ExpiresAt: expires}
+	return cred, expires
+}
+
+// saveLocked atomically rewrites the backing file. Caller must hold s.mu.
+func (s *RefreshStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(refreshFile{Families: s.families, Credentials: s.credentials})
+	if err != nil {
+		return fmt.Errorf("marshal refresh store: %w", err)
+	}
+	if err := atomicfile.Write(s.path, data); err != nil {
+		return fmt.Errorf("persist refresh store: %w", err)
+	}
+	return nil
+}
+
+func refOf(cap *capability.Capability) issuedRef {
+	return issuedRef{ID: cap.ID, IssuedAt: cap.IssuedAt, ExpiresAt: cap.ExpiresAt}
+}
+
+func hashCredential(cred string) string {
+	sum := sha256.Sum256([]byte(cred))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+func testGrant() RefreshGrant {
+	return RefreshGrant{
+		Subject:     "uid:1000",
+		Service:     "fs",
+		Rights:      []string{"fs.read"},
+		Constraints: capability.Constraints{PathPrefix: "/srv"},
+		Attrs:       map[string][]string{"clearance": {"pii"}},
+		TTL:         time.Minute,
+		RefreshTTL:  time.Hour,
+	}
+}
+
+// startFamily issues an initial capability under testGrant and opens its family.
+func startFamily(t *testing.T, s *RefreshStore) (*capability.Capability, string) {
+	t.Helper()
+	g := testGrant()
+	cap := g.NewCapability()
+	cred, _, err := s.Start(g, cap)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return cap, cred
+}
+
+func mintChild(g RefreshGrant, prev *capability.Capability) (*capability.Capability, error) {
+	cap := g.NewCapability()
+	cap.Parent = prev.ID
+	return cap, nil
+}
+
+// --- Refresh store tests ---
+
+func TestRefreshStore_RenewRotates(t *testing.T) {
+	s := NewRefreshStore()
+	first, cred := startFamily(t, s)
+
+	var seenPrev string
+	cap, next, expires, err := s.Renew(cred, func(g RefreshGrant, prev *capability.Capability) (*capability.Capability, error) {
+		seenPrev = prev.ID
+		return mintChild(g, prev)
+	})
+	if err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+	if seenPrev != first.ID || cap.Parent != first.ID {
+		t.Errorf("renewal should descend from %s, got prev=%s parent=%s", first.ID, seenPrev, cap.Parent)
+	}
+	if cap.Service != "fs" || cap.Subject != "uid:1000" || cap.Constraints.PathPrefix != "/srv" ||
+		len(cap.Attrs["clearance"]) != 1 {
+		t.Errorf("renewed claims lost the grant: %+v", cap)
+	}
+	if next == "" || next == cred {
+		t.Error("refresh credential should rotate")
+	}
+	if time.Until(expires) < 59*time.Minute {
+		t.Errorf("refresh expiry %v should be about an hour away", expires)
+	}
+
+	// The rotated credential works in turn.
+	if _, _, _, err := s.Renew(next, mintChild); err != nil {
+		t.Errorf("rotated credential: %v", err)
+	}
+}
+
+func TestRefreshStore_ReuseRevokesFamily(t *testing.T) {
+	s := NewRefreshStore()
+	first, cred := startFamily(t, s)
+	second, next, _, err := s.Renew(cred, mintChild)
+	if err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+
+	_, _, _, err = s.Renew(cred, mintChild)
+	var reuse *RefreshReuseError
+	if !errors.As(err, &reuse) {
+		t.Fatalf("err = %v, want *RefreshReuseError", err)
+	}
+	if _, ok := reuse.Caps[first.ID]; !ok {
+		t.Errorf("reuse should report %s for revocation: %v", first.ID, reuse.Caps)
+	}
+	if _, ok := reuse.Caps[second.ID]; !ok {
+		t.Errorf("reuse should report %s for revocation: %v", second.ID, reuse.Caps)
+	}
+
+	// The legitimate holder's current credential is dead too.
+	if _, _, _, err := s.Renew(next, mintChild); !errors.Is(err, ErrRefreshRevoked) {
+		t.Errorf("err = %v, want ErrRefreshRevoked", err)
+	}
+}
+
+func TestRefreshStore_Invalid(t *testing.T) {
+	s := NewRefreshStore()
+	if _, _, _, err := s.Renew("bogus", mintChild); !errors.Is(err, ErrRefreshInvalid) {
+		t.Errorf("err = %v, want ErrRefreshInvalid", err)
+	}
+}
+
+func TestRefreshStore_Expired(t *testing.T) {
+	s := NewRefreshStore()
+	g := testGrant()
+	g.RefreshTTL = -time.Second
+	cred, _, _ := s.Start(g, g.NewCapability())
+	if _, _, _, err := s.Renew(cred, mintChild); !errors.Is(err, ErrRefreshExpired) {
+		t.Errorf("err = %v, want ErrRefreshExpired", err)
+	}
+}
+
+func TestRefreshStore_MintFailureKeepsCredential(t *testing.T) {
+	s := NewRefreshStore()
+	_, cred := startFamily(t, s)
+	boom := errors.New("boom")
+	_, _, _, err := s.Renew(cred, func(RefreshGrant, *capability.Capability) (*capability.Capability, error) {
+		return nil, boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want mint error", err)
+	}
+	if _, _, _, err := s.Renew(cred, mintChild); err != nil {
+		t.Errorf("credential should survive a failed mint: %v", err)
+	}
+}
+
+func TestRefreshStore_StartPersistFailure(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenRefreshStore(filepath.Join(dir, "gone", "refresh.json"))
+	if err != nil {
+		t.Fatalf("OpenRefreshStore: %v", err)
+	}
+	g := testGrant()
+	cred, _, err := s.Start(g, g.NewCapability())
+	if err == nil || cred != "" {
+		t.Fatalf("Start = (%q, %v), want a persistence error and no credential", cred, err)
+	}
+	if len(s.families) != 0 || len(s.credentials) != 0 {
+		t.Error("a family that could not be persisted should be dropped")
+	}
+}
+
+func TestRefreshStore_PersistAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "refresh.json")
+	s, err := OpenRefreshStore(path)
+	if err != nil {
+		t.Fatalf("OpenRefreshStore: %v", err)
+	}
+	_, cred := startFamily(t, s)
+	_, next, _, err := s.Renew(cred, mintChild)
+	if err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+
+	reloaded, err := OpenRefreshStore(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if _, _, _, err := reloaded.Renew(next, mintChild); err != nil {
+		t.Errorf("credential should survive reload: %v", err)
+	}
+	// Reuse detection survives too.
+	var reuse *RefreshReuseError
+	if _, _, _, err := reloaded.Renew(cred, mintChild); !errors.As(err, &reuse) {
+		t.Errorf("err = %v, want *RefreshReuseError after reload", err)
+	}
+}
+
+func TestRefreshStore_Prune(t *testing.T) {
+	s := NewRefreshStore()
+	startFamily(t, s)
+	if err := s.Prune(time.Now()); err != nil || s.Len() != 1 {
+		t.Fatalf("live family pruned: Len=%d err=%v", s.Len(), err)
+	}
+	if err := s.Prune(time.Now().Add(2 * time.Hour)); err != nil || s.Len() != 0 {
+		t.Errorf("expired family kept: Len=%d err=%v", s.Len(), err)
+	}
+}
@@ -1,28 +1,317 @@
 package auth
 
-import "sync"
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
 
-// RevocationList is a thread-safe in-memory set of revoked capability IDs.
+	"github.com/Gao-OS/StrataOS/internal/atomicfile"
+	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/policy"
+)
+
+// Revocation records either a single revoked capability (CapID) or a
+// bulk revocation (Selector) matching every capability that satisfies it.
+// A zero ExpiresAt means the covered tokens' expiry is unknown, so the
+// entry is never pruned.
+type Revocation struct {
+	Seq       uint64    `json:"seq"`
+	CapID     string    `json:"cap_id,omitempty"`
+	Selector  *Selector `json:"selector,omitempty"`
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Selector is a revocation predicate (an epoch): it matches every
+// capability issued before IssuedBefore whose claims satisfy all of the
+// non-empty fields. Verifiers evaluate it against claims instead of
+// enumerating capability IDs.
+type Selector struct {
+	Service      string    `json:"service,omitempty"`
+	Subject      string    `json:"subject,omitempty"`
+	Right        string    `json:"right,omitempty"` // fully-qualified, e.g. "fs.read"
+	IssuedBefore time.Time `json:"issued_before"`
+}
+
+// Matches reports whether cap is covered by the selector.
+func (s *Selector) Matches(cap *capability.Capability) bool {
+	if !cap.IssuedAt.Before(s.IssuedBefore) {
+		return false
+	}
+	if s.Service != "" && cap.Service != s.Service {
+		return false
+	}
+	if s.Subject != "" && cap.Subject != s.Subject {
+		return false
+	}
+	// Wildcard rights and legacy actions count; a negated right does not.
+	if s.Right != "" && !policy.Grants(cap, s.Right) {
+		return false
+	}
+	return true
+}
+
+// revocationFile is the on-disk form of a RevocationList.
+type revocationFile struct {
+	Seq         uint64       `json:"seq"`
+	Revocations []Revocation `json:"revocations"`
+}
+
+// RevocationList is a thread-safe set of revoked capability IDs and bulk
+// revocation selectors.
+// Lists created with OpenRevocationList persist every change to disk;
+// lists from NewRevocationList are in-memory only.
 type RevocationList struct {
-	mu      sync.RWMutex
-	revoked map[string]struct{}
+	mu        sync.RWMutex
+	revoked   map[string]*Revocation // by capability ID
+	selectors []*Revocation          // bulk revocations, in sequence order
+	seq       uint64                 // last assigned sequence number
+	path      string                 // "" for in-memory lists
 }
 
 func NewRevocationList() *RevocationList {
 	return &RevocationList{
-		revoked: make(map[string]struct{}),
+		revoked: make(map[string]*Revocation),
+	}
+}
+
+// OpenRevocationList loads the list persisted at path, pruning entries
+// whose tokens have already expired. A missing file yields an empty list.
+func OpenRevocationList(path string) (*RevocationList, error) {
+	rl := NewRevocationList()
+	rl.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rl, nil
+		}
+		return nil, fmt.Errorf("read revocation list: %w", err)
+	}
+	var f revocationFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse revocation list: %w", err)
+	}
+	rl.seq = f.Seq
+	for i := range f.Revocations {
+		r := f.Revocations[i]
+		if r.Selector != nil {
+			rl.selectors = append(rl.selectors, &r)
+		} else {
+			rl.revoked[r.CapID] = &r
+		}
+		if r.Seq > rl.seq {
+			rl.seq = r.Seq
+		}
+	}
+	if _, err := rl.Prune(time.Now()); err != nil {
+		return nil, err
 	}
+	return rl, nil
 }
 
-func (rl *RevocationList) Revoke(tokenID string) {
+// Revoke revokes tokenID with unknown expiry; the entry is kept forever.
+func (rl *RevocationList) Revoke(tokenID string) error {
+	return rl.RevokeUntil(tokenID, time.Time{})
+}
+
+// RevokeUntil revokes tokenID, retaining the entry until expiresAt, after
+// which the token would be rejected as expired anyway. Revoking an already
+// revoked ID keeps its sequence number and only ever extends retention.
+func (rl *RevocationList) RevokeUntil(tokenID string, expiresAt time.Time) error {
+	_, err := rl.revokeUntil(tokenID, expiresAt)
+	return err
+}
+
+// revokeUntil implements RevokeUntil, also reporting whether tokenID was
+// newly revoked.
+func (rl *RevocationList) revokeUntil(tokenID string, expiresAt time.Time) (bool, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if r, ok := rl.revoked[tokenID]; ok {
+		if r.ExpiresAt.IsZero() || (!expiresAt.IsZero() && !expiresAt.After(r.ExpiresAt)) {
+			return false, nil
+		}
+		r.ExpiresAt = expiresAt
+		return false, rl.saveLocked()
+	}
+	rl.seq++
+	rl.revoked[tokenID] = &Revocation{
+		Seq:       rl.seq,
+		CapID:     tokenID,
+		RevokedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	return true, rl.saveLocked()
+}
+
+// RevokeMatching records a bulk revocation, retained until expiresAt (the
+// latest expiry of any token it can cover, or zero if unknown), and returns
+// the new entry.
+func (rl *RevocationList) RevokeMatching(sel Selector, expiresAt time.Time) (Revocation, error) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
-	rl.revoked[tokenID] = struct{}{}
+	rl.seq++
+	r := &Revocation{
+		Seq:       rl.seq,
+		Selector:  &sel,
+		RevokedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	rl.selectors = append(rl.selectors, r)
+	return *r, rl.saveLocked()
+}
+
+// Apply records an entry received from another list (a replica following
+// identity), keeping its selector but assigning a local sequence number.
+// It returns false if the entry was already present.
+func (rl *RevocationList) Apply(r Revocation) (bool, error) {
+	if r.Selector == nil {
+		return rl.revokeUntil(r.CapID, r.ExpiresAt)
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, existing := range rl.selectors {
+		if *existing.Selector == *r.Selector {
+			return false, nil
+		}
+	}
+	rl.seq++
+	sel := *r.Selector
+	rl.selectors = append(rl.selectors, &Revocation{
+		Seq:       rl.seq,
+		Selector:  &sel,
+		RevokedAt: r.RevokedAt,
+		ExpiresAt: r.ExpiresAt,
+	})
+	return true, rl.saveLocked()
 }
 
+// IsRevoked reports whether tokenID was revoked individually.
+// Verifiers holding claims should use Matches, which also applies
+// bulk revocations.
 func (rl *RevocationList) IsRevoked(tokenID string) bool {
 	rl.mu.RLock()
 	defer rl.mu.RUnlock()
 	_, ok := rl.revoked[tokenID]
 	return ok
 }
+
+// Matches reports whether cap is revoked, individually or by a selector.
+func (rl *RevocationList) Matches(cap *capability.Capability) bool {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	if _, ok := rl.revoked[cap.ID]; ok {
+		return true
+	}
+	for _, r := range rl.selectors {
+		if r.Selector.Matches(cap) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the revocation entry for tokenID, if any.
+func (rl *RevocationList) Get(tokenID string) (Revocation, bool) {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	r, ok := rl.revoked[tokenID]
+	if !ok {
+		return Revocation{}, false
+	}
+	return *r, true
+}
+
+// Seq returns the last assigned sequence number.
+func (rl *RevocationList) Seq() uint64 {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.seq
+}
+
+// Prune drops entries whose tokens expired before now and returns how many
+// were removed.
+func (rl *RevocationList) Prune(now time.Time) (int, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	n := 0
+	for id, r := range rl.revoked {
+		if !r.ExpiresAt.IsZero() && r.ExpiresAt.Before(now) {
+			delete(rl.revoked, id)
+			n++
+		}
+	}
+	kept := rl.selectors[:0]
+	for _, r := range rl.selectors {
+		if !r.ExpiresAt.IsZero() && r.ExpiresAt.Before(now) {
+			n++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	rl.selectors = kept
+	if n == 0 {
+		return 0, nil
+	}
+	return n, rl.saveLocked()
+}
+
+// List returns up to limit revocations with Seq greater than after, in
+// sequence order, and whether more remain. Pass the last returned Seq as
+// after to fetch the next page.
+func (rl *RevocationList) List(after uint64, limit int) ([]Revocation, bool) {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	out := make([]Revocation, 0, len(rl.revoked)+len(rl.selectors))
+	for _, r := range rl.all() {
+		if r.Seq > after {
+			out = append(out, *r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	if limit > 0 && len(out) > limit {
+		return out[:limit], true
+	}
+	return out, false
+}
+
+// Len returns the number of revocations currently held.
+func (rl *RevocationList) Len() int {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return len(rl.revoked) + len(rl.selectors)
+}
+
+// all returns every entry, individual and bulk. Caller must hold rl.mu.
+func (rl *RevocationList) all() []*Revocation {
+	out := make([]*Revocation, 0, len(rl.revoked)+len(rl.selectors))
+	for _, r := range rl.revoked {
+		out = append(out, r)
+	}
+	return append(out, rl.selectors...)
+}
+
+// saveLocked atomically rewrites the backing file. Caller must hold rl.mu.
+func (rl *RevocationList) saveLocked() error {
+	if rl.path == "" {
+		return nil
+	}
+	f := revocationFile{Seq: rl.seq, Revocations: make([]Revocation, 0, len(rl.revoked)+len(rl.selectors))}
+	for _, r := range rl.all() {
+		f.Revocations = append(f.Revocations, *r)
+	}
+	sort.Slice(f.Revocations, func(i, j int) bool { return f.Revocations[i].Seq < f.Revocations[j].Seq })
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("marshal revocation list: %w", err)
+	}
+
+	if err := atomicfile.Write(rl.path, data); err != nil {
+		return fmt.Errorf("persist revocation list: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// XChaCha20 and XChaCha20-Poly1305 (RFC 8439 and
+// draft-irtf-cfrg-xchacha), as required by PASETO v4.local and v2.local.
+// Tokens are small, so this favours clarity over speed.
+
+const (
+	chachaKeySize   = 32
+	xchachaNonceLen = 24
+	poly1305TagSize = 16
+)
+
+var errAEADOpen = errors.New("message authentication failed")
+
+// chachaQuarterRound mixes four words of the ChaCha state.
+func chachaQuarterRound(s *[16]uint32, a, b, c, d int) {
+	s[a] += s[b]
+	s[d] = bits.RotateLeft32(s[d]^s[a], 16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], 12)
+	s[a] += s[b]
+	s[d] = bits.RotateLeft32(s[d]^s[a], 8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], 7)
+}
+
+// chachaRounds applies the 20 ChaCha rounds to s in place.
+func chachaRounds(s *[16]uint32) {
+	for i := 0; i < 10; i++ {
+		chachaQuarterRound(s, 0, 4, 8, 12)
+		chachaQuarterRound(s, 1, 5, 9, 13)
+		chachaQuarterRound(s, 2, 6, 10, 14)
+		chachaQuarterRound(s, 3, 7, 11, 15)
+		chachaQuarterRound(s, 0, 5, 10, 15)
+		chachaQuarterRound(s, 1, 6, 11, 12)
+		chachaQuarterRound(s, 2, 7, 8, 13)
+		chachaQuarterRound(s, 3, 4, 9, 14)
+	}
+}
+
+// chachaInit builds the initial state from a key and four words of
+// counter/nonce input.
+func chachaInit(key []byte, in [4]uint32) [16]uint32 {
+	s := [16]uint32{0x61707865, 0x3320646e, 0x79622d32, 0x6b206574}
+	for i := 0; i < 8; i++ {
+		s[4+i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	copy(s[12:], in[:])
+	return s
+}
+
+// hchacha20 derives a subkey from key and a 16-byte nonce.
+func hchacha20(key, nonce []byte) []byte {
+	var in [4]uint32
+	for i := range in {
+		in[i] = binary.LittleEndian.Uint32(nonce[i*4:])
+	}
+	s := chachaInit(key, in)
+	chachaRounds(&s)
+	out := make([]byte, chachaKeySize)
+	for i, w := range append(s[0:4:4], s[12:16]...) {
+		binary.LittleEndian.PutUint32(out[i*4:], w)
+	}
+	return out
+}
+
+// chacha20XOR XORs src with the IETF ChaCha20 keystream (96-bit nonce)
+// starting at block counter.
+func chacha20XOR(key, nonce []byte, counter uint32, src []byte) []byte {
+	dst := make([]byte, len(src))
+	var block [64]byte
+	for off := 0; off < len(src); off += 64 {
+		in := [4]uint32{
+			counter,
+			binary.LittleEndian.Uint32(nonce[0:]),
+			binary.LittleEndian.Uint32(nonce[4:]),
+			binary.LittleEndian.Uint32(nonce[8:]),
+		}
+		s := chachaInit(key, in)
+		init := s
+		chachaRounds(&s)
+		for i := range s {
+			binary.LittleEndian.PutUint32(block[i*4:], s[i]+init[i])
+		}
+		end := off + 64
+		if end > len(src) {
+			end = len(src)
+		}
+		for i := off; i < end; i++ {
+			dst[i] = src[i] ^ block[i-off]
+		}
+		counter++
+	}
+	return dst
+}
+
+// xchachaKey splits a 24-byte XChaCha nonce into the derived subkey and
+// the 12-byte IETF nonce used with it.
+func xchachaKey(key, nonce []byte) ([]byte, []byte) {
+	subNonce := make([]byte, 12)
+	copy(subNonce[4:], nonce[16:24])
+	return hchacha20(key, nonce[:16]), subNonce
+}
+
+// xchacha20XOR XORs src with the XChaCha20 keystream from block 0.
+func xchacha20XOR(key, nonce, src []byte) []byte {
+	subKey, subNonce := xchachaKey(key, nonce)
+	return chacha20XOR(subKey, subNonce, 0, src)
+}
+
+// xchachaPolySeal encrypts and authenticates plaintext with
+// XChaCha20-Poly1305, returning ciphertext||tag.
+func xchachaPolySeal(key, nonce, plaintext, aad []byte) []byte {
+	subKey, subNonce := xchachaKey(key, nonce)
+	polyKey := chacha20XOR(subKey, subNonce, 0, make([]byte, 32))
+	ct := chacha20XOR(subKey, subNonce, 1, plaintext)
+	tag := poly1305Sum(aeadMACData(aad, ct), polyKey)
+	return append(ct, tag[:]...)
+}
+
+// xchachaPolyOpen verifies and decrypts ciphertext||tag.
+func xchachaPolyOpen(key, nonce, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < poly1305TagSize {
+		return nil, errAEADOpen
+	}
+	ct, tag := sealed[:len(sealed)-poly1305TagSize], sealed[len(sealed)-poly1305TagSize:]
+	subKey, subNonce := xchachaKey(key, nonce)
+	polyKey := chacha20XOR(subKey, subNonce, 0, make([]byte, 32))
+	want := poly1305Sum(aeadMACData(aad, ct), polyKey)
+	if subtle.ConstantTimeCompare(tag, want[:]) != 1 {
+		return nil, errAEADOpen
+	}
+	return chacha20XOR(subKey, subNonce, 1, ct), nil
+}
+
+// aeadMACData lays out the Poly1305 input per RFC 8439 section 2.8.
+func aeadMACData(aad, ct []byte) []byte {
+	pad := func(b []byte) []byte {
+		if r := len(b) % 16; r != 0 {
+			b = append(b, make([]byte, 16-r)...)
+		}
+		return b
+	}
+	var data []byte
+	data = pad(append(data, aad...))
+	data = pad(append(data, ct...))
+	var lens [16]byte
+	binary.LittleEndian.PutUint64(lens[0:], uint64(len(aad)))
+	binary.LittleEndian.PutUint64(lens[8:], uint64(len(ct)))
+	return append(data, lens[:]...)
+}
+
+// poly1305Sum computes the Poly1305 one-time authenticator of msg with a
+// 32-byte key, using 26-bit limbs.
+func poly1305Sum(msg, key []byte) [poly1305TagSize]byte {
+	const mask = 0x3ffffff
+	r0 := uint64(binary.LittleEndian.Uint32(key[0:])) & 0x3ffffff
+	r1 := uint64(binary.LittleEndian.Uint32(key[3:])>>2) & 0x3ffff03
+	r2 := uint64(binary.LittleEndian.Uint32(key[6:])>>4) & 0x3ffc0ff
+	r3 := uint64(binary.LittleEndian.Uint32(key[9:])>>6) & 0x3f03fff
+	r4 := uint64(binary.LittleEndian.Uint32(key[12:])>>8) & 0x00fffff
+	s1, s2, s3, s4 := r1*5, r2*5, r3*5, r4*5
+
+	var h0, h1, h2, h3, h4 uint64
+	for len(msg) > 0 {
+		var block [16]byte
+		n := copy(block[:16], msg)
+		msg = msg[n:]
+		hibit := uint64(1 << 24)
+		if n < 16 {
+			block[n] = 1
+			hibit = 0
+		}
+		h0 += uint64(binary.LittleEndian.Uint32(block[0:])) & mask
+		h1 += uint64(binary.LittleEndian.Uint32(block[3:])>>2) & mask
+		h2 += uint64(binary.LittleEndian.Uint32(block[6:])>>4) & mask
+		h3 += uint64(binary.LittleEndian.Uint32(block[9:])>>6) & mask
+		h4 += uint64(binary.LittleEndian.Uint32(block[12:])>>8) | hibit
+
+		d0 := h0*r0 + h1*s4 + h2*s3 + h3*s2 + h4*s1
+		d1 := h0*r1 + h1*r0 + h2*s4 + h3*s3 + h4*s2
+		d2 := h0*r2 + h1*r1 + h2*r0 + h3*s4 + h4*s3
+		d3 := h0*r3 + h1*r2 + h2*r1 + h3*r0 + h4*s4
+		d4 := h0*r4 + h1*r3 + h2*r2 + h3*r1 + h4*r0
+
+		c := d0 >> 26
+		h0 = d0 & mask
+		d1 += c
+		c = d1 >> 26
+		h1 = d1 & mask
+		d2 += c
+		c = d2 >> 26
+		h2 = d2 & mask
+		d3 += c
+		c = d3 >> 26
+		h3 = d3 & mask
+		d4 += c
+		c = d4 >> 26
+		h4 = d4 & mask
+		h0 += c * 5
+		c = h0 >> 26
+		h0 &= mask
+		h1 += c
+	}
+
+	// Fully carry h.
+	c := h1 >> 26
+	h1 &= mask
+	h2 += c
+	c = h2 >> 26
+	h2 &= mask
+	h3 += c
+	c = h3 >> 26
+	h3 &= mask
+	h4 += c
+	c = h4 >> 26
+	h4 &= mask
+	h0 += c * 5
+	c = h0 >> 26
+	h0 &= mask
+	h1 += c
+
+	// Compute h - p and select it if non-negative.
+	g0 := h0 + 5
+	c = g0 >> 26
+	g0 &= mask
+	g1 := h1 + c
+	c = g1 >> 26
+	g1 &= mask
+	g2 := h2 + c
+	c = g2 >> 26
+	g2 &= mask
+	g3 := h3 + c
+	c = g3 >> 26
+	g3 &= mask
+	g4 := h4 + c - (1 << 26)
+
+	sel := (g4 >> 63) - 1 // all ones if h >= p
+	h0 = (h0 &^ sel) | (g0 & sel)
+	h1 = (h1 &^ sel) | (g1 & sel)
+	h2 = (h2 &^ sel) | (g2 & sel)
+	h3 = (h3 &^ sel) | (g3 & sel)
+	h4 = (h4 &^ sel) | (g4 & sel)
+
+	// h mod 2^128, plus s.
+	w0 := (h0 | h1<<26) & 0xffffffff
+	w1 := (h1>>6 | h2<<20) & 0xffffffff
+	w2 := (h2>>12 | h3<<14) & 0xffffffff
+	w3 := (h3>>18 | h4<<8) & 0xffffffff
+
+	f := w0 + uint64(binary.LittleEndian.Uint32(key[16:]))
+	w0 = f & 0xffffffff
+	f = w1 + uint64(binary.LittleEndian.Uint32(key[20:])) + f>>32
+	w1 = f & 0xffffffff
+	f = w2 + uint64(binary.LittleEndian.Uint32(key[24:])) + f>>32
+	w2 = f & 0xffffffff
+	f = w3 + uint64(binary.LittleEndian.Uint32(key[28:])) + f>>32
+	w3 = f & 0xffffffff
+
+	var tag [poly1305TagSize]byte
+	binary.LittleEndian.PutUint32(tag[0:], uint32(w0))
+	binary.LittleEndian.PutUint32(tag[4:], uint32(w1))
+	binary.LittleEndian.PutUint32(tag[8:], uint32(w2))
+	binary.LittleEndian.PutUint32(tag[12:], uint32(w3))
+	return tag
+}
@@ -5,6 +5,10 @@ package capability
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"time"
 )
 
@@ -18,12 +22,171 @@ type Capability struct {
 	Actions     []string    `json:"actions"`
 	Rights      []string    `json:"rights,omitempty"`
 	Constraints Constraints `json:"constraints"`
+	Parent      string      `json:"parent,omitempty"` // jti this capability was derived from
+	Confirm     *Confirm    `json:"cnf,omitempty"`    // proof-of-possession binding; nil for bearer tokens
+	// Attrs are attributes of the subject, e.g. {"clearance": ["pii"]},
+	// matched against the labels of the resources it accesses.
+	Attrs map[string][]string `json:"attrs,omitempty"`
+}
+
+// Confirm binds a token to its holder. A bound token is honoured only
+// when presented by a process running as UID, and/or with a per-request
+// proof signed by the private half of Key.
+type Confirm struct {
+	UID *int   `json:"uid,omitempty"`
+	Key string `json:"key,omitempty"` // base64 ed25519 public key
 }
 
 // Constraints limits what a capability token may access.
 type Constraints struct {
 	PathPrefix string `json:"path_prefix,omitempty"`
 	RateLimit  string `json:"rate_limit,omitempty"`
+	// RateLimits holds further rate limits for the methods matching each
+	// right pattern, e.g. {"fs.read": "200rps, 8MiBps"}.
+	RateLimits map[string]string `json:"rate_limits,omitempty"`
+	MaxUses    int               `json:"max_uses,omitempty"` // authorized requests allowed in total; 0 = unlimited
+	OneShot    bool              `json:"one_shot,omitempty"` // revoke once the uses are spent
+	Schedule   *Schedule         `json:"schedule,omitempty"` // when the capability may be used; nil = always
+	Quotas     map[string]Quota  `json:"quotas,omitempty"`   // data volume quotas by name, e.g. "bytes_read"
+	// Paths lists the directory trees the capability may reach, in place
+	// of a single PathPrefix.
+	Paths []PathRoot `json:"paths,omitempty"`
+	// MaxFileSize caps the size, in bytes, writes may grow a file to;
+	// 0 = unlimited.
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+	// CreatePerm holds the permission bits, in octal ("0640"), files the
+	// capability creates may have at most.
+	CreatePerm string `json:"create_perm,omitempty"`
+
+	// Ext holds constraints defined outside this package (e.g. by a
+	// service), by name. They are encoded alongside the built-in ones.
+	Ext map[string]json.RawMessage `json:"-"`
+}
+
+// builtinConstraints lists the JSON names of Constraints' own fields.
+var builtinConstraints = func() map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(Constraints{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}()
+
+// IsBuiltinConstraint reports whether name is one of Constraints' fields
+// rather than an extension.
+func IsBuiltinConstraint(name string) bool {
+	return builtinConstraints[name]
+}
+
+// plainConstraints has Constraints' fields without its JSON methods.
+type plainConstraints Constraints
+
+// MarshalJSON encodes the built-in constraints and Ext as one flat object.
+func (c Constraints) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(plainConstraints(c))
+	if err != nil || len(c.Ext) == 0 {
+		return data, err
+	}
+	all := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for name, v := range c.Ext {
+		if !builtinConstraints[name] {
+			all[name] = v
+		}
+	}
+	return json.Marshal(all)
+}
+
+// UnmarshalJSON decodes the built-in constraints and collects any others
+// into Ext.
+func (c *Constraints) UnmarshalJSON(data []byte) error {
+	var p plainConstraints
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for name, v := range all {
+		if !builtinConstraints[name] {
+			if p.Ext == nil {
+				p.Ext = make(map[string]json.RawMessage)
+			}
+			p.Ext[name] = v
+		}
+	}
+	*c = Constraints(p)
+	return nil
+}
+
+// Set returns every constraint that is set, built-in or extension, by name.
+func (c Constraints) Set() (map[string]json.RawMessage, error) {
+	data, err := c.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// Quota caps how much of something a capability may consume per Window
+// ("hour", "day" or "lifetime", the default).
+type Quota struct {
+	Limit  int64  `json:"limit"`
+	Window string `json:"window,omitempty"`
+}
+
+// PathRoot is a directory tree a capability may reach. Request paths name
+// it by Name as their first component; the rest is relative to Root.
+type PathRoot struct {
+	Name  string   `json:"name,omitempty"`  // defaults to the base name of Root
+	Root  string   `json:"root"`            // absolute
+	Allow []string `json:"allow,omitempty"` // globs under Root; none allows everything
+	Deny  []string `json:"deny,omitempty"`  // globs under Root, winning over Allow
+	Mode  string   `json:"mode,omitempty"`  // "ro", or "rw" (the default)
+}
+
+// RootName returns the name requests address the root by.
+func (r PathRoot) RootName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return filepath.Base(r.Root)
+}
+
+// Schedule limits a capability to recurring windows of the week, minus
+// blackout periods. With no windows, any time outside a blackout is allowed.
+type Schedule struct {
+	TZ        string     `json:"tz,omitempty"` // IANA time zone of the windows; default UTC
+	Windows   []Window   `json:"windows,omitempty"`
+	Blackouts []Blackout `json:"blackouts,omitempty"`
+}
+
+// Window is a daily time range on some weekdays. Start and End are "HH:MM"
+// in the schedule's time zone; End is exclusive and may be "24:00". A window
+// whose End is not after its Start runs past midnight into the next day.
+type Window struct {
+	Days  []string `json:"days,omitempty"` // "mon".."sun"; empty = every day
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// Blackout is a period, such as a maintenance window, during which the
+// capability is denied regardless of its windows.
+type Blackout struct {
+	From   time.Time `json:"from"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
 }
 
 // NewCapability creates a capability with a random ID and the given parameters.
@@ -1,6 +1,8 @@
 package capability
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 )
@@ -82,3 +84,62 @@ func TestConstraints_ZeroValue(t *testing.T) {
 		t.Errorf("RateLimit should be empty, got %q", c.RateLimit)
 	}
 }
+
+func TestConfirm_OmittedForBearerTokens(t *testing.T) {
+	cap := NewCapability("fs", []string{"read"}, Constraints{}, time.Hour)
+	data, err := json.Marshal(cap)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if strings.Contains(string(data), `"cnf"`) {
+		t.Errorf("unbound capability should not carry cnf: %s", data)
+	}
+}
+
+func TestConstraints_ExtRoundTrip(t *testing.T) {
+	c := Constraints{
+		PathPrefix: "/srv",
+		Ext:        map[string]json.RawMessage{"kv_prefix": json.RawMessage(`"app/"`)},
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if string(data) != `{"kv_prefix":"app/","path_prefix":"/srv"}` {
+		t.Errorf("encoded = %s; extensions should sit beside built-ins", data)
+	}
+
+	var got Constraints
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got.PathPrefix != "/srv" || string(got.Ext["kv_prefix"]) != `"app/"` || len(got.Ext) != 1 {
+		t.Errorf("decoded = %+v", got)
+	}
+
+	set, _ := got.Set()
+	if len(set) != 2 {
+		t.Errorf("Set = %v, want path_prefix and kv_prefix", set)
+	}
+}
+
+func TestConstraints_ExtCannotShadowBuiltin(t *testing.T) {
+	c := Constraints{PathPrefix: "/srv", Ext: map[string]json.RawMessage{"path_prefix": json.RawMessage(`"/"`)}}
+	data, _ := json.Marshal(c)
+	if !strings.Contains(string(data), `"path_prefix":"/srv"`) {
+		t.Errorf("encoded = %s; built-in field must win", data)
+	}
+	if !IsBuiltinConstraint("max_uses") || IsBuiltinConstraint("kv_prefix") {
+		t.Error("IsBuiltinConstraint misclassifies")
+	}
+}
+
+func TestConstraints_NoExtDecodesNil(t *testing.T) {
+	var c Constraints
+	if err := json.Unmarshal([]byte(`{"rate_limit":"5rps"}`), &c); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if c.Ext != nil || c.RateLimit != "5rps" {
+		t.Errorf("decoded = %+v", c)
+	}
+}
@@ -0,0 +1,246 @@
+// Package confine opens files beneath a directory such that no path,
+// symlink or concurrent rename can reach outside it. On Linux the kernel
+// enforces this with openat2(RESOLVE_BENEATH); older kernels, and opens
+// that keep racing renames, fall back to resolving one component at a time
+// relative to directory descriptors.
+//
+// Hard links are not symlinks: a hard link inside the root to a file
+// outside it is the same file, and opening it is allowed. Keep untrusted
+// writers from creating them (fs.protected_hardlinks) if that matters.
+package confine
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// ErrEscape is returned, wrapped in an *os.PathError, for paths that would
+// resolve outside the root: absolute paths, ".." above it, and symlinks
+// leading out of it.
+var ErrEscape = errors.New("path escapes root")
+
+// ErrChanged is returned, wrapped in an *os.PathError, by OpenRealPath when
+// the path it is given now leads through a symlink: the tree changed since
+// RealPath resolved it.
+var ErrChanged = errors.New("path changed since it was resolved")
+
+// Root is a directory that paths are resolved beneath. It holds the
+// directory open, so renaming or replacing the directory's path afterwards
+// does not move the root.
+type Root struct {
+	dir  *os.File
+	name string
+}
+
+// OpenRoot opens the directory name as a root.
+func OpenRoot(name string) (*Root, error) {
+	dir, err := openDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Root{dir: dir, name: name}, nil
+}
+
+// Name returns the name the root was opened with.
+func (r *Root) Name() string {
+	return r.name
+}
+
+// Close closes the root. Files opened through it stay open.
+func (r *Root) Close() error {
+	return r.dir.Close()
+}
+
+// Open opens the named file beneath the root for reading.
+func (r *Root) Open(name string) (*os.File, error) {
+	return r.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file beneath the root with flag and, when
+// creating it, perm. Errors are *os.PathErrors naming name, never the
+// root's own path.
+func (r *Root) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return r.openFile(name, flag, perm)
+}
+
+// Lstat returns the named file's info without following a final symlink.
+func (r *Root) Lstat(name string) (os.FileInfo, error) {
+	return r.lstat(name)
+}
+
+// Stat returns the named file's info, following symlinks beneath the root.
+func (r *Root) Stat(name string) (os.FileInfo, error) {
+	return r.stat(name)
+}
+
+// Mkdir creates the named directory with perm.
+func (r *Root) Mkdir(name string, perm os.FileMode) error {
+	return r.mkdir(name, perm)
+}
+
+// Remove removes the named file or empty directory. A final symlink is
+// removed, not followed.
+func (r *Root) Remove(name string) error {
+	return r.remove(name)
+}
+
+// RemoveAll removes the named file or directory and everything beneath
+// it. Symlinks inside are removed, never followed. Unlike os.RemoveAll, a
+// name that does not exist is an error.
+func (r *Root) RemoveAll(name string) error {
+	return r.removeAll(name)
+}
+
+// Rename renames oldname beneath r to newname beneath dst, which may be r
+// itself. Neither final component is followed.
+func (r *Root) Rename(oldname string, dst *Root, newname string) error {
+	return r.rename(oldname, dst, newname)
+}
+
+// Symlink creates name as a symlink to target. The target must be relative
+// and, taken from name's directory, stay beneath the root as written;
+// others fail with ErrEscape. Opens through the link are confined anyway,
+// but a link out of the root would mislead anything else following it.
+func (r *Root) Symlink(target, name string) error {
+	clean := path.Clean(name)
+	to := path.Join(path.Dir(clean), target)
+	if target == "" || path.IsAbs(target) || to == ".." || strings.HasPrefix(to, "../") {
+		return &os.PathError{Op: "symlink", Path: name, Err: ErrEscape}
+	}
+	return r.symlink(target, name)
+}
+
+// split returns the directory holding name and name's last component, for
+// operations on the entry itself. The root has no such entry.
+func split(name string) (dir, base string, err error) {
+	clean := path.Clean(name)
+	dir, base = path.Split(clean)
+	switch {
+	case clean == ".":
+		return "", "", syscall.EINVAL
+	case base == "..", strings.HasPrefix(clean, "/"):
+		return "", "", ErrEscape
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return dir, base, nil
+}
+
+// named wraps err, stripped of any host path, in an *os.PathError naming
+// name.
+func named(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var pe *os.PathError
+	var le *os.LinkError
+	switch {
+	case errors.As(err, &pe):
+		err = pe.Err
+	case errors.As(err, &le):
+		err = le.Err
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// ReadDir returns the info of the entries of the named directory, sorted by
+// name, as Lstat reports them. Entries removed while it reads are skipped.
+func (r *Root) ReadDir(name string) ([]os.FileInfo, error) {
+	dir, err := r.openFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, n := range names {
+		info, err := r.lstat(path.Join(name, n))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// RealPath returns the absolute host path name resolves to beneath the
+// root, with symlinks followed as OpenFile follows them; with follow false
+// a final symlink is not followed, for operations on the entry itself. A
+// name that does not exist yet resolves to its directory's real path
+// joined with its last component. The root's own path is resolved too,
+// so the result names the file a rule on its real location covers.
+// Errors are as OpenFile's.
+func (r *Root) RealPath(name string, follow bool) (string, error) {
+	real, err := r.realPath(name, follow)
+	if errors.Is(err, os.ErrNotExist) {
+		dir, base, serr := split(name)
+		if serr != nil {
+			return "", err
+		}
+		if real, err = r.realPath(dir, true); err != nil {
+			return "", named("realpath", name, err)
+		}
+		real = filepath.Join(real, base)
+	}
+	if err != nil {
+		return "", err
+	}
+	return r.rebase("realpath", name, real)
+}
+
+// FilePath returns the absolute host path the file f, opened beneath the
+// root, actually resolved to, as RealPath would name it.
+func (r *Root) FilePath(f *os.File) (string, error) {
+	real, err := filePath(f)
+	if err != nil {
+		return "", named("realpath", f.Name(), err)
+	}
+	return r.rebase("realpath", f.Name(), real)
+}
+
+// OpenRealPath opens the file at real, a host path RealPath returned, as
+// OpenFile would but following no symlink, so that one swapped in since
+// RealPath resolved it fails with ErrChanged rather than redirect the open.
+func (r *Root) OpenRealPath(real string, flag int, perm os.FileMode) (*os.File, error) {
+	base, err := filePath(r.dir)
+	if err != nil {
+		return nil, named("open", filepath.Base(real), err)
+	}
+	rel, err := filepath.Rel(base, real)
+	if err != nil || !filepath.IsLocal(rel) && rel != "." {
+		return nil, &os.PathError{Op: "open", Path: filepath.Base(real), Err: ErrEscape}
+	}
+	f, err := r.openNoSymlinks(rel, flag, perm)
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, &os.PathError{Op: "open", Path: rel, Err: ErrChanged}
+	}
+	return f, err
+}
+
+// rebase re-roots the real path of name onto the root's real path, as
+// the open directory resolves now.
+func (r *Root) rebase(op, name, real string) (string, error) {
+	dir, err := filePath(r.dir)
+	if err != nil {
+		return "", named(op, name, err)
+	}
+	rel, err := filepath.Rel(dir, real)
+	if err != nil || !filepath.IsLocal(rel) && rel != "." {
+		// The root itself moved, or the file left it.
+		return "", &os.PathError{Op: op, Path: name, Err: ErrEscape}
+	}
+	return filepath.Join(dir, rel), nil
+}
@@ -0,0 +1,428 @@
+//go:build linux
+
+package confine
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Not in package syscall. sysOpenat2, which differs by architecture, is
+// in the sysnum files.
+const (
+	oPath               = 0x200000
+	atRemovedir         = 0x200
+	resolveNoMagiclinks = 0x02
+	resolveNoSymlinks   = 0x04
+	resolveBeneath      = 0x08
+)
+
+// openHow is the kernel's struct open_how.
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+// noOpenat2 is set once openat2 turns out to be missing (Linux before 5.6,
+// or filtered out by a seccomp profile); paths are then resolved by walk.
+var noOpenat2 atomic.Bool
+
+// maxOpenat2Retries bounds the retries openat2 asks for while renames race
+// with resolving ".."; past it, open falls back to walk, which does not
+// depend on the rename sequence counters that keep failing.
+const maxOpenat2Retries = 16
+
+// maxSymlinks bounds the symlinks walk follows resolving one path, as the
+// kernel does.
+const maxSymlinks = 40
+
+func openDir(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+}
+
+func (r *Root) openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return r.open(name, flag, perm, true)
+}
+
+func (r *Root) openNoSymlinks(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return r.open(name, flag, perm, false)
+}
+
+// open opens name beneath the root, following symlinks within it only if
+// symlinks is set; otherwise any symlink fails with ELOOP.
+func (r *Root) open(name string, flag int, perm os.FileMode, symlinks bool) (*os.File, error) {
+	dirfd := int(r.dir.Fd())
+	var fd int
+	var err error
+	if !noOpenat2.Load() {
+		fd, err = openat2(dirfd, name, flag, perm, symlinks)
+		if err == syscall.ENOSYS {
+			noOpenat2.Store(true)
+		}
+	}
+	if noOpenat2.Load() || err == syscall.EAGAIN {
+		fd, err = walk(dirfd, name, flag, perm, symlinks)
+	}
+	if err == syscall.EXDEV {
+		err = ErrEscape
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func (r *Root) lstat(name string) (os.FileInfo, error) {
+	f, err := r.openFile(name, oPath|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		err.(*os.PathError).Op = "lstat"
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (r *Root) stat(name string) (os.FileInfo, error) {
+	f, err := r.openFile(name, oPath, 0)
+	if err != nil {
+		err.(*os.PathError).Op = "stat"
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (r *Root) realPath(name string, follow bool) (string, error) {
+	flag := oPath
+	if !follow {
+		flag |= syscall.O_NOFOLLOW
+	}
+	f, err := r.openFile(name, flag, 0)
+	if err != nil {
+		err.(*os.PathError).Op = "realpath"
+		return "", err
+	}
+	defer f.Close()
+	real, err := filePath(f)
+	return real, named("realpath", name, err)
+}
+
+// filePath reads the path of f's descriptor back from /proc, which names
+// what the descriptor refers to rather than how it was opened.
+func filePath(f *os.File) (string, error) {
+	return os.Readlink("/proc/self/fd/" + strconv.Itoa(int(f.Fd())))
+}
+
+// parent opens the directory holding name and returns it with name's
+// last component, on which the *at calls below act without following it.
+func (r *Root) parent(op, name string) (*os.File, string, error) {
+	dir, base, err := split(name)
+	if err != nil {
+		return nil, "", named(op, name, err)
+	}
+	d, err := r.openFile(dir, oPath|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, "", named(op, name, err)
+	}
+	return d, base, nil
+}
+
+func (r *Root) mkdir(name string, perm os.FileMode) error {
+	d, base, err := r.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return named("mkdir", name, syscall.Mkdirat(int(d.Fd()), base, uint32(perm.Perm())))
+}
+
+func (r *Root) remove(name string) error {
+	d, base, err := r.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	err = unlinkat(int(d.Fd()), base, 0)
+	if err == syscall.EISDIR {
+		err = unlinkat(int(d.Fd()), base, atRemovedir)
+	}
+	return named("remove", name, err)
+}
+
+func (r *Root) removeAll(name string) error {
+	d, base, err := r.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return named("remove", name, removeAll(int(d.Fd()), base))
+}
+
+// removeAll removes name in dirfd and, if it is a directory, its entries,
+// each relative to its own directory's descriptor.
+func removeAll(dirfd int, name string) error {
+	err := unlinkat(dirfd, name, 0)
+	if err != syscall.EISDIR {
+		return err
+	}
+	fd, err := openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	names, err := dir.Readdirnames(-1)
+	for _, n := range names {
+		if err != nil {
+			break
+		}
+		if err = removeAll(fd, n); err == syscall.ENOENT {
+			err = nil
+		}
+	}
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	return unlinkat(dirfd, name, atRemovedir)
+}
+
+func (r *Root) rename(oldname string, dst *Root, newname string) error {
+	from, oldbase, err := r.parent("rename", oldname)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	to, newbase, err := dst.parent("rename", newname)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+	return named("rename", oldname, syscall.Renameat(int(from.Fd()), oldbase, int(to.Fd()), newbase))
+}
+
+func (r *Root) symlink(target, name string) error {
+	d, base, err := r.parent("symlink", name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return named("symlink", name, symlinkat(target, int(d.Fd()), base))
+}
+
+// openat2 opens name beneath dirfd, letting the kernel refuse any
+// resolution that leaves it, including through "/proc/self/fd"-style magic
+// links.
+func openat2(dirfd int, name string, flag int, perm os.FileMode, symlinks bool) (int, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return -1, err
+	}
+	how := openHow{
+		flags:   uint64(flag | syscall.O_CLOEXEC),
+		resolve: resolveBeneath | resolveNoMagiclinks,
+	}
+	if !symlinks {
+		how.resolve |= resolveNoSymlinks
+	}
+	if flag&os.O_CREATE != 0 {
+		how.mode = uint64(perm.Perm())
+	}
+	for retries := 0; ; {
+		fd, _, errno := syscall.Syscall6(sysOpenat2, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+			uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+		switch errno {
+		case 0:
+			return int(fd), nil
+		case syscall.EINTR:
+			continue
+		case syscall.EAGAIN:
+			// A rename raced with resolving ".."; the kernel asks for a
+			// retry rather than risk an escape. Renames that keep racing
+			// get EAGAIN back, for the caller to resolve another way.
+			if retries++; retries < maxOpenat2Retries {
+				continue
+			}
+		}
+		return -1, errno
+	}
+}
+
+// walk resolves name beneath dirfd one component at a time, opening each
+// directory relative to the last with O_NOFOLLOW and splicing in symlink
+// targets itself, so that neither a symlink nor a concurrent rename leads
+// out of dirfd. Without symlinks, any symlink fails with ELOOP instead.
+// Errors are errnos; EXDEV means an escape, as with openat2.
+func walk(dirfd int, name string, flag int, perm os.FileMode, symlinks bool) (int, error) {
+	if strings.HasPrefix(name, "/") {
+		return -1, syscall.EXDEV
+	}
+	root, err := openat(dirfd, ".", oPath|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return -1, err
+	}
+	// dirs[i] is the directory i components down; ".." pops one.
+	dirs := []int{root}
+	defer func() {
+		for _, fd := range dirs {
+			syscall.Close(fd)
+		}
+	}()
+
+	parts := strings.Split(name, "/")
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(dirs) == 1 {
+				return -1, syscall.EXDEV
+			}
+			syscall.Close(dirs[len(dirs)-1])
+			dirs = dirs[:len(dirs)-1]
+			continue
+		}
+
+		dir := dirs[len(dirs)-1]
+		if !lastPart(parts) {
+			fd, err := openat(dir, part, oPath|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+			if err == nil {
+				dirs = append(dirs, fd)
+				continue
+			}
+			if err != syscall.ENOTDIR && err != syscall.ELOOP {
+				return -1, err
+			}
+			if !symlinks {
+				return -1, refuseLink(dir, part, err)
+			}
+			if parts, err = splice(dir, part, parts, &links); err != nil {
+				return -1, err
+			}
+			continue
+		}
+
+		fd, err := openat(dir, part, flag|syscall.O_NOFOLLOW, perm)
+		if err == nil && flag&oPath != 0 && flag&syscall.O_NOFOLLOW == 0 {
+			// O_PATH|O_NOFOLLOW opens a final symlink itself rather than
+			// failing; follow it, or refuse it, as openat2 would.
+			var st syscall.Stat_t
+			if err = syscall.Fstat(fd, &st); err != nil || st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+				syscall.Close(fd)
+				if err != nil {
+					return -1, err
+				}
+				err = syscall.ELOOP
+			}
+		}
+		if err == nil {
+			return fd, nil
+		}
+		// O_NOFOLLOW fails a final symlink with ELOOP (ENOTDIR with
+		// O_DIRECTORY); follow it unless the caller asked not to.
+		if flag&syscall.O_NOFOLLOW != 0 || err != syscall.ENOTDIR && err != syscall.ELOOP {
+			return -1, err
+		}
+		if !symlinks {
+			return -1, refuseLink(dir, part, err)
+		}
+		if parts, err = splice(dir, part, parts, &links); err != nil {
+			return -1, err
+		}
+	}
+	// name resolved to a directory already open, such as the root itself.
+	return openat(dirs[len(dirs)-1], ".", flag, perm)
+}
+
+// lastPart reports whether parts holds no further components to resolve.
+func lastPart(parts []string) bool {
+	for _, p := range parts {
+		if p != "" && p != "." {
+			return false
+		}
+	}
+	return true
+}
+
+// refuseLink returns ELOOP if part of dir, which failed to open with err,
+// is a symlink the caller will not follow, and err otherwise.
+func refuseLink(dir int, part string, err error) error {
+	if _, lerr := readlinkat(dir, part); lerr == nil {
+		return syscall.ELOOP
+	}
+	return err
+}
+
+// splice replaces the symlink part of dir with its target at the front of
+// the remaining parts. A part that is not a symlink yields ENOTDIR.
+func splice(dir int, part string, parts []string, links *int) ([]string, error) {
+	target, err := readlinkat(dir, part)
+	if err != nil {
+		return nil, syscall.ENOTDIR
+	}
+	if *links++; *links > maxSymlinks {
+		return nil, syscall.ELOOP
+	}
+	if strings.HasPrefix(target, "/") {
+		return nil, syscall.EXDEV
+	}
+	return append(strings.Split(target, "/"), parts...), nil
+}
+
+func openat(dirfd int, name string, flag int, perm os.FileMode) (int, error) {
+	for {
+		fd, err := syscall.Openat(dirfd, name, flag|syscall.O_CLOEXEC, uint32(perm.Perm()))
+		if err != syscall.EINTR {
+			return fd, err
+		}
+	}
+}
+
+func readlinkat(dirfd int, name string) (string, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, syscall.PathMax)
+	n, _, errno := syscall.Syscall6(syscall.SYS_READLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+	if errno != 0 {
+		return "", errno
+	}
+	return string(buf[:n]), nil
+}
+
+func unlinkat(dirfd int, name string, flags int) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(flags))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func symlinkat(target string, dirfd int, name string) error {
+	t, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(t)), uintptr(dirfd), uintptr(unsafe.Pointer(p)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
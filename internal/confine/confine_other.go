@@ -0,0 +1,163 @@
+//go:build !linux
+
+package confine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Outside Linux paths are checked component by component and then opened
+// by name, which a concurrent rename can race. Symlinks are refused.
+
+func openDir(name string) (*os.File, error) {
+	return os.Open(name)
+}
+
+func (r *Root) openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	full, err := r.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	f, err := os.OpenFile(full, flag, perm)
+	if err != nil {
+		return nil, named("open", name, err)
+	}
+	return f, nil
+}
+
+// openNoSymlinks is openFile: resolve refuses symlinks anyway.
+func (r *Root) openNoSymlinks(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return r.openFile(name, flag, perm)
+}
+
+func (r *Root) lstat(name string) (os.FileInfo, error) {
+	full, err := r.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	info, err := os.Lstat(full)
+	return info, named("lstat", name, err)
+}
+
+func (r *Root) stat(name string) (os.FileInfo, error) {
+	full, err := r.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	info, err := os.Stat(full)
+	return info, named("stat", name, err)
+}
+
+func (r *Root) realPath(name string, follow bool) (string, error) {
+	// resolve refuses symlinks, so the resolved path is the real one.
+	full, err := r.resolve(name)
+	if err == nil {
+		_, err = os.Lstat(full)
+	}
+	if err != nil {
+		return "", named("realpath", name, err)
+	}
+	real, err := hostPath(full)
+	return real, named("realpath", name, err)
+}
+
+// filePath returns the real path of the name f was opened with.
+func filePath(f *os.File) (string, error) {
+	return hostPath(f.Name())
+}
+
+// hostPath returns the real path of full, a host path resolve returned:
+// only the root's own path can name symlinks.
+func hostPath(full string) (string, error) {
+	abs, err := filepath.Abs(full)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// parent returns the host path of name, its directory resolved as by
+// resolve and its last component left as it is.
+func (r *Root) parent(op, name string) (string, error) {
+	dir, base, err := split(name)
+	if err == nil {
+		dir, err = r.resolve(dir)
+	}
+	if err != nil {
+		return "", &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return filepath.Join(dir, base), nil
+}
+
+func (r *Root) mkdir(name string, perm os.FileMode) error {
+	full, err := r.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return named("mkdir", name, os.Mkdir(full, perm))
+}
+
+func (r *Root) remove(name string) error {
+	full, err := r.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	return named("remove", name, os.Remove(full))
+}
+
+func (r *Root) removeAll(name string) error {
+	full, err := r.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(full); err != nil {
+		return named("remove", name, err)
+	}
+	return named("remove", name, os.RemoveAll(full))
+}
+
+func (r *Root) rename(oldname string, dst *Root, newname string) error {
+	from, err := r.parent("rename", oldname)
+	if err != nil {
+		return err
+	}
+	to, err := dst.parent("rename", newname)
+	if err != nil {
+		return err
+	}
+	return named("rename", oldname, os.Rename(from, to))
+}
+
+func (r *Root) symlink(target, name string) error {
+	full, err := r.parent("symlink", name)
+	if err != nil {
+		return err
+	}
+	return named("symlink", name, os.Symlink(target, full))
+}
+
+// resolve returns the host path of name, refusing escapes and symlinks.
+func (r *Root) resolve(name string) (string, error) {
+	clean := filepath.Clean(name)
+	if clean != "." && !filepath.IsLocal(clean) {
+		return "", ErrEscape
+	}
+	full := r.name
+	parts := strings.Split(clean, string(filepath.Separator))
+	for i, part := range parts {
+		full = filepath.Join(full, part)
+		info, err := os.Lstat(full)
+		if os.IsNotExist(err) && i == len(parts)-1 {
+			break
+		}
+		if err != nil {
+			return "", err.(*os.PathError).Err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", ErrEscape
+		}
+	}
+	return full, nil
+}
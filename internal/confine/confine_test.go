@@ -0,0 +1,440 @@
+//go:build linux
+
+package confine
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// resolvers runs fn with openat2, if the kernel has it, and with walk.
+func resolvers(t *testing.T, fn func(t *testing.T)) {
+	t.Cleanup(func() { noOpenat2.Store(false) })
+	noOpenat2.Store(false)
+	if fd, err := openat2(-100, ".", os.O_RDONLY, 0, true); err != syscall.ENOSYS {
+		syscall.Close(fd)
+		t.Run("openat2", fn)
+	}
+	noOpenat2.Store(true)
+	t.Run("walk", fn)
+}
+
+// tree makes a root holding data/f.txt ("inside") and a sibling directory
+// outside it holding secret ("outside"), and opens the root.
+func tree(t *testing.T) (*Root, string) {
+	t.Helper()
+	base := t.TempDir()
+	root, outside := filepath.Join(base, "root"), filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "data"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(root, "data", "f.txt"), []byte("inside"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("outside"), 0644)
+	r, err := OpenRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, outside
+}
+
+func read(t *testing.T, r *Root, name string) (string, error) {
+	t.Helper()
+	f, err := r.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+func TestOpen_Inside(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, _ := tree(t)
+		os.Symlink("data/f.txt", filepath.Join(r.Name(), "link"))
+		os.Symlink("../data", filepath.Join(r.Name(), "data", "self"))
+		for _, name := range []string{"data/f.txt", "./data//f.txt", "data/../data/f.txt", "link", "data/self/self/f.txt"} {
+			if got, err := read(t, r, name); err != nil || got != "inside" {
+				t.Errorf("%s = (%q, %v), want inside", name, got, err)
+			}
+		}
+		if _, err := r.Open("data/missing"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("missing file: %v, want ErrNotExist", err)
+		}
+	})
+}
+
+func TestOpen_SymlinkEscape(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		os.Symlink(filepath.Join(outside, "secret"), filepath.Join(r.Name(), "abs"))
+		os.Symlink("../../outside/secret", filepath.Join(r.Name(), "data", "rel"))
+		os.Symlink("..", filepath.Join(r.Name(), "up"))
+		os.Symlink("/proc/self/root/etc/hostname", filepath.Join(r.Name(), "magic"))
+		for _, name := range []string{"abs", "data/rel", "up/outside/secret", "../outside/secret",
+			"data/../../outside/secret", filepath.Join(outside, "secret"), "magic"} {
+			got, err := read(t, r, name)
+			if !errors.Is(err, ErrEscape) {
+				t.Errorf("%s = (%q, %v), want ErrEscape", name, got, err)
+			}
+			var pe *os.PathError
+			if errors.As(err, &pe) && pe.Path != name {
+				t.Errorf("%s: error names %q", name, pe.Path)
+			}
+		}
+	})
+}
+
+func TestOpen_HardlinkIsSameFile(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		if err := os.Link(filepath.Join(outside, "secret"), filepath.Join(r.Name(), "hard")); err != nil {
+			t.Skipf("cannot hard link: %v", err)
+		}
+		// Confinement is by name: a hard link is the file itself, not a
+		// pointer out of the root, and is opened like any other.
+		if got, err := read(t, r, "hard"); err != nil || got != "outside" {
+			t.Errorf("hard link = (%q, %v)", got, err)
+		}
+		if _, err := r.OpenFile("hard2", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(filepath.Join(r.Name(), "hard2"), filepath.Join(outside, "copy")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Open("../outside/copy"); !errors.Is(err, ErrEscape) {
+			t.Errorf("reaching a hard link outside by name: %v, want ErrEscape", err)
+		}
+	})
+}
+
+func TestOpen_RenameRace(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		dir := filepath.Join(r.Name(), "swap")
+		os.Mkdir(dir, 0755)
+		os.WriteFile(filepath.Join(dir, "secret"), []byte("inside"), 0644)
+		link := filepath.Join(r.Name(), "swap-link")
+		os.Symlink(outside, link)
+		parked := filepath.Join(r.Name(), "parked")
+
+		// Swap "swap" between the real directory and a symlink out of the
+		// root while opening swap/secret.
+		var stop atomic.Bool
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				os.Rename(dir, parked)
+				os.Rename(link, dir)
+				os.Rename(dir, link)
+				os.Rename(parked, dir)
+			}
+		}()
+		defer func() { stop.Store(true); wg.Wait() }()
+
+		for i := 0; i < 2000; i++ {
+			got, err := read(t, r, "swap/secret")
+			if got == "outside" {
+				t.Fatalf("open %d escaped the root", i)
+			}
+			if err != nil && !errors.Is(err, ErrEscape) && !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("open %d: %v", i, err)
+			}
+		}
+	})
+}
+
+func TestOpenRoot_Pinned(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		// Moving the root away and putting something else at its path
+		// does not move the root.
+		moved := r.Name() + ".moved"
+		if err := os.Rename(r.Name(), moved); err != nil {
+			t.Fatal(err)
+		}
+		os.Symlink(outside, r.Name())
+		if got, err := read(t, r, "data/f.txt"); err != nil || got != "inside" {
+			t.Errorf("after rename = (%q, %v), want inside", got, err)
+		}
+		if _, err := r.Open("secret"); err == nil {
+			t.Error("opened a file from what now sits at the root's old path")
+		}
+	})
+}
+
+func TestOpenFile_Create(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		f, err := r.OpenFile("data/new.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if _, err := os.Stat(filepath.Join(r.Name(), "data", "new.txt")); err != nil {
+			t.Errorf("created file: %v", err)
+		}
+		os.Symlink(filepath.Join(outside, "planted"), filepath.Join(r.Name(), "dangling"))
+		if _, err := r.OpenFile("dangling", os.O_WRONLY|os.O_CREATE, 0600); !errors.Is(err, ErrEscape) {
+			t.Errorf("create through an escaping symlink: %v, want ErrEscape", err)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "planted")); err == nil {
+			t.Error("file created outside the root")
+		}
+	})
+}
+
+func TestLstatAndReadDir(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		os.Symlink(outside, filepath.Join(r.Name(), "data", "out"))
+		info, err := r.Lstat("data/out")
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("Lstat(symlink) = (%v, %v), want the link itself", info, err)
+		}
+		infos, err := r.ReadDir("data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 2 || infos[0].Name() != "f.txt" || infos[0].Size() != 6 || infos[1].Name() != "out" {
+			t.Errorf("ReadDir = %v", infos)
+		}
+		if _, err := r.ReadDir("data/out"); !errors.Is(err, ErrEscape) {
+			t.Errorf("ReadDir through an escaping symlink: %v, want ErrEscape", err)
+		}
+		if _, err := r.ReadDir("."); err != nil {
+			t.Errorf("ReadDir of the root: %v", err)
+		}
+	})
+}
+
+func TestStat(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		os.Symlink("data/f.txt", filepath.Join(r.Name(), "link"))
+		os.Symlink(outside, filepath.Join(r.Name(), "out"))
+		info, err := r.Stat("link")
+		if err != nil || !info.Mode().IsRegular() || info.Size() != 6 {
+			t.Errorf("Stat(link) = (%v, %v), want the file it names", info, err)
+		}
+		if _, err := r.Stat("out/secret"); !errors.Is(err, ErrEscape) {
+			t.Errorf("Stat through an escaping symlink: %v, want ErrEscape", err)
+		}
+	})
+}
+
+func TestMkdirRemove(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		if err := r.Mkdir("data/new", 0750); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(filepath.Join(r.Name(), "data", "new")); err != nil || !info.IsDir() {
+			t.Errorf("created directory: (%v, %v)", info, err)
+		}
+		if err := r.Mkdir("data/new", 0750); !errors.Is(err, os.ErrExist) {
+			t.Errorf("Mkdir of an existing directory: %v, want ErrExist", err)
+		}
+		os.Symlink(outside, filepath.Join(r.Name(), "out"))
+		if err := r.Mkdir("out/planted", 0750); !errors.Is(err, ErrEscape) {
+			t.Errorf("Mkdir through an escaping symlink: %v, want ErrEscape", err)
+		}
+		if err := r.Remove("data"); err == nil {
+			t.Error("removed a non-empty directory")
+		}
+		if err := r.Remove("data/new"); err != nil {
+			t.Errorf("Remove(empty directory): %v", err)
+		}
+		// The link goes, not what it points at.
+		if err := r.Remove("out"); err != nil {
+			t.Errorf("Remove(symlink): %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+			t.Errorf("symlink target removed: %v", err)
+		}
+		for _, name := range []string{".", "data/..", "../outside/secret"} {
+			if err := r.Remove(name); err == nil {
+				t.Errorf("Remove(%q) succeeded", name)
+			}
+		}
+	})
+}
+
+func TestRemoveAll(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		os.MkdirAll(filepath.Join(r.Name(), "data", "a", "b"), 0755)
+		os.WriteFile(filepath.Join(r.Name(), "data", "a", "b", "x"), nil, 0644)
+		os.Symlink(outside, filepath.Join(r.Name(), "data", "a", "out"))
+		if err := r.RemoveAll("data"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(filepath.Join(r.Name(), "data")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("data still there: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+			t.Errorf("RemoveAll followed a symlink out of the root: %v", err)
+		}
+		if err := r.RemoveAll("data"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("RemoveAll of a missing name: %v, want ErrNotExist", err)
+		}
+	})
+}
+
+func TestRename(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		if err := r.Rename("data/f.txt", r, "g.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := read(t, r, "g.txt"); err != nil || got != "inside" {
+			t.Errorf("renamed file = (%q, %v)", got, err)
+		}
+		if err := r.Rename("g.txt", r, "../outside/g.txt"); !errors.Is(err, ErrEscape) {
+			t.Errorf("rename out of the root: %v, want ErrEscape", err)
+		}
+		os.Symlink(outside, filepath.Join(r.Name(), "out"))
+		if err := r.Rename("out/secret", r, "stolen"); !errors.Is(err, ErrEscape) {
+			t.Errorf("rename in through an escaping symlink: %v, want ErrEscape", err)
+		}
+
+		other, err := OpenRoot(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		if err := r.Rename("g.txt", other, "moved"); err != nil {
+			t.Fatalf("rename between roots: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "moved")); err != nil {
+			t.Errorf("file not moved to the other root: %v", err)
+		}
+	})
+}
+
+func TestSymlink(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		if err := r.Symlink("f.txt", "data/alias"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := read(t, r, "data/alias"); err != nil || got != "inside" {
+			t.Errorf("through the new link = (%q, %v)", got, err)
+		}
+		if err := r.Symlink("../data/f.txt", "data/up"); err != nil {
+			t.Errorf("relative target within the root: %v", err)
+		}
+		for _, target := range []string{filepath.Join(outside, "secret"), "../../outside/secret", "../.."} {
+			if err := r.Symlink(target, "data/bad"); !errors.Is(err, ErrEscape) {
+				t.Errorf("Symlink(%q): %v, want ErrEscape", target, err)
+			}
+		}
+	})
+}
+
+func TestRealPath(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		base := t.TempDir()
+		real := filepath.Join(base, "real")
+		os.MkdirAll(filepath.Join(real, "secret"), 0755)
+		os.MkdirAll(filepath.Join(real, "public"), 0755)
+		os.WriteFile(filepath.Join(real, "secret", "key"), []byte("k"), 0644)
+		os.Symlink("../secret/key", filepath.Join(real, "public", "key"))
+		os.Symlink("secret", filepath.Join(real, "hidden"))
+		// The root is named through a symlink of its own, which is resolved
+		// too.
+		named := filepath.Join(base, "named")
+		os.Symlink(real, named)
+		r, err := OpenRoot(named)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		resolved, err := filepath.EvalSymlinks(real)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			name   string
+			follow bool
+			want   string
+		}{
+			{"secret/key", true, "secret/key"},
+			{"public/key", true, "secret/key"},
+			{"public/key", false, "public/key"},
+			{"hidden/key", false, "secret/key"},
+			{"hidden/new", true, "secret/new"},
+			{"hidden", false, "hidden"},
+			{".", true, ""},
+		}
+		for _, tc := range cases {
+			got, err := r.RealPath(tc.name, tc.follow)
+			if want := filepath.Join(resolved, tc.want); err != nil || got != want {
+				t.Errorf("RealPath(%q, %v) = (%q, %v), want %q", tc.name, tc.follow, got, err, want)
+			}
+		}
+		if _, err := r.RealPath("missing/new", true); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("RealPath under a missing directory: %v", err)
+		}
+
+		f, err := r.Open("public/key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if got, err := r.FilePath(f); err != nil || got != filepath.Join(resolved, "secret", "key") {
+			t.Errorf("FilePath = (%q, %v)", got, err)
+		}
+	})
+}
+
+func TestOpenRealPath(t *testing.T) {
+	resolvers(t, func(t *testing.T) {
+		r, outside := tree(t)
+		real, err := r.RealPath("data/f.txt", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := r.OpenRealPath(real, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenRealPath: %v", err)
+		}
+		f.Close()
+		created, _ := r.RealPath("data/new", true)
+		if f, err := r.OpenRealPath(created, os.O_WRONLY|os.O_CREATE, 0644); err != nil {
+			t.Errorf("OpenRealPath creating: %v", err)
+		} else {
+			f.Close()
+		}
+
+		// Swap a symlink in for the file, then for its directory.
+		host := filepath.Join(r.Name(), "data")
+		os.MkdirAll(filepath.Join(r.Name(), "other"), 0755)
+		os.WriteFile(filepath.Join(r.Name(), "other", "f.txt"), []byte("other"), 0644)
+		os.Remove(filepath.Join(host, "f.txt"))
+		os.Symlink("../other/f.txt", filepath.Join(host, "f.txt"))
+		if _, err := r.OpenRealPath(real, os.O_RDONLY, 0); !errors.Is(err, ErrChanged) {
+			t.Errorf("file swapped for a symlink: %v, want ErrChanged", err)
+		}
+		os.RemoveAll(host)
+		os.Symlink("other", host)
+		if _, err := r.OpenRealPath(real, os.O_RDONLY, 0); !errors.Is(err, ErrChanged) {
+			t.Errorf("directory swapped for a symlink: %v, want ErrChanged", err)
+		}
+		if _, err := r.OpenRealPath(filepath.Join(outside, "secret"), os.O_RDONLY, 0); !errors.Is(err, ErrEscape) {
+			t.Errorf("path outside the root: %v, want ErrEscape", err)
+		}
+	})
+}
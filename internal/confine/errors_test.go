@@ -0,0 +1,43 @@
+package confine
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Errors name the path as given on every platform, never the root's.
+func TestErrorsNameRelativePath(t *testing.T) {
+	dir := t.TempDir()
+	r, err := OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, op := range []func() error{
+		func() error { _, err := r.Open("missing/file"); return err },
+		func() error { _, err := r.OpenFile("missing/file", os.O_WRONLY|os.O_CREATE, 0o644); return err },
+		func() error { _, err := r.Stat("missing/file"); return err },
+		func() error { return r.Mkdir("missing/file", 0o755) },
+	} {
+		err := op()
+		var pe *os.PathError
+		if !errors.As(err, &pe) || pe.Path != "missing/file" || !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("err = %#v, want a not-found *os.PathError naming missing/file", err)
+		}
+		if err != nil && strings.Contains(err.Error(), dir) {
+			t.Errorf("error %q names the root", err)
+		}
+	}
+	// Only the last component missing, resolving succeeds and the stat
+	// itself fails.
+	_, err = r.Lstat("file")
+	var pe *os.PathError
+	if !errors.As(err, &pe) || pe.Path != "file" || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Lstat: err = %#v, want a not-found *os.PathError naming file", err)
+	}
+	if err != nil && strings.Contains(err.Error(), dir) {
+		t.Errorf("Lstat error %q names the root", err)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package confine
+
+// sysOpenat2 is openat2's number in the unified syscall table that every
+// architecture Go runs Linux on uses, but MIPS.
+const sysOpenat2 = 437
@@ -0,0 +1,7 @@
+//go:build linux && (mips64 || mips64le)
+
+package confine
+
+// sysOpenat2 is openat2's number in the n64 syscall table, which starts at
+// 5000.
+const sysOpenat2 = 5437
@@ -0,0 +1,7 @@
+//go:build linux && (mips || mipsle)
+
+package confine
+
+// sysOpenat2 is openat2's number in the o32 syscall table, which starts at
+// 4000.
+const sysOpenat2 = 4437
@@ -0,0 +1,189 @@
+// Package credential keeps a long-running client's capability token fresh.
+//
+// A Source holds a short-lived access token and its refresh credential
+// (from identity.issue with "refresh": true). It renews through
+// identity.renew once most of the token's lifetime has passed, either on
+// demand from Token or in the background from Run. Renewals are
+// serialized: presenting a rotated-out refresh credential twice would be
+// treated by identity as theft and revoke the whole token family.
+package credential
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/ipc"
+)
+
+// DefaultRenewFraction is the fraction of a token's lifetime after which
+// it is renewed.
+const DefaultRenewFraction = 0.8
+
+// retryInterval is how soon Run retries a failed renewal.
+const retryInterval = 5 * time.Second
+
+// Token is an access token and the refresh credential that renews it.
+type Token struct {
+	Token          string
+	CapID          string
+	Expires        time.Time
+	Refresh        string
+	RefreshExpires time.Time
+}
+
+// Source renews a Token through the identity service. Safe for concurrent use.
+type Source struct {
+	identitySock string
+
+	mu       sync.Mutex
+	cur      Token
+	obtained time.Time
+
+	// RenewFraction is the fraction of the token lifetime after which
+	// Token renews it (default DefaultRenewFraction).
+	RenewFraction float64
+}
+
+// NewSource returns a Source for t, renewing through identitySock.
+func NewSource(identitySock string, t Token) *Source {
+	return &Source{
+		identitySock:  identitySock,
+		cur:           t,
+		obtained:      time.Now(),
+		RenewFraction: DefaultRenewFraction,
+	}
+}
+
+// Issue requests a token with a refresh credential via identity.issue and
+// returns a Source for it. params are identity.issue params; "refresh" is
+// set automatically.
+func Issue(identitySock string, params map[string]any) (*Source, error) {
+	p := make(map[string]any, len(params)+1)
+	for k, v := range params {
+		p[k] = v
+	}
+	p["refresh"] = true
+	t, err := call(identitySock, "identity.issue", p)
+	if err != nil {
+		return nil, err
+	}
+	if t.Refresh == "" {
+		return nil, fmt.Errorf("identity.issue: no refresh credential returned")
+	}
+	return NewSource(identitySock, t), nil
+}
+
+// Current returns the held token without renewing it.
+func (s *Source) Current() Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur
+}
+
+// Token returns a valid access token, renewing first if the current one is
+// past its renewal point.
+func (s *Source) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().Before(s.renewAtLocked()) {
+		return s.cur.Token, nil
+	}
+	if err := s.renewLocked(); err != nil {
+		// Still usable until it actually expires.
+		if time.Now().Before(s.cur.Expires) {
+			return s.cur.Token, nil
+		}
+		return "", err
+	}
+	return s.cur.Token, nil
+}
+
+// Renew renews the token now.
+func (s *Source) Renew() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.renewLocked()
+}
+
+// Run renews the token in the background whenever it reaches its renewal
+// point, until ctx is cancelled. Failed renewals are retried.
+func (s *Source) Run(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		wait := time.Until(s.renewAtLocked())
+		s.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := s.Renew(); err != nil {
+			log.Printf("[credential] renew failed: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryInterval):
+			}
+		}
+	}
+}
+
+// renewAtLocked returns when the current token should be renewed.
+// Caller must hold s.mu.
+func (s *Source) renewAtLocked() time.Time {
+	frac := s.RenewFraction
+	if frac <= 0 || frac > 1 {
+		frac = DefaultRenewFraction
+	}
+	life := s.cur.Expires.Sub(s.obtained)
+	return s.obtained.Add(time.Duration(float64(life) * frac))
+}
+
+// renewLocked calls identity.renew. Caller must hold s.mu.
+func (s *Source) renewLocked() error {
+	t, err := call(s.identitySock, "identity.renew", map[string]any{"refresh_token": s.cur.Refresh})
+	if err != nil {
+		return err
+	}
+	s.cur = t
+	s.obtained = time.Now()
+	return nil
+}
+
+// call sends an issue or renew request and decodes the token result.
+func call(identitySock, method string, params map[string]any) (Token, error) {
+	resp, err := ipc.SendRequest(identitySock, &ipc.Request{
+		V:      1,
+		ReqID:  fmt.Sprintf("%s-%d", method, time.Now().UnixNano()),
+		Method: method,
+		Params: params,
+	})
+	if err != nil {
+		return Token{}, fmt.Errorf("%s: %w", method, err)
+	}
+	if !resp.OK {
+		return Token{}, fmt.Errorf("%s: %s", method, resp.Error.Message)
+	}
+	result, _ := resp.Result.(map[string]any)
+	var t Token
+	t.Token, _ = result["token"].(string)
+	t.CapID, _ = result["cap_id"].(string)
+	t.Refresh, _ = result["refresh_token"].(string)
+	if exp, ok := result["expires"].(float64); ok {
+		t.Expires = time.Unix(int64(exp), 0)
+	}
+	if exp, ok := result["refresh_expires"].(float64); ok {
+		t.RefreshExpires = time.Unix(int64(exp), 0)
+	}
+	if t.Token == "" {
+		return Token{}, fmt.Errorf("%s: no token in response", method)
+	}
+	return t, nil
+}
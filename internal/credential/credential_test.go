@@ -0,0 +1,154 @@
+package credential
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/auth"
+	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/ipc"
+)
+
+// fakeIdentity serves identity.issue and identity.renew from a real
+// RefreshStore, minting tokens that live for ttl. It counts renewals.
+func fakeIdentity(t *testing.T, ttl time.Duration) (string, *int32) {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "identity.sock")
+	store := auth.NewRefreshStore()
+	var renewals int32
+
+	tokenResult := func(cap *capability.Capability, cred string, credExp time.Time) map[string]any {
+		return map[string]any{
+			"token":           "tok-" + cap.ID,
+			"cap_id":          cap.ID,
+			"expires":         cap.ExpiresAt.Unix(),
+			"refresh_token":   cred,
+			"refresh_expires": credExp.Unix(),
+		}
+	}
+
+	srv := ipc.NewServer(sock)
+	srv.Handle("identity.issue", func(req *ipc.Request) ipc.Response {
+		g := auth.RefreshGrant{Service: "fs", Rights: []string{"fs.read"}, TTL: ttl, RefreshTTL: time.Hour}
+		cap := g.NewCapability()
+		cred, exp, _ := store.Start(g, cap)
+		return ipc.SuccessResponse(req.ReqID, tokenResult(cap, cred, exp))
+	})
+	srv.Handle("identity.renew", func(req *ipc.Request) ipc.Response {
+		cred, _ := req.Params["refresh_token"].(string)
+		cap, next, exp, err := store.Renew(cred, func(g auth.RefreshGrant, _ *capability.Capability) (*capability.Capability, error) {
+			return g.NewCapability(), nil
+		})
+		if err != nil {
+			return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, err.Error())
+		}
+		atomic.AddInt32(&renewals, 1)
+		return ipc.SuccessResponse(req.ReqID, tokenResult(cap, next, exp))
+	})
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(srv.Stop)
+	return sock, &renewals
+}
+
+func TestIssueAndToken(t *testing.T) {
+	sock, renewals := fakeIdentity(t, time.Hour)
+	src, err := Issue(sock, map[string]any{"service": "fs", "rights": []any{"fs.read"}})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	cur := src.Current()
+	if cur.Refresh == "" || cur.CapID == "" {
+		t.Fatalf("incomplete token: %+v", cur)
+	}
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if tok != cur.Token {
+		t.Error("fresh token should be returned as is")
+	}
+	if n := atomic.LoadInt32(renewals); n != 0 {
+		t.Errorf("renewals = %d, want 0 for a fresh token", n)
+	}
+}
+
+func TestToken_RenewsNearExpiry(t *testing.T) {
+	sock, renewals := fakeIdentity(t, time.Hour)
+	src, err := Issue(sock, map[string]any{"service": "fs"})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	before := src.Current()
+	src.obtained = time.Now().Add(-5 * time.Hour) // well past 80% of its life
+
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	after := src.Current()
+	if tok == before.Token || after.CapID == before.CapID {
+		t.Error("token should have been renewed")
+	}
+	if after.Refresh == before.Refresh {
+		t.Error("refresh credential should have rotated")
+	}
+	if n := atomic.LoadInt32(renewals); n != 1 {
+		t.Errorf("renewals = %d, want 1", n)
+	}
+}
+
+func TestToken_ConcurrentCallersRenewOnce(t *testing.T) {
+	sock, renewals := fakeIdentity(t, time.Hour)
+	src, err := Issue(sock, map[string]any{"service": "fs"})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	src.obtained = time.Now().Add(-5 * time.Hour)
+
+	// Serialized renewals never present a rotated-out credential, which
+	// identity would treat as reuse.
+	done := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			_, err := src.Token()
+			done <- err
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("Token: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(renewals); n == 0 {
+		t.Error("expected at least one renewal")
+	}
+	if err := src.Renew(); err != nil {
+		t.Errorf("credential chain broken by concurrent renewals: %v", err)
+	}
+}
+
+func TestRun_RenewsInBackground(t *testing.T) {
+	sock, renewals := fakeIdentity(t, 2*time.Second)
+	src, err := Issue(sock, map[string]any{"service": "fs"})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	src.RenewFraction = 0.01
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go src.Run(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(renewals) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Run did not renew before expiry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 )
 
 // --- types tests ---
@@ -292,3 +294,80 @@ func TestServer_BadProtocolVersion(t *testing.T) {
 		t.Error("expected error for bad protocol version")
 	}
 }
+
+func TestServer_PeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is Linux-only")
+	}
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "server.sock")
+
+	srv := NewServer(sock)
+	srv.Handle("test.whoami", func(req *Request) Response {
+		if req.Peer == nil {
+			return ErrorResponse(req.ReqID, ErrInternal, "no peer credentials")
+		}
+		return SuccessResponse(req.ReqID, map[string]any{"uid": req.Peer.UID, "pid": req.Peer.PID})
+	})
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer srv.Stop()
+
+	resp, err := SendRequest(sock, &Request{V: 1, ReqID: "who-1", Method: "test.whoami"})
+	if err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	if !resp.OK {
+		t.Fatalf("expected OK, got error: %v", resp.Error.Message)
+	}
+	result := resp.Result.(map[string]any)
+	if int(result["uid"].(float64)) != os.Getuid() {
+		t.Errorf("uid = %v, want %d", result["uid"], os.Getuid())
+	}
+	if int(result["pid"].(float64)) != os.Getpid() {
+		t.Errorf("pid = %v, want %d", result["pid"], os.Getpid())
+	}
+}
+
+func TestRequestJSON_PeerNotSerialized(t *testing.T) {
+	data := []byte(`{"v":1,"req_id":"r","method":"m","Peer":{"uid":0},"peer":{"uid":0}}`)
+	var req Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if req.Peer != nil {
+		t.Error("Peer must not be settable from the wire")
+	}
+}
+
+func TestSendRequestTimeout_NoReply(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "silent.sock")
+
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Read the request but never answer.
+		ReadFrame(conn)
+		time.Sleep(time.Second)
+	}()
+
+	start := time.Now()
+	_, err = SendRequestTimeout(sock, &Request{V: 1, ReqID: "t", Method: "x.y"}, 50*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("timeout not honoured: took %v", elapsed)
+	}
+}
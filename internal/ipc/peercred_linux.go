@@ -0,0 +1,29 @@
+//go:build linux
+
+package ipc
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCred reads the connecting process's credentials via SO_PEERCRED.
+// Returns nil if the connection is not a Unix socket or the lookup fails.
+func peerCred(conn net.Conn) *PeerCred {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return nil
+	}
+	return &PeerCred{PID: int(cred.Pid), UID: int(cred.Uid), GID: int(cred.Gid)}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package ipc
+
+import "net"
+
+// peerCred is unsupported outside Linux; callers treat the peer as unknown.
+func peerCred(conn net.Conn) *PeerCred {
+	return nil
+}
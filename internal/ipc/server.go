@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 )
 
 // Handler processes a single IPC request and returns a response.
@@ -75,11 +76,13 @@ func (s *Server) acceptLoop() {
 
 func (s *Server) handleConn(conn net.Conn) {
 	defer conn.Close()
+	peer := peerCred(conn)
 	for {
 		req, err := ReadRequest(conn)
 		if err != nil {
 			return
 		}
+		req.Peer = peer
 		if req.V != 1 {
 			WriteFrame(conn, ErrorResponse(req.ReqID, ErrInvalidRequest, "unsupported protocol version"))
 			continue
@@ -99,11 +102,20 @@ func (s *Server) handleConn(conn net.Conn) {
 
 // SendRequest connects to a UDS, sends one request, and reads one response.
 func SendRequest(socketPath string, req *Request) (*Response, error) {
-	conn, err := net.Dial("unix", socketPath)
+	return SendRequestTimeout(socketPath, req, 0)
+}
+
+// SendRequestTimeout is SendRequest bounded by timeout for the whole
+// exchange (dial, write and read). A zero timeout waits indefinitely.
+func SendRequestTimeout(socketPath string, req *Request, timeout time.Duration) (*Response, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
 	if err != nil {
 		return nil, fmt.Errorf("dial %s: %w", socketPath, err)
 	}
 	defer conn.Close()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
 
 	if err := WriteFrame(conn, req); err != nil {
 		return nil, fmt.Errorf("write request: %w", err)
@@ -8,10 +8,32 @@ type Request struct {
 	Method string         `json:"method"`
 	Auth   *Auth          `json:"auth,omitempty"`
 	Params map[string]any `json:"params,omitempty"`
+
+	// Peer holds the caller's kernel-verified credentials. It is filled in
+	// by Server and is never read from or written to the wire.
+	Peer *PeerCred `json:"-"`
+}
+
+// PeerUID returns the caller's UID, or -1 if it is unknown.
+func (r *Request) PeerUID() int {
+	if r.Peer == nil {
+		return -1
+	}
+	return r.Peer.UID
 }
 
 type Auth struct {
 	Token string `json:"token"`
+	// Proof is a signature over the request's req_id and method by the key
+	// a proof-of-possession token is bound to (see auth.SignProof).
+	Proof string `json:"proof,omitempty"`
+}
+
+// PeerCred identifies the process on the other end of a Unix socket.
+type PeerCred struct {
+	PID int `json:"pid"`
+	UID int `json:"uid"`
+	GID int `json:"gid"`
 }
 
 // Response is the envelope for all IPC replies.
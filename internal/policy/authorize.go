@@ -21,6 +21,7 @@ type PolicyError struct {
 	Code    int
 	Name    string
 	Message string
+	Details map[string]any
 }
 
 func (e *PolicyError) Error() string {
@@ -29,56 +30,111 @@ func (e *PolicyError) Error() string {
 
 // Authorize checks whether claims permit the requested method.
 // ctx may contain method-specific context (e.g. "path" for filesystem operations).
-// Returns nil if authorized, or *PolicyError describing the denial.
+// Returns nil if authorized, or *PolicyError describing the denial; with
+// SetDebug on, the denial's details include the decision trace.
 func Authorize(claims *capability.Capability, method string, ctx map[string]any) error {
+	return decide(claims, method, ctx, false)
+}
+
+// Check decides as Authorize would without spending anything: no use,
+// rate-limit token or quota. Services check the further resources of a
+// request with it, such as a rename's destination, before authorizing the
+// request itself.
+func Check(claims *capability.Capability, method string, ctx map[string]any) error {
+	return decide(claims, method, ctx, true)
+}
+
+// decide implements Authorize and Check, attaching the decision trace to
+// denials with SetDebug on.
+func decide(claims *capability.Capability, method string, ctx map[string]any, dryRun bool) error {
+	ev := &evaluation{dryRun: dryRun}
+	if debugTrace.Load() {
+		ev.trace = &Trace{}
+	}
+	err := authorize(claims, method, ctx, ev)
+	if pe, ok := err.(*PolicyError); ok && ev.trace != nil {
+		if pe.Details == nil {
+			pe.Details = map[string]any{}
+		}
+		pe.Details["trace"] = ev.trace.Steps
+	}
+	return err
+}
+
+// authorize implements Authorize and Explain.
+func authorize(claims *capability.Capability, method string, ctx map[string]any, ev *evaluation) error {
 	if claims == nil {
-		return &PolicyError{
+		return ev.fail("token", &PolicyError{
 			Code:    CodeUnauthenticated,
 			Name:    "UNAUTHENTICATED",
 			Message: "token required",
-		}
+		})
 	}
 
 	// Parse method into service.action.
 	parts := strings.SplitN(method, ".", 2)
 	if len(parts) != 2 {
-		return &PolicyError{
+		return ev.fail("method", &PolicyError{
 			Code:    CodePermissionDenied,
 			Name:    "PERMISSION_DENIED",
 			Message: fmt.Sprintf("invalid method format: %q", method),
-		}
+		})
 	}
-	service, action := parts[0], parts[1]
+	service := parts[0]
 
 	// Token must be scoped to the correct service.
 	if claims.Service != service {
-		return &PolicyError{
+		return ev.fail("service", &PolicyError{
 			Code:    CodePermissionDenied,
 			Name:    "PERMISSION_DENIED",
 			Message: fmt.Sprintf("token not valid for service %q", service),
-		}
+		})
 	}
+	ev.step("service", StepPass, service)
 
-	// Check fully-qualified rights (preferred) or legacy actions (fallback).
-	if !hasRight(claims.Rights, method) && !hasAction(claims.Actions, action) {
-		return &PolicyError{
+	// Check fully-qualified rights (preferred) or legacy actions (fallback);
+	// see rights.go for patterns and precedence.
+	by, granted := grantedBy(claims, method)
+	if !granted {
+		err := &PolicyError{
 			Code:    CodePermissionDenied,
 			Name:    "PERMISSION_DENIED",
 			Message: fmt.Sprintf("method %q not permitted", method),
 		}
+		if by != "" {
+			err.Message += " (denied by " + by + ")"
+		}
+		return ev.fail("rights", err)
 	}
+	// Some requests need further rights than their method's, e.g. an
+	// fs.open that creates the file needs fs.create.
+	for _, right := range ctxRights(ctx) {
+		if rby, ok := grantedBy(claims, right); !ok {
+			err := &PolicyError{
+				Code:    CodePermissionDenied,
+				Name:    "PERMISSION_DENIED",
+				Message: fmt.Sprintf("method %q needs right %q", method, right),
+			}
+			if rby != "" {
+				err.Message += " (denied by " + rby + ")"
+			}
+			return ev.fail("rights", err)
+		}
+	}
+	ev.step("rights", StepPass, "granted by "+by)
 
-	// Enforce constraints.
-	return enforceConstraints(claims, ctx)
-}
+	// Operator rules may forbid what the token grants.
+	if err := enforceRules(claims, method, ctx, ev); err != nil {
+		return err
+	}
 
-func hasRight(rights []string, required string) bool {
-	for _, r := range rights {
-		if r == required {
-			return true
-		}
+	// The resource's labels must be matched by the subject's attributes.
+	if err := enforceLabels(claims, ctx, ev); err != nil {
+		return err
 	}
-	return false
+
+	// Enforce constraints; they see the method too, for per-method limits.
+	return enforceConstraints(claims, withMethod(ctx, method), ev)
 }
 
 func hasAction(actions []string, required string) bool {
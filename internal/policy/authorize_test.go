@@ -1,6 +1,7 @@
 package policy
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/Gao-OS/StrataOS/internal/capability"
@@ -132,3 +133,119 @@ func TestPolicyError_Error(t *testing.T) {
 		t.Errorf("Error() = %q, want %q", pe.Error(), "denied")
 	}
 }
+
+// --- Right patterns and precedence ---
+
+func TestAuthorize_WildcardRights(t *testing.T) {
+	cases := []struct {
+		rights []string
+		method string
+		want   bool
+	}{
+		{[]string{"fs.*"}, "fs.open", true},
+		{[]string{"fs.*"}, "fs.dir.make", true},
+		{[]string{"supervisor.svc.*"}, "supervisor.svc.restart", true},
+		{[]string{"supervisor.svc.*"}, "supervisor.status", false},
+		{[]string{"supervisor.svc.*"}, "supervisor.svcx.restart", false},
+		{[]string{"fs.o*"}, "fs.open", false}, // no partial-segment globs
+	}
+	for _, tc := range cases {
+		service, _, _ := strings.Cut(tc.method, ".")
+		claims := &capability.Capability{Service: service, Rights: tc.rights}
+		err := Authorize(claims, tc.method, nil)
+		if got := err == nil; got != tc.want {
+			t.Errorf("rights %v, %s: allowed = %v, want %v (%v)", tc.rights, tc.method, got, tc.want, err)
+		}
+	}
+}
+
+func TestAuthorize_NegativeRightWins(t *testing.T) {
+	claims := &capability.Capability{
+		Service: "fs",
+		Rights:  []string{"fs.*", "!fs.write"},
+	}
+	if err := Authorize(claims, "fs.read", nil); err != nil {
+		t.Errorf("fs.read: %v", err)
+	}
+	if err := Authorize(claims, "fs.write", nil); err == nil {
+		t.Error("!fs.write should deny despite fs.*")
+	}
+}
+
+func TestAuthorize_NegativeRightOverridesAction(t *testing.T) {
+	claims := &capability.Capability{
+		Service: "fs",
+		Actions: []string{"read", "write"},
+		Rights:  []string{"!fs.write"},
+	}
+	if err := Authorize(claims, "fs.write", nil); err == nil {
+		t.Error("!fs.write should deny the legacy write action")
+	}
+	if err := Authorize(claims, "fs.read", nil); err != nil {
+		t.Errorf("fs.read: %v", err)
+	}
+}
+
+func TestAuthorize_NegativeWildcard(t *testing.T) {
+	claims := &capability.Capability{
+		Service: "supervisor",
+		Rights:  []string{"supervisor.*", "!supervisor.svc.*"},
+	}
+	if err := Authorize(claims, "supervisor.status", nil); err != nil {
+		t.Errorf("supervisor.status: %v", err)
+	}
+	if err := Authorize(claims, "supervisor.svc.stop", nil); err == nil {
+		t.Error("!supervisor.svc.* should deny supervisor.svc.stop")
+	}
+}
+
+func TestAuthorize_PrecedenceIgnoresOrder(t *testing.T) {
+	for _, rights := range [][]string{
+		{"fs.*", "!fs.write", "fs.write"},
+		{"fs.write", "!fs.write", "fs.*"},
+		{"!fs.write", "fs.write", "fs.*"},
+	} {
+		claims := &capability.Capability{Service: "fs", Rights: rights}
+		if err := Authorize(claims, "fs.write", nil); err == nil {
+			t.Errorf("rights %v: fs.write allowed", rights)
+		}
+		if err := Authorize(claims, "fs.read", nil); err != nil {
+			t.Errorf("rights %v: fs.read: %v", rights, err)
+		}
+	}
+}
+
+func TestMatchRight(t *testing.T) {
+	cases := []struct {
+		pattern, method string
+		want            bool
+	}{
+		{"fs.read", "fs.read", true},
+		{"fs.read", "fs.readdir", false},
+		{"fs.*", "fs.read", true},
+		{"fs.*", "fs", false},
+		{"fs.*", "fsx.read", false},
+		{"a.b.*", "a.b.c.d", true},
+		{"a.b.*", "a.b", false},
+	}
+	for _, tc := range cases {
+		if got := MatchRight(tc.pattern, tc.method); got != tc.want {
+			t.Errorf("MatchRight(%q, %q) = %v, want %v", tc.pattern, tc.method, got, tc.want)
+		}
+	}
+}
+
+func TestValidateRight(t *testing.T) {
+	valid := []string{"fs.read", "fs.*", "supervisor.svc.*", "!fs.write", "!fs.*", "kv.get_many", "net-v2.dial"}
+	for _, r := range valid {
+		if err := ValidateRight(r); err != nil {
+			t.Errorf("ValidateRight(%q): %v", r, err)
+		}
+	}
+	invalid := []string{"", "fs", "*", "!", "!*", "*.read", "fs.*.read", "fs.re*", "fs..read", "fs.read.", "FS.read", "fs.read!", "!!fs.read", "fs read"}
+	for _, r := range invalid {
+		if err := ValidateRight(r); err == nil {
+			t.Errorf("ValidateRight(%q) accepted", r)
+		}
+	}
+}
@@ -1,25 +1,216 @@
 package policy
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/Gao-OS/StrataOS/internal/capability"
 )
 
-// enforceConstraints checks all constraints from the capability against ctx.
-func enforceConstraints(claims *capability.Capability, ctx map[string]any) error {
-	if err := enforcePathPrefix(claims.Constraints.PathPrefix, ctx); err != nil {
-		return err
-	}
-	if err := enforceRateLimit(claims.ID, claims.Constraints.RateLimit); err != nil {
-		return err
+// The built-in constraints, in evaluation order. Rate limits, quotas and
+// max_uses spend, so they run last: a request denied by another
+// constraint costs nothing, and one denied by a later spending constraint
+// is refunded.
+func init() {
+	RegisterConstraint(ConstraintType{
+		Name:  "path_prefix",
+		Parse: parseString,
+		Evaluate: func(v any, _ *capability.Capability, ctx map[string]any) error {
+			// A handle's path was checked when it was opened.
+			if onHandle, _ := ctx[CtxHandle].(bool); onHandle {
+				return nil
+			}
+			return enforcePathPrefix(v.(string), ctx)
+		},
+		CtxKeys:        []string{"path"},
+		SkipWithoutCtx: true,
+	})
+	RegisterConstraint(ConstraintType{
+		Name:  "paths",
+		Parse: parsePaths,
+		Evaluate: func(v any, _ *capability.Capability, ctx map[string]any) error {
+			// A handle was checked, for the access it was opened with,
+			// when it was opened.
+			if onHandle, _ := ctx[CtxHandle].(bool); onHandle {
+				return nil
+			}
+			return enforcePaths(v.([]capability.PathRoot), ctx)
+		},
+		CtxKeys:        []string{"path", CtxWrite},
+		SkipWithoutCtx: true,
+	})
+	RegisterConstraint(ConstraintType{
+		Name:  "max_file_size",
+		Parse: parseMaxFileSize,
+		Evaluate: func(v any, _ *capability.Capability, ctx map[string]any) error {
+			return enforceMaxFileSize(v.(int64), ctx)
+		},
+		CtxKeys:        []string{CtxFileSize},
+		SkipWithoutCtx: true,
+	})
+	RegisterConstraint(ConstraintType{
+		Name:  "create_perm",
+		Parse: parseCreatePerm,
+		Evaluate: func(v any, _ *capability.Capability, ctx map[string]any) error {
+			return enforceCreatePerm(v.(os.FileMode), ctx)
+		},
+		CtxKeys:        []string{CtxPerm},
+		SkipWithoutCtx: true,
+	})
+	RegisterConstraint(ConstraintType{
+		Name: "schedule",
+		Parse: func(raw json.RawMessage) (any, error) {
+			var s capability.Schedule
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return nil, err
+			}
+			return parseSchedule(&s)
+		},
+		Evaluate: func(v any, _ *capability.Capability, _ map[string]any) error {
+			return v.(*schedule).enforce(time.Now())
+		},
+	})
+	// rate_limit and rate_limits are enforced together, so that a request
+	// takes from its buckets only if every one of them has room. They
+	// spend before quotas and max_uses, which refund them if they deny.
+	RegisterConstraint(ConstraintType{
+		Name: "rate_limit",
+		Parse: func(raw json.RawMessage) (any, error) {
+			v, err := parseString(raw)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := parseRateLimit(v.(string)); err != nil {
+				return nil, err
+			}
+			return v, nil
+		},
+		Evaluate: func(_ any, claims *capability.Capability, ctx map[string]any) error {
+			return enforceRates(claims, ctx, true)
+		},
+		DryRun: func(_ any, claims *capability.Capability, ctx map[string]any) error {
+			return enforceRates(claims, ctx, false)
+		},
+		Refund: func(_ any, claims *capability.Capability, ctx map[string]any,
+			_ time.Time) {
+			refundRates(claims, ctx)
+		},
+		Spends: true,
+	})
+	RegisterConstraint(ConstraintType{
+		Name: "rate_limits",
+		Parse: func(raw json.RawMessage) (any, error) {
+			var m map[string]string
+			if err := json.Unmarshal(raw, &m); err != nil {
+				return nil, err
+			}
+			for pattern, expr := range m {
+				if err := ValidateRight(pattern); err != nil {
+					return nil, err
+				}
+				if strings.HasPrefix(pattern, "!") {
+					return nil, fmt.Errorf("method pattern %q must not be negative", pattern)
+				}
+				if _, err := parseRateLimit(expr); err != nil {
+					return nil, err
+				}
+			}
+			return m, nil
+		},
+		Evaluate: func(_ any, claims *capability.Capability, ctx map[string]any) error {
+			if claims.Constraints.RateLimit != "" {
+				return nil // enforced with rate_limit
+			}
+			return enforceRates(claims, ctx, true)
+		},
+		DryRun: func(_ any, claims *capability.Capability, ctx map[string]any) error {
+			if claims.Constraints.RateLimit != "" {
+				return nil
+			}
+			return enforceRates(claims, ctx, false)
+		},
+		Refund: func(_ any, claims *capability.Capability, ctx map[string]any,
+			_ time.Time) {
+			if claims.Constraints.RateLimit == "" {
+				refundRates(claims, ctx)
+			}
+		},
+		Spends: true,
+	})
+	RegisterConstraint(ConstraintType{
+		Name: "one_shot",
+		Parse: func(raw json.RawMessage) (any, error) {
+			var b bool
+			return b, json.Unmarshal(raw, &b)
+		},
+		// Enforced through max_uses; the service revokes spent one-shots.
+		Evaluate: func(any, *capability.Capability, map[string]any) error { return nil },
+	})
+	// Quotas are charged before max_uses, so a request over its quota
+	// spends no use.
+	RegisterConstraint(ConstraintType{
+		Name: "quotas",
+		Parse: func(raw json.RawMessage) (any, error) {
+			var q map[string]capability.Quota
+			if err := json.Unmarshal(raw, &q); err != nil {
+				return nil, err
+			}
+			return q, validateQuotas(q)
+		},
+		Evaluate: func(_ any, claims *capability.Capability, ctx map[string]any) error {
+			return globalQuotas.charge(claims, quotaAmounts(ctx), true)
+		},
+		DryRun: func(_ any, claims *capability.Capability, ctx map[string]any) error {
+			return globalQuotas.charge(claims, quotaAmounts(ctx), false)
+		},
+		Refund: func(_ any, claims *capability.Capability, ctx map[string]any,
+			spentAt time.Time) {
+			for name, n := range quotaAmounts(ctx) {
+				ReleaseQuota(claims, name, n, spentAt)
+			}
+		},
+		CtxKeys:        []string{CtxQuota},
+		SkipWithoutCtx: true,
+		Spends:         true,
+	})
+	RegisterConstraint(ConstraintType{
+		Name: "max_uses",
+		Parse: func(raw json.RawMessage) (any, error) {
+			var n int
+			if err := json.Unmarshal(raw, &n); err != nil {
+				return nil, err
+			}
+			if n < 0 {
+				return nil, fmt.Errorf("must not be negative")
+			}
+			return n, nil
+		},
+		Evaluate: func(_ any, claims *capability.Capability, ctx map[string]any) error {
+			return enforceMaxUses(claims, ctx, true)
+		},
+		DryRun: func(_ any, claims *capability.Capability, ctx map[string]any) error {
+			return enforceMaxUses(claims, ctx, false)
+		},
+		Refund: func(_ any, claims *capability.Capability, ctx map[string]any,
+			_ time.Time) {
+			if onHandle, _ := ctx[CtxHandle].(bool); !onHandle {
+				globalUses.Refund(claims)
+			}
+		},
+		Spends: true,
+	})
+}
+
+func parseString(raw json.RawMessage) (any, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
 	}
-	return nil
+	return s, nil
 }
 
 // enforcePathPrefix ensures ctx["path"] is within the allowed prefix.
@@ -72,91 +263,8 @@ func enforcePathPrefix(prefix string, ctx map[string]any) error {
 		return &PolicyError{
 			Code:    CodePermissionDenied,
 			Name:    "PERMISSION_DENIED",
-			Message: fmt.Sprintf("path %s outside allowed prefix %s", absPath, absPrefix),
-		}
-	}
-	return nil
-}
-
-// staleBucketTTL is the duration after which an unused rate limit bucket is evicted.
-const staleBucketTTL = 5 * time.Minute
-
-// In-memory token bucket rate limiter, keyed by cap_id.
-var globalLimiter = &rateLimiter{
-	buckets: make(map[string]*bucket),
-}
-
-type rateLimiter struct {
-	mu      sync.Mutex
-	buckets map[string]*bucket
-}
-
-type bucket struct {
-	tokens float64
-	rate   float64
-	last   time.Time
-}
-
-// parseRate parses "50rps" into 50.0 tokens/second.
-func parseRate(s string) (float64, bool) {
-	s = strings.TrimSpace(s)
-	if !strings.HasSuffix(s, "rps") {
-		return 0, false
-	}
-	n, err := strconv.ParseFloat(strings.TrimSuffix(s, "rps"), 64)
-	if err != nil || n <= 0 {
-		return 0, false
-	}
-	return n, true
-}
-
-// CodeInvalidArgument matches the protocol error code for bad input.
-const CodeInvalidArgument = 1
-
-func enforceRateLimit(capID, rateLimit string) error {
-	if rateLimit == "" {
-		return nil
-	}
-	rate, ok := parseRate(rateLimit)
-	if !ok {
-		return &PolicyError{
-			Code:    CodeInvalidArgument,
-			Name:    "INVALID_ARGUMENT",
-			Message: fmt.Sprintf("unparseable rate limit: %q (expected format: \"50rps\")", rateLimit),
-		}
-	}
-
-	globalLimiter.mu.Lock()
-	defer globalLimiter.mu.Unlock()
-
-	// Lazy eviction of stale buckets to prevent unbounded memory growth.
-	now := time.Now()
-	for id, b := range globalLimiter.buckets {
-		if now.Sub(b.last) > staleBucketTTL {
-			delete(globalLimiter.buckets, id)
-		}
-	}
-
-	b, exists := globalLimiter.buckets[capID]
-	if !exists {
-		b = &bucket{tokens: rate, rate: rate, last: now}
-		globalLimiter.buckets[capID] = b
-	}
-
-	// Refill tokens based on elapsed time.
-	b.tokens += now.Sub(b.last).Seconds() * b.rate
-	if b.tokens > b.rate {
-		b.tokens = b.rate
-	}
-	b.last = now
-
-	if b.tokens < 1 {
-		return &PolicyError{
-			Code:    CodeResourceExhausted,
-			Name:    "RESOURCE_EXHAUSTED",
-			Message: "rate limit exceeded",
+			Message: fmt.Sprintf("path %s outside path_prefix", path),
 		}
 	}
-	b.tokens--
 	return nil
 }
@@ -1,10 +1,13 @@
 package policy
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/confine"
 )
 
 // --- enforcePathPrefix tests ---
@@ -79,34 +82,220 @@ func TestEnforcePathPrefix_OutsidePrefix(t *testing.T) {
 	}
 }
 
-// --- parseRate tests ---
+func TestAuthorize_PathPrefixSkippedOnHandle(t *testing.T) {
+	// fs.read passes the handle's absolute path for policy rules; the
+	// prefix was enforced when the handle was opened.
+	claims := &capability.Capability{
+		Service:     "fs",
+		Rights:      []string{"fs.read"},
+		Constraints: capability.Constraints{PathPrefix: "/srv"},
+	}
+	ctx := map[string]any{CtxHandle: true, "path": "/srv/data/file"}
+	if err := Authorize(claims, "fs.read", ctx); err != nil {
+		t.Errorf("read on a handle: %v", err)
+	}
+}
+
+// --- paths tests ---
+
+func testRoots() []capability.PathRoot {
+	return []capability.PathRoot{
+		{Root: "/srv/app", Allow: []string{"data/**"}, Deny: []string{"data/**/*.key"}, Mode: ModeReadWrite},
+		{Name: "docs", Root: "/usr/share/doc", Mode: ModeReadOnly},
+	}
+}
+
+func TestEnforcePaths_Globs(t *testing.T) {
+	cases := map[string]bool{
+		"app/data":                 true, // ** matches no segments
+		"app/data/report.csv":      true,
+		"app/data/2026/10/log.txt": true,
+		"app/data/tls/server.key":  false,
+		"app/data/server.key":      false,
+		"app/config.json":          false,
+		"app":                      false, // the root itself is not under data/
+		"docs/README":              true,
+		"docs":                     true,
+		".":                        true, // the list of roots
+		"other/file":               false,
+		"app/data/../config.json":  false,
+		"/srv/app/data/x":          false,
+	}
+	for path, want := range cases {
+		err := enforcePaths(testRoots(), map[string]any{"path": path})
+		if (err == nil) != want {
+			t.Errorf("%s: err = %v, want allowed=%v", path, err, want)
+		}
+	}
+}
+
+func TestEnforcePaths_Modes(t *testing.T) {
+	write := func(path string) error {
+		return enforcePaths(testRoots(), map[string]any{"path": path, CtxWrite: true})
+	}
+	if err := write("app/data/out.csv"); err != nil {
+		t.Errorf("write under a read-write root: %v", err)
+	}
+	if err := write("docs/README"); err == nil {
+		t.Error("write under a read-only root should be denied")
+	}
+	if err := write("app/data/new.key"); err == nil {
+		t.Error("deny globs apply to writes too")
+	}
+	if err := write("."); err == nil {
+		t.Error("the list of roots cannot be written")
+	}
+}
+
+func TestEnforcePaths_Symlink(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"data/notes.txt": "server.key",     // a denied file
+		"data/cfg":       "../config.json", // a file outside the allowed tree
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"data/server.key", "config.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := confine.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	roots := []capability.PathRoot{{Name: "app", Root: dir, Allow: []string{"data/**"}, Deny: []string{"**/*.key"}}}
+	check := func(name string, follow bool) error {
+		host, err := root.RealPath(name, follow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enforcePaths(roots, map[string]any{"path": "app/" + name, CtxHostPath: host})
+	}
+
+	// Named, the links pass the globs; the files they resolve to do not.
+	for _, name := range []string{"data/notes.txt", "data/cfg"} {
+		if err := enforcePaths(roots, map[string]any{"path": "app/" + name}); err != nil {
+			t.Fatalf("%s as named: %v", name, err)
+		}
+		if err := check(name, true); err == nil {
+			t.Errorf("%s: a symlink led past the globs", name)
+		}
+		// The link itself, as remove and rename see it, is allowed.
+		if err := check(name, false); err != nil {
+			t.Errorf("%s, not followed: %v", name, err)
+		}
+	}
+	if err := enforcePaths(roots, map[string]any{"path": "app/data/x", CtxHostPath: "/elsewhere/x"}); err == nil {
+		t.Error("a host path outside the root should be denied")
+	}
+}
+
+func TestAuthorize_Paths(t *testing.T) {
+	claims := &capability.Capability{
+		Service:     "fs",
+		Rights:      []string{"fs.*"},
+		Constraints: capability.Constraints{Paths: testRoots()},
+	}
+	if err := Authorize(claims, "fs.open", map[string]any{"path": "app/data/a.csv"}); err != nil {
+		t.Errorf("allowed path: %v", err)
+	}
+	err := Authorize(claims, "fs.open", map[string]any{"path": "app/data/a.key"})
+	if pe, ok := err.(*PolicyError); !ok || pe.Code != CodePermissionDenied {
+		t.Errorf("denied glob = %v, want PERMISSION_DENIED", err)
+	}
+	if err := Authorize(claims, "fs.read", map[string]any{CtxHandle: true, "path": "/srv/app/data/a.key"}); err != nil {
+		t.Errorf("reads on a handle were checked at open: %v", err)
+	}
+	if CheckPath(claims, "app/data/a.key", "", false) == nil || CheckPath(claims, "app/data/a.csv", "", false) != nil {
+		t.Error("CheckPath should agree with the constraint")
+	}
+	if CheckPath(claims, "docs/README", "", true) == nil || CheckPath(claims, "docs/README", "", false) != nil {
+		t.Error("CheckPath should only let read-only roots be read")
+	}
+}
+
+func TestSplitRootPath(t *testing.T) {
+	roots := testRoots()
+	root, rel, ok := SplitRootPath(roots, "app/data//x.csv")
+	if !ok || root.Root != "/srv/app" || rel != "data/x.csv" {
+		t.Errorf("app/data//x.csv = (%v, %q, %v)", root, rel, ok)
+	}
+	if root, rel, ok = SplitRootPath(roots, "docs"); !ok || rel != "." || root.RootName() != "docs" {
+		t.Errorf("docs = (%v, %q, %v)", root, rel, ok)
+	}
+	for _, p := range []string{".", "..", "../app", "/srv/app", "nope/x"} {
+		if _, _, ok := SplitRootPath(roots, p); ok {
+			t.Errorf("%s should name no root", p)
+		}
+	}
+}
+
+func TestValidateConstraints_Paths(t *testing.T) {
+	if err := ValidateConstraints(capability.Constraints{Paths: testRoots()}); err != nil {
+		t.Errorf("valid paths: %v", err)
+	}
+	for name, roots := range map[string][]capability.PathRoot{
+		"relative root":  {{Root: "srv/app"}},
+		"duplicate name": {{Root: "/a/data"}, {Root: "/b/data"}},
+		"bad name":       {{Name: "a/b", Root: "/a"}},
+		"bad mode":       {{Root: "/a", Mode: "wo"}},
+		"bad glob":       {{Root: "/a", Allow: []string{"[x"}}},
+		"escaping glob":  {{Root: "/a", Deny: []string{"../**"}}},
+		"absolute glob":  {{Root: "/a", Allow: []string{"/a/**"}}},
+	} {
+		if err := ValidateConstraints(capability.Constraints{Paths: roots}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// --- parseRateLimit tests ---
 
 func TestParseRate_Valid(t *testing.T) {
-	rate, ok := parseRate("50rps")
-	if !ok || rate != 50 {
-		t.Errorf("parseRate(\"50rps\") = (%f, %v), want (50, true)", rate, ok)
+	specs, err := parseRateLimit("50rps")
+	if err != nil || len(specs) != 1 || specs[0].rate != 50 || specs[0].burst != 50 {
+		t.Errorf("parseRateLimit(\"50rps\") = (%+v, %v), want rate and burst 50", specs, err)
 	}
 }
 
 func TestParseRate_Fractional(t *testing.T) {
-	rate, ok := parseRate("0.5rps")
-	if !ok || rate != 0.5 {
-		t.Errorf("parseRate(\"0.5rps\") = (%f, %v), want (0.5, true)", rate, ok)
+	specs, err := parseRateLimit("0.5rps")
+	if err != nil || specs[0].rate != 0.5 || specs[0].burst != 1 {
+		t.Errorf("parseRateLimit(\"0.5rps\") = (%+v, %v), want rate 0.5, burst 1", specs, err)
 	}
 }
 
 func TestParseRate_Invalid(t *testing.T) {
-	cases := []string{"", "50rpm", "abc", "0rps", "-5rps", "rps"}
+	cases := []string{"", "50rpx", "abc", "0rps", "-5rps", "rps", "50rps,", "50rps burst", "50rps burst 0", "50rps bust 5"}
 	for _, s := range cases {
-		_, ok := parseRate(s)
-		if ok {
-			t.Errorf("parseRate(%q) should fail", s)
+		if _, err := parseRateLimit(s); err == nil {
+			t.Errorf("parseRateLimit(%q) should fail", s)
 		}
 	}
 }
 
 // --- enforceRateLimit tests ---
 
+// enforceRateLimit applies a capability's rate_limit alone.
+func enforceRateLimit(capID, rateLimit string) error {
+	return checkRateLimits(capID, rateLimit, nil, "", 0, true)
+}
+
+// useMemoryLimiter gives the test a fresh limiter.
+func useMemoryLimiter(t *testing.T) *MemoryLimiter {
+	m := NewMemoryLimiter()
+	SetLimiter(m)
+	t.Cleanup(func() { SetLimiter(NewMemoryLimiter()) })
+	return m
+}
+
 func TestEnforceRateLimit_EmptyRateLimit(t *testing.T) {
 	err := enforceRateLimit("cap1", "")
 	if err != nil {
@@ -115,7 +304,7 @@ func TestEnforceRateLimit_EmptyRateLimit(t *testing.T) {
 }
 
 func TestEnforceRateLimit_MalformedRateReturnsError(t *testing.T) {
-	err := enforceRateLimit("cap-malformed", "50rpm")
+	err := enforceRateLimit("cap-malformed", "50rpx")
 	if err == nil {
 		t.Fatal("expected error for malformed rate limit")
 	}
@@ -127,9 +316,7 @@ func TestEnforceRateLimit_MalformedRateReturnsError(t *testing.T) {
 
 func TestEnforceRateLimit_BasicExhaustion(t *testing.T) {
 	capID := "cap-exhaust-test"
-	globalLimiter.mu.Lock()
-	delete(globalLimiter.buckets, capID)
-	globalLimiter.mu.Unlock()
+	useMemoryLimiter(t)
 
 	// 2 requests/second — bucket starts full with 2 tokens.
 	for i := 0; i < 2; i++ {
@@ -150,9 +337,7 @@ func TestEnforceRateLimit_BasicExhaustion(t *testing.T) {
 
 func TestEnforceRateLimit_TokenRefill(t *testing.T) {
 	capID := "cap-refill-test"
-	globalLimiter.mu.Lock()
-	delete(globalLimiter.buckets, capID)
-	globalLimiter.mu.Unlock()
+	mem := useMemoryLimiter(t)
 
 	// 10rps — exhaust all tokens.
 	for i := 0; i < 10; i++ {
@@ -164,10 +349,10 @@ func TestEnforceRateLimit_TokenRefill(t *testing.T) {
 	}
 
 	// Simulate time passing by manually adjusting the bucket.
-	globalLimiter.mu.Lock()
-	b := globalLimiter.buckets[capID]
-	b.last = b.last.Add(-1 * time.Second)
-	globalLimiter.mu.Unlock()
+	mem.mu.Lock()
+	b := mem.buckets[capID]
+	b.Last = b.Last.Add(-1 * time.Second)
+	mem.mu.Unlock()
 
 	// After 1 second at 10rps, 10 tokens should have refilled.
 	if err := enforceRateLimit(capID, "10rps"); err != nil {
@@ -178,10 +363,7 @@ func TestEnforceRateLimit_TokenRefill(t *testing.T) {
 func TestEnforceRateLimit_PerCapIsolation(t *testing.T) {
 	capA := "cap-iso-a"
 	capB := "cap-iso-b"
-	globalLimiter.mu.Lock()
-	delete(globalLimiter.buckets, capA)
-	delete(globalLimiter.buckets, capB)
-	globalLimiter.mu.Unlock()
+	useMemoryLimiter(t)
 
 	// Exhaust cap A (1rps).
 	enforceRateLimit(capA, "1rps")
@@ -200,23 +382,23 @@ func TestEnforceRateLimit_StaleEviction(t *testing.T) {
 	staleID := "cap-stale-evict"
 	activeID := "cap-active-evict"
 
-	globalLimiter.mu.Lock()
+	mem := useMemoryLimiter(t)
+	mem.mu.Lock()
 	// Insert a stale bucket (last used > staleBucketTTL ago).
-	globalLimiter.buckets[staleID] = &bucket{
-		tokens: 10,
-		rate:   10,
-		last:   time.Now().Add(-staleBucketTTL - time.Minute),
+	mem.buckets[staleID] = &Bucket{
+		Tokens: 10,
+		Rate:   10,
+		Last:   time.Now().Add(-staleBucketTTL - time.Minute),
 	}
-	delete(globalLimiter.buckets, activeID)
-	globalLimiter.mu.Unlock()
+	mem.mu.Unlock()
 
 	// This call triggers lazy eviction.
 	enforceRateLimit(activeID, "10rps")
 
-	globalLimiter.mu.Lock()
-	_, staleExists := globalLimiter.buckets[staleID]
-	_, activeExists := globalLimiter.buckets[activeID]
-	globalLimiter.mu.Unlock()
+	mem.mu.Lock()
+	_, staleExists := mem.buckets[staleID]
+	_, activeExists := mem.buckets[activeID]
+	mem.mu.Unlock()
 
 	if staleExists {
 		t.Error("stale bucket should have been evicted")
@@ -226,20 +408,43 @@ func TestEnforceRateLimit_StaleEviction(t *testing.T) {
 	}
 }
 
+func TestEnforceRateLimit_SlowBucketOutlivesTTL(t *testing.T) {
+	id := "cap-slow-evict"
+	mem := useMemoryLimiter(t)
+
+	for i := 0; i < 100; i++ {
+		if err := enforceRateLimit(id, "100rph"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	// Wait past the TTL: 6 minutes refill 10 of the 100 tokens.
+	mem.mu.Lock()
+	mem.buckets[id].Last = time.Now().Add(-staleBucketTTL - time.Minute)
+	mem.mu.Unlock()
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if enforceRateLimit(id, "100rph") == nil {
+			allowed++
+		}
+	}
+	if allowed < 9 || allowed > 11 {
+		t.Errorf("%d requests allowed after 6 minutes, want about 10", allowed)
+	}
+}
+
 // --- enforceConstraints integration ---
 
 func TestEnforceConstraints_NoConstraints(t *testing.T) {
 	claims := &capability.Capability{ID: "test"}
-	if err := enforceConstraints(claims, nil); err != nil {
+	if err := enforceConstraints(claims, nil, &evaluation{}); err != nil {
 		t.Errorf("no constraints should pass: %v", err)
 	}
 }
 
 func TestEnforceConstraints_PathAndRate(t *testing.T) {
 	capID := "cap-both-constraints"
-	globalLimiter.mu.Lock()
-	delete(globalLimiter.buckets, capID)
-	globalLimiter.mu.Unlock()
+	useMemoryLimiter(t)
 
 	claims := &capability.Capability{
 		ID: capID,
@@ -249,7 +454,7 @@ func TestEnforceConstraints_PathAndRate(t *testing.T) {
 		},
 	}
 	ctx := map[string]any{"path": "file.txt"}
-	if err := enforceConstraints(claims, ctx); err != nil {
+	if err := enforceConstraints(claims, ctx, &evaluation{}); err != nil {
 		t.Errorf("valid path + rate should pass: %v", err)
 	}
 }
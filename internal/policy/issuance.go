@@ -0,0 +1,264 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// IssuancePolicy decides which requesters may mint which capabilities.
+// Requesters are identified by the kernel-verified UID of the calling
+// process, or by presenting an admin capability (a token authorized for
+// identity.issue), which bypasses the rules entirely.
+type IssuancePolicy struct {
+	AdminUIDs []int          `json:"admin_uids"`
+	Rules     []IssuanceRule `json:"rules"`
+}
+
+// IssuanceRule grants a set of requester UIDs the ability to mint
+// capabilities for one service, within limits.
+type IssuanceRule struct {
+	UIDs          []int    `json:"uids"`
+	Service       string   `json:"service"`
+	Rights        []string `json:"rights"` // fully-qualified rights the requester may grant
+	MaxTTLSeconds int      `json:"max_ttl_seconds,omitempty"`
+	// MaxRefreshTTLSeconds allows refresh credentials living at most this
+	// long; zero means the rule does not allow refresh credentials.
+	MaxRefreshTTLSeconds int      `json:"max_refresh_ttl_seconds,omitempty"`
+	Require              Required `json:"require,omitempty"`
+	// Attrs lists the subject attribute values the requester may grant,
+	// e.g. {"clearance": ["pii"]}; none may be granted by default.
+	Attrs map[string][]string `json:"attrs,omitempty"`
+}
+
+// Required lists constraints every capability minted under a rule must carry.
+type Required struct {
+	// PathPrefix: the issued path_prefix, or every root of the issued
+	// paths, must equal or lie beneath it.
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// RateLimit: the issued rate_limit must be present and, for each limit
+	// in it, carry one of the same kind no faster and with no larger burst.
+	RateLimit string `json:"rate_limit,omitempty"`
+	// MaxUses: the issued max_uses must be present and at most it.
+	MaxUses int `json:"max_uses,omitempty"`
+}
+
+// IssuanceRequest describes a capability a requester is asking to mint.
+type IssuanceRequest struct {
+	PeerUID    int    // -1 when the peer is unknown
+	Admin      bool   // requester presented an admin capability
+	Subject    string // "" keeps the default subject
+	Service    string
+	Rights     []string // fully-qualified; legacy actions already expanded
+	TTL        time.Duration
+	RefreshTTL time.Duration // zero when no refresh credential is requested
+	PathPrefix string
+	PathRoots  []string // roots of the paths constraint
+	RateLimit  string
+	MaxUses    int // zero when the capability is not use-limited
+	Attrs      map[string][]string
+}
+
+// UIDSubject is the token subject attributed to a requesting UID.
+func UIDSubject(uid int) string {
+	return fmt.Sprintf("uid:%d", uid)
+}
+
+// DefaultIssuancePolicy allows root and the given UID (normally identity's
+// own) to issue anything, and nobody else.
+func DefaultIssuancePolicy(uid int) *IssuancePolicy {
+	admins := []int{0}
+	if uid != 0 {
+		admins = append(admins, uid)
+	}
+	return &IssuancePolicy{AdminUIDs: admins}
+}
+
+// LoadIssuancePolicy reads a JSON issuance policy from path.
+func LoadIssuancePolicy(path string) (*IssuancePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read issuance policy: %w", err)
+	}
+	var p IssuancePolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse issuance policy: %w", err)
+	}
+	for i, r := range p.Rules {
+		if r.Service == "" {
+			return nil, fmt.Errorf("issuance rule %d: missing service", i)
+		}
+		for _, right := range r.Rights {
+			if err := ValidateRight(right); err != nil {
+				return nil, fmt.Errorf("issuance rule %d: %v", i, err)
+			}
+			if strings.HasPrefix(right, "!") {
+				return nil, fmt.Errorf("issuance rule %d: negative right %q; rules list what may be granted", i, right)
+			}
+		}
+		for key, values := range r.Attrs {
+			for _, v := range values {
+				if err := ValidateAttr(key, v); err != nil {
+					return nil, fmt.Errorf("issuance rule %d: %v", i, err)
+				}
+			}
+		}
+		if r.Require.RateLimit != "" {
+			if _, err := parseRateLimit(r.Require.RateLimit); err != nil {
+				return nil, fmt.Errorf("issuance rule %d: %w", i, err)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// IsAdmin reports whether uid is an issuance admin.
+func (p *IssuancePolicy) IsAdmin(uid int) bool {
+	return containsUID(p.AdminUIDs, uid)
+}
+
+// CheckIssuance returns nil if the request may be granted, or a
+// *PolicyError with Details["field"] naming the violating field.
+// Rules are tried in order; if none permits the request, the error from
+// the first rule that applies to the requester and service is returned.
+func (p *IssuancePolicy) CheckIssuance(r IssuanceRequest) error {
+	if r.Admin || containsUID(p.AdminUIDs, r.PeerUID) {
+		return nil
+	}
+	// Only admins may attribute tokens to someone else.
+	if r.Subject != "" && (r.PeerUID < 0 || r.Subject != UIDSubject(r.PeerUID)) {
+		return issuanceDenied("subject", fmt.Sprintf("requester may not issue capabilities for subject %q", r.Subject))
+	}
+
+	var first error
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Service != r.Service || !containsUID(rule.UIDs, r.PeerUID) {
+			continue
+		}
+		err := rule.check(r)
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return first
+	}
+	return issuanceDenied("service", fmt.Sprintf("requester not allowed to issue capabilities for service %q", r.Service))
+}
+
+func (rule *IssuanceRule) check(r IssuanceRequest) error {
+	for _, right := range r.Rights {
+		// Negative rights only narrow a capability; anyone may add them.
+		if strings.HasPrefix(right, "!") {
+			continue
+		}
+		if !rule.grantable(right) {
+			return issuanceDenied("rights", fmt.Sprintf("right %q not grantable", right))
+		}
+	}
+	for key, values := range r.Attrs {
+		for _, v := range values {
+			if !containsString(rule.Attrs[key], v) {
+				return issuanceDenied("attrs", fmt.Sprintf("attribute %s=%s not grantable", key, v))
+			}
+		}
+	}
+	if rule.MaxTTLSeconds > 0 && r.TTL > time.Duration(rule.MaxTTLSeconds)*time.Second {
+		return issuanceDenied("ttl_seconds", fmt.Sprintf("ttl exceeds maximum of %ds", rule.MaxTTLSeconds))
+	}
+	if r.RefreshTTL > 0 {
+		if rule.MaxRefreshTTLSeconds <= 0 {
+			return issuanceDenied("refresh_ttl_seconds", "refresh credentials not allowed")
+		}
+		if r.RefreshTTL > time.Duration(rule.MaxRefreshTTLSeconds)*time.Second {
+			return issuanceDenied("refresh_ttl_seconds", fmt.Sprintf("refresh ttl exceeds maximum of %ds", rule.MaxRefreshTTLSeconds))
+		}
+	}
+	if req := rule.Require.PathPrefix; req != "" {
+		if len(r.PathRoots) == 0 && !withinRealPrefix(r.PathPrefix, req) {
+			return issuanceDenied("path_prefix", fmt.Sprintf("path_prefix must be within %s", req))
+		}
+		for _, root := range r.PathRoots {
+			if !withinRealPrefix(root, req) {
+				return issuanceDenied("paths", fmt.Sprintf("root %s must be within %s", root, req))
+			}
+		}
+	}
+	if req := rule.Require.RateLimit; req != "" {
+		max, _ := parseRateLimit(req)
+		got, err := parseRateLimit(r.RateLimit)
+		if r.RateLimit == "" || err != nil || !withinRate(got, max) {
+			return issuanceDenied("rate_limit", fmt.Sprintf("rate_limit required, at most %s", req))
+		}
+	}
+	if req := rule.Require.MaxUses; req > 0 && (r.MaxUses <= 0 || r.MaxUses > req) {
+		return issuanceDenied("max_uses", fmt.Sprintf("max_uses required, at most %d", req))
+	}
+	return nil
+}
+
+// grantable reports whether one of the rule's rights covers right.
+func (rule *IssuanceRule) grantable(right string) bool {
+	for _, p := range rule.Rights {
+		if coversRight(p, right) {
+			return true
+		}
+	}
+	return false
+}
+
+// withinPrefix reports whether path equals prefix or lies beneath it.
+// An empty path (no constraint) is never within a required prefix.
+func withinPrefix(path, prefix string) bool {
+	if path == "" {
+		return false
+	}
+	path = filepath.Clean(path)
+	prefix = filepath.Clean(prefix)
+	return path == prefix || prefix == "/" || strings.HasPrefix(path, prefix+string(filepath.Separator))
+}
+
+// withinRealPrefix is withinPrefix with symlinks in both paths resolved,
+// so that a link beneath prefix to a directory elsewhere is not within it.
+func withinRealPrefix(path, prefix string) bool {
+	if path == "" {
+		return false
+	}
+	path, err := realPath(path)
+	if err != nil {
+		return false
+	}
+	prefix, err = realPath(prefix)
+	if err != nil {
+		return false
+	}
+	return withinPrefix(path, prefix)
+}
+
+func containsUID(uids []int, uid int) bool {
+	if uid < 0 {
+		return false
+	}
+	for _, u := range uids {
+		if u == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func issuanceDenied(field, msg string) *PolicyError {
+	return &PolicyError{
+		Code:    CodePermissionDenied,
+		Name:    "PERMISSION_DENIED",
+		Message: msg,
+		Details: map[string]any{"field": field},
+	}
+}
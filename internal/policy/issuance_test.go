@@ -0,0 +1,318 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testIssuancePolicy() *IssuancePolicy {
+	return &IssuancePolicy{
+		AdminUIDs: []int{0},
+		Rules: []IssuanceRule{
+			{
+				UIDs:          []int{1000},
+				Service:       "fs",
+				Rights:        []string{"fs.open", "fs.read", "fs.list"},
+				MaxTTLSeconds: 600,
+				Require:       Required{PathPrefix: "/srv/data", RateLimit: "50rps"},
+			},
+		},
+	}
+}
+
+func validIssuance() IssuanceRequest {
+	return IssuanceRequest{
+		PeerUID:    1000,
+		Service:    "fs",
+		Rights:     []string{"fs.read"},
+		TTL:        5 * time.Minute,
+		PathPrefix: "/srv/data/app",
+		RateLimit:  "10rps",
+	}
+}
+
+func deniedField(t *testing.T, err error) string {
+	t.Helper()
+	pe, ok := err.(*PolicyError)
+	if !ok {
+		t.Fatalf("expected *PolicyError, got %T (%v)", err, err)
+	}
+	if pe.Code != CodePermissionDenied {
+		t.Errorf("code = %d, want %d", pe.Code, CodePermissionDenied)
+	}
+	field, _ := pe.Details["field"].(string)
+	return field
+}
+
+func TestCheckIssuance_AllowedByRule(t *testing.T) {
+	if err := testIssuancePolicy().CheckIssuance(validIssuance()); err != nil {
+		t.Errorf("unexpected denial: %v", err)
+	}
+}
+
+func TestCheckIssuance_AdminUID(t *testing.T) {
+	r := IssuanceRequest{PeerUID: 0, Service: "identity", Rights: []string{"identity.issue"}, TTL: 24 * time.Hour}
+	if err := testIssuancePolicy().CheckIssuance(r); err != nil {
+		t.Errorf("admin UID should bypass rules: %v", err)
+	}
+}
+
+func TestCheckIssuance_AdminCapability(t *testing.T) {
+	r := IssuanceRequest{PeerUID: 4242, Admin: true, Service: "fs", Rights: []string{"fs.open"}}
+	if err := testIssuancePolicy().CheckIssuance(r); err != nil {
+		t.Errorf("admin capability should bypass rules: %v", err)
+	}
+}
+
+func TestCheckIssuance_UnknownRequester(t *testing.T) {
+	r := validIssuance()
+	r.PeerUID = 4242
+	if f := deniedField(t, testIssuancePolicy().CheckIssuance(r)); f != "service" {
+		t.Errorf("field = %q, want %q", f, "service")
+	}
+}
+
+func TestCheckIssuance_UnknownPeer(t *testing.T) {
+	r := validIssuance()
+	r.PeerUID = -1
+	if err := DefaultIssuancePolicy(0).CheckIssuance(r); err == nil {
+		t.Error("unknown peer must be denied")
+	}
+}
+
+func TestCheckIssuance_WrongService(t *testing.T) {
+	r := validIssuance()
+	r.Service = "identity"
+	r.Rights = []string{"identity.issue"}
+	if f := deniedField(t, testIssuancePolicy().CheckIssuance(r)); f != "service" {
+		t.Errorf("field = %q, want %q", f, "service")
+	}
+}
+
+func TestCheckIssuance_Violations(t *testing.T) {
+	cases := []struct {
+		name  string
+		edit  func(*IssuanceRequest)
+		field string
+	}{
+		{"right not grantable", func(r *IssuanceRequest) { r.Rights = []string{"fs.read", "fs.write"} }, "rights"},
+		{"ttl too long", func(r *IssuanceRequest) { r.TTL = time.Hour }, "ttl_seconds"},
+		{"missing prefix", func(r *IssuanceRequest) { r.PathPrefix = "" }, "path_prefix"},
+		{"prefix outside", func(r *IssuanceRequest) { r.PathPrefix = "/srv/database" }, "path_prefix"},
+		{"prefix escapes", func(r *IssuanceRequest) { r.PathPrefix = "/srv/data/../secret" }, "path_prefix"},
+		{"root outside", func(r *IssuanceRequest) { r.PathRoots = []string{"/srv/data/a", "/srv/other"} }, "paths"},
+		{"missing rate", func(r *IssuanceRequest) { r.RateLimit = "" }, "rate_limit"},
+		{"rate too fast", func(r *IssuanceRequest) { r.RateLimit = "100rps" }, "rate_limit"},
+	}
+	for _, tc := range cases {
+		r := validIssuance()
+		tc.edit(&r)
+		if f := deniedField(t, testIssuancePolicy().CheckIssuance(r)); f != tc.field {
+			t.Errorf("%s: field = %q, want %q", tc.name, f, tc.field)
+		}
+	}
+}
+
+func TestCheckIssuance_PathRoots(t *testing.T) {
+	r := validIssuance()
+	r.PathPrefix = ""
+	r.PathRoots = []string{"/srv/data/a", "/srv/data/b"}
+	if err := testIssuancePolicy().CheckIssuance(r); err != nil {
+		t.Errorf("roots within the required prefix: %v", err)
+	}
+}
+
+func TestCheckIssuance_SymlinkedPrefix(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "data", "app"), 0o755)
+	os.Mkdir(filepath.Join(dir, "secret"), 0o755)
+	os.Symlink("../secret", filepath.Join(dir, "data", "link"))
+
+	p := testIssuancePolicy()
+	p.Rules[0].Require.PathPrefix = filepath.Join(dir, "data")
+	r := validIssuance()
+	r.PathPrefix = filepath.Join(dir, "data", "app")
+	if err := p.CheckIssuance(r); err != nil {
+		t.Errorf("prefix within the required one: %v", err)
+	}
+	// Lexically within it, a link leads out.
+	r.PathPrefix = filepath.Join(dir, "data", "link")
+	if f := deniedField(t, p.CheckIssuance(r)); f != "path_prefix" {
+		t.Errorf("prefix through a link: field = %q, want path_prefix", f)
+	}
+	r.PathPrefix = ""
+	r.PathRoots = []string{filepath.Join(dir, "data", "link", "x")}
+	if f := deniedField(t, p.CheckIssuance(r)); f != "paths" {
+		t.Errorf("root through a link: field = %q, want paths", f)
+	}
+}
+
+func TestCheckIssuance_Subject(t *testing.T) {
+	r := validIssuance()
+	r.Subject = UIDSubject(1000)
+	if err := testIssuancePolicy().CheckIssuance(r); err != nil {
+		t.Errorf("own subject should be allowed: %v", err)
+	}
+
+	r.Subject = "uid:0"
+	if f := deniedField(t, testIssuancePolicy().CheckIssuance(r)); f != "subject" {
+		t.Errorf("field = %q, want %q", f, "subject")
+	}
+
+	r.Admin = true
+	if err := testIssuancePolicy().CheckIssuance(r); err != nil {
+		t.Errorf("admin may name any subject: %v", err)
+	}
+}
+
+func TestCheckIssuance_RefreshTTL(t *testing.T) {
+	r := validIssuance()
+	r.RefreshTTL = time.Hour
+	if f := deniedField(t, testIssuancePolicy().CheckIssuance(r)); f != "refresh_ttl_seconds" {
+		t.Errorf("field = %q, want %q when the rule allows no refresh", f, "refresh_ttl_seconds")
+	}
+
+	p := testIssuancePolicy()
+	p.Rules[0].MaxRefreshTTLSeconds = 3600
+	if err := p.CheckIssuance(r); err != nil {
+		t.Errorf("refresh within limit should be allowed: %v", err)
+	}
+	r.RefreshTTL = 2 * time.Hour
+	if f := deniedField(t, p.CheckIssuance(r)); f != "refresh_ttl_seconds" {
+		t.Errorf("field = %q, want %q", f, "refresh_ttl_seconds")
+	}
+}
+
+func TestCheckIssuance_MaxUses(t *testing.T) {
+	p := testIssuancePolicy()
+	p.Rules[0].Require.MaxUses = 5
+	r := validIssuance()
+	if f := deniedField(t, p.CheckIssuance(r)); f != "max_uses" {
+		t.Errorf("field = %q, want %q when max_uses is missing", f, "max_uses")
+	}
+	r.MaxUses = 10
+	if f := deniedField(t, p.CheckIssuance(r)); f != "max_uses" {
+		t.Errorf("field = %q, want %q when max_uses is too high", f, "max_uses")
+	}
+	r.MaxUses = 1
+	if err := p.CheckIssuance(r); err != nil {
+		t.Errorf("max_uses within limit should be allowed: %v", err)
+	}
+}
+
+func TestCheckIssuance_LaterRuleMayAllow(t *testing.T) {
+	p := testIssuancePolicy()
+	p.Rules = append(p.Rules, IssuanceRule{
+		UIDs:    []int{1000},
+		Service: "fs",
+		Rights:  []string{"fs.write"},
+		Require: Required{PathPrefix: "/srv/scratch"},
+	})
+	r := IssuanceRequest{PeerUID: 1000, Service: "fs", Rights: []string{"fs.write"}, PathPrefix: "/srv/scratch/x"}
+	if err := p.CheckIssuance(r); err != nil {
+		t.Errorf("second rule should allow: %v", err)
+	}
+}
+
+func TestCheckIssuance_WildcardRights(t *testing.T) {
+	p := testIssuancePolicy()
+	p.Rules[0].Rights = []string{"fs.*"}
+	for _, rights := range [][]string{{"fs.read"}, {"fs.dir.make"}, {"fs.*"}, {"fs.dir.*"}} {
+		r := validIssuance()
+		r.Rights = rights
+		if err := p.CheckIssuance(r); err != nil {
+			t.Errorf("fs.* should cover %v: %v", rights, err)
+		}
+	}
+
+	p.Rules[0].Rights = []string{"fs.read", "fs.list"}
+	r := validIssuance()
+	r.Rights = []string{"fs.*"}
+	if f := deniedField(t, p.CheckIssuance(r)); f != "rights" {
+		t.Errorf("field = %q, want %q for a wildcard broader than the rule", f, "rights")
+	}
+}
+
+func TestCheckIssuance_NegativeRightsAlwaysGrantable(t *testing.T) {
+	r := validIssuance()
+	r.Rights = []string{"fs.read", "!fs.write", "!supervisor.*"}
+	if err := testIssuancePolicy().CheckIssuance(r); err != nil {
+		t.Errorf("negative rights only narrow and should be allowed: %v", err)
+	}
+}
+
+func TestCheckIssuance_Attrs(t *testing.T) {
+	p := testIssuancePolicy()
+	r := validIssuance()
+	r.Attrs = map[string][]string{"clearance": {"pii"}}
+	if f := deniedField(t, p.CheckIssuance(r)); f != "attrs" {
+		t.Errorf("field = %q, want %q when the rule grants no attributes", f, "attrs")
+	}
+	p.Rules[0].Attrs = map[string][]string{"clearance": {"pii", "finance"}}
+	if err := p.CheckIssuance(r); err != nil {
+		t.Errorf("grantable attribute denied: %v", err)
+	}
+	r.Attrs["team"] = []string{"payments"}
+	if f := deniedField(t, p.CheckIssuance(r)); f != "attrs" {
+		t.Errorf("field = %q, want %q for an attribute outside the rule", f, "attrs")
+	}
+}
+
+func TestDefaultIssuancePolicy(t *testing.T) {
+	p := DefaultIssuancePolicy(1000)
+	for _, uid := range []int{0, 1000} {
+		r := IssuanceRequest{PeerUID: uid, Service: "fs", Rights: []string{"fs.open"}}
+		if err := p.CheckIssuance(r); err != nil {
+			t.Errorf("uid %d should be admin: %v", uid, err)
+		}
+	}
+	r := IssuanceRequest{PeerUID: 1001, Service: "fs", Rights: []string{"fs.open"}}
+	if err := p.CheckIssuance(r); err == nil {
+		t.Error("other UIDs should be denied by default")
+	}
+}
+
+func TestLoadIssuancePolicy(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "issuance.json")
+	os.WriteFile(path, []byte(`{
+		"admin_uids": [0],
+		"rules": [{"uids": [1000], "service": "fs", "rights": ["fs.read"], "max_ttl_seconds": 60,
+		           "require": {"path_prefix": "/srv", "rate_limit": "5rps"}}]
+	}`), 0644)
+
+	p, err := LoadIssuancePolicy(path)
+	if err != nil {
+		t.Fatalf("LoadIssuancePolicy: %v", err)
+	}
+	if len(p.Rules) != 1 || p.Rules[0].Require.PathPrefix != "/srv" {
+		t.Errorf("unexpected policy: %+v", p)
+	}
+}
+
+func TestLoadIssuancePolicy_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"badjson.json":   `{`,
+		"noservice.json": `{"rules": [{"uids": [1]}]}`,
+		"badrate.json":   `{"rules": [{"service": "fs", "require": {"rate_limit": "fast"}}]}`,
+		"badright.json":  `{"rules": [{"service": "fs", "rights": ["fs.*.read"]}]}`,
+		"negright.json":  `{"rules": [{"service": "fs", "rights": ["!fs.write"]}]}`,
+		"badattr.json":   `{"rules": [{"service": "fs", "attrs": {"clearance": ["Top Secret"]}}]}`,
+	}
+	for name, body := range cases {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(body), 0644)
+		if _, err := LoadIssuancePolicy(path); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := LoadIssuancePolicy(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
@@ -0,0 +1,155 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// CtxLabels carries the labels of the resource a request accesses
+// ([]string). Authorize requires the capability's attributes to satisfy
+// every one of them.
+const CtxLabels = "labels"
+
+// ClearanceAttr is the attribute a bare label is matched against.
+const ClearanceAttr = "clearance"
+
+// Labels are "name" or "key=value". A resource labelled "pii" may only be
+// accessed by capabilities whose clearance attribute includes "pii"; one
+// labelled "team=payments" only by those whose team attribute includes
+// "payments". A resource's labels must all be satisfied.
+
+// ValidateLabel reports whether label is well-formed.
+func ValidateLabel(label string) error {
+	key, value := splitLabel(label)
+	if !validLabelPart(key) || !validLabelPart(value) {
+		return fmt.Errorf("label %q must be name or key=value of [a-z0-9_.:-]", label)
+	}
+	return nil
+}
+
+// ValidateAttr reports whether key and value form a valid attribute.
+func ValidateAttr(key, value string) error {
+	if !validLabelPart(key) || !validLabelPart(value) {
+		return fmt.Errorf("attribute %s=%s must be key=value of [a-z0-9_.:-]", key, value)
+	}
+	return nil
+}
+
+func validLabelPart(s string) bool {
+	return s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '.' || r == ':' || r == '-')
+	}) < 0
+}
+
+// splitLabel returns the attribute key and value a label requires.
+func splitLabel(label string) (string, string) {
+	if key, value, ok := strings.Cut(label, "="); ok {
+		return key, value
+	}
+	return ClearanceAttr, label
+}
+
+// CheckLabels reports whether claims' attributes satisfy every label.
+func CheckLabels(claims *capability.Capability, labels []string) error {
+	for _, l := range labels {
+		key, value := splitLabel(l)
+		if !containsString(claims.Attrs[key], value) {
+			return &PolicyError{
+				Code:    CodePermissionDenied,
+				Name:    "PERMISSION_DENIED",
+				Message: fmt.Sprintf("resource labelled %q requires attribute %s=%s", l, key, value),
+				Details: map[string]any{"label": l},
+			}
+		}
+	}
+	return nil
+}
+
+// enforceLabels applies CheckLabels to the labels in ctx, if any.
+func enforceLabels(claims *capability.Capability, ctx map[string]any, ev *evaluation) error {
+	labels, _ := ctx[CtxLabels].([]string)
+	if len(labels) == 0 {
+		ev.step("labels", StepSkip, "resource is unlabelled")
+		return nil
+	}
+	if err := CheckLabels(claims, labels); err != nil {
+		return ev.fail("labels", err)
+	}
+	ev.step("labels", StepPass, strings.Join(labels, ","))
+	return nil
+}
+
+// LabelDB is a sidecar database of resource labels by absolute path. A
+// path carries its own labels and those of every directory above it.
+type LabelDB struct {
+	labels map[string][]string
+}
+
+// LoadLabels reads a label database: a JSON object mapping absolute paths
+// to label lists, e.g. {"/srv/data/hr": ["pii"]}. Paths are resolved
+// through symlinks as they exist at load, since the host paths looked up
+// are.
+func LoadLabels(path string) (*LabelDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read label database: %w", err)
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse label database: %w", err)
+	}
+	db := &LabelDB{labels: make(map[string][]string, len(raw))}
+	for p, labels := range raw {
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("label database: path %q must be absolute", p)
+		}
+		for _, l := range labels {
+			if err := ValidateLabel(l); err != nil {
+				return nil, fmt.Errorf("label database: %s: %w", p, err)
+			}
+		}
+		real, err := realPath(p)
+		if err != nil {
+			return nil, fmt.Errorf("label database: %s: %w", p, err)
+		}
+		db.labels[real] = append(db.labels[real], labels...)
+	}
+	return db, nil
+}
+
+// Len returns the number of labelled paths.
+func (db *LabelDB) Len() int {
+	if db == nil {
+		return 0
+	}
+	return len(db.labels)
+}
+
+// Lookup returns the labels of the absolute path, inherited ones included,
+// sorted and without duplicates. A nil database labels nothing.
+func (db *LabelDB) Lookup(path string) []string {
+	if db == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var out []string
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		for _, l := range db.labels[p] {
+			if !seen[l] {
+				seen[l] = true
+				out = append(out, l)
+			}
+		}
+		if p == filepath.Dir(p) {
+			break
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+func TestValidateLabel(t *testing.T) {
+	for _, l := range []string{"pii", "team=payments", "level:3", "a.b-c_d"} {
+		if err := ValidateLabel(l); err != nil {
+			t.Errorf("ValidateLabel(%q): %v", l, err)
+		}
+	}
+	for _, l := range []string{"", "PII", "=pii", "team=", "a b", "a=b=c", "pii,hr"} {
+		if err := ValidateLabel(l); err == nil {
+			t.Errorf("ValidateLabel(%q) accepted", l)
+		}
+	}
+}
+
+func TestCheckLabels(t *testing.T) {
+	claims := &capability.Capability{Attrs: map[string][]string{
+		"clearance": {"pii", "finance"},
+		"team":      {"payments"},
+	}}
+	cases := []struct {
+		labels []string
+		want   bool
+	}{
+		{nil, true},
+		{[]string{"pii"}, true},
+		{[]string{"pii", "finance", "team=payments"}, true},
+		{[]string{"secret"}, false},
+		{[]string{"pii", "team=hr"}, false},
+		{[]string{"clearance=pii"}, true},
+		{[]string{"payments"}, false}, // a bare label is a clearance, not any attribute
+	}
+	for _, tc := range cases {
+		err := CheckLabels(claims, tc.labels)
+		if got := err == nil; got != tc.want {
+			t.Errorf("CheckLabels(%v) allowed = %v, want %v (%v)", tc.labels, got, tc.want, err)
+		}
+	}
+	if err := CheckLabels(&capability.Capability{}, []string{"pii"}); err == nil {
+		t.Error("a capability without attributes should not satisfy a label")
+	}
+}
+
+func TestAuthorize_Labels(t *testing.T) {
+	cleared := &capability.Capability{Service: "fs", Rights: []string{"fs.read"}, Attrs: map[string][]string{"clearance": {"pii"}}}
+	plain := &capability.Capability{Service: "fs", Rights: []string{"fs.read"}}
+
+	ctx := map[string]any{CtxLabels: []string{"pii"}}
+	if err := Authorize(cleared, "fs.read", ctx); err != nil {
+		t.Errorf("cleared capability: %v", err)
+	}
+	err := Authorize(plain, "fs.read", ctx)
+	pe, ok := err.(*PolicyError)
+	if !ok || pe.Code != CodePermissionDenied || pe.Details["label"] != "pii" {
+		t.Errorf("uncleared capability: err = %v, want PERMISSION_DENIED naming label pii", err)
+	}
+	if err := Authorize(plain, "fs.read", map[string]any{CtxLabels: []string(nil)}); err != nil {
+		t.Errorf("unlabelled resource: %v", err)
+	}
+}
+
+func TestLabelDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "labels.json")
+	os.WriteFile(path, []byte(`{
+		"/srv/data": ["team=payments"],
+		"/srv/data/hr/": ["pii"],
+		"/srv/data/hr/salaries.csv": ["pii", "finance"]
+	}`), 0644)
+	db, err := LoadLabels(path)
+	if err != nil {
+		t.Fatalf("LoadLabels: %v", err)
+	}
+	cases := map[string][]string{
+		"/srv/data/hr/salaries.csv": {"finance", "pii", "team=payments"},
+		"/srv/data/hr/x":            {"pii", "team=payments"},
+		"/srv/data/../data/readme":  {"team=payments"},
+		"/srv/database":             nil,
+		"/":                         nil,
+	}
+	for p, want := range cases {
+		if got := db.Lookup(p); !reflect.DeepEqual(got, want) {
+			t.Errorf("Lookup(%q) = %v, want %v", p, got, want)
+		}
+	}
+	var none *LabelDB
+	if none.Lookup("/srv/data") != nil || none.Len() != 0 {
+		t.Error("a nil database should label nothing")
+	}
+}
+
+func TestLoadLabels_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"badjson.json":  `{`,
+		"relative.json": `{"srv/data": ["pii"]}`,
+		"badlabel.json": `{"/srv": ["Top Secret"]}`,
+	}
+	for name, body := range cases {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(body), 0644)
+		if _, err := LoadLabels(path); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Bucket is the state of one rate-limit token bucket.
+type Bucket struct {
+	CapID  string    `json:"cap_id"`
+	Limit  string    `json:"limit"`            // the limit as written
+	Method string    `json:"method,omitempty"` // rate_limits pattern; "" for rate_limit
+	Tokens float64   `json:"tokens"`
+	Rate   float64   `json:"rate"` // tokens per second
+	Burst  float64   `json:"burst"`
+	Last   time.Time `json:"last"` // when Tokens was computed
+}
+
+// level returns the bucket's tokens at now.
+func (b *Bucket) level(now time.Time) float64 {
+	return math.Min(b.Tokens+now.Sub(b.Last).Seconds()*b.Rate, b.Burst)
+}
+
+// stale reports whether the bucket has gone unused past staleBucketTTL and
+// refilled, so that dropping it hands back no tokens early.
+func (b *Bucket) stale(now time.Time) bool {
+	return now.Sub(b.Last) > staleBucketTTL && b.level(now) >= b.Burst
+}
+
+// LimiterBackend stores rate-limit buckets by key. Services sharing a
+// backend draw from the same buckets, so a capability's budget is not
+// multiplied by spreading requests over them.
+type LimiterBackend interface {
+	// Update calls fn with the buckets of keys, by key, leaving out those
+	// there are none of, and keeps the changes fn makes to the map if it
+	// returns true. fn runs exclusively: no other Update of those keys,
+	// in any process sharing the backend, runs meanwhile.
+	Update(keys []string, fn func(buckets map[string]*Bucket) bool) error
+	// Buckets returns every bucket.
+	Buckets() ([]Bucket, error)
+}
+
+// MemoryLimiter keeps buckets in this process's memory; a restart
+// refills them.
+type MemoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// NewMemoryLimiter returns an empty in-memory limiter.
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: make(map[string]*Bucket)}
+}
+
+// Update implements LimiterBackend.
+func (m *MemoryLimiter) Update(keys []string, fn func(map[string]*Bucket) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Lazy eviction of stale buckets to prevent unbounded growth.
+	now := time.Now()
+	for key, b := range m.buckets {
+		if b.stale(now) {
+			delete(m.buckets, key)
+		}
+	}
+	buckets := make(map[string]*Bucket, len(keys))
+	for _, key := range keys {
+		if b, ok := m.buckets[key]; ok {
+			buckets[key] = b
+		}
+	}
+	if !fn(buckets) {
+		return nil
+	}
+	for _, key := range keys {
+		if b, ok := buckets[key]; ok {
+			m.buckets[key] = b
+		} else {
+			delete(m.buckets, key)
+		}
+	}
+	return nil
+}
+
+// Buckets implements LimiterBackend.
+func (m *MemoryLimiter) Buckets() ([]Bucket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Bucket, 0, len(m.buckets))
+	for _, b := range m.buckets {
+		out = append(out, *b)
+	}
+	return out, nil
+}
+
+// FileLimiter keeps buckets in a directory shared by every process on the
+// node that opens it, one record per bucket, so restarts do not refill
+// them. Updates lock only the buckets a request draws from; they reach the
+// disk when the limiter is flushed (see FlushState). A bucket whose record
+// does not parse starts afresh, full, and stale ones are swept out.
+type FileLimiter struct {
+	dir *stateDir
+}
+
+// OpenFileLimiter returns a limiter backed by the directory at path,
+// creating it if needed.
+func OpenFileLimiter(path string) (*FileLimiter, error) {
+	dir, err := openStateDir(path, func(data []byte, now time.Time) bool {
+		var b Bucket
+		return json.Unmarshal(data, &b) != nil || b.stale(now)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open rate limits: %w", err)
+	}
+	return &FileLimiter{dir: dir}, nil
+}
+
+// Update implements LimiterBackend.
+func (l *FileLimiter) Update(keys []string, fn func(map[string]*Bucket) bool) error {
+	return l.dir.update(keys, func(recs map[string][]byte) map[string][]byte {
+		buckets := make(map[string]*Bucket, len(recs))
+		for key, data := range recs {
+			var b Bucket
+			if json.Unmarshal(data, &b) == nil {
+				buckets[key] = &b
+			}
+		}
+		if !fn(buckets) {
+			return nil
+		}
+		out := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			if b, ok := buckets[key]; ok {
+				// A bucket that cannot be encoded starts afresh too.
+				data, _ := json.Marshal(b)
+				out[key] = data
+			} else if recs[key] != nil {
+				out[key] = nil
+			}
+		}
+		return out
+	})
+}
+
+// Buckets implements LimiterBackend.
+func (l *FileLimiter) Buckets() ([]Bucket, error) {
+	var out []Bucket
+	err := l.dir.scan(func(data []byte) ([]byte, bool) {
+		var b Bucket
+		if json.Unmarshal(data, &b) == nil {
+			out = append(out, b)
+		}
+		return nil, false
+	})
+	return out, err
+}
+
+// Flush syncs the buckets this process has changed to disk, and now and
+// then sweeps stale ones out.
+func (l *FileLimiter) Flush() error {
+	return l.dir.flush()
+}
+
+// globalLimiter holds the buckets Authorize enforces rate limits with.
+var globalLimiter LimiterBackend = NewMemoryLimiter()
+
+// SetLimiter replaces the backend Authorize keeps rate-limit buckets in,
+// typically with one from OpenFileLimiter. Call it before serving requests.
+func SetLimiter(b LimiterBackend) {
+	globalLimiter = b
+}
+
+// BucketLevels returns the buckets of capID, or of every capability if
+// capID is "", with their tokens refilled to now, ordered by capability.
+func BucketLevels(capID string) ([]Bucket, error) {
+	buckets, err := globalLimiter.Buckets()
+	var out []Bucket
+	now := time.Now()
+	for _, b := range buckets {
+		if (capID == "" || b.CapID == capID) && !b.stale(now) {
+			b.Tokens, b.Last = b.level(now), now
+			out = append(out, b)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CapID != out[j].CapID {
+			return out[i].CapID < out[j].CapID
+		}
+		if out[i].Method != out[j].Method {
+			return out[i].Method < out[j].Method
+		}
+		return out[i].Limit < out[j].Limit
+	})
+	return out, err
+}
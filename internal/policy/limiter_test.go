@@ -0,0 +1,158 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+func openFileLimiter(t *testing.T, path string) *FileLimiter {
+	t.Helper()
+	l, err := OpenFileLimiter(path)
+	if err != nil {
+		t.Fatalf("OpenFileLimiter: %v", err)
+	}
+	return l
+}
+
+func TestFileLimiter_SharedAcrossInstances(t *testing.T) {
+	t.Cleanup(func() { SetLimiter(NewMemoryLimiter()) })
+	path := filepath.Join(t.TempDir(), "ratelimits")
+
+	SetLimiter(openFileLimiter(t, path))
+	for i := 0; i < 2; i++ {
+		if err := enforceRateLimit("file-shared", "2rph"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	// Another process, or this one restarted, sees the spent bucket.
+	SetLimiter(openFileLimiter(t, path))
+	if err := enforceRateLimit("file-shared", "2rph"); err == nil {
+		t.Error("bucket refilled by reopening the limiter")
+	}
+}
+
+func TestFileLimiter_UpdatesExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimits")
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		// Each locks through its own file descriptors, as separate
+		// processes would.
+		l := openFileLimiter(t, path)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				err := l.Update([]string{"n"}, func(buckets map[string]*Bucket) bool {
+					if buckets["n"] == nil {
+						buckets["n"] = &Bucket{}
+					}
+					buckets["n"].Tokens++
+					return true
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var n float64
+	openFileLimiter(t, path).Update([]string{"n"}, func(buckets map[string]*Bucket) bool {
+		n = buckets["n"].Tokens
+		return false
+	})
+	if n != 100 {
+		t.Errorf("counter = %v after 100 updates; updates overlapped", n)
+	}
+}
+
+func TestFileLimiter_CorruptRecordResets(t *testing.T) {
+	t.Cleanup(func() { SetLimiter(NewMemoryLimiter()) })
+	l := openFileLimiter(t, filepath.Join(t.TempDir(), "ratelimits"))
+	SetLimiter(l)
+	for _, id := range []string{"corrupt", "intact"} {
+		if err := enforceRateLimit(id, "1rph"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A crash left one bucket's record half-written.
+	if err := os.WriteFile(l.dir.recordPath("corrupt"), []byte(`{"cap_id":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := enforceRateLimit("corrupt", "1rph"); err != nil {
+		t.Errorf("a corrupt bucket should start afresh: %v", err)
+	}
+	if err := enforceRateLimit("corrupt", "1rph"); err == nil {
+		t.Error("the fresh bucket should have been spent and recorded")
+	}
+	if err := enforceRateLimit("intact", "1rph"); err == nil {
+		t.Error("other buckets should be unaffected")
+	}
+}
+
+func TestBucketLevels(t *testing.T) {
+	useMemoryLimiter(t)
+	claims := &capability.Capability{
+		ID:      "levels",
+		Service: "fs",
+		Rights:  []string{"fs.*"},
+		Constraints: capability.Constraints{
+			RateLimit:  "10rph",
+			RateLimits: map[string]string{"fs.open": "5rph"},
+		},
+	}
+	if err := Authorize(claims, "fs.open", nil); err != nil {
+		t.Fatal(err)
+	}
+	Authorize(&capability.Capability{ID: "other", Service: "fs", Rights: []string{"fs.*"},
+		Constraints: capability.Constraints{RateLimit: "1rps"}}, "fs.list", nil)
+
+	levels, err := BucketLevels("levels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 2 {
+		t.Fatalf("levels = %+v, want 2 buckets", levels)
+	}
+	if b := levels[0]; b.Method != "" || b.Limit != "10rph" || b.Tokens < 8.99 || b.Tokens > 9.01 || b.Burst != 10 {
+		t.Errorf("rate_limit bucket = %+v, want 9 of 10 tokens", b)
+	}
+	if b := levels[1]; b.Method != "fs.open" || b.Limit != "5rph" {
+		t.Errorf("fs.open bucket = %+v", b)
+	}
+	if all, _ := BucketLevels(""); len(all) != 3 {
+		t.Errorf("all levels = %+v, want 3 buckets", all)
+	}
+}
+
+func TestBucketLevels_IdleDrainedBucket(t *testing.T) {
+	mem := useMemoryLimiter(t)
+	for i := 0; i < 100; i++ {
+		if err := enforceRateLimit("drained", "100rph"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	enforceRateLimit("refilled", "1rps")
+	// Idle past the TTL: the drained bucket has refilled only 10 of its
+	// tokens and still limits; the other is full again.
+	mem.mu.Lock()
+	for _, b := range mem.buckets {
+		b.Last = time.Now().Add(-staleBucketTTL - time.Minute)
+	}
+	mem.mu.Unlock()
+
+	levels, err := BucketLevels("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 1 || levels[0].CapID != "drained" || levels[0].Tokens > 11 {
+		t.Errorf("levels = %+v, want just the drained bucket at about 10 tokens", levels)
+	}
+}
@@ -0,0 +1,236 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// Path root access modes.
+const (
+	ModeReadOnly  = "ro"
+	ModeReadWrite = "rw"
+)
+
+// CtxWrite marks a request that modifies the filesystem (bool). Read-only
+// roots deny such requests.
+const CtxWrite = "write"
+
+// parsePaths decodes and validates a paths constraint.
+func parsePaths(raw json.RawMessage) (any, error) {
+	var roots []capability.PathRoot
+	if err := json.Unmarshal(raw, &roots); err != nil {
+		return nil, err
+	}
+	if err := validatePaths(roots); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+// validatePaths checks roots, their names, modes and globs.
+func validatePaths(roots []capability.PathRoot) error {
+	if len(roots) == 0 {
+		return fmt.Errorf("at least one root is required")
+	}
+	names := make(map[string]bool)
+	for _, r := range roots {
+		if !filepath.IsAbs(r.Root) {
+			return fmt.Errorf("root %q must be absolute", r.Root)
+		}
+		name := r.RootName()
+		if name == "." || name == ".." || name == "/" || strings.Contains(name, "/") {
+			return fmt.Errorf("root %s: invalid name %q", r.Root, name)
+		}
+		if names[name] {
+			return fmt.Errorf("root name %q used twice", name)
+		}
+		names[name] = true
+		switch r.Mode {
+		case "", ModeReadOnly, ModeReadWrite:
+		default:
+			return fmt.Errorf("root %s: mode must be %q or %q", name, ModeReadOnly, ModeReadWrite)
+		}
+		for _, g := range append(append([]string(nil), r.Allow...), r.Deny...) {
+			if err := validateGlob(g); err != nil {
+				return fmt.Errorf("root %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateGlob checks a relative slash-separated glob.
+func validateGlob(g string) error {
+	if g == "" || strings.HasPrefix(g, "/") {
+		return fmt.Errorf("glob %q must be a relative path", g)
+	}
+	for _, seg := range strings.Split(g, "/") {
+		if seg == ".." {
+			return fmt.Errorf("glob %q must not contain ..", g)
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("glob %q: %v", g, err)
+		}
+	}
+	return nil
+}
+
+// matchGlob reports whether the slash-separated relative path name matches
+// glob. A "**" segment matches any number of segments, none included;
+// other segments are path.Match patterns. The root itself is ".".
+func matchGlob(glob, name string) bool {
+	var segs []string
+	if name != "." {
+		segs = strings.Split(name, "/")
+	}
+	return matchSegments(strings.Split(glob, "/"), segs)
+}
+
+func matchSegments(glob, segs []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(glob[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], segs[0]); !ok {
+			return false
+		}
+		glob, segs = glob[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// SplitRootPath returns the root of roots a relative request path names by
+// its first component, and the rest of the path ("." for the root itself).
+func SplitRootPath(roots []capability.PathRoot, p string) (*capability.PathRoot, string, bool) {
+	clean := path.Clean(p)
+	if strings.HasPrefix(clean, "/") || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return nil, "", false
+	}
+	name, rest, _ := strings.Cut(clean, "/")
+	if rest == "" {
+		rest = "."
+	}
+	for i := range roots {
+		if roots[i].RootName() == name {
+			return &roots[i], rest, true
+		}
+	}
+	return nil, "", false
+}
+
+// enforcePaths checks ctx["path"], and the host path it resolves to,
+// against the capability's roots.
+func enforcePaths(roots []capability.PathRoot, ctx map[string]any) error {
+	p, _ := ctx["path"].(string)
+	if p == "" {
+		return nil
+	}
+	host, _ := ctx[CtxHostPath].(string)
+	write, _ := ctx[CtxWrite].(bool)
+	return checkPaths(roots, p, host, write)
+}
+
+// checkPaths reports whether a request path, read or written, lies under
+// one of roots and is allowed there. "." is the list of roots, which may
+// be read. The root's globs must allow both the path as named and, if
+// host is not "", the host path it resolves to, so that a symlink cannot
+// lead a request to a file they exclude.
+func checkPaths(roots []capability.PathRoot, p, host string, write bool) error {
+	if strings.HasPrefix(p, "/") {
+		return pathDenied("absolute paths not allowed; name one of the capability's roots")
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return pathDenied("path traversal not allowed")
+		}
+	}
+	if path.Clean(p) == "." {
+		if write {
+			return pathDenied("the list of roots is read-only")
+		}
+		return nil
+	}
+	root, rel, ok := SplitRootPath(roots, p)
+	if !ok {
+		return pathDenied(fmt.Sprintf("path %s names none of the capability's roots", p))
+	}
+	if write && root.Mode == ModeReadOnly {
+		return pathDenied(fmt.Sprintf("root %s is read-only", root.RootName()))
+	}
+	if err := checkGlobs(root, p, rel); err != nil {
+		return err
+	}
+	if host == "" {
+		return nil
+	}
+	real, ok := rootRel(root, host)
+	if !ok {
+		return pathDenied(fmt.Sprintf("path %s resolves outside root %s", p, root.RootName()))
+	}
+	if real == rel {
+		return nil
+	}
+	return checkGlobs(root, p, real)
+}
+
+// rootRel returns the host path host relative to root's real path,
+// slash-separated, and whether it lies beneath it.
+func rootRel(root *capability.PathRoot, host string) (string, bool) {
+	base, err := realPath(root.Root)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(base, host)
+	if err != nil || !filepath.IsLocal(rel) && rel != "." {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// checkGlobs reports whether root's globs allow rel, a path beneath it
+// that the request path p names.
+func checkGlobs(root *capability.PathRoot, p, rel string) error {
+	for _, g := range root.Deny {
+		if matchGlob(g, rel) {
+			return pathDenied(fmt.Sprintf("path %s denied by %s", p, g))
+		}
+	}
+	if len(root.Allow) == 0 {
+		return nil
+	}
+	for _, g := range root.Allow {
+		if matchGlob(g, rel) {
+			return nil
+		}
+	}
+	return pathDenied(fmt.Sprintf("path %s not allowed under root %s", p, root.RootName()))
+}
+
+func pathDenied(msg string) *PolicyError {
+	return &PolicyError{Code: CodePermissionDenied, Name: "PERMISSION_DENIED", Message: msg}
+}
+
+// CheckPath reports whether claims' paths constraint lets it read, or
+// write, the request path p at host path host ("" if unknown), so that
+// listings can hide what it may not touch and recursive operations can
+// refuse trees holding such paths, as CheckLabels does for labels.
+// Capabilities without one may.
+func CheckPath(claims *capability.Capability, p, host string, write bool) error {
+	if len(claims.Constraints.Paths) == 0 {
+		return nil
+	}
+	return checkPaths(claims.Constraints.Paths, p, host, write)
+}
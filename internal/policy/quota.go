@@ -0,0 +1,364 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// Quota names. bytes_read, bytes_written and list_entries count what a
+// capability consumes per window; open_handles caps the handles it holds
+// at once and takes no window.
+const (
+	QuotaBytesRead    = "bytes_read"
+	QuotaBytesWritten = "bytes_written"
+	QuotaListEntries  = "list_entries"
+	QuotaOpenHandles  = "open_handles"
+)
+
+// Quota windows. Hours and days are UTC.
+const (
+	WindowHour     = "hour"
+	WindowDay      = "day"
+	WindowLifetime = "lifetime"
+)
+
+// CtxQuota carries what a request consumes, by quota name
+// (map[string]int64). A request declaring 0 of a quota is denied only if
+// the quota is already spent; amounts known only once the request has been
+// served are charged afterwards with ChargeQuota.
+const CtxQuota = "quota"
+
+// validateQuotas checks quota names, limits and windows.
+func validateQuotas(quotas map[string]capability.Quota) error {
+	for name, q := range quotas {
+		switch name {
+		case QuotaBytesRead, QuotaBytesWritten, QuotaListEntries:
+			switch q.Window {
+			case "", WindowHour, WindowDay, WindowLifetime:
+			default:
+				return fmt.Errorf("quota %s: window must be %q, %q or %q", name, WindowHour, WindowDay, WindowLifetime)
+			}
+		case QuotaOpenHandles:
+			if q.Window != "" {
+				return fmt.Errorf("quota %s counts handles held at once and takes no window", name)
+			}
+		default:
+			return fmt.Errorf("unknown quota %q", name)
+		}
+		if q.Limit <= 0 {
+			return fmt.Errorf("quota %s: limit must be positive", name)
+		}
+	}
+	return nil
+}
+
+// quotaUsage is one capability's consumption, by quota name.
+type quotaUsage struct {
+	Service string               `json:"service"`
+	Expires time.Time            `json:"expires"`
+	Used    map[string]*quotaUse `json:"used"`
+}
+
+type quotaUse struct {
+	Used  int64     `json:"used"`
+	Reset time.Time `json:"reset,omitempty"` // when the window ends; zero for lifetime counts
+}
+
+// windowEnd returns the end of the window containing now, or the zero time
+// for a lifetime window.
+func windowEnd(window string, now time.Time) time.Time {
+	switch window {
+	case WindowHour:
+		return now.UTC().Truncate(time.Hour).Add(time.Hour)
+	case WindowDay:
+		return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	}
+	return time.Time{}
+}
+
+// QuotaTracker records quota consumption by jti until the capability
+// expires. With a path, usage is kept in that directory, one record per
+// capability, and shared by every process opening it, as FileLimiter shares
+// rate-limit buckets. A record that does not parse starts afresh.
+type QuotaTracker struct {
+	mu    sync.Mutex
+	dir   *stateDir              // nil in memory
+	usage map[string]*quotaUsage // without a directory
+}
+
+// NewQuotaTracker returns an in-memory quota tracker.
+func NewQuotaTracker() *QuotaTracker {
+	return &QuotaTracker{usage: make(map[string]*quotaUsage)}
+}
+
+// OpenQuotaTracker returns a tracker keeping usage in the directory at
+// path, creating it if needed.
+func OpenQuotaTracker(path string) (*QuotaTracker, error) {
+	dir, err := openStateDir(path, func(data []byte, now time.Time) bool {
+		var u quotaUsage
+		return json.Unmarshal(data, &u) != nil || u.Expires.Before(now)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open quotas: %w", err)
+	}
+	return &QuotaTracker{dir: dir}, nil
+}
+
+// update calls fn with capID's usage, empty if it has none, keeping its
+// changes if it returns true.
+func (q *QuotaTracker) update(capID string, fn func(u *quotaUsage) bool) error {
+	if q.dir == nil {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		pruneQuotas(q.usage, time.Now())
+		u, ok := q.usage[capID]
+		if !ok {
+			u = &quotaUsage{Used: make(map[string]*quotaUse)}
+		}
+		if fn(u) {
+			q.usage[capID] = u
+		}
+		return nil
+	}
+	return q.dir.update([]string{capID}, func(recs map[string][]byte) map[string][]byte {
+		var u quotaUsage
+		if data, ok := recs[capID]; !ok || json.Unmarshal(data, &u) != nil {
+			u = quotaUsage{}
+		}
+		if u.Used == nil {
+			u.Used = make(map[string]*quotaUse)
+		}
+		if !fn(&u) {
+			return nil
+		}
+		data, _ := json.Marshal(&u)
+		return map[string][]byte{capID: data}
+	})
+}
+
+// Flush syncs the usage this tracker has changed, if it has a directory,
+// to disk, and now and then sweeps out that of expired capabilities.
+func (q *QuotaTracker) Flush() error {
+	if q.dir == nil {
+		return nil
+	}
+	return q.dir.flush()
+}
+
+// current returns claims' count for quota name at now, starting a new
+// window if the last one has ended.
+func current(u *quotaUsage, claims *capability.Capability, name string, now time.Time) *quotaUse {
+	u.Service, u.Expires = claims.Service, claims.ExpiresAt
+	c, ok := u.Used[name]
+	if !ok {
+		c = &quotaUse{}
+		u.Used[name] = c
+	}
+	if !c.Reset.IsZero() && !now.Before(c.Reset) {
+		c.Used, c.Reset = 0, time.Time{}
+	}
+	if c.Reset.IsZero() {
+		c.Reset = windowEnd(claims.Constraints.Quotas[name].Window, now)
+	}
+	return c
+}
+
+// charge adds amounts to claims' usage of the quotas it carries, all or
+// nothing, or returns RESOURCE_EXHAUSTED for the first quota they would
+// exceed. With spend unset it only checks.
+func (q *QuotaTracker) charge(claims *capability.Capability, amounts map[string]int64, spend bool) error {
+	var names []string
+	for name := range amounts {
+		if _, ok := claims.Constraints.Quotas[name]; ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	var denied error
+	err := q.update(claims.ID, func(u *quotaUsage) bool {
+		now := time.Now()
+		for _, name := range names {
+			limit, c, n := claims.Constraints.Quotas[name].Limit, current(u, claims, name, now), amounts[name]
+			if c.Used+n > limit || n == 0 && c.Used >= limit {
+				denied = quotaExceeded(name, limit, c, n)
+				return false
+			}
+		}
+		if !spend {
+			return false
+		}
+		for _, name := range names {
+			current(u, claims, name, now).Used += amounts[name]
+		}
+		return true
+	})
+	if err != nil {
+		// An unrecorded charge could be consumed again, so deny.
+		return &PolicyError{
+			Code:    CodeResourceExhausted,
+			Name:    "RESOURCE_EXHAUSTED",
+			Message: fmt.Sprintf("cannot record quota use: %v", err),
+		}
+	}
+	return denied
+}
+
+func quotaExceeded(name string, limit int64, c *quotaUse, n int64) *PolicyError {
+	pe := &PolicyError{
+		Code:    CodeResourceExhausted,
+		Name:    "RESOURCE_EXHAUSTED",
+		Message: fmt.Sprintf("quota %s exceeded (%d of %d used)", name, c.Used, limit),
+		Details: map[string]any{"quota": name, "limit": limit, "used": c.Used},
+	}
+	if n > 0 {
+		pe.Message = fmt.Sprintf("quota %s exceeded (%d requested, %d of %d used)", name, n, c.Used, limit)
+		pe.Details["requested"] = n
+	}
+	if !c.Reset.IsZero() {
+		reset := c.Reset.Format(time.RFC3339)
+		pe.Message += "; resets at " + reset
+		pe.Details["reset_at"] = reset
+	}
+	return pe
+}
+
+// pruneQuotas drops the usage of capabilities that have expired.
+func pruneQuotas(usage map[string]*quotaUsage, now time.Time) {
+	for id, u := range usage {
+		if u.Expires.Before(now) {
+			delete(usage, id)
+		}
+	}
+}
+
+// Release returns n of quota name to claims: a handle it closed, or the
+// unused part of an amount charged up front, at chargedAt or later. A
+// charge made in a window that has since ended is not returned: it would
+// be taken off the new window's count instead.
+func (q *QuotaTracker) Release(claims *capability.Capability, name string, n int64, chargedAt time.Time) error {
+	return q.update(claims.ID, func(u *quotaUsage) bool {
+		c := u.Used[name]
+		if c == nil || n <= 0 {
+			return false
+		}
+		if !c.Reset.Equal(windowEnd(claims.Constraints.Quotas[name].Window, chargedAt)) {
+			return false
+		}
+		c.Used = max(c.Used-n, 0)
+		return true
+	})
+}
+
+// ResetHandles zeroes the open_handles counts of service's capabilities,
+// whose handles a restarting service no longer holds.
+func (q *QuotaTracker) ResetHandles(service string) error {
+	reset := func(u *quotaUsage) bool {
+		if u.Service != service || u.Used[QuotaOpenHandles] == nil {
+			return false
+		}
+		delete(u.Used, QuotaOpenHandles)
+		return true
+	}
+	if q.dir == nil {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for _, u := range q.usage {
+			reset(u)
+		}
+		return nil
+	}
+	return q.dir.scan(func(data []byte) ([]byte, bool) {
+		var u quotaUsage
+		if json.Unmarshal(data, &u) != nil || !reset(&u) {
+			return nil, false
+		}
+		data, _ = json.Marshal(&u)
+		return data, true
+	})
+}
+
+// QuotaStatus is a capability's standing against one of its quotas.
+type QuotaStatus struct {
+	Name    string     `json:"name"`
+	Limit   int64      `json:"limit"`
+	Window  string     `json:"window,omitempty"`
+	Used    int64      `json:"used"`
+	ResetAt *time.Time `json:"reset_at,omitempty"`
+}
+
+// Report returns claims' standing against each of its quotas, by name.
+func (q *QuotaTracker) Report(claims *capability.Capability) ([]QuotaStatus, error) {
+	var out []QuotaStatus
+	err := q.update(claims.ID, func(u *quotaUsage) bool {
+		now := time.Now()
+		for name, quota := range claims.Constraints.Quotas {
+			st := QuotaStatus{Name: name, Limit: quota.Limit, Window: quota.Window}
+			var c quotaUse
+			if u.Used[name] != nil {
+				c = *u.Used[name]
+			}
+			if !c.Reset.IsZero() && !now.Before(c.Reset) {
+				c = quotaUse{}
+			}
+			if c.Reset.IsZero() {
+				c.Reset = windowEnd(quota.Window, now)
+			}
+			st.Used = c.Used
+			if !c.Reset.IsZero() {
+				st.ResetAt = &c.Reset
+			}
+			out = append(out, st)
+		}
+		return false
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, err
+}
+
+// globalQuotas is the tracker Authorize enforces quotas against.
+var globalQuotas = NewQuotaTracker()
+
+// SetQuotaTracker replaces the tracker Authorize enforces quotas against,
+// typically with one from OpenQuotaTracker. Call it before serving requests.
+func SetQuotaTracker(q *QuotaTracker) {
+	globalQuotas = q
+}
+
+// ChargeQuota charges n of quota name to claims once a request has been
+// served, if claims carries the quota, or returns RESOURCE_EXHAUSTED if
+// that would exceed it.
+func ChargeQuota(claims *capability.Capability, name string, n int64) error {
+	return globalQuotas.charge(claims, map[string]int64{name: n}, true)
+}
+
+// ReleaseQuota returns n of quota name, charged at chargedAt or later, to
+// claims; see QuotaTracker.Release.
+func ReleaseQuota(claims *capability.Capability, name string, n int64, chargedAt time.Time) error {
+	if _, ok := claims.Constraints.Quotas[name]; !ok {
+		return nil
+	}
+	return globalQuotas.Release(claims, name, n, chargedAt)
+}
+
+// QuotaReport returns claims' standing against each of its quotas.
+func QuotaReport(claims *capability.Capability) ([]QuotaStatus, error) {
+	if len(claims.Constraints.Quotas) == 0 {
+		return nil, nil
+	}
+	return globalQuotas.Report(claims)
+}
+
+// quotaAmounts returns the amounts ctx declares.
+func quotaAmounts(ctx map[string]any) map[string]int64 {
+	amounts, _ := ctx[CtxQuota].(map[string]int64)
+	return amounts
+}
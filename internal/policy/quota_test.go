@@ -0,0 +1,213 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// useQuotaTracker gives the test a fresh in-memory tracker.
+func useQuotaTracker(t *testing.T) *QuotaTracker {
+	q := NewQuotaTracker()
+	SetQuotaTracker(q)
+	t.Cleanup(func() { SetQuotaTracker(NewQuotaTracker()) })
+	return q
+}
+
+func quotaClaims(id string, quotas map[string]capability.Quota) *capability.Capability {
+	return &capability.Capability{
+		ID:          id,
+		Service:     "fs",
+		Rights:      []string{"fs.*"},
+		ExpiresAt:   time.Now().Add(time.Hour),
+		Constraints: capability.Constraints{Quotas: quotas},
+	}
+}
+
+func consume(claims *capability.Capability, method, quota string, n int64) error {
+	return Authorize(claims, method, map[string]any{CtxQuota: map[string]int64{quota: n}})
+}
+
+func TestQuota_BytesPerDay(t *testing.T) {
+	useQuotaTracker(t)
+	claims := quotaClaims("quota-bytes", map[string]capability.Quota{QuotaBytesRead: {Limit: 1000, Window: WindowDay}})
+
+	if err := consume(claims, "fs.read", QuotaBytesRead, 600); err != nil {
+		t.Fatalf("first read: %v", err)
+	}
+	err := consume(claims, "fs.read", QuotaBytesRead, 600)
+	pe, ok := err.(*PolicyError)
+	if !ok || pe.Code != CodeResourceExhausted || pe.Details["quota"] != QuotaBytesRead {
+		t.Fatalf("over quota = %v, want RESOURCE_EXHAUSTED naming bytes_read", err)
+	}
+	wantReset := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour).Format(time.RFC3339)
+	if pe.Details["reset_at"] != wantReset {
+		t.Errorf("reset_at = %v, want %s", pe.Details["reset_at"], wantReset)
+	}
+	if err := consume(claims, "fs.read", QuotaBytesRead, 400); err != nil {
+		t.Errorf("the rest of the quota: %v", err)
+	}
+	if err := Authorize(claims, "fs.list", nil); err != nil {
+		t.Errorf("requests declaring no bytes are unaffected: %v", err)
+	}
+}
+
+func TestQuota_WindowResets(t *testing.T) {
+	q := useQuotaTracker(t)
+	claims := quotaClaims("quota-window", map[string]capability.Quota{QuotaBytesRead: {Limit: 10, Window: WindowHour}})
+	if err := consume(claims, "fs.read", QuotaBytesRead, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := consume(claims, "fs.read", QuotaBytesRead, 1); err == nil {
+		t.Fatal("quota should be spent")
+	}
+	q.usage[claims.ID].Used[QuotaBytesRead].Reset = time.Now().Add(-time.Second)
+	if err := consume(claims, "fs.read", QuotaBytesRead, 10); err != nil {
+		t.Errorf("a new window should start afresh: %v", err)
+	}
+}
+
+func TestQuota_ReleaseInLaterWindow(t *testing.T) {
+	useQuotaTracker(t)
+	claims := quotaClaims("quota-release", map[string]capability.Quota{QuotaBytesRead: {Limit: 10, Window: WindowHour}})
+	if err := consume(claims, "fs.read", QuotaBytesRead, 10); err != nil {
+		t.Fatal(err)
+	}
+	// Charged in the previous hour: returning it would credit this one.
+	ReleaseQuota(claims, QuotaBytesRead, 10, time.Now().Add(-time.Hour))
+	if err := consume(claims, "fs.read", QuotaBytesRead, 1); err == nil {
+		t.Fatal("a release from an ended window should be ignored")
+	}
+	ReleaseQuota(claims, QuotaBytesRead, 5, time.Now())
+	if err := consume(claims, "fs.read", QuotaBytesRead, 5); err != nil {
+		t.Errorf("a release in the same window: %v", err)
+	}
+}
+
+func TestQuota_LifetimeHasNoReset(t *testing.T) {
+	useQuotaTracker(t)
+	claims := quotaClaims("quota-lifetime", map[string]capability.Quota{QuotaBytesRead: {Limit: 1}})
+	consume(claims, "fs.read", QuotaBytesRead, 1)
+	pe := consume(claims, "fs.read", QuotaBytesRead, 1).(*PolicyError)
+	if _, ok := pe.Details["reset_at"]; ok {
+		t.Errorf("lifetime quota reported a reset: %v", pe.Details)
+	}
+}
+
+func TestQuota_OpenHandles(t *testing.T) {
+	q := useQuotaTracker(t)
+	claims := quotaClaims("quota-handles", map[string]capability.Quota{QuotaOpenHandles: {Limit: 2}})
+	for i := 0; i < 2; i++ {
+		if err := consume(claims, "fs.open", QuotaOpenHandles, 1); err != nil {
+			t.Fatalf("open %d: %v", i, err)
+		}
+	}
+	if err := consume(claims, "fs.open", QuotaOpenHandles, 1); err == nil {
+		t.Fatal("third handle should exceed the quota")
+	}
+	ReleaseQuota(claims, QuotaOpenHandles, 1, time.Now())
+	if err := consume(claims, "fs.open", QuotaOpenHandles, 1); err != nil {
+		t.Fatalf("after closing one: %v", err)
+	}
+	q.ResetHandles("fs")
+	if err := consume(claims, "fs.open", QuotaOpenHandles, 1); err != nil {
+		t.Errorf("after a restart: %v", err)
+	}
+}
+
+func TestQuota_ChargedAfterServing(t *testing.T) {
+	useQuotaTracker(t)
+	claims := quotaClaims("quota-list", map[string]capability.Quota{QuotaListEntries: {Limit: 5}})
+	if err := consume(claims, "fs.list", QuotaListEntries, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChargeQuota(claims, QuotaListEntries, 5); err != nil {
+		t.Fatalf("charge: %v", err)
+	}
+	if err := consume(claims, "fs.list", QuotaListEntries, 0); err == nil {
+		t.Error("a spent quota should deny even requests declaring 0")
+	}
+	if err := ChargeQuota(quotaClaims("no-quota", nil), QuotaListEntries, 100); err != nil {
+		t.Errorf("capabilities without the quota are not charged: %v", err)
+	}
+}
+
+func TestQuota_ExplainSpendsNothing(t *testing.T) {
+	useQuotaTracker(t)
+	claims := quotaClaims("quota-explain", map[string]capability.Quota{QuotaBytesRead: {Limit: 10}})
+	ctx := map[string]any{CtxQuota: map[string]any{QuotaBytesRead: float64(10)}}
+	for i := 0; i < 3; i++ {
+		if _, err := Explain(claims, "fs.read", ctx); err != nil {
+			t.Fatalf("explain %d: %v", i, err)
+		}
+	}
+	if err := Authorize(claims, "fs.read", ctx); err != nil {
+		t.Errorf("explain charged the quota: %v", err)
+	}
+}
+
+func TestQuotaTracker_SharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas")
+	a, err := OpenQuotaTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := quotaClaims("quota-shared", map[string]capability.Quota{QuotaBytesRead: {Limit: 100, Window: WindowDay}})
+	if err := a.charge(claims, map[string]int64{QuotaBytesRead: 70}, true); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := OpenQuotaTracker(path)
+	if err := b.charge(claims, map[string]int64{QuotaBytesRead: 40}, true); err == nil {
+		t.Error("second tracker should see the first one's usage")
+	}
+	report, err := b.Report(claims)
+	if err != nil || len(report) != 1 || report[0].Used != 70 || report[0].ResetAt == nil {
+		t.Errorf("report = %+v, %v", report, err)
+	}
+}
+
+func TestQuotaTracker_CorruptRecordResets(t *testing.T) {
+	q, err := OpenQuotaTracker(filepath.Join(t.TempDir(), "quotas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas := map[string]capability.Quota{QuotaBytesRead: {Limit: 10}}
+	corrupt, intact := quotaClaims("quota-corrupt", quotas), quotaClaims("quota-intact", quotas)
+	for _, claims := range []*capability.Capability{corrupt, intact} {
+		if err := q.charge(claims, map[string]int64{QuotaBytesRead: 10}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(q.dir.recordPath(corrupt.ID), []byte("\x00\x00"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.charge(corrupt, map[string]int64{QuotaBytesRead: 10}, true); err != nil {
+		t.Errorf("a corrupt record should start afresh: %v", err)
+	}
+	if err := q.charge(intact, map[string]int64{QuotaBytesRead: 1}, true); err == nil {
+		t.Error("other capabilities' usage should be unaffected")
+	}
+}
+
+func TestValidateConstraints_Quotas(t *testing.T) {
+	good := capability.Constraints{Quotas: map[string]capability.Quota{
+		QuotaBytesRead:   {Limit: 1 << 30, Window: WindowDay},
+		QuotaOpenHandles: {Limit: 8},
+	}}
+	if err := ValidateConstraints(good); err != nil {
+		t.Errorf("valid quotas: %v", err)
+	}
+	for name, q := range map[string]map[string]capability.Quota{
+		"unknown quota": {"bytes_deleted": {Limit: 1}},
+		"bad window":    {QuotaBytesRead: {Limit: 1, Window: "week"}},
+		"gauge window":  {QuotaOpenHandles: {Limit: 1, Window: WindowDay}},
+		"non-positive":  {QuotaListEntries: {Limit: 0}},
+	} {
+		if err := ValidateConstraints(capability.Constraints{Quotas: q}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
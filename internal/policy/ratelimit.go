@@ -0,0 +1,343 @@
+package policy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// Rate limits are token buckets. A rate limit expression is one or more
+// limits separated by commas, all of which apply:
+//
+//	50rps              50 requests a second, in bursts of up to 50
+//	300rpm burst 20    300 requests a minute, at most 20 at once
+//	1000rph            1000 requests an hour
+//	4MiBps             4 MiB a second (units Bps, KiBps, MiBps, GiBps)
+//	200rps, 8MiBps     both
+//
+// A limit's burst defaults to its count, one unit's worth, and is given in
+// the same unit ("4MiBps burst 16" holds up to 16 MiB). Byte limits apply
+// only to requests that report how many bytes they move, in CtxBytes.
+//
+// A capability's rate_limit applies to every method; its rate_limits map
+// right patterns to expressions for the methods they match, on top of it.
+
+// CtxBytes carries the number of bytes a request moves (int or float64),
+// charged against byte-rate limits.
+const CtxBytes = "bytes"
+
+// rateUnits maps each unit to its size in bytes (1 for requests) and its
+// period.
+var rateUnits = map[string]struct {
+	bytes  bool
+	size   float64
+	period time.Duration
+}{
+	"rps":   {false, 1, time.Second},
+	"rpm":   {false, 1, time.Minute},
+	"rph":   {false, 1, time.Hour},
+	"Bps":   {true, 1, time.Second},
+	"KiBps": {true, 1 << 10, time.Second},
+	"MiBps": {true, 1 << 20, time.Second},
+	"GiBps": {true, 1 << 30, time.Second},
+}
+
+// rateSpec is one parsed limit.
+type rateSpec struct {
+	text  string  // as written
+	bytes bool    // counts bytes rather than requests
+	rate  float64 // tokens per second
+	burst float64 // bucket capacity, in tokens
+}
+
+// parseRateLimit parses a rate limit expression.
+func parseRateLimit(s string) ([]rateSpec, error) {
+	var specs []rateSpec
+	for _, part := range strings.Split(s, ",") {
+		spec, err := parseRateSpec(part)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func parseRateSpec(s string) (rateSpec, error) {
+	s = strings.TrimSpace(s)
+	bad := func(why string) (rateSpec, error) {
+		return rateSpec{}, fmt.Errorf("rate limit %q: %s (expected e.g. \"50rps\" or \"300rpm burst 20\")", s, why)
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 1 && (len(fields) != 3 || fields[1] != "burst") {
+		return bad("malformed")
+	}
+	i := strings.IndexFunc(fields[0], unicode.IsLetter)
+	if i < 0 {
+		return bad("missing unit")
+	}
+	n, err := strconv.ParseFloat(fields[0][:i], 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) {
+		return bad("count must be a positive number")
+	}
+	unit, ok := rateUnits[fields[0][i:]]
+	if !ok {
+		return bad("unknown unit " + fields[0][i:])
+	}
+	burst := math.Max(n*unit.size, 1)
+	if len(fields) == 3 {
+		b, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || b*unit.size < 1 || math.IsInf(b, 0) {
+			return bad("burst must be a number of at least one unit")
+		}
+		burst = b * unit.size
+	}
+	return rateSpec{
+		text:  s,
+		bytes: unit.bytes,
+		rate:  n * unit.size / unit.period.Seconds(),
+		burst: burst,
+	}, nil
+}
+
+// withinRate reports whether limits got are at least as strict as max:
+// each limit in max has one in got of its kind that is no faster and
+// allows no larger bursts.
+func withinRate(got, max []rateSpec) bool {
+	for _, m := range max {
+		ok := false
+		for _, g := range got {
+			if g.bytes == m.bytes && g.rate <= m.rate && g.burst <= m.burst {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// staleBucketTTL is the duration after which an unused rate limit bucket is
+// evicted, once it has refilled: a slower limit's bucket is kept until then,
+// as evicting it would hand its tokens back early. A bucket comes back full,
+// so only full ones go.
+const staleBucketTTL = 5 * time.Minute
+
+// bucketKey names the bucket of limit i of capID's expression for the
+// method pattern scope ("" for rate_limit).
+func bucketKey(capID, scope string, i int) string {
+	if scope == "" && i == 0 {
+		return capID
+	}
+	return capID + "\x00" + scope + "\x00" + strconv.Itoa(i)
+}
+
+// bucketUse is a bucket a request draws from.
+type bucketUse struct {
+	key   string
+	capID string
+	spec  rateSpec
+	scope string  // method pattern of the rate_limits entry; "" for rate_limit
+	n     float64 // tokens taken
+}
+
+// useKeys returns the keys of the buckets uses draw from.
+func useKeys(uses []bucketUse) []string {
+	keys := make([]string, len(uses))
+	for i, u := range uses {
+		keys[i] = u.key
+	}
+	return keys
+}
+
+// takeTokens reports whether every bucket in uses holds enough tokens
+// and, if so and spend is set, takes them. A request is charged all or
+// nothing.
+func takeTokens(uses []bucketUse, spend bool) error {
+	var denied error
+	err := globalLimiter.Update(useKeys(uses), func(buckets map[string]*Bucket) bool {
+		now := time.Now()
+		levels := make([]float64, len(uses))
+		var short *bucketUse
+		var wait float64 // seconds until every bucket has room
+		for i := range uses {
+			u := &uses[i]
+			if u.n > u.spec.burst {
+				// Waiting would not help: the bucket never holds this much.
+				denied = rateDenied(u, fmt.Sprintf("request of %.0f bytes exceeds the burst of rate limit %s", u.n, u.spec.text), nil)
+				return false
+			}
+			levels[i] = u.spec.burst
+			if b, ok := buckets[u.key]; ok {
+				levels[i] = b.level(now)
+			}
+			if levels[i] < u.n {
+				if w := (u.n - levels[i]) / u.spec.rate; short == nil || w > wait {
+					short, wait = u, w
+				}
+			}
+		}
+		if short != nil {
+			retry := int64(math.Ceil(wait * 1000))
+			denied = rateDenied(short, "rate limit "+short.spec.text+" exceeded", map[string]any{"retry_after_ms": retry})
+			return false
+		}
+		if !spend {
+			return false
+		}
+		for i, u := range uses {
+			buckets[u.key] = &Bucket{
+				CapID:  u.capID,
+				Limit:  u.spec.text,
+				Method: u.scope,
+				Tokens: levels[i] - u.n,
+				Rate:   u.spec.rate,
+				Burst:  u.spec.burst,
+				Last:   now,
+			}
+		}
+		return true
+	})
+	if err != nil {
+		// Unrecorded tokens could be spent again, so deny.
+		return &PolicyError{
+			Code:    CodeResourceExhausted,
+			Name:    "RESOURCE_EXHAUSTED",
+			Message: fmt.Sprintf("cannot update rate limits: %v", err),
+		}
+	}
+	return denied
+}
+
+// rateDenied reports the limit of u as exhausted, naming its method
+// pattern if it has one.
+func rateDenied(u *bucketUse, msg string, details map[string]any) error {
+	if details == nil {
+		details = map[string]any{}
+	}
+	details["limit"] = u.spec.text
+	if u.scope != "" {
+		details["method"] = u.scope
+		msg += " for " + u.scope
+	}
+	return &PolicyError{
+		Code:    CodeResourceExhausted,
+		Name:    "RESOURCE_EXHAUSTED",
+		Message: msg,
+		Details: details,
+	}
+}
+
+// CodeInvalidArgument matches the protocol error code for bad input.
+const CodeInvalidArgument = 1
+
+// returnTokens puts the tokens uses took back in their buckets, up to
+// their bursts, for a request denied after it was charged.
+func returnTokens(uses []bucketUse) error {
+	return globalLimiter.Update(useKeys(uses), func(buckets map[string]*Bucket) bool {
+		now := time.Now()
+		dirty := false
+		for _, u := range uses {
+			if b, ok := buckets[u.key]; ok {
+				b.Tokens, b.Last = math.Min(b.level(now)+u.n, b.Burst), now
+				dirty = true
+			}
+		}
+		return dirty
+	})
+}
+
+// checkRateLimits reports whether capID may make a request of method,
+// moving bytes (0 if it reports none), under its rate_limit and the
+// perMethod limits matching method, taking from every bucket involved if
+// spend is set.
+func checkRateLimits(capID, rateLimit string, perMethod map[string]string, method string, bytes float64, spend bool) error {
+	uses, err := rateUses(capID, rateLimit, perMethod, method, bytes)
+	if err != nil || len(uses) == 0 {
+		return err
+	}
+	return takeTokens(uses, spend)
+}
+
+// rateUses returns the buckets a request of method moving bytes draws
+// from under rateLimit and perMethod.
+func rateUses(capID, rateLimit string, perMethod map[string]string, method string, bytes float64) ([]bucketUse, error) {
+	var uses []bucketUse
+	add := func(scope, expr string) error {
+		specs, err := parseRateLimit(expr)
+		if err != nil {
+			return &PolicyError{
+				Code:    CodeInvalidArgument,
+				Name:    "INVALID_ARGUMENT",
+				Message: "unparseable " + err.Error(),
+			}
+		}
+		for i, spec := range specs {
+			n := 1.0
+			if spec.bytes {
+				if bytes <= 0 {
+					continue
+				}
+				n = bytes
+			}
+			uses = append(uses, bucketUse{key: bucketKey(capID, scope, i), capID: capID, spec: spec, scope: scope, n: n})
+		}
+		return nil
+	}
+	if rateLimit != "" {
+		if err := add("", rateLimit); err != nil {
+			return nil, err
+		}
+	}
+	patterns := make([]string, 0, len(perMethod))
+	for p := range perMethod {
+		if MatchRight(p, method) {
+			patterns = append(patterns, p)
+		}
+	}
+	sort.Strings(patterns)
+	for _, p := range patterns {
+		if err := add(p, perMethod[p]); err != nil {
+			return nil, err
+		}
+	}
+	return uses, nil
+}
+
+// refundRates returns what enforceRates took for the request in ctx.
+func refundRates(claims *capability.Capability, ctx map[string]any) {
+	method, _ := ctx[CtxMethod].(string)
+	c := claims.Constraints
+	if uses, err := rateUses(claims.ID, c.RateLimit, c.RateLimits, method, ctxBytes(ctx)); err == nil && len(uses) > 0 {
+		returnTokens(uses)
+	}
+}
+
+// ctxBytes returns the bytes the request in ctx moves.
+func ctxBytes(ctx map[string]any) float64 {
+	switch v := ctx[CtxBytes].(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// enforceRates applies claims' rate_limit and rate_limits to the request
+// in ctx.
+func enforceRates(claims *capability.Capability, ctx map[string]any, spend bool) error {
+	method, _ := ctx[CtxMethod].(string)
+	c := claims.Constraints
+	return checkRateLimits(claims.ID, c.RateLimit, c.RateLimits, method, ctxBytes(ctx), spend)
+}
@@ -0,0 +1,207 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+func TestParseRateLimit_Units(t *testing.T) {
+	cases := []struct {
+		expr  string
+		bytes bool
+		rate  float64
+		burst float64
+	}{
+		{"60rpm", false, 1, 60},
+		{"300rpm burst 20", false, 5, 20},
+		{"3600rph", false, 1, 3600},
+		{"512Bps", true, 512, 512},
+		{"2KiBps", true, 2048, 2048},
+		{"4MiBps burst 16", true, 4 << 20, 16 << 20},
+	}
+	for _, tc := range cases {
+		specs, err := parseRateLimit(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		s := specs[0]
+		if s.bytes != tc.bytes || s.rate != tc.rate || s.burst != tc.burst {
+			t.Errorf("%s = %+v, want bytes=%v rate=%v burst=%v", tc.expr, s, tc.bytes, tc.rate, tc.burst)
+		}
+	}
+
+	specs, err := parseRateLimit("200rps, 8MiBps")
+	if err != nil || len(specs) != 2 || specs[0].bytes || !specs[1].bytes {
+		t.Errorf("combined limits = (%+v, %v)", specs, err)
+	}
+}
+
+func retryAfter(t *testing.T, err error) int64 {
+	t.Helper()
+	pe, ok := err.(*PolicyError)
+	if !ok || pe.Code != CodeResourceExhausted {
+		t.Fatalf("err = %v, want RESOURCE_EXHAUSTED", err)
+	}
+	ms, _ := pe.Details["retry_after_ms"].(int64)
+	return ms
+}
+
+func TestRateLimit_RetryAfter(t *testing.T) {
+	claims := &capability.Capability{
+		ID:          "rate-retry-after",
+		Service:     "fs",
+		Rights:      []string{"fs.*"},
+		Constraints: capability.Constraints{RateLimit: "1rpm"},
+	}
+	if err := Authorize(claims, "fs.list", nil); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	ms := retryAfter(t, Authorize(claims, "fs.list", nil))
+	if ms < 59000 || ms > 60000 {
+		t.Errorf("retry_after_ms = %d, want about a minute", ms)
+	}
+}
+
+func TestRateLimits_PerMethod(t *testing.T) {
+	claims := &capability.Capability{
+		ID:      "rate-per-method",
+		Service: "fs",
+		Rights:  []string{"fs.*"},
+		Constraints: capability.Constraints{
+			RateLimits: map[string]string{"fs.open": "1rps", "fs.read": "3rps"},
+		},
+	}
+	if err := Authorize(claims, "fs.open", nil); err != nil {
+		t.Fatalf("first open: %v", err)
+	}
+	err := Authorize(claims, "fs.open", nil)
+	if retryAfter(t, err) <= 0 {
+		t.Error("denial should carry retry_after_ms")
+	}
+	if m := err.(*PolicyError).Details["method"]; m != "fs.open" {
+		t.Errorf("details.method = %v, want fs.open", m)
+	}
+	for i := 0; i < 3; i++ {
+		if err := Authorize(claims, "fs.read", nil); err != nil {
+			t.Fatalf("read %d has its own limit: %v", i, err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := Authorize(claims, "fs.list", nil); err != nil {
+			t.Fatalf("fs.list is unlimited: %v", err)
+		}
+	}
+}
+
+func TestRateLimits_AllOrNothing(t *testing.T) {
+	claims := &capability.Capability{
+		ID:      "rate-all-or-nothing",
+		Service: "fs",
+		Rights:  []string{"fs.*"},
+		Constraints: capability.Constraints{
+			RateLimit:  "2rps",
+			RateLimits: map[string]string{"fs.open": "1rps"},
+		},
+	}
+	if err := Authorize(claims, "fs.open", nil); err != nil {
+		t.Fatalf("first open: %v", err)
+	}
+	if err := Authorize(claims, "fs.open", nil); err == nil {
+		t.Fatal("second open should hit the fs.open limit")
+	}
+	// The denied open took nothing from the overall bucket.
+	if err := Authorize(claims, "fs.list", nil); err != nil {
+		t.Errorf("overall limit should have a token left: %v", err)
+	}
+	if err := Authorize(claims, "fs.list", nil); err == nil {
+		t.Error("overall limit should now be spent")
+	}
+}
+
+func TestRateLimit_Bytes(t *testing.T) {
+	claims := &capability.Capability{
+		ID:          "rate-bytes",
+		Service:     "fs",
+		Rights:      []string{"fs.*"},
+		Constraints: capability.Constraints{RateLimit: "100rps, 1KiBps"},
+	}
+	read := func(n int) error {
+		return Authorize(claims, "fs.read", map[string]any{CtxHandle: true, CtxBytes: n})
+	}
+	if err := read(600); err != nil {
+		t.Fatalf("first read: %v", err)
+	}
+	if ms := retryAfter(t, read(600)); ms <= 0 || ms > 1000 {
+		t.Errorf("retry_after_ms = %d, want under a second", ms)
+	}
+	err := read(2048)
+	if retryAfter(t, err) != 0 {
+		t.Error("a read larger than the burst can never succeed; no retry_after_ms")
+	}
+	if err := Authorize(claims, "fs.list", nil); err != nil {
+		t.Errorf("requests moving no bytes are not byte-limited: %v", err)
+	}
+}
+
+func TestValidateConstraints_RateLimits(t *testing.T) {
+	good := capability.Constraints{RateLimits: map[string]string{"fs.*": "10rps", "fs.read": "4MiBps burst 8"}}
+	if err := ValidateConstraints(good); err != nil {
+		t.Errorf("valid rate_limits: %v", err)
+	}
+	for _, m := range []map[string]string{
+		{"fs.read": "fast"},
+		{"fs.*.read": "10rps"},
+		{"!fs.read": "10rps"},
+	} {
+		if err := ValidateConstraints(capability.Constraints{RateLimits: m}); err == nil {
+			t.Errorf("rate_limits %v should fail validation", m)
+		}
+	}
+}
+
+func TestWithinRate(t *testing.T) {
+	max, _ := parseRateLimit("50rps, 1MiBps")
+	cases := map[string]bool{
+		"10rps, 512KiBps":           true,
+		"50rps burst 10, 1MiBps":    true,
+		"10rps":                     false, // no byte limit
+		"3000rpm, 1MiBps":           false, // as fast, but bursts of 3000
+		"10rps, 1MiBps burst 2":     false,
+		"100rps, 1MiBps, 10rps":     true, // the 10rps limit satisfies 50rps
+		"1rps, 10rph, 1Bps, 512Bps": true,
+	}
+	for expr, want := range cases {
+		got, err := parseRateLimit(expr)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if withinRate(got, max) != want {
+			t.Errorf("withinRate(%q) = %v, want %v", expr, !want, want)
+		}
+	}
+}
+
+func TestRateLimit_RefundedWhenLaterDenied(t *testing.T) {
+	useMemoryLimiter(t)
+	useQuotaTracker(t)
+	claims := quotaClaims("rate-refund", map[string]capability.Quota{QuotaBytesRead: {Limit: 10}})
+	claims.Constraints.RateLimit = "2rph"
+
+	// Over quota: the rate-limit token is given back.
+	for i := 0; i < 3; i++ {
+		if err := consume(claims, "fs.read", QuotaBytesRead, 100); err == nil || !strings.Contains(err.Error(), "quota") {
+			t.Fatalf("request %d: err = %v, want the quota to deny", i, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := consume(claims, "fs.read", QuotaBytesRead, 1); err != nil {
+			t.Fatalf("request %d within both limits: %v", i, err)
+		}
+	}
+	if err := consume(claims, "fs.read", QuotaBytesRead, 1); err == nil || !strings.Contains(err.Error(), "rate limit") {
+		t.Errorf("third request: err = %v, want the rate limit to deny", err)
+	}
+}
@@ -0,0 +1,208 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// ConstraintType defines one kind of capability constraint. Services
+// register their own types (e.g. a key-value store's key prefix) with
+// RegisterConstraint; Authorize then enforces them like the built-in ones.
+type ConstraintType struct {
+	// Name is the constraint's key in the token's constraints object.
+	Name string
+	// Parse decodes and validates the constraint's JSON value.
+	Parse func(raw json.RawMessage) (any, error)
+	// Evaluate returns nil if the request may proceed, or an error
+	// (preferably a *PolicyError) denying it. value is Parse's result;
+	// ctx is the request's, with the method under CtxMethod.
+	Evaluate func(value any, claims *capability.Capability, ctx map[string]any) error
+	// CtxKeys lists the ctx keys Evaluate reads. If set and the request's
+	// ctx has none of them, the constraint cannot be evaluated and the
+	// request is denied, unless SkipWithoutCtx is set.
+	CtxKeys []string
+	// SkipWithoutCtx makes a constraint not apply to requests whose ctx has
+	// none of its CtxKeys (as path_prefix does not apply to fs.handles).
+	// Set it only when such requests cannot touch what the constraint
+	// limits.
+	SkipWithoutCtx bool
+	// Spends marks constraints that consume something, such as a use.
+	// They are evaluated after every other constraint has passed.
+	Spends bool
+	// Refund, if set, gives back what Evaluate spent for the request in
+	// ctx. When a Spends constraint denies a request, those evaluated
+	// before it are refunded, so a request is charged all or nothing.
+	// spentAt is no later than the spending.
+	Refund func(value any, claims *capability.Capability, ctx map[string]any,
+		spentAt time.Time)
+	// DryRun, if set, is used instead of Evaluate by Explain. It must
+	// decide as Evaluate would without side effects such as consuming a
+	// use or a rate-limit token; types whose Evaluate has side effects
+	// must set it.
+	DryRun func(value any, claims *capability.Capability, ctx map[string]any) error
+}
+
+var constraintRegistry = struct {
+	mu    sync.RWMutex
+	types map[string]*ConstraintType
+	order []*ConstraintType
+}{types: make(map[string]*ConstraintType)}
+
+// RegisterConstraint adds a constraint type. Constraints are evaluated in
+// registration order (Spends types last, refunded in reverse). It panics
+// if the type is incomplete or its name is already registered, so call it
+// from init.
+func RegisterConstraint(t ConstraintType) {
+	if t.Name == "" || t.Parse == nil || t.Evaluate == nil {
+		panic("policy: incomplete constraint type " + t.Name)
+	}
+	constraintRegistry.mu.Lock()
+	defer constraintRegistry.mu.Unlock()
+	if _, dup := constraintRegistry.types[t.Name]; dup {
+		panic("policy: constraint type registered twice: " + t.Name)
+	}
+	constraintRegistry.types[t.Name] = &t
+	constraintRegistry.order = append(constraintRegistry.order, &t)
+}
+
+// ValidateConstraints parses every constraint in c whose type is
+// registered in this process. Unregistered ones are passed over: the
+// issuer need not know every service's constraints, and the service that
+// does enforces them.
+func ValidateConstraints(c capability.Constraints) error {
+	set, err := c.Set()
+	if err != nil {
+		return fmt.Errorf("encode constraints: %w", err)
+	}
+	constraintRegistry.mu.RLock()
+	defer constraintRegistry.mu.RUnlock()
+	for name, raw := range set {
+		t, ok := constraintRegistry.types[name]
+		if !ok {
+			continue
+		}
+		if _, err := t.Parse(raw); err != nil {
+			return fmt.Errorf("constraint %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// enforceConstraints evaluates every constraint claims carries against
+// ctx. A constraint this process has no type for is denied: a verifier
+// must not grant access it does not understand the limits of.
+func enforceConstraints(claims *capability.Capability, ctx map[string]any, ev *evaluation) error {
+	set, err := claims.Constraints.Set()
+	if err != nil {
+		return ev.fail("constraints", constraintDenied(fmt.Sprintf("cannot decode constraints: %v", err), ""))
+	}
+
+	constraintRegistry.mu.RLock()
+	order := constraintRegistry.order
+	for name := range set {
+		if _, ok := constraintRegistry.types[name]; !ok {
+			constraintRegistry.mu.RUnlock()
+			return ev.fail("constraint "+name, constraintDenied(fmt.Sprintf("unknown constraint %q", name), name))
+		}
+	}
+	constraintRegistry.mu.RUnlock()
+
+	// What the Spends constraints took, to give back if a later one denies.
+	type spending struct {
+		t     *ConstraintType
+		value any
+	}
+	var spent []spending
+	spentAt := time.Now()
+	fail := func(check string, err error) error {
+		for i := len(spent) - 1; i >= 0; i-- {
+			if s := spent[i]; s.t.Refund != nil {
+				s.t.Refund(s.value, claims, ctx, spentAt)
+			}
+		}
+		return ev.fail(check, err)
+	}
+
+	for _, spends := range []bool{false, true} {
+		for _, t := range order {
+			raw, ok := set[t.Name]
+			if !ok || t.Spends != spends {
+				continue
+			}
+			check := "constraint " + t.Name
+			if !hasCtx(t, ctx) {
+				if t.SkipWithoutCtx {
+					ev.step(check, StepSkip, "not applicable to this request")
+					continue
+				}
+				msg := fmt.Sprintf("constraint %q cannot be evaluated for this request",
+					t.Name)
+				return fail(check, constraintDenied(msg, t.Name))
+			}
+			value, err := t.Parse(raw)
+			if err != nil {
+				return fail(check, &PolicyError{
+					Code:    CodeInvalidArgument,
+					Name:    "INVALID_ARGUMENT",
+					Message: fmt.Sprintf("invalid %s constraint: %v", t.Name, err),
+					Details: map[string]any{"constraint": t.Name},
+				})
+			}
+			evaluate := t.Evaluate
+			if ev.dryRun && t.DryRun != nil {
+				evaluate = t.DryRun
+			}
+			if err := evaluate(value, claims, ctx); err != nil {
+				return fail(check, err)
+			}
+			if spends && !ev.dryRun {
+				spent = append(spent, spending{t, value})
+			}
+			ev.step(check, StepPass, string(raw))
+		}
+	}
+	return nil
+}
+
+// CtxMethod carries the method being authorized in the ctx constraints
+// are evaluated against. Authorize sets it.
+const CtxMethod = "method"
+
+// withMethod returns a copy of ctx with CtxMethod set.
+func withMethod(ctx map[string]any, method string) map[string]any {
+	out := make(map[string]any, len(ctx)+1)
+	for k, v := range ctx {
+		out[k] = v
+	}
+	out[CtxMethod] = method
+	return out
+}
+
+// hasCtx reports whether ctx carries any of t's ctx keys, or t reads none.
+func hasCtx(t *ConstraintType, ctx map[string]any) bool {
+	if len(t.CtxKeys) == 0 {
+		return true
+	}
+	for _, k := range t.CtxKeys {
+		if _, ok := ctx[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func constraintDenied(msg, name string) *PolicyError {
+	pe := &PolicyError{
+		Code:    CodePermissionDenied,
+		Name:    "PERMISSION_DENIED",
+		Message: msg,
+	}
+	if name != "" {
+		pe.Details = map[string]any{"constraint": name}
+	}
+	return pe
+}
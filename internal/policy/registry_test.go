@@ -0,0 +1,224 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// A service-defined constraint, as a key-value service might register it.
+func init() {
+	RegisterConstraint(ConstraintType{
+		Name:  "test_kv_prefix",
+		Parse: parseString,
+		Evaluate: func(v any, _ *capability.Capability, ctx map[string]any) error {
+			key, _ := ctx["key"].(string)
+			if !strings.HasPrefix(key, v.(string)) {
+				return &PolicyError{Code: CodePermissionDenied, Name: "PERMISSION_DENIED",
+					Message: fmt.Sprintf("key %q outside prefix %q", key, v)}
+			}
+			return nil
+		},
+		CtxKeys: []string{"key"},
+	})
+}
+
+// The same, opting in to being skipped for requests without a key.
+func init() {
+	RegisterConstraint(ConstraintType{
+		Name:  "test_kv_optional_prefix",
+		Parse: parseString,
+		Evaluate: func(v any, _ *capability.Capability, ctx map[string]any) error {
+			if key, _ := ctx["key"].(string); !strings.HasPrefix(key, v.(string)) {
+				return &PolicyError{Code: CodePermissionDenied, Name: "PERMISSION_DENIED", Message: "key outside prefix"}
+			}
+			return nil
+		},
+		CtxKeys:        []string{"key"},
+		SkipWithoutCtx: true,
+	})
+}
+
+// A spending constraint that denies requests asking it to, after the
+// built-in ones have spent.
+func init() {
+	RegisterConstraint(ConstraintType{
+		Name:  "test_deny_spend",
+		Parse: func(json.RawMessage) (any, error) { return nil, nil },
+		Evaluate: func(_ any, _ *capability.Capability, ctx map[string]any) error {
+			if deny, _ := ctx["deny"].(bool); deny {
+				return &PolicyError{Code: CodeResourceExhausted, Name: "RESOURCE_EXHAUSTED", Message: "denied"}
+			}
+			return nil
+		},
+		Spends: true,
+	})
+}
+
+func withExt(t *testing.T, c capability.Constraints, name string, v any) capability.Constraints {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Ext == nil {
+		c.Ext = make(map[string]json.RawMessage)
+	}
+	c.Ext[name] = raw
+	return c
+}
+
+func TestRegistry_ServiceConstraint(t *testing.T) {
+	claims := &capability.Capability{
+		ID:          "kv-cap",
+		Service:     "kv",
+		Rights:      []string{"kv.get"},
+		Constraints: withExt(t, capability.Constraints{}, "test_kv_prefix", "app/"),
+	}
+	if err := Authorize(claims, "kv.get", map[string]any{"key": "app/config"}); err != nil {
+		t.Errorf("key under prefix should pass: %v", err)
+	}
+	if err := Authorize(claims, "kv.get", map[string]any{"key": "other/secret"}); err == nil {
+		t.Error("key outside prefix should be denied")
+	}
+}
+
+func TestRegistry_MissingCtxFailsClosed(t *testing.T) {
+	claims := &capability.Capability{
+		ID:          "kv-nokey",
+		Service:     "kv",
+		Rights:      []string{"kv.get", "kv.list"},
+		Constraints: withExt(t, capability.Constraints{}, "test_kv_prefix", "app/"),
+	}
+	// A method that leaves out the key cannot be checked against the
+	// prefix, so it is denied rather than let through.
+	err := Authorize(claims, "kv.list", nil)
+	pe, ok := err.(*PolicyError)
+	if !ok || pe.Code != CodePermissionDenied || pe.Details["constraint"] != "test_kv_prefix" {
+		t.Fatalf("err = %v, want PERMISSION_DENIED naming the constraint", err)
+	}
+}
+
+func TestRegistry_SkipWithoutCtx(t *testing.T) {
+	claims := &capability.Capability{
+		ID:          "kv-skip",
+		Service:     "kv",
+		Rights:      []string{"kv.get", "kv.stats"},
+		Constraints: withExt(t, capability.Constraints{}, "test_kv_optional_prefix", "app/"),
+	}
+	// A type that opts in does not apply without its ctx keys...
+	if err := Authorize(claims, "kv.stats", nil); err != nil {
+		t.Errorf("request without key ctx: %v", err)
+	}
+	// ...but still applies when they are there.
+	if err := Authorize(claims, "kv.get", map[string]any{"key": "other/secret"}); err == nil {
+		t.Error("key outside prefix should be denied")
+	}
+}
+
+func TestRegistry_UnknownConstraintFailsClosed(t *testing.T) {
+	claims := &capability.Capability{
+		ID:          "unknown-cap",
+		Service:     "fs",
+		Rights:      []string{"fs.read"},
+		Constraints: withExt(t, capability.Constraints{}, "geo_fence", "eu"),
+	}
+	err := Authorize(claims, "fs.read", nil)
+	pe, ok := err.(*PolicyError)
+	if !ok || pe.Code != CodePermissionDenied {
+		t.Fatalf("err = %v, want PERMISSION_DENIED", err)
+	}
+	if pe.Details["constraint"] != "geo_fence" {
+		t.Errorf("details = %v, want the unknown constraint named", pe.Details)
+	}
+}
+
+func TestRegistry_InvalidValue(t *testing.T) {
+	claims := &capability.Capability{
+		ID:          "bad-kv",
+		Service:     "kv",
+		Rights:      []string{"kv.get"},
+		Constraints: withExt(t, capability.Constraints{}, "test_kv_prefix", 42),
+	}
+	pe, ok := Authorize(claims, "kv.get", map[string]any{"key": "x"}).(*PolicyError)
+	if !ok || pe.Code != CodeInvalidArgument {
+		t.Errorf("non-string prefix should be INVALID_ARGUMENT, got %v", pe)
+	}
+}
+
+func TestRegistry_SpendsRunLast(t *testing.T) {
+	SetUseCounter(NewUseCounter())
+	defer SetUseCounter(NewUseCounter())
+
+	c := withExt(t, capability.Constraints{MaxUses: 1}, "test_kv_prefix", "app/")
+	claims := &capability.Capability{
+		ID: "kv-once", Service: "kv", Rights: []string{"kv.get"},
+		ExpiresAt: time.Now().Add(time.Hour), Constraints: c,
+	}
+	if err := Authorize(claims, "kv.get", map[string]any{"key": "nope"}); err == nil {
+		t.Fatal("expected denial")
+	}
+	if n := globalUses.Uses("kv-once"); n != 0 {
+		t.Errorf("uses = %d; a denied request should spend none", n)
+	}
+}
+
+func TestValidateConstraints(t *testing.T) {
+	if err := ValidateConstraints(capability.Constraints{RateLimit: "fast"}); err == nil {
+		t.Error("bad rate_limit should fail validation")
+	}
+	bad := withExt(t, capability.Constraints{}, "test_kv_prefix", []int{1})
+	if err := ValidateConstraints(bad); err == nil {
+		t.Error("bad registered extension should fail validation")
+	}
+	// The issuer need not know every service's constraints.
+	unknown := withExt(t, capability.Constraints{PathPrefix: "/srv"}, "geo_fence", "eu")
+	if err := ValidateConstraints(unknown); err != nil {
+		t.Errorf("unknown extension should pass validation: %v", err)
+	}
+}
+
+func TestRegisterConstraint_Panics(t *testing.T) {
+	for name, ct := range map[string]ConstraintType{
+		"duplicate":  {Name: "path_prefix", Parse: parseString, Evaluate: func(any, *capability.Capability, map[string]any) error { return nil }},
+		"incomplete": {Name: "no_evaluator", Parse: parseString},
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected panic")
+				}
+			}()
+			RegisterConstraint(ct)
+		})
+	}
+}
+
+func TestRegistry_DeniedSpendRefunds(t *testing.T) {
+	useQuotaTracker(t)
+	SetUseCounter(NewUseCounter())
+	defer SetUseCounter(NewUseCounter())
+	claims := quotaClaims("refund-cap", map[string]capability.Quota{QuotaBytesRead: {Limit: 10}})
+	claims.Constraints.MaxUses = 2
+	claims.Constraints = withExt(t, claims.Constraints, "test_deny_spend", true)
+
+	ctx := map[string]any{CtxQuota: map[string]int64{QuotaBytesRead: 10}, "deny": true}
+	if err := Authorize(claims, "fs.read", ctx); err == nil {
+		t.Fatal("request should be denied")
+	}
+	if n := globalUses.Uses(claims.ID); n != 0 {
+		t.Errorf("denied request spent %d uses", n)
+	}
+	report, _ := QuotaReport(claims)
+	if len(report) != 1 || report[0].Used != 0 {
+		t.Errorf("denied request charged the quota: %+v", report)
+	}
+	ctx["deny"] = false
+	if err := Authorize(claims, "fs.read", ctx); err != nil {
+		t.Errorf("the refunded quota and use: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// Rights are method names ("fs.read"), or patterns over them:
+//
+//	fs.read           exactly fs.read
+//	fs.*              every fs method, at any depth (fs.read, fs.dir.make)
+//	supervisor.svc.*  every method under supervisor.svc
+//	!fs.write         never fs.write, whatever else is granted
+//
+// A wildcard is a whole final segment and needs at least one segment
+// before it. Precedence is fixed: a matching negative right denies, then
+// any matching positive right or legacy action grants. Order and
+// specificity play no part.
+
+// ValidateRight reports whether right is a well-formed right or pattern.
+func ValidateRight(right string) error {
+	pattern := strings.TrimPrefix(right, "!")
+	segs := strings.Split(pattern, ".")
+	if len(segs) < 2 {
+		return fmt.Errorf("right %q must have the form service.method", right)
+	}
+	for i, seg := range segs {
+		if seg == "*" {
+			if i != len(segs)-1 {
+				return fmt.Errorf("right %q: wildcard must be the last segment", right)
+			}
+			continue
+		}
+		if seg == "" || strings.IndexFunc(seg, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+		}) >= 0 {
+			return fmt.Errorf("right %q: invalid segment %q", right, seg)
+		}
+	}
+	return nil
+}
+
+// MatchRight reports whether the positive pattern matches method.
+func MatchRight(pattern, method string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, ".*"); ok {
+		return strings.HasPrefix(method, prefix+".")
+	}
+	return pattern == method
+}
+
+// Grants reports whether claims permit method, applying the precedence
+// rules above to its rights and legacy actions.
+func Grants(claims *capability.Capability, method string) bool {
+	_, ok := grantedBy(claims, method)
+	return ok
+}
+
+// grantedBy is Grants, also naming what decided: the first matching
+// positive right or legacy action when granted, or the negative right
+// when denied by one ("" if nothing matched).
+func grantedBy(claims *capability.Capability, method string) (string, bool) {
+	by := ""
+	for _, r := range claims.Rights {
+		if negated, ok := strings.CutPrefix(r, "!"); ok {
+			if MatchRight(negated, method) {
+				return r, false
+			}
+		} else if by == "" && MatchRight(r, method) {
+			by = r
+		}
+	}
+	if by != "" {
+		return by, true
+	}
+	service, action, _ := strings.Cut(method, ".")
+	if claims.Service == service && hasAction(claims.Actions, action) {
+		return "action " + action, true
+	}
+	return "", false
+}
+
+// coversRight reports whether a granter holding pattern may grant
+// requested: an exact right it matches, or a wildcard no broader than its own.
+func coversRight(pattern, requested string) bool {
+	if prefix, ok := strings.CutSuffix(requested, ".*"); ok {
+		granterPrefix, wild := strings.CutSuffix(pattern, ".*")
+		return wild && (prefix == granterPrefix || strings.HasPrefix(prefix, granterPrefix+"."))
+	}
+	return MatchRight(pattern, requested)
+}
@@ -0,0 +1,454 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// Rule effects.
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// CtxHostPath carries the absolute host path a request's "path" resolves
+// to (string), symlinks resolved, which rules' path_prefix matches.
+// Without it, a relative path is taken from the working directory.
+const CtxHostPath = "host_path"
+
+// RuleSet is an operator-defined policy layered over capabilities: a
+// request must be granted by its token and allowed by the rules. Rules are
+// tried in order and the first match decides; a request no rule matches
+// gets Default ("allow" unless set to "deny").
+type RuleSet struct {
+	Default string `json:"default,omitempty"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Rule matches requests by every condition it sets; unset conditions
+// match anything.
+type Rule struct {
+	Name   string `json:"name,omitempty"`
+	Effect string `json:"effect"`
+	// Service and Methods select methods. Methods are right patterns
+	// ("fs.read", "fs.*") and must belong to Service if both are set.
+	Service string   `json:"service,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+	// Subjects matches the token's sub claim exactly.
+	Subjects []string `json:"subjects,omitempty"`
+	// PathPrefix (absolute) matches requests whose path equals or lies
+	// beneath it; requests without a path never match. The path matched,
+	// like the prefix, is the real one, with symlinks resolved (but for a
+	// final symlink a request removes, renames or creates), so a link
+	// elsewhere does not escape a rule on its target. Services resolve it
+	// when they check the request and refuse to act on it if a symlink has
+	// been swapped in since.
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// Schedule matches while it would allow use: inside a window and
+	// outside every blackout.
+	Schedule *capability.Schedule `json:"schedule,omitempty"`
+
+	schedule *schedule
+}
+
+// ParseRules decodes and validates a JSON rule set.
+func ParseRules(data []byte) (*RuleSet, error) {
+	var rs RuleSet
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rs); err != nil {
+		return nil, fmt.Errorf("parse policy rules: %w", err)
+	}
+	if err := rs.compile(); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// LoadRules reads a JSON rule set from path.
+func LoadRules(path string) (*RuleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy rules: %w", err)
+	}
+	return ParseRules(data)
+}
+
+// compile validates the rule set and parses its schedules.
+func (rs *RuleSet) compile() error {
+	switch rs.Default {
+	case "":
+		rs.Default = EffectAllow
+	case EffectAllow, EffectDeny:
+	default:
+		return fmt.Errorf("policy rules: default must be %q or %q", EffectAllow, EffectDeny)
+	}
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("policy rule %s: %w", rs.label(i), err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) compile() error {
+	if r.Effect != EffectAllow && r.Effect != EffectDeny {
+		return fmt.Errorf("effect must be %q or %q", EffectAllow, EffectDeny)
+	}
+	if strings.Contains(r.Service, ".") {
+		return fmt.Errorf("service %q must not contain a dot", r.Service)
+	}
+	for _, m := range r.Methods {
+		if err := ValidateRight(m); err != nil {
+			return err
+		}
+		if strings.HasPrefix(m, "!") {
+			return fmt.Errorf("method %q: use a deny rule instead of a negative pattern", m)
+		}
+		if r.Service != "" && !MatchRight(r.Service+".*", m) {
+			return fmt.Errorf("method %q is not in service %q", m, r.Service)
+		}
+	}
+	for _, s := range r.Subjects {
+		if s == "" {
+			return fmt.Errorf("empty subject")
+		}
+	}
+	if r.PathPrefix != "" && !filepath.IsAbs(r.PathPrefix) {
+		return fmt.Errorf("path_prefix %q must be absolute", r.PathPrefix)
+	}
+	if r.Schedule != nil {
+		s, err := parseSchedule(r.Schedule)
+		if err != nil {
+			return fmt.Errorf("schedule: %w", err)
+		}
+		r.schedule = s
+	}
+	return nil
+}
+
+// label names rule i for messages: its name, or its position.
+func (rs *RuleSet) label(i int) string {
+	if rs.Rules[i].Name != "" {
+		return rs.Rules[i].Name
+	}
+	return fmt.Sprintf("#%d", i)
+}
+
+// methods returns the rule's method patterns, with Service folded in; nil
+// means every method.
+func (r *Rule) methods() []string {
+	if len(r.Methods) == 0 && r.Service != "" {
+		return []string{r.Service + ".*"}
+	}
+	return r.Methods
+}
+
+// matches reports whether the rule applies to the request at now.
+func (r *Rule) matches(claims *capability.Capability, method string, ctx map[string]any, now time.Time) bool {
+	if ms := r.methods(); ms != nil && !anyRight(ms, func(p string) bool { return MatchRight(p, method) }) {
+		return false
+	}
+	if len(r.Subjects) > 0 && !containsString(r.Subjects, claims.Subject) {
+		return false
+	}
+	if r.PathPrefix != "" {
+		// A host path comes resolved; a bare path is resolved here.
+		path, _ := ctx[CtxHostPath].(string)
+		if path == "" {
+			raw, _ := ctx["path"].(string)
+			if raw == "" {
+				return false
+			}
+			var err error
+			if path, err = realPath(raw); err != nil {
+				return false
+			}
+		}
+		// The prefix is resolved too, so a rule naming a link to a tree
+		// covers the tree.
+		prefix, err := realPath(r.PathPrefix)
+		if err != nil || !withinPrefix(path, prefix) {
+			return false
+		}
+	}
+	if r.schedule != nil {
+		if _, blackout := r.schedule.blackoutAt(now); blackout || !r.schedule.inWindow(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// realPath returns the absolute path of path with symlinks resolved, as far
+// as it exists.
+func realPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if dir == filepath.Dir(dir) {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// match returns the index of the first rule matching the request, or -1.
+func (rs *RuleSet) match(claims *capability.Capability, method string, ctx map[string]any, now time.Time) int {
+	for i := range rs.Rules {
+		if rs.Rules[i].matches(claims, method, ctx, now) {
+			return i
+		}
+	}
+	return -1
+}
+
+// evaluate applies the rule set to a request its capability grants.
+func (rs *RuleSet) evaluate(claims *capability.Capability, method string, ctx map[string]any, now time.Time) error {
+	i := rs.match(claims, method, ctx, now)
+	if i >= 0 {
+		if rs.Rules[i].Effect == EffectAllow {
+			return nil
+		}
+		return &PolicyError{
+			Code:    CodePermissionDenied,
+			Name:    "PERMISSION_DENIED",
+			Message: fmt.Sprintf("%s denied by policy rule %s", method, rs.label(i)),
+			Details: map[string]any{"rule": rs.label(i)},
+		}
+	}
+	if rs.Default == EffectDeny {
+		return &PolicyError{
+			Code:    CodePermissionDenied,
+			Name:    "PERMISSION_DENIED",
+			Message: fmt.Sprintf("%s denied by policy default", method),
+			Details: map[string]any{"rule": "default"},
+		}
+	}
+	return nil
+}
+
+// RuleFinding is a problem Check found in a rule set.
+type RuleFinding struct {
+	Kind    string `json:"kind"` // "unreachable" or "conflict"
+	Rule    int    `json:"rule"`
+	Other   int    `json:"other"` // the earlier rule responsible
+	Message string `json:"message"`
+}
+
+// Check reports rules that can never match because an earlier rule
+// matches everything they do (unreachable), and pairs of rules with
+// opposite effects whose matches overlap, so their order decides the
+// outcome (conflict). Schedules are compared only for equality, so rules
+// differing only in schedule may be reported as conflicting even if their
+// times never meet.
+func (rs *RuleSet) Check() []RuleFinding {
+	var out []RuleFinding
+	for j := range rs.Rules {
+		b := &rs.Rules[j]
+		for i := 0; i < j; i++ {
+			a := &rs.Rules[i]
+			if a.covers(b) {
+				out = append(out, RuleFinding{
+					Kind: "unreachable", Rule: j, Other: i,
+					Message: fmt.Sprintf("rule %s is unreachable: rule %s matches every request it does", rs.label(j), rs.label(i)),
+				})
+				break
+			}
+			if a.Effect != b.Effect && a.overlaps(b) {
+				out = append(out, RuleFinding{
+					Kind: "conflict", Rule: j, Other: i,
+					Message: fmt.Sprintf("rule %s (%s) overlaps earlier rule %s (%s), which wins where both match",
+						rs.label(j), b.Effect, rs.label(i), a.Effect),
+				})
+			}
+		}
+	}
+	return out
+}
+
+// covers reports whether r matches every request o matches.
+func (r *Rule) covers(o *Rule) bool {
+	if rm := r.methods(); rm != nil {
+		om := o.methods()
+		if om == nil {
+			return false
+		}
+		for _, m := range om {
+			if !anyRight(rm, func(p string) bool { return coversRight(p, m) }) {
+				return false
+			}
+		}
+	}
+	if len(r.Subjects) > 0 {
+		if len(o.Subjects) == 0 {
+			return false
+		}
+		for _, s := range o.Subjects {
+			if !containsString(r.Subjects, s) {
+				return false
+			}
+		}
+	}
+	if r.PathPrefix != "" && !withinPrefix(o.PathPrefix, r.PathPrefix) {
+		return false
+	}
+	return r.Schedule == nil || reflect.DeepEqual(r.Schedule, o.Schedule)
+}
+
+// overlaps reports whether some request could match both r and o.
+func (r *Rule) overlaps(o *Rule) bool {
+	if rm, om := r.methods(), o.methods(); rm != nil && om != nil {
+		hit := false
+		for _, m := range om {
+			if anyRight(rm, func(p string) bool { return coversRight(p, m) || coversRight(m, p) }) {
+				hit = true
+				break
+			}
+		}
+		if !hit {
+			return false
+		}
+	}
+	if len(r.Subjects) > 0 && len(o.Subjects) > 0 {
+		hit := false
+		for _, s := range o.Subjects {
+			if containsString(r.Subjects, s) {
+				hit = true
+				break
+			}
+		}
+		if !hit {
+			return false
+		}
+	}
+	if r.PathPrefix != "" && o.PathPrefix != "" &&
+		!withinPrefix(r.PathPrefix, o.PathPrefix) && !withinPrefix(o.PathPrefix, r.PathPrefix) {
+		return false
+	}
+	return true
+}
+
+func anyRight(patterns []string, f func(string) bool) bool {
+	for _, p := range patterns {
+		if f(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// globalRules is the rule set Authorize applies; nil allows everything
+// capabilities grant.
+var globalRules atomic.Pointer[RuleSet]
+
+// SetRules replaces the rule set Authorize applies. nil removes it.
+func SetRules(rs *RuleSet) {
+	globalRules.Store(rs)
+}
+
+// RulesLoaded reports whether a rule set is in force.
+func RulesLoaded() bool {
+	return globalRules.Load() != nil
+}
+
+// CheckRules applies the current rule set, if any, to a further resource
+// of a request Authorize allowed, such as each entry of a directory it
+// removes or renames; ctx describes that resource as it would the
+// request's own.
+func CheckRules(claims *capability.Capability, method string, ctx map[string]any) error {
+	rs := globalRules.Load()
+	if rs == nil {
+		return nil
+	}
+	return rs.evaluate(claims, method, ctx, time.Now())
+}
+
+// enforceRules applies the current rule set, if any.
+func enforceRules(claims *capability.Capability, method string, ctx map[string]any, ev *evaluation) error {
+	rs := globalRules.Load()
+	if rs == nil {
+		ev.step("rules", StepSkip, "no policy rules loaded")
+		return nil
+	}
+	now := time.Now()
+	if err := rs.evaluate(claims, method, ctx, now); err != nil {
+		return ev.fail("rules", err)
+	}
+	if ev.trace == nil {
+		return nil
+	}
+	if i := rs.match(claims, method, ctx, now); i >= 0 {
+		ev.step("rules", StepPass, "allowed by policy rule "+rs.label(i))
+	} else {
+		ev.step("rules", StepPass, "no rule matched; default allow")
+	}
+	return nil
+}
+
+// WatchRules polls the rule file at path every interval and installs it
+// with SetRules whenever its size or modification time changes, until ctx
+// is done. onChange is told of each reload or failed reload; on failure
+// the previous rules stay in force.
+func WatchRules(ctx context.Context, path string, interval time.Duration, onChange func(*RuleSet, error)) {
+	var lastMod time.Time
+	var lastSize int64 = -1
+	if fi, err := os.Stat(path); err == nil {
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			if lastSize != -1 {
+				lastSize = -1
+				onChange(nil, fmt.Errorf("stat policy rules: %w", err))
+			}
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+		rs, err := LoadRules(path)
+		if err != nil {
+			onChange(nil, err)
+			continue
+		}
+		SetRules(rs)
+		onChange(rs, nil)
+	}
+}
@@ -0,0 +1,307 @@
+package policy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/confine"
+)
+
+func mustParseRules(t *testing.T, data string) *RuleSet {
+	t.Helper()
+	rs, err := ParseRules([]byte(data))
+	if err != nil {
+		t.Fatalf("ParseRules: %v", err)
+	}
+	return rs
+}
+
+func ruleName(err error) string {
+	pe, ok := err.(*PolicyError)
+	if !ok {
+		return ""
+	}
+	name, _ := pe.Details["rule"].(string)
+	return name
+}
+
+func TestRules_DenyOverridesCapability(t *testing.T) {
+	SetRules(mustParseRules(t, `{"rules": [
+		{"name": "no-etc", "effect": "deny", "methods": ["fs.read"], "path_prefix": "/etc"}
+	]}`))
+	t.Cleanup(func() { SetRules(nil) })
+
+	claims := &capability.Capability{Service: "fs", Rights: []string{"fs.*"}}
+	err := Authorize(claims, "fs.read", map[string]any{CtxHandle: true, "path": "/etc/shadow"})
+	if err == nil {
+		t.Fatal("fs.read under /etc should be denied by the rule")
+	}
+	if pe := err.(*PolicyError); pe.Code != CodePermissionDenied || ruleName(err) != "no-etc" {
+		t.Errorf("err = %+v, want PERMISSION_DENIED from rule no-etc", pe)
+	}
+	if err := Authorize(claims, "fs.read", map[string]any{CtxHandle: true, "path": "/etcetera/x"}); err != nil {
+		t.Errorf("/etcetera is not under /etc: %v", err)
+	}
+	if err := Authorize(claims, "fs.list", map[string]any{"path": "etc"}); err != nil {
+		t.Errorf("fs.list is not covered by the rule: %v", err)
+	}
+}
+
+func TestRules_NeverGrant(t *testing.T) {
+	SetRules(mustParseRules(t, `{"rules": [{"effect": "allow"}]}`))
+	t.Cleanup(func() { SetRules(nil) })
+
+	claims := &capability.Capability{Service: "fs", Rights: []string{"fs.list"}}
+	if err := Authorize(claims, "fs.open", nil); err == nil {
+		t.Error("an allow rule must not grant what the token does not")
+	}
+}
+
+func TestRules_FirstMatchAndDefault(t *testing.T) {
+	rs := mustParseRules(t, `{"default": "deny", "rules": [
+		{"effect": "allow", "service": "fs", "subjects": ["uid:1000"], "path_prefix": "/srv/public"},
+		{"effect": "deny", "service": "fs", "path_prefix": "/srv"},
+		{"effect": "allow", "service": "fs"}
+	]}`)
+	alice := &capability.Capability{Service: "fs", Subject: "uid:1000"}
+	bob := &capability.Capability{Service: "fs", Subject: "uid:1001"}
+	now := time.Now()
+	cases := []struct {
+		claims *capability.Capability
+		method string
+		path   string
+		rule   string // "" when allowed
+	}{
+		{alice, "fs.open", "/srv/public/a", ""},
+		{bob, "fs.open", "/srv/public/a", "#1"},
+		{alice, "fs.open", "/srv/private", "#1"},
+		{bob, "fs.open", "/home/bob", ""},
+		{bob, "fs.open", "", ""},
+		{bob, "registry.list", "", "default"},
+	}
+	for _, tc := range cases {
+		var ctx map[string]any
+		if tc.path != "" {
+			ctx = map[string]any{"path": tc.path}
+		}
+		err := rs.evaluate(tc.claims, tc.method, ctx, now)
+		if got := ruleName(err); got != tc.rule {
+			t.Errorf("%s %s %q: rule = %q, want %q (%v)", tc.claims.Subject, tc.method, tc.path, got, tc.rule, err)
+		}
+	}
+}
+
+func TestRules_HostPath(t *testing.T) {
+	rs := mustParseRules(t, `{"rules": [{"name": "no-keys", "effect": "deny", "service": "fs", "path_prefix": "/srv/keys"}]}`)
+	claims := &capability.Capability{Service: "fs"}
+	ctx := map[string]any{"path": "a.key", CtxHostPath: "/srv/keys/a.key"}
+	if got := ruleName(rs.evaluate(claims, "fs.open", ctx, time.Now())); got != "no-keys" {
+		t.Errorf("host path under /srv/keys: rule = %q, want no-keys", got)
+	}
+	ctx[CtxHostPath] = "/srv/data/a.key"
+	if err := rs.evaluate(claims, "fs.open", ctx, time.Now()); err != nil {
+		t.Errorf("host path elsewhere: %v", err)
+	}
+}
+
+func TestCheckRules_Subpath(t *testing.T) {
+	claims := &capability.Capability{Service: "fs", Rights: []string{"fs.*"}}
+	ctx := map[string]any{"path": "data/keep/a.txt", CtxHostPath: "/srv/data/keep/a.txt"}
+	if err := CheckRules(claims, "fs.remove", ctx); err != nil || RulesLoaded() {
+		t.Fatalf("no rules: err = %v, loaded = %v", err, RulesLoaded())
+	}
+
+	SetRules(mustParseRules(t, `{"rules": [
+		{"name": "keep", "effect": "deny", "service": "fs", "methods": ["fs.remove", "fs.rename"], "path_prefix": "/srv/data/keep"}
+	]}`))
+	t.Cleanup(func() { SetRules(nil) })
+	if !RulesLoaded() {
+		t.Fatal("RulesLoaded = false with rules set")
+	}
+	// The directory itself is not covered; an entry beneath it is.
+	dir := map[string]any{"path": "data", CtxHostPath: "/srv/data", CtxWrite: true}
+	if err := Authorize(claims, "fs.remove", dir); err != nil {
+		t.Fatalf("remove data: %v", err)
+	}
+	if got := ruleName(CheckRules(claims, "fs.remove", ctx)); got != "keep" {
+		t.Errorf("entry under keep: rule = %q, want keep", got)
+	}
+	if err := CheckRules(claims, "fs.stat", ctx); err != nil {
+		t.Errorf("another method: %v", err)
+	}
+	ctx[CtxHostPath] = "/srv/data/other/a.txt"
+	if err := CheckRules(claims, "fs.remove", ctx); err != nil {
+		t.Errorf("entry elsewhere: %v", err)
+	}
+}
+
+func TestRules_SymlinkedPath(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"keys", "public"} {
+		os.Mkdir(filepath.Join(dir, d), 0o755)
+	}
+	os.WriteFile(filepath.Join(dir, "keys", "a.key"), []byte("k"), 0o600)
+	os.Symlink("../keys/a.key", filepath.Join(dir, "public", "a.key"))
+	os.Symlink("../keys", filepath.Join(dir, "public", "keys"))
+
+	rs := mustParseRules(t, `{"rules": [{"name": "no-keys", "effect": "deny", "service": "fs", "path_prefix": "`+filepath.Join(dir, "keys")+`"}]}`)
+	claims := &capability.Capability{Service: "fs"}
+	for _, path := range []string{"public/a.key", "public/keys/new.key"} {
+		ctx := map[string]any{"path": filepath.Join(dir, path)}
+		if got := ruleName(rs.evaluate(claims, "fs.open", ctx, time.Now())); got != "no-keys" {
+			t.Errorf("%s through a symlink: rule = %q, want no-keys", path, got)
+		}
+	}
+	// A host path is taken as the service resolved it: one naming the
+	// link itself, for a request on the link, is not under keys.
+	ctx := map[string]any{"path": "public/a.key", CtxHostPath: filepath.Join(dir, "public", "a.key")}
+	if err := rs.evaluate(claims, "fs.remove", ctx, time.Now()); err != nil {
+		t.Errorf("the link itself: %v", err)
+	}
+}
+
+func TestRules_SymlinkedRoot(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	real := filepath.Join(dir, "real")
+	os.MkdirAll(filepath.Join(real, "secret"), 0o755)
+	os.WriteFile(filepath.Join(real, "secret", "f"), []byte("s"), 0o600)
+	link := filepath.Join(dir, "link")
+	os.Symlink(real, link)
+
+	// A capability rooted at the link reaches the target's files, which a
+	// rule on the target covers, and so does a rule naming the link.
+	root, err := confine.OpenRoot(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	host, err := root.RealPath("secret/f", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := &capability.Capability{Service: "fs"}
+	for _, prefix := range []string{filepath.Join(real, "secret"), filepath.Join(link, "secret")} {
+		rs := mustParseRules(t, `{"rules": [{"name": "no-secret", "effect": "deny", "path_prefix": "`+prefix+`"}]}`)
+		ctx := map[string]any{"path": "secret/f", CtxHostPath: host}
+		if got := ruleName(rs.evaluate(claims, "fs.open", ctx, time.Now())); got != "no-secret" {
+			t.Errorf("rule on %s: rule = %q, want no-secret", prefix, got)
+		}
+	}
+}
+
+func TestRules_Schedule(t *testing.T) {
+	rs := mustParseRules(t, `{"rules": [
+		{"effect": "deny", "service": "fs", "schedule": {"tz": "UTC", "windows": [{"start": "00:00", "end": "06:00"}]}}
+	]}`)
+	claims := &capability.Capability{Service: "fs"}
+	night := time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC)
+	day := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	if err := rs.evaluate(claims, "fs.open", nil, night); err == nil {
+		t.Error("rule should deny inside its schedule")
+	}
+	if err := rs.evaluate(claims, "fs.open", nil, day); err != nil {
+		t.Errorf("rule should not match outside its schedule: %v", err)
+	}
+}
+
+func TestParseRules_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"bad json":          `{`,
+		"unknown field":     `{"rules": [{"effect": "deny", "method": ["fs.read"]}]}`,
+		"bad default":       `{"default": "maybe"}`,
+		"missing effect":    `{"rules": [{"service": "fs"}]}`,
+		"bad method":        `{"rules": [{"effect": "deny", "methods": ["fs.*.read"]}]}`,
+		"negative method":   `{"rules": [{"effect": "allow", "methods": ["!fs.read"]}]}`,
+		"method vs service": `{"rules": [{"effect": "deny", "service": "fs", "methods": ["registry.list"]}]}`,
+		"relative path":     `{"rules": [{"effect": "deny", "path_prefix": "etc"}]}`,
+		"bad schedule":      `{"rules": [{"effect": "deny", "schedule": {"tz": "Mars/Olympus"}}]}`,
+	}
+	for name, data := range cases {
+		if _, err := ParseRules([]byte(data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestRules_Check(t *testing.T) {
+	rs := mustParseRules(t, `{"rules": [
+		{"name": "etc", "effect": "deny", "service": "fs", "path_prefix": "/etc"},
+		{"name": "hosts", "effect": "allow", "methods": ["fs.read"], "path_prefix": "/etc/hosts"},
+		{"name": "ops-read", "effect": "allow", "methods": ["fs.read", "fs.list"], "subjects": ["uid:0"]},
+		{"name": "srv", "effect": "deny", "methods": ["fs.open"], "path_prefix": "/srv"},
+		{"name": "registry", "effect": "deny", "service": "registry"}
+	]}`)
+	findings := rs.Check()
+	want := []RuleFinding{
+		{Kind: "unreachable", Rule: 1, Other: 0},
+		{Kind: "conflict", Rule: 2, Other: 0},
+	}
+	if len(findings) != len(want) {
+		t.Fatalf("findings = %+v, want %d", findings, len(want))
+	}
+	for i, w := range want {
+		f := findings[i]
+		if f.Kind != w.Kind || f.Rule != w.Rule || f.Other != w.Other {
+			t.Errorf("finding %d = %+v, want %s of rule %d by %d", i, f, w.Kind, w.Rule, w.Other)
+		}
+	}
+}
+
+func TestRules_CheckClean(t *testing.T) {
+	rs := mustParseRules(t, `{"rules": [
+		{"effect": "allow", "methods": ["fs.read"], "path_prefix": "/etc/hosts"},
+		{"effect": "deny", "service": "fs", "path_prefix": "/etc/ssl"},
+		{"effect": "deny", "methods": ["supervisor.svc.*"], "subjects": ["uid:1000"]}
+	]}`)
+	if f := rs.Check(); len(f) != 0 {
+		t.Errorf("unexpected findings: %+v", f)
+	}
+}
+
+func TestWatchRules(t *testing.T) {
+	t.Cleanup(func() { SetRules(nil) })
+	path := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(path, []byte(`{"rules": []}`), 0644)
+	rs, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("LoadRules: %v", err)
+	}
+	SetRules(rs)
+
+	events := make(chan error, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchRules(ctx, path, 10*time.Millisecond, func(_ *RuleSet, err error) { events <- err })
+
+	claims := &capability.Capability{Service: "fs", Rights: []string{"fs.open"}}
+	if err := Authorize(claims, "fs.open", nil); err != nil {
+		t.Fatalf("before reload: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond) // let the watcher record the original file
+	os.WriteFile(path, []byte(`{"rules": [{"effect": "deny", "service": "fs"}]}`), 0644)
+	if err := <-events; err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if err := Authorize(claims, "fs.open", nil); err == nil {
+		t.Error("reloaded deny rule not applied")
+	}
+
+	os.WriteFile(path, []byte(`{"rules": [{"effect": "sometimes"}]}`), 0644)
+	if err := <-events; err == nil {
+		t.Fatal("invalid rules should be reported")
+	}
+	if err := Authorize(claims, "fs.open", nil); err == nil {
+		t.Error("previous rules should stay in force after a bad reload")
+	}
+}
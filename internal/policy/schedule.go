@@ -0,0 +1,216 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// maxScheduleSteps bounds the search for the next usable time, which hops
+// between window starts and blackout ends.
+const maxScheduleSteps = 64
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// schedule is a capability.Schedule with its strings parsed.
+type schedule struct {
+	loc       *time.Location
+	windows   []window
+	blackouts []capability.Blackout
+}
+
+type window struct {
+	days       [7]bool
+	start, end time.Duration // offsets from midnight; end <= start wraps
+}
+
+// ValidateSchedule reports whether s is well-formed: a known time zone,
+// known weekdays, "HH:MM" times, and blackouts that end after they start.
+func ValidateSchedule(s *capability.Schedule) error {
+	_, err := parseSchedule(s)
+	return err
+}
+
+func parseSchedule(s *capability.Schedule) (*schedule, error) {
+	tz := s.TZ
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", s.TZ)
+	}
+	p := &schedule{loc: loc, blackouts: s.Blackouts}
+	for i, w := range s.Windows {
+		var pw window
+		if len(w.Days) == 0 {
+			pw.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		for _, d := range w.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return nil, fmt.Errorf("window %d: unknown day %q", i, d)
+			}
+			pw.days[wd] = true
+		}
+		if pw.start, err = parseClock(w.Start); err != nil {
+			return nil, fmt.Errorf("window %d: start: %w", i, err)
+		}
+		if pw.end, err = parseClock(w.End); err != nil {
+			return nil, fmt.Errorf("window %d: end: %w", i, err)
+		}
+		if pw.start == 24*time.Hour {
+			return nil, fmt.Errorf("window %d: start: 24:00 is only valid as an end", i)
+		}
+		p.windows = append(p.windows, pw)
+	}
+	for i, b := range s.Blackouts {
+		if !b.Until.After(b.From) {
+			return nil, fmt.Errorf("blackout %d: until must be after from", i)
+		}
+	}
+	return p, nil
+}
+
+// parseClock parses "HH:MM" (00:00 to 24:00) into an offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	h, errH := strconv.Atoi(hh)
+	m, errM := strconv.Atoi(mm)
+	if !ok || len(hh) != 2 || len(mm) != 2 || errH != nil || errM != nil ||
+		h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// enforce denies use outside the schedule's windows or inside a blackout,
+// stating when the capability next becomes usable.
+func (p *schedule) enforce(now time.Time) error {
+	var reason, msg string
+	if b, ok := p.blackoutAt(now); ok {
+		reason = "blackout"
+		msg = "capability is in a blackout period"
+		if b.Reason != "" {
+			msg += " (" + b.Reason + ")"
+		}
+	} else if !p.inWindow(now) {
+		reason = "outside_window"
+		msg = "capability is outside its scheduled windows"
+	} else {
+		return nil
+	}
+
+	details := map[string]any{"reason": reason}
+	if next, ok := p.next(now); ok {
+		next = next.In(p.loc)
+		details["next_allowed"] = next.Format(time.RFC3339)
+		msg += "; usable again at " + next.Format(time.RFC3339)
+	} else {
+		msg += "; no scheduled window remains"
+	}
+	return &PolicyError{
+		Code:    CodePermissionDenied,
+		Name:    "PERMISSION_DENIED",
+		Message: msg,
+		Details: details,
+	}
+}
+
+func (p *schedule) blackoutAt(t time.Time) (capability.Blackout, bool) {
+	for _, b := range p.blackouts {
+		if !t.Before(b.From) && t.Before(b.Until) {
+			return b, true
+		}
+	}
+	return capability.Blackout{}, false
+}
+
+// midnight returns the start of the day d days after t's, in p's zone.
+func (p *schedule) midnight(t time.Time, d int) time.Time {
+	y, m, day := t.In(p.loc).Date()
+	return time.Date(y, m, day+d, 0, 0, 0, 0, p.loc)
+}
+
+// inWindow reports whether t falls in a window, including one that began
+// the previous day and runs past midnight.
+func (p *schedule) inWindow(t time.Time) bool {
+	if len(p.windows) == 0 {
+		return true
+	}
+	for _, w := range p.windows {
+		for d := -1; d <= 0; d++ {
+			day := p.midnight(t, d)
+			if !w.days[day.Weekday()] {
+				continue
+			}
+			start, end := w.bounds(day)
+			if !t.Before(start) && t.Before(end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bounds returns the window's start and end on the day starting at midnight.
+func (w window) bounds(midnight time.Time) (time.Time, time.Time) {
+	end := w.end
+	if end <= w.start {
+		end += 24 * time.Hour
+	}
+	y, m, d := midnight.Date()
+	loc := midnight.Location()
+	at := func(off time.Duration) time.Time {
+		// Built from wall-clock fields so DST changes shift the instant,
+		// not the printed time.
+		return time.Date(y, m, d, int(off/time.Hour), int(off%time.Hour/time.Minute), 0, 0, loc)
+	}
+	return at(w.start), at(end)
+}
+
+// nextWindowStart returns the earliest window start after t, within a week.
+func (p *schedule) nextWindowStart(t time.Time) (time.Time, bool) {
+	var best time.Time
+	for d := 0; d <= 7; d++ {
+		day := p.midnight(t, d)
+		for _, w := range p.windows {
+			if !w.days[day.Weekday()] {
+				continue
+			}
+			start, _ := w.bounds(day)
+			if start.After(t) && (best.IsZero() || start.Before(best)) {
+				best = start
+			}
+		}
+		if !best.IsZero() {
+			return best, true
+		}
+	}
+	return best, false
+}
+
+// next returns the earliest time at or after t when the schedule allows use.
+func (p *schedule) next(t time.Time) (time.Time, bool) {
+	for i := 0; i < maxScheduleSteps; i++ {
+		if b, ok := p.blackoutAt(t); ok {
+			t = b.Until
+			continue
+		}
+		if p.inWindow(t) {
+			return t, true
+		}
+		start, ok := p.nextWindowStart(t)
+		if !ok {
+			return time.Time{}, false
+		}
+		t = start
+	}
+	return time.Time{}, false
+}
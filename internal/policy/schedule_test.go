@@ -0,0 +1,184 @@
+package policy
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // named zones without relying on the host's database
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// 2026-10-19 is a Monday.
+func at(t *testing.T, s string) time.Time {
+	t.Helper()
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatalf("parse %q: %v", s, err)
+	}
+	return ts
+}
+
+func businessHours() *capability.Schedule {
+	return &capability.Schedule{
+		TZ: "Europe/Berlin",
+		Windows: []capability.Window{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "17:00"},
+		},
+	}
+}
+
+func scheduleDenial(t *testing.T, err error) (reason, next string) {
+	t.Helper()
+	pe, ok := err.(*PolicyError)
+	if !ok || pe.Code != CodePermissionDenied {
+		t.Fatalf("err = %v, want PERMISSION_DENIED", err)
+	}
+	reason, _ = pe.Details["reason"].(string)
+	next, _ = pe.Details["next_allowed"].(string)
+	return reason, next
+}
+
+// enforceAt parses s and enforces it at now, as the schedule constraint
+// does.
+func enforceAt(t *testing.T, s *capability.Schedule, now time.Time) error {
+	t.Helper()
+	p, err := parseSchedule(s)
+	if err != nil {
+		t.Fatalf("parseSchedule: %v", err)
+	}
+	return p.enforce(now)
+}
+
+func TestEnforceSchedule_Unconstrained(t *testing.T) {
+	claims := &capability.Capability{ID: "sched-cap", Service: "fs", Rights: []string{"fs.read"}}
+	if err := Authorize(claims, "fs.read", nil); err != nil {
+		t.Errorf("no schedule should pass: %v", err)
+	}
+}
+
+func TestEnforceSchedule_InsideWindow(t *testing.T) {
+	// 10:30 Berlin (CEST, UTC+2) on a Monday.
+	if err := enforceAt(t, businessHours(), at(t, "2026-10-19T08:30:00Z")); err != nil {
+		t.Errorf("inside window should pass: %v", err)
+	}
+}
+
+func TestEnforceSchedule_OutsideWindow(t *testing.T) {
+	tests := []struct {
+		name, now, next string
+	}{
+		{"before opening", "2026-10-19T05:00:00Z", "2026-10-19T09:00:00+02:00"},
+		{"end is exclusive", "2026-10-19T15:00:00Z", "2026-10-20T09:00:00+02:00"},
+		{"friday evening", "2026-10-23T18:00:00Z", "2026-10-26T09:00:00+01:00"}, // DST ends on the 25th
+		{"weekend", "2026-10-24T12:00:00Z", "2026-10-26T09:00:00+01:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, next := scheduleDenial(t, enforceAt(t, businessHours(), at(t, tt.now)))
+			if reason != "outside_window" {
+				t.Errorf("reason = %q, want outside_window", reason)
+			}
+			if next != tt.next {
+				t.Errorf("next_allowed = %q, want %q", next, tt.next)
+			}
+		})
+	}
+}
+
+func TestEnforceSchedule_OvernightWindow(t *testing.T) {
+	s := &capability.Schedule{Windows: []capability.Window{{Days: []string{"sat"}, Start: "22:00", End: "04:00"}}}
+	for _, now := range []string{"2026-10-24T23:00:00Z", "2026-10-25T03:59:00Z"} {
+		if err := enforceAt(t, s, at(t, now)); err != nil {
+			t.Errorf("%s should be inside the overnight window: %v", now, err)
+		}
+	}
+	// Sunday night is not a window start.
+	_, next := scheduleDenial(t, enforceAt(t, s, at(t, "2026-10-25T23:00:00Z")))
+	if next != "2026-10-31T22:00:00Z" {
+		t.Errorf("next_allowed = %q", next)
+	}
+}
+
+func TestEnforceSchedule_Blackout(t *testing.T) {
+	s := businessHours()
+	s.Blackouts = []capability.Blackout{{
+		From:   at(t, "2026-10-19T10:00:00Z"),
+		Until:  at(t, "2026-10-19T12:00:00Z"),
+		Reason: "storage maintenance",
+	}}
+	err := enforceAt(t, s, at(t, "2026-10-19T11:00:00Z"))
+	reason, next := scheduleDenial(t, err)
+	if reason != "blackout" {
+		t.Errorf("reason = %q, want blackout", reason)
+	}
+	if next != "2026-10-19T14:00:00+02:00" {
+		t.Errorf("next_allowed = %q", next)
+	}
+	if msg := err.Error(); msg != "capability is in a blackout period (storage maintenance); usable again at 2026-10-19T14:00:00+02:00" {
+		t.Errorf("message = %q", msg)
+	}
+	if err := enforceAt(t, s, at(t, "2026-10-19T12:00:00Z")); err != nil {
+		t.Errorf("blackout end is exclusive: %v", err)
+	}
+}
+
+func TestEnforceSchedule_BlackoutPastWindowEnd(t *testing.T) {
+	// A blackout running past closing time pushes next_allowed to the
+	// next day's window.
+	s := businessHours()
+	s.Blackouts = []capability.Blackout{{From: at(t, "2026-10-19T13:00:00Z"), Until: at(t, "2026-10-19T20:00:00Z")}}
+	_, next := scheduleDenial(t, enforceAt(t, s, at(t, "2026-10-19T14:00:00Z")))
+	if next != "2026-10-20T09:00:00+02:00" {
+		t.Errorf("next_allowed = %q", next)
+	}
+}
+
+func TestEnforceSchedule_BlackoutOnly(t *testing.T) {
+	s := &capability.Schedule{Blackouts: []capability.Blackout{
+		{From: at(t, "2026-10-19T10:00:00Z"), Until: at(t, "2026-10-19T11:00:00Z")},
+	}}
+	if err := enforceAt(t, s, at(t, "2026-10-19T09:00:00Z")); err != nil {
+		t.Errorf("no windows means always allowed outside blackouts: %v", err)
+	}
+	if err := enforceAt(t, s, at(t, "2026-10-19T10:30:00Z")); err == nil {
+		t.Error("blackout should deny")
+	}
+}
+
+func TestEnforceSchedule_Invalid(t *testing.T) {
+	claims := &capability.Capability{
+		ID:          "sched-cap",
+		Service:     "fs",
+		Rights:      []string{"fs.read"},
+		Constraints: capability.Constraints{Schedule: &capability.Schedule{TZ: "Mars/Olympus"}},
+	}
+	pe, ok := Authorize(claims, "fs.read", nil).(*PolicyError)
+	if !ok || pe.Code != CodeInvalidArgument {
+		t.Errorf("invalid schedule should be INVALID_ARGUMENT, got %v", pe)
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	now := time.Now()
+	bad := []*capability.Schedule{
+		{TZ: "Nowhere/City"},
+		{Windows: []capability.Window{{Days: []string{"funday"}, Start: "09:00", End: "10:00"}}},
+		{Windows: []capability.Window{{Start: "9:00", End: "10:00"}}},
+		{Windows: []capability.Window{{Start: "09:00", End: "25:00"}}},
+		{Windows: []capability.Window{{Start: "24:00", End: "01:00"}}},
+		{Windows: []capability.Window{{Start: "09:60", End: "10:00"}}},
+		{Blackouts: []capability.Blackout{{From: now, Until: now}}},
+	}
+	for i, s := range bad {
+		if err := ValidateSchedule(s); err == nil {
+			t.Errorf("case %d: expected error", i)
+		}
+	}
+	good := &capability.Schedule{
+		TZ:      "America/New_York",
+		Windows: []capability.Window{{Days: []string{"Sat", "sun"}, Start: "00:00", End: "24:00"}},
+	}
+	if err := ValidateSchedule(good); err != nil {
+		t.Errorf("valid schedule rejected: %v", err)
+	}
+}
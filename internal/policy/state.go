@@ -0,0 +1,278 @@
+package policy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// stateDir is a directory of state the node's services share, such as
+// rate-limit buckets, holding one small record per key so that a request
+// locks and rewrites only the records it touches. Records are rewritten in
+// place under an exclusive flock, which other processes see at once;
+// syncing them to disk, an fsync per request, is left to flush. A crash of
+// the machine loses at most the updates since the last flush: buckets and
+// quotas refill by that much. A record a crash left half-written no longer
+// parses, and its owner starts it afresh.
+type stateDir struct {
+	path string
+	// expired reports whether a record may be dropped at now; flush
+	// sweeps such records out now and then. Records that do not parse
+	// should be.
+	expired func(data []byte, now time.Time) bool
+
+	mu        sync.Mutex
+	dirty     map[string]bool // records written since the last flush, by file name
+	lastSweep time.Time
+}
+
+// stateSweepInterval is how often flush sweeps expired records out.
+const stateSweepInterval = time.Minute
+
+func openStateDir(path string, expired func([]byte, time.Time) bool) (*stateDir, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &stateDir{path: path, expired: expired, dirty: make(map[string]bool), lastSweep: time.Now()}, nil
+}
+
+// recordPath returns the file holding key's record. Keys may hold any
+// byte and be of any length, so file names are their SHA-256 digests.
+func (d *stateDir) recordPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.path, hex.EncodeToString(sum[:])+".json")
+}
+
+// lock opens the record name, creating it empty if it is missing, and
+// takes an exclusive flock on it.
+func lock(name string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %w", name, err)
+		}
+		// A record removed while we waited for it is no longer the one
+		// at name: start over.
+		held, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if cur, err := os.Stat(name); err == nil && os.SameFile(held, cur) {
+			return f, nil
+		}
+		f.Close()
+	}
+}
+
+// update locks the records of keys, in order so that processes locking
+// several never deadlock, and calls fn with their contents by key, leaving
+// out those that are missing. The records fn returns are written back,
+// and those it returns as nil removed.
+func (d *stateDir) update(keys []string, fn func(recs map[string][]byte) map[string][]byte) error {
+	names := make(map[string]string, len(keys)) // by key
+	for _, key := range keys {
+		names[key] = d.recordPath(key)
+	}
+	keys = make([]string, 0, len(names))
+	for key := range names {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return names[keys[i]] < names[keys[j]] })
+
+	files := make(map[string]*os.File, len(keys))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	recs := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		f, err := lock(names[key])
+		if err != nil {
+			return err
+		}
+		files[key] = f
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", f.Name(), err)
+		}
+		if len(data) > 0 {
+			recs[key] = data
+		}
+	}
+
+	out := fn(recs)
+	for _, key := range keys {
+		if data, ok := out[key]; ok {
+			if err := d.write(files[key], data); err != nil {
+				return err
+			}
+		} else if recs[key] == nil {
+			// Only lock created it.
+			os.Remove(files[key].Name())
+		}
+	}
+	return nil
+}
+
+// write replaces the record in f, which the caller has locked, with data,
+// or removes it if data is empty.
+func (d *stateDir) write(f *os.File, data []byte) error {
+	if len(data) == 0 {
+		if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		if _, err := f.WriteAt(data, 0); err != nil {
+			return fmt.Errorf("write %s: %w", f.Name(), err)
+		}
+		if err := f.Truncate(int64(len(data))); err != nil {
+			return fmt.Errorf("write %s: %w", f.Name(), err)
+		}
+	}
+	d.mu.Lock()
+	d.dirty[f.Name()] = true
+	d.mu.Unlock()
+	return nil
+}
+
+// scan calls fn with every record in turn, each locked meanwhile, and
+// writes back what fn returns if it returns true, removing the record if
+// that is nil.
+func (d *stateDir) scan(fn func(data []byte) ([]byte, bool)) error {
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		if err := d.rewrite(filepath.Join(d.path, e.Name()), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrite locks the record name and, unless it is gone, calls fn with it
+// as scan does.
+func (d *stateDir) rewrite(name string, fn func(data []byte) ([]byte, bool)) error {
+	f, err := lock(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", name, err)
+	}
+	if len(data) == 0 {
+		// Removed since it was listed, and created again by lock.
+		os.Remove(name)
+		return nil
+	}
+	if data, ok := fn(data); ok {
+		return d.write(f, data)
+	}
+	return nil
+}
+
+// flush syncs the records this process has written since the last flush
+// to disk, and now and then sweeps expired records out.
+func (d *stateDir) flush() error {
+	d.mu.Lock()
+	sweep := time.Since(d.lastSweep) >= stateSweepInterval
+	if sweep {
+		d.lastSweep = time.Now()
+	}
+	d.mu.Unlock()
+	var errs []error
+	if sweep {
+		now := time.Now()
+		errs = append(errs, d.scan(func(data []byte) ([]byte, bool) {
+			return nil, d.expired(data, now)
+		}))
+	}
+
+	d.mu.Lock()
+	dirty := d.dirty
+	d.dirty = make(map[string]bool)
+	d.mu.Unlock()
+	if len(dirty) == 0 {
+		return errors.Join(errs...)
+	}
+	failed := false
+	for name := range dirty {
+		if err := syncFile(name); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			failed = true
+		}
+	}
+	// Records created or removed are in the directory's entries.
+	if err := syncFile(d.path); err != nil {
+		errs = append(errs, err)
+		failed = true
+	}
+	if failed {
+		d.mu.Lock()
+		for name := range dirty {
+			d.dirty[name] = true
+		}
+		d.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+func syncFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// FlushState syncs the rate-limit and quota files Authorize updates to
+// disk. Services call it periodically, through SyncState, and once more
+// when they shut down.
+func FlushState() error {
+	var errs []error
+	if l, ok := globalLimiter.(interface{ Flush() error }); ok {
+		errs = append(errs, l.Flush())
+	}
+	errs = append(errs, globalQuotas.Flush())
+	return errors.Join(errs...)
+}
+
+// SyncState calls FlushState every interval until ctx is done, telling
+// onError of failures.
+func SyncState(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := FlushState(); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
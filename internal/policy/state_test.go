@@ -0,0 +1,173 @@
+package policy
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestStateDir opens a state directory whose records expire when
+// they read "expired".
+func openTestStateDir(t *testing.T) *stateDir {
+	t.Helper()
+	d, err := openStateDir(filepath.Join(t.TempDir(), "state"), func(data []byte, _ time.Time) bool {
+		return string(data) == "expired"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// records returns every record in d, sorted.
+func records(t *testing.T, d *stateDir) []string {
+	t.Helper()
+	var out []string
+	if err := d.scan(func(data []byte) ([]byte, bool) {
+		out = append(out, string(data))
+		return nil, false
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestStateDir_Update(t *testing.T) {
+	d := openTestStateDir(t)
+	long := strings.Repeat("k", 300) // longer than a file name may be
+	set := func(recs map[string][]byte) map[string][]byte {
+		return map[string][]byte{"a": []byte("1"), "b\x00/..": []byte("22"), long: []byte("4")}
+	}
+	if err := d.update([]string{"b\x00/..", "a", "a", long}, set); err != nil {
+		t.Fatal(err)
+	}
+	// A shorter record replaces a longer one whole.
+	var seen map[string][]byte
+	err := d.update([]string{"a", "b\x00/..", "c"}, func(recs map[string][]byte) map[string][]byte {
+		seen = recs
+		return map[string][]byte{"a": nil, "b\x00/..": []byte("3")}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || string(seen["a"]) != "1" || string(seen["b\x00/.."]) != "22" {
+		t.Errorf("update saw %q; missing records should be left out", seen)
+	}
+	if got := records(t, d); !reflect.DeepEqual(got, []string{"3", "4"}) {
+		t.Errorf("records = %q", got)
+	}
+}
+
+func TestStateDir_Flush(t *testing.T) {
+	d := openTestStateDir(t)
+	if err := d.flush(); err != nil {
+		t.Fatalf("flush with nothing written: %v", err)
+	}
+
+	write := func(recs map[string][]byte) map[string][]byte {
+		return map[string][]byte{"a": []byte("1")}
+	}
+	if err := d.update([]string{"a"}, write); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if len(d.dirty) != 1 {
+		t.Fatal("not dirty after an update")
+	}
+	if err := d.flush(); err != nil || len(d.dirty) != 0 {
+		t.Fatalf("flush: %v, dirty %v", err, d.dirty)
+	}
+
+	// An update that keeps nothing leaves it clean, and creates no record.
+	keep := func(map[string][]byte) map[string][]byte { return nil }
+	if err := d.update([]string{"a", "new"}, keep); err != nil || len(d.dirty) != 0 {
+		t.Fatalf("read-only update: %v, dirty %v", err, d.dirty)
+	}
+	if got := records(t, d); len(got) != 1 {
+		t.Errorf("records = %q after a read-only update", got)
+	}
+}
+
+func TestStateDir_Sweep(t *testing.T) {
+	d := openTestStateDir(t)
+	err := d.update([]string{"live", "dead"}, func(map[string][]byte) map[string][]byte {
+		return map[string][]byte{"live": []byte("1"), "dead": []byte("expired")}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.flush(); err != nil || len(records(t, d)) != 2 {
+		t.Fatalf("flush swept before the interval: %v", err)
+	}
+	d.lastSweep = time.Now().Add(-stateSweepInterval)
+	if err := d.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := records(t, d); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("records = %q after a sweep", got)
+	}
+}
+
+func TestFlushState(t *testing.T) {
+	t.Cleanup(func() {
+		SetLimiter(NewMemoryLimiter())
+		SetQuotaTracker(NewQuotaTracker())
+	})
+	dir := t.TempDir()
+	limiter := openFileLimiter(t, filepath.Join(dir, "ratelimits"))
+	quotas, err := OpenQuotaTracker(filepath.Join(dir, "quotas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetLimiter(limiter)
+	SetQuotaTracker(quotas)
+
+	if err := enforceRateLimit("flush-state", "10rps"); err != nil {
+		t.Fatal(err)
+	}
+	if len(limiter.dir.dirty) == 0 {
+		t.Fatal("limiter not dirty after spending a token")
+	}
+	if err := FlushState(); err != nil {
+		t.Fatalf("FlushState: %v", err)
+	}
+	if len(limiter.dir.dirty) != 0 || len(quotas.dir.dirty) != 0 {
+		t.Error("state still dirty after FlushState")
+	}
+
+	// The in-memory backends have nothing to flush.
+	SetLimiter(NewMemoryLimiter())
+	SetQuotaTracker(NewQuotaTracker())
+	if err := FlushState(); err != nil {
+		t.Errorf("FlushState in memory: %v", err)
+	}
+}
+
+// BenchmarkFileLimiter_Update measures the per-request cost of a shared
+// rate-limit bucket, and what syncing every update would add to it.
+func BenchmarkFileLimiter_Update(b *testing.B) {
+	for _, synced := range []bool{false, true} {
+		b.Run(fmt.Sprintf("synced=%v", synced), func(b *testing.B) {
+			l, err := OpenFileLimiter(filepath.Join(b.TempDir(), "ratelimits"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < b.N; i++ {
+				err := l.Update([]string{"bench"}, func(buckets map[string]*Bucket) bool {
+					buckets["bench"] = &Bucket{CapID: "bench", Tokens: float64(i)}
+					return true
+				})
+				if err == nil && synced {
+					err = l.Flush()
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package policy
+
+import (
+	"sync/atomic"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// Step results.
+const (
+	StepPass = "pass"
+	StepFail = "fail"
+	StepSkip = "skip"
+)
+
+// Step is one check an authorization decision ran.
+type Step struct {
+	Check  string `json:"check"` // e.g. "service", "rights", "rules", "constraint path_prefix"
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Trace records the checks of one authorization decision, in order.
+type Trace struct {
+	Steps []Step `json:"steps"`
+}
+
+// Add appends a step; services use it for checks made outside Authorize,
+// such as revocation.
+func (t *Trace) Add(check, result, detail string) {
+	t.Steps = append(t.Steps, Step{Check: check, Result: result, Detail: detail})
+}
+
+// evaluation carries per-decision options through Authorize's checks.
+type evaluation struct {
+	trace  *Trace // nil when not tracing
+	dryRun bool   // evaluate without consuming uses or rate-limit tokens
+}
+
+func (ev *evaluation) step(check, result, detail string) {
+	if ev.trace != nil {
+		ev.trace.Add(check, result, detail)
+	}
+}
+
+// fail records a failed check and returns err.
+func (ev *evaluation) fail(check string, err error) error {
+	ev.step(check, StepFail, err.Error())
+	return err
+}
+
+var debugTrace atomic.Bool
+
+// SetDebug makes Authorize trace every decision and attach the trace to
+// denials as details.trace. Traces reveal the token's rights and the
+// operator's rules to the caller, so enable it only while debugging.
+func SetDebug(on bool) {
+	debugTrace.Store(on)
+}
+
+// Debug reports whether SetDebug is on.
+func Debug() bool {
+	return debugTrace.Load()
+}
+
+// Explain evaluates what Authorize would decide for the request, without
+// side effects: no use is spent and no rate-limit token consumed. It
+// returns the trace and the error Authorize would return.
+func Explain(claims *capability.Capability, method string, ctx map[string]any) (*Trace, error) {
+	ev := &evaluation{trace: &Trace{}, dryRun: true}
+	err := authorize(claims, method, ctx, ev)
+	return ev.trace, err
+}
+
+// Explanation is the result of an explain request.
+type Explanation struct {
+	Method  string         `json:"method"`
+	Allowed bool           `json:"allowed"`
+	Trace   []Step         `json:"trace"`
+	Denial  map[string]any `json:"denial,omitempty"` // code, name, message, details
+}
+
+// NewExplanation builds the explain result for a trace and the decision err.
+func NewExplanation(method string, trace *Trace, err error) Explanation {
+	e := Explanation{Method: method, Allowed: err == nil, Trace: trace.Steps}
+	if err == nil {
+		return e
+	}
+	e.Denial = map[string]any{"message": err.Error()}
+	if pe, ok := err.(*PolicyError); ok {
+		e.Denial["code"] = pe.Code
+		e.Denial["name"] = pe.Name
+		if pe.Details != nil {
+			e.Denial["details"] = pe.Details
+		}
+	}
+	return e
+}
+
+// redacted maps the checks whose detail names the operator's rules or a
+// resource's labels to what is said of them instead.
+var redacted = map[string]string{
+	"rules":  "policy rules",
+	"labels": "resource labels",
+}
+
+// Redact strips the names of the operator's rules and the resource's
+// labels from the explanation, for callers not entitled to them: their
+// checks keep only their results, and a denial by one says only which
+// kind of check denied.
+func (e *Explanation) Redact() {
+	failed := ""
+	for i := range e.Trace {
+		st := &e.Trace[i]
+		if _, ok := redacted[st.Check]; !ok {
+			continue
+		}
+		st.Detail = ""
+		if st.Result == StepFail {
+			failed = st.Check
+		}
+	}
+	if e.Denial != nil && failed != "" {
+		e.Denial["message"] = "denied by " + redacted[failed]
+		delete(e.Denial, "details")
+	}
+}
@@ -0,0 +1,163 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// stepResult returns the result of the first step named check, or "".
+func stepResult(trace *Trace, check string) (string, string) {
+	for _, s := range trace.Steps {
+		if s.Check == check {
+			return s.Result, s.Detail
+		}
+	}
+	return "", ""
+}
+
+func TestExplain_Allowed(t *testing.T) {
+	claims := &capability.Capability{
+		ID:          "explain-allowed",
+		Service:     "fs",
+		Rights:      []string{"fs.*"},
+		Constraints: capability.Constraints{PathPrefix: "/srv", RateLimit: "10rps"},
+	}
+	trace, err := Explain(claims, "fs.open", map[string]any{"path": "data/x"})
+	if err != nil {
+		t.Fatalf("Explain: %v", err)
+	}
+	want := map[string]string{
+		"service":                StepPass,
+		"rights":                 StepPass,
+		"rules":                  StepSkip,
+		"constraint path_prefix": StepPass,
+		"constraint rate_limit":  StepPass,
+	}
+	for check, result := range want {
+		if got, _ := stepResult(trace, check); got != result {
+			t.Errorf("%s = %q, want %q (trace %+v)", check, got, result, trace.Steps)
+		}
+	}
+	if _, detail := stepResult(trace, "rights"); detail != "granted by fs.*" {
+		t.Errorf("rights detail = %q", detail)
+	}
+}
+
+func TestExplain_Denials(t *testing.T) {
+	claims := &capability.Capability{Service: "fs", Rights: []string{"fs.*", "!fs.write"}}
+	trace, err := Explain(claims, "fs.write", nil)
+	if err == nil {
+		t.Fatal("fs.write should be denied")
+	}
+	if result, detail := stepResult(trace, "rights"); result != StepFail || !strings.Contains(detail, "!fs.write") {
+		t.Errorf("rights step = %q %q, want a failure naming !fs.write", result, detail)
+	}
+	if last := trace.Steps[len(trace.Steps)-1]; last.Check != "rights" {
+		t.Errorf("evaluation should stop at the failing check, last step = %+v", last)
+	}
+
+	trace, _ = Explain(&capability.Capability{Service: "identity"}, "fs.open", nil)
+	if result, _ := stepResult(trace, "service"); result != StepFail {
+		t.Errorf("service step = %q, want fail", result)
+	}
+	trace, _ = Explain(nil, "fs.open", nil)
+	if result, _ := stepResult(trace, "token"); result != StepFail {
+		t.Errorf("token step = %q, want fail", result)
+	}
+}
+
+func TestExplain_NoSideEffects(t *testing.T) {
+	SetUseCounter(NewUseCounter())
+	t.Cleanup(func() { SetUseCounter(NewUseCounter()) })
+	claims := &capability.Capability{
+		ID:          "explain-dry-run",
+		Service:     "fs",
+		Rights:      []string{"fs.open"},
+		ExpiresAt:   time.Now().Add(time.Hour),
+		Constraints: capability.Constraints{MaxUses: 1, RateLimit: "1rps"},
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := Explain(claims, "fs.open", nil); err != nil {
+			t.Fatalf("explain %d: %v", i, err)
+		}
+	}
+	if n := globalUses.Uses(claims.ID); n != 0 {
+		t.Errorf("explain spent %d uses", n)
+	}
+	if err := Authorize(claims, "fs.open", nil); err != nil {
+		t.Fatalf("first real use: %v", err)
+	}
+
+	trace, err := Explain(claims, "fs.open", nil)
+	pe, ok := err.(*PolicyError)
+	if !ok || pe.Code != CodeResourceExhausted {
+		t.Fatalf("explain after the last use = %v, want RESOURCE_EXHAUSTED", err)
+	}
+	if result, _ := stepResult(trace, "constraint rate_limit"); result != StepFail {
+		t.Errorf("rate_limit step = %q, want fail (the bucket is empty)", result)
+	}
+}
+
+func TestAuthorize_DebugTrace(t *testing.T) {
+	claims := &capability.Capability{Service: "fs", Rights: []string{"fs.list"}}
+	if pe := Authorize(claims, "fs.open", nil).(*PolicyError); pe.Details["trace"] != nil {
+		t.Error("denials should carry no trace unless debugging")
+	}
+
+	SetDebug(true)
+	t.Cleanup(func() { SetDebug(false) })
+	pe := Authorize(claims, "fs.open", nil).(*PolicyError)
+	steps, ok := pe.Details["trace"].([]Step)
+	if !ok || len(steps) == 0 || steps[len(steps)-1].Check != "rights" {
+		t.Errorf("details.trace = %#v, want steps ending at rights", pe.Details["trace"])
+	}
+}
+
+func TestNewExplanation(t *testing.T) {
+	tr := &Trace{}
+	tr.Add("rights", StepPass, "")
+	e := NewExplanation("fs.open", tr, nil)
+	if !e.Allowed || e.Denial != nil || len(e.Trace) != 1 {
+		t.Errorf("allowed explanation = %+v", e)
+	}
+	e = NewExplanation("fs.open", tr, &PolicyError{Code: 3, Name: "PERMISSION_DENIED", Message: "no"})
+	if e.Allowed || e.Denial["name"] != "PERMISSION_DENIED" || e.Denial["message"] != "no" {
+		t.Errorf("denied explanation = %+v", e)
+	}
+}
+
+func TestExplanation_Redact(t *testing.T) {
+	SetRules(mustParseRules(t, `{"rules": [{"name": "no-secrets", "effect": "deny", "service": "fs", "path_prefix": "/srv/secret"}]}`))
+	t.Cleanup(func() { SetRules(nil) })
+	claims := &capability.Capability{Service: "fs", Rights: []string{"fs.*"}}
+
+	ctx := map[string]any{"path": "secret/a", CtxHostPath: "/srv/secret/a"}
+	trace, err := Explain(claims, "fs.open", ctx)
+	e := NewExplanation("fs.open", trace, err)
+	e.Redact()
+	if e.Allowed || e.Denial["message"] != "denied by policy rules" || e.Denial["details"] != nil {
+		t.Errorf("denial = %+v, want one naming no rule", e.Denial)
+	}
+	for _, st := range e.Trace {
+		if strings.Contains(st.Detail, "no-secrets") {
+			t.Errorf("step %+v names the rule", st)
+		}
+	}
+	if _, detail := stepResult(&Trace{Steps: e.Trace}, "rights"); detail != "granted by fs.*" {
+		t.Errorf("rights detail = %q, want it kept", detail)
+	}
+
+	ctx = map[string]any{"path": "pub/a", CtxHostPath: "/srv/pub/a", CtxLabels: []string{"pii"}}
+	trace, err = Explain(claims, "fs.open", ctx)
+	e = NewExplanation("fs.open", trace, err)
+	e.Redact()
+	if e.Denial["message"] != "denied by resource labels" || e.Denial["details"] != nil {
+		t.Errorf("label denial = %+v, want one naming no label", e.Denial)
+	}
+	if result, detail := stepResult(&Trace{Steps: e.Trace}, "rules"); result != StepPass || detail != "" {
+		t.Errorf("rules step = %q %q, want a bare pass", result, detail)
+	}
+}
@@ -0,0 +1,205 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/atomicfile"
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// CtxHandle marks a request that operates on a handle the capability
+// already opened. Such requests do not spend a max_uses use: the use was
+// spent when the handle was opened.
+const CtxHandle = "handle"
+
+// UseCounter counts the uses of max_uses capabilities, keyed by jti.
+// Counts are kept until the capability expires; if the counter has a path
+// they are persisted there, so a restart does not hand out fresh uses.
+type UseCounter struct {
+	mu     sync.Mutex
+	path   string
+	counts map[string]*useCount
+
+	// OnExhausted, if set, is called (outside the counter's lock) when a
+	// capability spends its last use.
+	OnExhausted func(claims *capability.Capability)
+}
+
+type useCount struct {
+	Uses    int       `json:"uses"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewUseCounter returns an in-memory use counter.
+func NewUseCounter() *UseCounter {
+	return &UseCounter{counts: make(map[string]*useCount)}
+}
+
+// OpenUseCounter loads the use counter persisted at path, dropping counts
+// of expired capabilities. A missing file yields an empty counter.
+func OpenUseCounter(path string) (*UseCounter, error) {
+	u := NewUseCounter()
+	u.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read use counts: %w", err)
+	}
+	if err := json.Unmarshal(data, &u.counts); err != nil {
+		return nil, fmt.Errorf("parse use counts %s: %w", path, err)
+	}
+	u.pruneLocked(time.Now())
+	return u, nil
+}
+
+// Uses returns how many uses of capID have been spent.
+func (u *UseCounter) Uses(capID string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if c, ok := u.counts[capID]; ok {
+		return c.Uses
+	}
+	return 0
+}
+
+// Len returns the number of capabilities being counted.
+func (u *UseCounter) Len() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.counts)
+}
+
+// Spend records one use of claims, or returns RESOURCE_EXHAUSTED if its
+// max_uses are already spent. Capabilities without max_uses are not
+// counted. A failure to persist the count denies the use, since it could
+// otherwise be spent again after a restart.
+func (u *UseCounter) Spend(claims *capability.Capability) error {
+	max := claims.Constraints.MaxUses
+	if max <= 0 {
+		return nil
+	}
+
+	u.mu.Lock()
+	now := time.Now()
+	u.pruneLocked(now)
+	c, ok := u.counts[claims.ID]
+	if !ok {
+		c = &useCount{Expires: claims.ExpiresAt}
+		u.counts[claims.ID] = c
+	}
+	if c.Uses >= max {
+		u.mu.Unlock()
+		return usesExhausted(max)
+	}
+	c.Uses++
+	if err := u.saveLocked(); err != nil {
+		c.Uses--
+		u.mu.Unlock()
+		return &PolicyError{
+			Code:    CodeResourceExhausted,
+			Name:    "RESOURCE_EXHAUSTED",
+			Message: fmt.Sprintf("cannot record capability use: %v", err),
+		}
+	}
+	exhausted := c.Uses == max
+	u.mu.Unlock()
+
+	if exhausted && u.OnExhausted != nil {
+		u.OnExhausted(claims)
+	}
+	return nil
+}
+
+// Refund gives back a use of claims spent by a request that was then
+// denied. OnExhausted is not undone.
+func (u *UseCounter) Refund(claims *capability.Capability) {
+	if claims.Constraints.MaxUses <= 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c, ok := u.counts[claims.ID]
+	if !ok || c.Uses == 0 {
+		return
+	}
+	c.Uses--
+	if err := u.saveLocked(); err != nil {
+		// The use stays spent on disk; erring that way is safe.
+		c.Uses++
+	}
+}
+
+// Check reports whether claims has a use left, without spending it.
+func (u *UseCounter) Check(claims *capability.Capability) error {
+	max := claims.Constraints.MaxUses
+	if max <= 0 {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if c, ok := u.counts[claims.ID]; ok && c.Uses >= max {
+		return usesExhausted(max)
+	}
+	return nil
+}
+
+func usesExhausted(max int) *PolicyError {
+	return &PolicyError{
+		Code:    CodeResourceExhausted,
+		Name:    "RESOURCE_EXHAUSTED",
+		Message: "capability use limit reached",
+		Details: map[string]any{"max_uses": max},
+	}
+}
+
+// pruneLocked drops counts of capabilities that have expired; they can no
+// longer be used anyway.
+func (u *UseCounter) pruneLocked(now time.Time) {
+	for id, c := range u.counts {
+		if c.Expires.Before(now) {
+			delete(u.counts, id)
+		}
+	}
+}
+
+func (u *UseCounter) saveLocked() error {
+	if u.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(u.counts)
+	if err != nil {
+		return fmt.Errorf("marshal use counts: %w", err)
+	}
+	if err := atomicfile.Write(u.path, data); err != nil {
+		return fmt.Errorf("write use counts: %w", err)
+	}
+	return nil
+}
+
+// globalUses is the counter Authorize enforces max_uses against.
+var globalUses = NewUseCounter()
+
+// SetUseCounter replaces the counter Authorize enforces max_uses against,
+// typically with one from OpenUseCounter. Call it before serving requests.
+func SetUseCounter(u *UseCounter) {
+	globalUses = u
+}
+
+// enforceMaxUses spends a use of claims (or with spend unset, checks that
+// one remains) unless ctx marks the request as operating on an
+// already-open handle.
+func enforceMaxUses(claims *capability.Capability, ctx map[string]any, spend bool) error {
+	if onHandle, _ := ctx[CtxHandle].(bool); onHandle {
+		return nil
+	}
+	if !spend {
+		return globalUses.Check(claims)
+	}
+	return globalUses.Spend(claims)
+}
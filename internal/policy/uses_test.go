@@ -0,0 +1,169 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+func usesCap(id string, max int) *capability.Capability {
+	return &capability.Capability{
+		ID:          id,
+		Service:     "fs",
+		Rights:      []string{"fs.open", "fs.read"},
+		ExpiresAt:   time.Now().Add(time.Hour),
+		Constraints: capability.Constraints{MaxUses: max},
+	}
+}
+
+func wantExhausted(t *testing.T, err error) {
+	t.Helper()
+	pe, ok := err.(*PolicyError)
+	if !ok || pe.Code != CodeResourceExhausted {
+		t.Fatalf("err = %v, want RESOURCE_EXHAUSTED", err)
+	}
+}
+
+func TestUseCounter_Unlimited(t *testing.T) {
+	u := NewUseCounter()
+	for i := 0; i < 5; i++ {
+		if err := u.Spend(usesCap("free", 0)); err != nil {
+			t.Fatalf("Spend: %v", err)
+		}
+	}
+	if u.Len() != 0 {
+		t.Error("capabilities without max_uses should not be counted")
+	}
+}
+
+func TestUseCounter_Exhaustion(t *testing.T) {
+	u := NewUseCounter()
+	var exhausted []string
+	u.OnExhausted = func(c *capability.Capability) { exhausted = append(exhausted, c.ID) }
+
+	cap := usesCap("three", 3)
+	for i := 0; i < 3; i++ {
+		if err := u.Spend(cap); err != nil {
+			t.Fatalf("use %d: %v", i+1, err)
+		}
+	}
+	wantExhausted(t, u.Spend(cap))
+	if u.Uses("three") != 3 {
+		t.Errorf("Uses = %d, want 3", u.Uses("three"))
+	}
+	if len(exhausted) != 1 || exhausted[0] != "three" {
+		t.Errorf("OnExhausted calls = %v, want exactly one for %q", exhausted, "three")
+	}
+
+	// Counts are per capability.
+	if err := u.Spend(usesCap("other", 3)); err != nil {
+		t.Errorf("other capability: %v", err)
+	}
+}
+
+func TestUseCounter_SurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uses.json")
+	u, err := OpenUseCounter(path)
+	if err != nil {
+		t.Fatalf("OpenUseCounter: %v", err)
+	}
+	cap := usesCap("once", 1)
+	if err := u.Spend(cap); err != nil {
+		t.Fatalf("Spend: %v", err)
+	}
+
+	u2, err := OpenUseCounter(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	wantExhausted(t, u2.Spend(cap))
+}
+
+func TestUseCounter_PrunesExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uses.json")
+	u, _ := OpenUseCounter(path)
+	cap := usesCap("old", 2)
+	cap.ExpiresAt = time.Now().Add(50 * time.Millisecond)
+	u.Spend(cap)
+	u.Spend(usesCap("live", 2))
+	time.Sleep(100 * time.Millisecond)
+
+	u2, err := OpenUseCounter(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if u2.Len() != 1 || u2.Uses("live") != 1 {
+		t.Errorf("after reload: len=%d live=%d, want only the live count", u2.Len(), u2.Uses("live"))
+	}
+}
+
+func TestUseCounter_SaveFailureDenies(t *testing.T) {
+	dir := t.TempDir()
+	u, _ := OpenUseCounter(filepath.Join(dir, "missing", "uses.json"))
+	wantExhausted(t, u.Spend(usesCap("x", 2)))
+	if u.Uses("x") != 0 {
+		t.Error("an unrecorded use should not be counted")
+	}
+}
+
+func TestOpenUseCounter_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uses.json")
+	os.WriteFile(path, []byte("{not json"), 0600)
+	if _, err := OpenUseCounter(path); err == nil {
+		t.Error("expected error for corrupt file")
+	}
+}
+
+func TestAuthorize_MaxUses(t *testing.T) {
+	SetUseCounter(NewUseCounter())
+	defer SetUseCounter(NewUseCounter())
+
+	cap := usesCap("auth-once", 1)
+	if err := Authorize(cap, "fs.open", map[string]any{"path": "a"}); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	// Operating on the handle just opened is not another use.
+	if err := Authorize(cap, "fs.read", map[string]any{CtxHandle: true}); err != nil {
+		t.Errorf("handle read: %v", err)
+	}
+	wantExhausted(t, Authorize(cap, "fs.open", map[string]any{"path": "b"}))
+}
+
+func TestAuthorize_DeniedRequestSpendsNoUse(t *testing.T) {
+	SetUseCounter(NewUseCounter())
+	defer SetUseCounter(NewUseCounter())
+
+	cap := usesCap("auth-denied", 1)
+	cap.Constraints.PathPrefix = "/srv"
+	if err := Authorize(cap, "fs.open", map[string]any{"path": "../etc"}); err == nil {
+		t.Fatal("traversal should be denied")
+	}
+	if globalUses.Uses("auth-denied") != 0 {
+		t.Error("a denied request should not spend a use")
+	}
+}
+
+func TestCheck_SpendsNoUse(t *testing.T) {
+	SetUseCounter(NewUseCounter())
+	defer SetUseCounter(NewUseCounter())
+
+	cap := usesCap("check", 1)
+	cap.Constraints.PathPrefix = "/srv"
+	for i := 0; i < 3; i++ {
+		if err := Check(cap, "fs.open", map[string]any{"path": "a"}); err != nil {
+			t.Fatalf("check %d: %v", i, err)
+		}
+	}
+	if err := Check(cap, "fs.open", map[string]any{"path": "../etc"}); err == nil {
+		t.Error("Check should deny what Authorize denies")
+	}
+	if globalUses.Uses("check") != 0 {
+		t.Error("Check spent a use")
+	}
+	if err := Authorize(cap, "fs.open", map[string]any{"path": "a"}); err != nil {
+		t.Errorf("the use is still there: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+// Context keys of requests that write.
+const (
+	// CtxRights lists rights a request needs besides its method's
+	// ([]string), e.g. fs.create for an fs.open that creates the file.
+	CtxRights = "rights"
+	// CtxFileSize is the size a write leaves its file at (int64, int or
+	// float64).
+	CtxFileSize = "file_size"
+	// CtxPerm is the permission bits of a file being created
+	// (os.FileMode).
+	CtxPerm = "perm"
+	// CtxDir marks the file being created as a directory (bool).
+	CtxDir = "dir"
+)
+
+// ctxRights returns the further rights ctx declares a request needs.
+func ctxRights(ctx map[string]any) []string {
+	rights, _ := ctx[CtxRights].([]string)
+	return rights
+}
+
+// ParsePerm parses octal permission bits such as "0640".
+func ParsePerm(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0o777 {
+		return 0, fmt.Errorf("invalid permission bits %q: want octal, e.g. \"0640\"", s)
+	}
+	return os.FileMode(n), nil
+}
+
+func parseMaxFileSize(raw json.RawMessage) (any, error) {
+	var n int64
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("must not be negative")
+	}
+	return n, nil
+}
+
+func parseCreatePerm(raw json.RawMessage) (any, error) {
+	v, err := parseString(raw)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePerm(v.(string))
+}
+
+// enforceMaxFileSize denies writes that would leave a file larger than max.
+func enforceMaxFileSize(max int64, ctx map[string]any) error {
+	var size int64
+	switch v := ctx[CtxFileSize].(type) {
+	case int64:
+		size = v
+	case int:
+		size = int64(v)
+	case float64:
+		size = int64(v)
+	default:
+		return nil
+	}
+	if max == 0 || size <= max {
+		return nil
+	}
+	return &PolicyError{
+		Code:    CodeResourceExhausted,
+		Name:    "RESOURCE_EXHAUSTED",
+		Message: fmt.Sprintf("write would grow the file to %d bytes, over max_file_size %d", size, max),
+		Details: map[string]any{"max_file_size": max, "file_size": size},
+	}
+}
+
+// enforceCreatePerm denies creating files with permission bits outside mask.
+// Directories may also have the search bit of each class mask lets read.
+func enforceCreatePerm(mask os.FileMode, ctx map[string]any) error {
+	var perm os.FileMode
+	switch v := ctx[CtxPerm].(type) {
+	case os.FileMode:
+		perm = v
+	case float64:
+		perm = os.FileMode(v)
+	case string:
+		p, err := ParsePerm(v)
+		if err != nil {
+			return pathDenied(err.Error())
+		}
+		perm = p
+	default:
+		return nil
+	}
+	allowed := mask
+	if dir, _ := ctx[CtxDir].(bool); dir {
+		allowed |= (mask & 0o444) >> 2
+	}
+	if perm.Perm()&^allowed != 0 {
+		return pathDenied(fmt.Sprintf("mode %#o exceeds create_perm %#o", perm.Perm(), mask))
+	}
+	return nil
+}
+
+// CreatePerm returns def limited to the bits claims' create_perm allows,
+// for files created without an explicit mode.
+func CreatePerm(claims *capability.Capability, def os.FileMode) os.FileMode {
+	if claims == nil || claims.Constraints.CreatePerm == "" {
+		return def
+	}
+	mask, err := ParsePerm(claims.Constraints.CreatePerm)
+	if err != nil {
+		return def
+	}
+	return def & mask
+}
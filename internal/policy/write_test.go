@@ -0,0 +1,100 @@
+package policy
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Gao-OS/StrataOS/internal/capability"
+)
+
+func TestAuthorize_CtxRights(t *testing.T) {
+	claims := &capability.Capability{Service: "fs", Rights: []string{"fs.open", "fs.write"}}
+	ctx := func(rights ...string) map[string]any { return map[string]any{CtxRights: rights} }
+
+	if err := Authorize(claims, "fs.open", ctx("fs.write")); err != nil {
+		t.Errorf("open to write with fs.write: %v", err)
+	}
+	err := Authorize(claims, "fs.open", ctx("fs.write", "fs.create"))
+	if pe, ok := err.(*PolicyError); !ok || pe.Code != CodePermissionDenied || !strings.Contains(pe.Message, `"fs.create"`) {
+		t.Errorf("open to create without fs.create: %v", err)
+	}
+
+	claims.Rights = []string{"fs.*", "!fs.create"}
+	err = Authorize(claims, "fs.open", ctx("fs.create"))
+	if err == nil || !strings.Contains(err.Error(), "denied by !fs.create") {
+		t.Errorf("negated right: %v", err)
+	}
+	// fs.explain passes the rights as decoded JSON.
+	if err := Authorize(claims, "fs.open", map[string]any{CtxRights: []any{"fs.write"}}); err != nil {
+		t.Errorf("[]any rights: %v", err)
+	}
+}
+
+func TestParsePerm(t *testing.T) {
+	for s, want := range map[string]os.FileMode{"0640": 0o640, "644": 0o644, "0": 0} {
+		if got, err := ParsePerm(s); err != nil || got != want {
+			t.Errorf("ParsePerm(%q) = (%#o, %v), want %#o", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "0888", "01777", "rw-r--r--"} {
+		if _, err := ParsePerm(s); err == nil {
+			t.Errorf("ParsePerm(%q) accepted", s)
+		}
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	claims := &capability.Capability{
+		Service:     "fs",
+		Rights:      []string{"fs.write", "fs.read"},
+		Constraints: capability.Constraints{MaxFileSize: 100},
+	}
+	if err := Authorize(claims, "fs.write", map[string]any{CtxFileSize: int64(100)}); err != nil {
+		t.Errorf("write up to the limit: %v", err)
+	}
+	err := Authorize(claims, "fs.write", map[string]any{CtxFileSize: int64(101)})
+	pe, ok := err.(*PolicyError)
+	if !ok || pe.Code != CodeResourceExhausted || pe.Details["max_file_size"] != int64(100) {
+		t.Errorf("write past the limit: %v", err)
+	}
+	if err := Authorize(claims, "fs.read", map[string]any{CtxHandle: true}); err != nil {
+		t.Errorf("reads are not limited: %v", err)
+	}
+	if err := ValidateConstraints(capability.Constraints{MaxFileSize: -1}); err == nil {
+		t.Error("negative max_file_size accepted")
+	}
+}
+
+func TestCreatePerm(t *testing.T) {
+	claims := &capability.Capability{
+		Service:     "fs",
+		Rights:      []string{"fs.create"},
+		Constraints: capability.Constraints{CreatePerm: "0640"},
+	}
+	for perm, want := range map[os.FileMode]bool{0o640: true, 0o600: true, 0o400: true, 0o644: false, 0o660: false, 0o755: false} {
+		err := Authorize(claims, "fs.create", map[string]any{CtxPerm: perm})
+		if (err == nil) != want {
+			t.Errorf("perm %#o: err = %v, want allowed=%v", perm, err, want)
+		}
+	}
+	if err := Authorize(claims, "fs.create", map[string]any{CtxPerm: "0644"}); err == nil {
+		t.Error("perm as an octal string (fs.explain) not checked")
+	}
+	// Directories may be searched wherever they may be read.
+	for perm, want := range map[os.FileMode]bool{0o750: true, 0o751: false, 0o770: false} {
+		err := Authorize(claims, "fs.create", map[string]any{CtxPerm: perm, CtxDir: true})
+		if (err == nil) != want {
+			t.Errorf("directory perm %#o: err = %v, want allowed=%v", perm, err, want)
+		}
+	}
+	if got := CreatePerm(claims, 0o644); got != 0o640 {
+		t.Errorf("CreatePerm = %#o, want 0640", got)
+	}
+	if got := CreatePerm(&capability.Capability{}, 0o644); got != 0o644 {
+		t.Errorf("CreatePerm without create_perm = %#o, want 0644", got)
+	}
+	if err := ValidateConstraints(capability.Constraints{CreatePerm: "rw"}); err == nil {
+		t.Error("invalid create_perm accepted")
+	}
+}
@@ -0,0 +1,361 @@
+// Package revocation distributes capability revocations from the identity
+// service to every service that verifies tokens.
+//
+// Services run a Follower: it subscribes to identity, receives pushed
+// revocations on <service>.revoke, and catches up on anything it missed by
+// fetching identity.revocations since the last sequence number it applied.
+// Identity runs a Hub, which pushes each revocation to all subscribers with
+// retries and reports which of them acknowledged.
+package revocation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/auth"
+	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/ipc"
+)
+
+// Push delivery defaults.
+const (
+	DefaultAttempts = 3
+	DefaultBackoff  = 50 * time.Millisecond
+	DefaultTimeout  = time.Second
+)
+
+// TrustedPeer reports whether a peer may take part in revocation traffic
+// (subscribe or push): root, or a process running as our own UID.
+func TrustedPeer(p *ipc.PeerCred) bool {
+	return p != nil && (p.UID == 0 || p.UID == os.Getuid())
+}
+
+// socketPath converts a registry-style endpoint ("unix:///path") to a path.
+func socketPath(endpoint string) string {
+	return strings.TrimPrefix(endpoint, "unix://")
+}
+
+// Hub fans revocations out to subscribed services. Safe for concurrent use.
+type Hub struct {
+	mu   sync.RWMutex
+	subs map[string]string // service name -> socket path
+
+	Attempts int           // delivery attempts per subscriber
+	Backoff  time.Duration // delay before the first retry, doubled each time
+	Timeout  time.Duration // per-attempt request timeout
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs:     make(map[string]string),
+		Attempts: DefaultAttempts,
+		Backoff:  DefaultBackoff,
+		Timeout:  DefaultTimeout,
+	}
+}
+
+// Subscribe registers (or re-registers) a service's endpoint. It returns
+// true if the subscription is new or its endpoint changed.
+func (h *Hub) Subscribe(service, endpoint string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sock := socketPath(endpoint)
+	if h.subs[service] == sock {
+		return false
+	}
+	h.subs[service] = sock
+	return true
+}
+
+// Subscribers returns the names of all subscribed services.
+func (h *Hub) Subscribers() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	names := make([]string, 0, len(h.subs))
+	for name := range h.subs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Publish pushes r to every subscriber concurrently, calling
+// <service>.revoke with retries. It returns the services that acknowledged
+// and those that did not; the latter catch up on their next sync.
+func (h *Hub) Publish(r auth.Revocation) (acked, pending []string) {
+	h.mu.RLock()
+	subs := make(map[string]string, len(h.subs))
+	for name, sock := range h.subs {
+		subs[name] = sock
+	}
+	h.mu.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	acked, pending = []string{}, []string{}
+	for name, sock := range subs {
+		wg.Add(1)
+		go func(name, sock string) {
+			defer wg.Done()
+			ok := h.deliver(name, sock, r)
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				acked = append(acked, name)
+			} else {
+				pending = append(pending, name)
+			}
+		}(name, sock)
+	}
+	wg.Wait()
+	return acked, pending
+}
+
+func (h *Hub) deliver(service, sock string, r auth.Revocation) bool {
+	req := &ipc.Request{
+		V:      1,
+		ReqID:  fmt.Sprintf("revoke-%d-%s", r.Seq, service),
+		Method: service + ".revoke",
+		Params: revocationParams(r),
+	}
+	delay := h.Backoff
+	for attempt := 0; attempt < h.Attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		resp, err := ipc.SendRequestTimeout(sock, req, h.Timeout)
+		if err == nil && resp.OK {
+			return true
+		}
+	}
+	return false
+}
+
+// revocationParams encodes r as IPC params.
+func revocationParams(r auth.Revocation) map[string]any {
+	params := map[string]any{
+		"seq":        r.Seq,
+		"revoked_at": r.RevokedAt,
+		"expires_at": r.ExpiresAt,
+	}
+	if r.Selector != nil {
+		params["selector"] = r.Selector
+	} else {
+		params["cap_id"] = r.CapID
+	}
+	return params
+}
+
+// decode converts untyped IPC data (params or a result field) into v.
+func decode(in any, v any) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Follower mirrors identity's revocation list inside a verifying service.
+type Follower struct {
+	service      string
+	endpoint     string
+	identitySock string
+	list         *auth.RevocationList
+	onRevoke     func(r auth.Revocation)
+
+	mu      sync.Mutex
+	last    uint64 // highest contiguous identity sequence applied
+	syncing bool
+}
+
+// NewFollower creates a follower for service, reachable at endpoint, that
+// follows the identity service at identitySock. onRevoke, if non-nil, is
+// called once for each newly applied revocation.
+func NewFollower(service, endpoint, identitySock string, onRevoke func(r auth.Revocation)) *Follower {
+	return &Follower{
+		service:      service,
+		endpoint:     endpoint,
+		identitySock: identitySock,
+		list:         auth.NewRevocationList(),
+		onRevoke:     onRevoke,
+	}
+}
+
+// IsRevoked reports whether cap has been revoked, individually or by a
+// bulk revocation selector.
+func (f *Follower) IsRevoked(cap *capability.Capability) bool {
+	return f.list.Matches(cap)
+}
+
+// LastSeq returns the highest identity sequence number applied without gaps.
+func (f *Follower) LastSeq() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.last
+}
+
+// apply records r locally. It returns true if r arrived out of order,
+// meaning earlier revocations are missing and a sync is needed.
+func (f *Follower) apply(r auth.Revocation) (gap bool) {
+	fresh, _ := f.list.Apply(r) // in-memory list: never fails
+	if fresh && f.onRevoke != nil {
+		f.onRevoke(r)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Seq == f.last+1:
+		f.last = r.Seq
+	case r.Seq > f.last+1:
+		return true
+	}
+	return false
+}
+
+// Handle is the ipc.Handler for pushed revocations (<service>.revoke).
+// Only trusted peers may push.
+func (f *Follower) Handle(req *ipc.Request) ipc.Response {
+	if !TrustedPeer(req.Peer) {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrPermDenied, "revocations accepted from identity only")
+	}
+	var r auth.Revocation
+	if err := decode(req.Params, &r); err != nil || (r.CapID == "" && r.Selector == nil) {
+		return ipc.ErrorResponse(req.ReqID, ipc.ErrInvalidRequest, "missing cap_id or selector param")
+	}
+	if f.apply(r) {
+		go f.Sync()
+	}
+	return ipc.SuccessResponse(req.ReqID, map[string]any{"status": "revoked", "seq": f.LastSeq()})
+}
+
+// Subscribe registers this service with identity. If identity's sequence
+// is behind ours (its state was reset), the follower rewinds so the next
+// Sync fetches everything again.
+func (f *Follower) Subscribe() error {
+	resp, err := ipc.SendRequestTimeout(f.identitySock, &ipc.Request{
+		V:      1,
+		ReqID:  "subscribe-" + f.service,
+		Method: "identity.subscribe",
+		Params: map[string]any{"service": f.service, "endpoint": f.endpoint},
+	}, DefaultTimeout)
+	if err != nil {
+		return fmt.Errorf("subscribe: %w", err)
+	}
+	if !resp.OK {
+		return fmt.Errorf("subscribe: %s", resp.Error.Message)
+	}
+	var result struct {
+		Seq uint64 `json:"seq"`
+	}
+	if err := decode(resp.Result, &result); err != nil {
+		return fmt.Errorf("subscribe: %w", err)
+	}
+	f.mu.Lock()
+	if result.Seq < f.last {
+		f.last = 0
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+// Revoke asks identity to revoke capID on this service's behalf, e.g. once
+// a one-shot capability has been used. The revocation comes back to every
+// follower, this one included, like any other.
+func (f *Follower) Revoke(capID string) error {
+	resp, err := ipc.SendRequestTimeout(f.identitySock, &ipc.Request{
+		V:      1,
+		ReqID:  "revoke-" + capID,
+		Method: "identity.revoke",
+		Params: map[string]any{"cap_id": capID},
+	}, DefaultTimeout)
+	if err != nil {
+		return fmt.Errorf("revoke %s: %w", capID, err)
+	}
+	if !resp.OK {
+		return fmt.Errorf("revoke %s: %s", capID, resp.Error.Message)
+	}
+	return nil
+}
+
+// Sync fetches every revocation after the last applied sequence number.
+// Concurrent calls collapse into one.
+func (f *Follower) Sync() error {
+	f.mu.Lock()
+	if f.syncing {
+		f.mu.Unlock()
+		return nil
+	}
+	f.syncing = true
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.syncing = false
+		f.mu.Unlock()
+	}()
+
+	for {
+		after := f.LastSeq()
+		resp, err := ipc.SendRequestTimeout(f.identitySock, &ipc.Request{
+			V:      1,
+			ReqID:  fmt.Sprintf("sync-%s-%d", f.service, after),
+			Method: "identity.revocations",
+			Params: map[string]any{"after": after},
+		}, DefaultTimeout)
+		if err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+		if !resp.OK {
+			return fmt.Errorf("sync: %s", resp.Error.Message)
+		}
+		var page struct {
+			Revocations []auth.Revocation `json:"revocations"`
+			Next        uint64            `json:"next"`
+			More        bool              `json:"more"`
+		}
+		if err := decode(resp.Result, &page); err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+		for _, r := range page.Revocations {
+			f.apply(r)
+		}
+		// The page is complete up to Next even where identity has pruned
+		// entries, so gaps below it are not missing revocations.
+		f.mu.Lock()
+		if page.Next > f.last {
+			f.last = page.Next
+		}
+		f.mu.Unlock()
+		if !page.More {
+			return nil
+		}
+	}
+}
+
+// Run subscribes and syncs immediately, then again every interval so that
+// restarts on either side are healed, pruning expired entries as it goes.
+// It returns when ctx is cancelled.
+func (f *Follower) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := f.Subscribe(); err != nil {
+			log.Printf("[%s] revocation follower: %v", f.service, err)
+		} else if err := f.Sync(); err != nil {
+			log.Printf("[%s] revocation follower: %v", f.service, err)
+		}
+		f.list.Prune(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
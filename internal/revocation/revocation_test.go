@@ -0,0 +1,327 @@
+package revocation
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Gao-OS/StrataOS/internal/auth"
+	"github.com/Gao-OS/StrataOS/internal/capability"
+	"github.com/Gao-OS/StrataOS/internal/ipc"
+)
+
+// fakeIdentity serves identity.subscribe, identity.revoke and
+// identity.revocations from rl, paging results pageSize at a time.
+func fakeIdentity(t *testing.T, dir string, rl *auth.RevocationList, hub *Hub, pageSize int) string {
+	t.Helper()
+	sock := filepath.Join(dir, "identity.sock")
+	srv := ipc.NewServer(sock)
+	srv.Handle("identity.subscribe", func(req *ipc.Request) ipc.Response {
+		service, _ := req.Params["service"].(string)
+		endpoint, _ := req.Params["endpoint"].(string)
+		if hub != nil {
+			hub.Subscribe(service, endpoint)
+		}
+		return ipc.SuccessResponse(req.ReqID, map[string]any{"seq": rl.Seq()})
+	})
+	srv.Handle("identity.revoke", func(req *ipc.Request) ipc.Response {
+		capID, _ := req.Params["cap_id"].(string)
+		rl.RevokeUntil(capID, time.Now().Add(time.Hour))
+		if hub != nil {
+			entry, _ := rl.Get(capID)
+			hub.Publish(entry)
+		}
+		return ipc.SuccessResponse(req.ReqID, map[string]any{"status": "revoked"})
+	})
+	srv.Handle("identity.revocations", func(req *ipc.Request) ipc.Response {
+		after, _ := req.Params["after"].(float64)
+		page, more := rl.List(uint64(after), pageSize)
+		next := uint64(after)
+		if len(page) > 0 {
+			next = page[len(page)-1].Seq
+		}
+		return ipc.SuccessResponse(req.ReqID, map[string]any{"revocations": page, "next": next, "more": more})
+	})
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start identity: %v", err)
+	}
+	t.Cleanup(srv.Stop)
+	return sock
+}
+
+// startFollower serves f.Handle as <service>.revoke at sock.
+func startFollower(t *testing.T, f *Follower, service, sock string) {
+	t.Helper()
+	srv := ipc.NewServer(sock)
+	srv.Handle(service+".revoke", f.Handle)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start follower: %v", err)
+	}
+	t.Cleanup(srv.Stop)
+}
+
+// capWithID returns claims with the given ID, issued a minute ago.
+func capWithID(id string) *capability.Capability {
+	return &capability.Capability{ID: id, Service: "svc", IssuedAt: time.Now().Add(-time.Minute)}
+}
+
+func revokeAll(rl *auth.RevocationList, ids ...string) {
+	for _, id := range ids {
+		rl.RevokeUntil(id, time.Now().Add(time.Hour))
+	}
+}
+
+func TestHub_PublishAcknowledged(t *testing.T) {
+	dir := t.TempDir()
+	rl := auth.NewRevocationList()
+	hub := NewHub()
+	idSock := fakeIdentity(t, dir, rl, hub, 100)
+
+	var notified []string
+	svcSock := filepath.Join(dir, "svc.sock")
+	f := NewFollower("svc", "unix://"+svcSock, idSock, func(r auth.Revocation) { notified = append(notified, r.CapID) })
+	startFollower(t, f, "svc", svcSock)
+	if err := f.Subscribe(); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	revokeAll(rl, "cap-1")
+	entry, _ := rl.Get("cap-1")
+	acked, pending := hub.Publish(entry)
+
+	if len(acked) != 1 || acked[0] != "svc" {
+		t.Errorf("acked = %v, want [svc]", acked)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending = %v, want none", pending)
+	}
+	if !f.IsRevoked(capWithID("cap-1")) {
+		t.Error("follower should see the pushed revocation")
+	}
+	if f.LastSeq() != 1 {
+		t.Errorf("LastSeq = %d, want 1", f.LastSeq())
+	}
+	if len(notified) != 1 || notified[0] != "cap-1" {
+		t.Errorf("onRevoke calls = %v, want [cap-1]", notified)
+	}
+
+	// Re-delivery is idempotent and does not notify twice.
+	hub.Publish(entry)
+	if len(notified) != 1 {
+		t.Errorf("onRevoke called %d times, want 1", len(notified))
+	}
+}
+
+func TestHub_PublishPendingWhenDown(t *testing.T) {
+	dir := t.TempDir()
+	hub := NewHub()
+	hub.Backoff = time.Millisecond
+	hub.Subscribe("down", "unix://"+filepath.Join(dir, "down.sock"))
+
+	upSock := filepath.Join(dir, "up.sock")
+	up := NewFollower("up", "unix://"+upSock, filepath.Join(dir, "none.sock"), nil)
+	startFollower(t, up, "up", upSock)
+	hub.Subscribe("up", "unix://"+upSock)
+
+	acked, pending := hub.Publish(auth.Revocation{Seq: 1, CapID: "cap-x"})
+	sort.Strings(acked)
+	if len(acked) != 1 || acked[0] != "up" {
+		t.Errorf("acked = %v, want [up]", acked)
+	}
+	if len(pending) != 1 || pending[0] != "down" {
+		t.Errorf("pending = %v, want [down]", pending)
+	}
+}
+
+func TestHub_SubscribeReportsChange(t *testing.T) {
+	hub := NewHub()
+	if !hub.Subscribe("fs", "unix:///run/strata/fs.sock") {
+		t.Error("first subscription should report new")
+	}
+	if hub.Subscribe("fs", "/run/strata/fs.sock") {
+		t.Error("same endpoint should not report a change")
+	}
+	if !hub.Subscribe("fs", "/elsewhere/fs.sock") {
+		t.Error("new endpoint should report a change")
+	}
+	if subs := hub.Subscribers(); len(subs) != 1 {
+		t.Errorf("Subscribers = %v, want one", subs)
+	}
+}
+
+func TestFollower_SyncCatchesUp(t *testing.T) {
+	dir := t.TempDir()
+	rl := auth.NewRevocationList()
+	idSock := fakeIdentity(t, dir, rl, nil, 2) // small pages exercise paging
+
+	revokeAll(rl, "a", "b", "c", "d", "e")
+	f := NewFollower("svc", "unix:///unused", idSock, nil)
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if !f.IsRevoked(capWithID(id)) {
+			t.Errorf("%s should be revoked after sync", id)
+		}
+	}
+	if f.LastSeq() != 5 {
+		t.Errorf("LastSeq = %d, want 5", f.LastSeq())
+	}
+
+	// Only newer entries are fetched on the next sync.
+	revokeAll(rl, "f")
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if !f.IsRevoked(capWithID("f")) || f.LastSeq() != 6 {
+		t.Errorf("incremental sync failed: revoked=%v last=%d", f.IsRevoked(capWithID("f")), f.LastSeq())
+	}
+}
+
+func TestFollower_GapTriggersSync(t *testing.T) {
+	dir := t.TempDir()
+	rl := auth.NewRevocationList()
+	idSock := fakeIdentity(t, dir, rl, nil, 100)
+	revokeAll(rl, "missed-1", "missed-2", "pushed")
+
+	f := NewFollower("svc", "unix:///unused", idSock, nil)
+	entry, _ := rl.Get("pushed")
+	resp := f.Handle(&ipc.Request{
+		V: 1, ReqID: "r", Method: "svc.revoke",
+		Peer:   &ipc.PeerCred{UID: os.Getuid()},
+		Params: revocationParams(entry),
+	})
+	if !resp.OK {
+		t.Fatalf("push rejected: %v", resp.Error.Message)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !f.IsRevoked(capWithID("missed-1")) || !f.IsRevoked(capWithID("missed-2")) {
+		if time.Now().After(deadline) {
+			t.Fatal("gap in sequence numbers did not trigger a catch-up sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFollower_AppliesSelector(t *testing.T) {
+	dir := t.TempDir()
+	rl := auth.NewRevocationList()
+	idSock := fakeIdentity(t, dir, rl, nil, 100)
+	entry, _ := rl.RevokeMatching(auth.Selector{Service: "svc", IssuedBefore: time.Now()}, time.Now().Add(time.Hour))
+
+	var notified []auth.Revocation
+	f := NewFollower("svc", "unix:///unused", idSock, func(r auth.Revocation) { notified = append(notified, r) })
+	resp := f.Handle(&ipc.Request{
+		V: 1, ReqID: "r", Method: "svc.revoke",
+		Peer:   &ipc.PeerCred{UID: os.Getuid()},
+		Params: revocationParams(entry),
+	})
+	if !resp.OK {
+		t.Fatalf("push rejected: %v", resp.Error.Message)
+	}
+	if !f.IsRevoked(capWithID("any-old-token")) {
+		t.Error("selector should revoke tokens issued before the epoch")
+	}
+	fresh := capWithID("new")
+	fresh.IssuedAt = time.Now().Add(time.Minute)
+	if f.IsRevoked(fresh) {
+		t.Error("selector must not revoke tokens issued after the epoch")
+	}
+
+	// A later sync delivering the same selector is not applied twice.
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if len(notified) != 1 {
+		t.Errorf("onRevoke called %d times, want 1", len(notified))
+	}
+}
+
+func TestFollower_Revoke(t *testing.T) {
+	dir := t.TempDir()
+	rl := auth.NewRevocationList()
+	hub := NewHub()
+	idSock := fakeIdentity(t, dir, rl, hub, 100)
+
+	svcSock := filepath.Join(dir, "svc.sock")
+	f := NewFollower("svc", "unix://"+svcSock, idSock, nil)
+	startFollower(t, f, "svc", svcSock)
+	if err := f.Subscribe(); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	if err := f.Revoke("spent"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if !rl.IsRevoked("spent") {
+		t.Error("identity should have recorded the revocation")
+	}
+	if !f.IsRevoked(capWithID("spent")) {
+		t.Error("follower should have received its own revocation")
+	}
+}
+
+func TestFollower_RejectsUntrustedPeer(t *testing.T) {
+	f := NewFollower("svc", "unix:///unused", "/nonexistent", nil)
+	untrusted := []*ipc.PeerCred{nil, {UID: os.Getuid() + 12345}}
+	for _, peer := range untrusted {
+		resp := f.Handle(&ipc.Request{
+			V: 1, ReqID: "r", Method: "svc.revoke", Peer: peer,
+			Params: map[string]any{"seq": 1, "cap_id": "victim"},
+		})
+		if resp.OK {
+			t.Errorf("push from %+v should be rejected", peer)
+		}
+	}
+	if f.IsRevoked(capWithID("victim")) {
+		t.Error("untrusted push must not revoke")
+	}
+}
+
+func TestFollower_SubscribeRewindsOnReset(t *testing.T) {
+	dir := t.TempDir()
+	rl := auth.NewRevocationList()
+	idSock := fakeIdentity(t, dir, rl, nil, 100)
+
+	f := NewFollower("svc", "unix:///unused", idSock, nil)
+	f.last = 42 // identity has since lost its state
+	if err := f.Subscribe(); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if f.LastSeq() != 0 {
+		t.Errorf("LastSeq = %d, want 0 after identity reset", f.LastSeq())
+	}
+}
+
+func TestFollower_RunStopsOnCancel(t *testing.T) {
+	dir := t.TempDir()
+	rl := auth.NewRevocationList()
+	idSock := fakeIdentity(t, dir, rl, nil, 100)
+	revokeAll(rl, "early")
+
+	f := NewFollower("svc", "unix:///unused", idSock, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		f.Run(ctx, time.Hour)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !f.IsRevoked(capWithID("early")) {
+		if time.Now().After(deadline) {
+			t.Fatal("Run did not perform an initial sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
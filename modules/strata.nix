@@ -23,6 +23,67 @@ in
       description = "Directory for sockets and ephemeral state.";
     };
 
+    issuancePolicyFile = mkOption {
+      type = types.nullOr types.path;
+      default = null;
+      description = "JSON issuance policy for identity.issue. Null allows only root.";
+    };
+
+    policyRulesFile = mkOption {
+      type = types.nullOr types.path;
+      default = null;
+      description = "JSON policy rules layered over capabilities. Null applies none.";
+    };
+
+    fsLabelsFile = mkOption {
+      type = types.nullOr types.path;
+      default = null;
+      description = "JSON database of fs resource labels by absolute path. Null labels nothing.";
+    };
+
+    fsDefaultRoot = mkOption {
+      type = types.nullOr types.str;
+      default = null;
+      description = "Directory fs serves to capabilities without a path_prefix. Null refuses them.";
+    };
+
+    fsHandleIdleTimeout = mkOption {
+      type = types.nullOr types.str;
+      default = null;
+      example = "5m";
+      description = "Go duration after which fs closes unused handles; \"0\" never does. Null means 10m.";
+    };
+
+    fsMaxHandles = mkOption {
+      type = types.nullOr types.int;
+      default = null;
+      description = "Open handles fs holds at most in all; 0 is unlimited. Null means 4096.";
+    };
+
+    fsMaxHandlesPerCap = mkOption {
+      type = types.nullOr types.int;
+      default = null;
+      description = "Open handles a capability holds at most; 0 is unlimited. Null means 256.";
+    };
+
+    policyDebug = mkOption {
+      type = types.bool;
+      default = false;
+      description = "Attach authorization decision traces to denials. Reveals rights and rules to callers.";
+    };
+
+    tokenVersion = mkOption {
+      type = types.enum [ "v2" "v4" ];
+      default = "v4";
+      description = "PASETO version of tokens issued by identity.";
+    };
+
+    acceptedTokenVersions = mkOption {
+      type = types.nullOr (types.listOf (types.enum [ "v2" "v4" ]));
+      default = null;
+      description = "PASETO versions identity and fs accept. Null means only tokenVersion.";
+    };
+
     package = mkOption {
       type = types.package;
       description = "The strata-supervisor package to use.";
@@ -52,15 +113,36 @@ in
 
       environment = {
         STRATA_RUNTIME_DIR = cfg.runtimeDir;
+        STRATA_STATE_DIR = "/var/lib/strata";
         STRATA_NODE_ID = cfg.nodeId;
         STRATA_IDENTITY_BIN = "${cfg.identityPackage}/bin/identity";
         STRATA_FS_BIN = "${cfg.fsPackage}/bin/fs";
         STRATA_REGISTRY_BIN = "${cfg.registryPackage}/bin/registry";
+        STRATA_TOKEN_VERSION = cfg.tokenVersion;
+      } // optionalAttrs (cfg.acceptedTokenVersions != null) {
+        STRATA_TOKEN_VERSIONS = concatStringsSep "," cfg.acceptedTokenVersions;
+      } // optionalAttrs (cfg.issuancePolicyFile != null) {
+        STRATA_ISSUANCE_POLICY = "${cfg.issuancePolicyFile}";
+      } // optionalAttrs (cfg.policyRulesFile != null) {
+        STRATA_POLICY_RULES = "${cfg.policyRulesFile}";
+      } // optionalAttrs (cfg.fsLabelsFile != null) {
+        STRATA_FS_LABELS = "${cfg.fsLabelsFile}";
+      } // optionalAttrs (cfg.fsDefaultRoot != null) {
+        STRATA_FS_ROOT = cfg.fsDefaultRoot;
+      } // optionalAttrs (cfg.fsHandleIdleTimeout != null) {
+        STRATA_FS_HANDLE_IDLE = cfg.fsHandleIdleTimeout;
+      } // optionalAttrs (cfg.fsMaxHandles != null) {
+        STRATA_FS_MAX_HANDLES = toString cfg.fsMaxHandles;
+      } // optionalAttrs (cfg.fsMaxHandlesPerCap != null) {
+        STRATA_FS_MAX_HANDLES_PER_CAP = toString cfg.fsMaxHandlesPerCap;
+      } // optionalAttrs cfg.policyDebug {
+        STRATA_POLICY_DEBUG = "1";
       };
 
       serviceConfig = {
         ExecStart = "${cfg.package}/bin/supervisor";
         RuntimeDirectory = "strata";
+        StateDirectory = "strata";
         Restart = "on-failure";
         RestartSec = 5;
         Type = "simple";